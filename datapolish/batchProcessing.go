@@ -0,0 +1,257 @@
+package datapolish
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/addressManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/notificationManager"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	"github.com/OpenDriversLog/goodl-lib/translate"
+)
+
+const bpTag = "glib/dp/batchProcessing.go"
+
+// BatchJob is the processing of GPS data of one device in a time range (see ProcessGPSData).
+type BatchJob struct {
+	DeviceId    int
+	StartTime   int64
+	EndTime     int64
+	Recalculate bool
+}
+
+// BatchConfig configures ProcessGPSDataBatch.
+type BatchConfig struct {
+	// Workers is the count of devices processed in parallel
+	Workers int
+	// GeocodeWorkers is the count of parallel address lookups per device
+	GeocodeWorkers int
+	// GeocodeInterval is the minimum time between two requests to the Geocoder over all workers
+	GeocodeInterval time.Duration
+	// Geocoder is used for address lookups, a addressManager.HTTPGeocoder if nil
+	Geocoder addressManager.Geocoder
+}
+
+// GetDefaultBatchConfig returns the default BatchConfig.
+func GetDefaultBatchConfig() *BatchConfig {
+	return &BatchConfig{
+		Workers:         4,
+		GeocodeWorkers:  2,
+		GeocodeInterval: 200 * time.Millisecond,
+	}
+}
+
+// BatchResult is the result of a single BatchJob.
+type BatchResult struct {
+	Job    BatchJob
+	Report *ProcessingReport
+	// Error is the message of the error processing this job failed with, empty if successful
+	Error string
+}
+
+// BatchReport contains the results of ProcessGPSDataBatch in the order of the given jobs and some totals.
+type BatchReport struct {
+	Results   []*BatchResult
+	Succeeded int
+	Failed    int
+
+	NewKeyPoints   int
+	NewTracks      int
+	NewTrips       int
+	NewTrackPoints int
+	AddressErrors  int
+	Duration       int64 // ms
+}
+
+// ProcessGPSDataBatch processes the given jobs in parallel with config.Workers workers (GetDefaultBatchConfig if nil).
+// Only one job at a time works with the database, while the others detect stops or wait for the Geocoder - so don't
+// run other imports on the same database in parallel. Failing jobs don't stop the other ones.
+func ProcessGPSDataBatch(jobs []BatchJob, config *BatchConfig, uId int64, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (report *BatchReport) {
+	start := time.Now()
+	if config == nil {
+		config = GetDefaultBatchConfig()
+	}
+	workers := config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	report = &BatchReport{Results: make([]*BatchResult, len(jobs))}
+
+	var dbLock sync.Mutex
+	if activeNotifications == nil {
+		// share them between all jobs, they are only modified while holding dbLock
+		nots, err := notificationManager.GetActiveNotifications(true, dbCon)
+		if err != nil {
+			dbg.W(bpTag, "Error getting active notifications : ", err)
+		} else {
+			activeNotifications = &nots
+		}
+	}
+	geocoding := &geocodeOptions{
+		workers:  config.GeocodeWorkers,
+		limiter:  &rateLimiter{interval: config.GeocodeInterval},
+		geocoder: config.Geocoder,
+	}
+
+	c := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range c {
+				job := jobs[idx]
+				res := &BatchResult{Job: job}
+				var err error
+				res.Report, err = processGPSData(job.StartTime, job.EndTime, job.DeviceId, job.Recalculate, uId, activeNotifications, T, dbCon, &dbLock, geocoding)
+				if err != nil {
+					dbg.E(bpTag, "Error processing device %d : ", job.DeviceId, err)
+					res.Error = err.Error()
+				}
+				report.Results[idx] = res
+			}
+		}()
+	}
+	for idx := range jobs {
+		c <- idx
+	}
+	close(c)
+	wg.Wait()
+	retryGeocodeJobs(uId, geocoding, dbCon)
+
+	for _, res := range report.Results {
+		if res.Error != "" {
+			report.Failed++
+		} else {
+			report.Succeeded++
+		}
+		if res.Report != nil {
+			report.NewKeyPoints += res.Report.NewKeyPoints
+			report.NewTracks += res.Report.NewTracks
+			report.NewTrips += res.Report.NewTrips
+			report.NewTrackPoints += res.Report.NewTrackPoints
+			report.AddressErrors += len(res.Report.AddressErrors)
+		}
+	}
+	report.Duration = int64(time.Since(start) / time.Millisecond)
+	dbg.I(bpTag, "Processed %d jobs in %d ms, %d failed", len(jobs), report.Duration, report.Failed)
+	return
+}
+
+// geocodeOptions configures how the addresses of KeyPoints are looked up.
+type geocodeOptions struct {
+	// workers is the count of parallel lookups
+	workers int
+	// limiter limits the rate of Geocoder lookups (not of cached addresses), may be shared by multiple geocodeOptions
+	limiter *rateLimiter
+	// geocoder is used for lookups, a addressManager.HTTPGeocoder if nil
+	geocoder addressManager.Geocoder
+}
+
+// lookupGeocoder returns the Geocoder to look up addresses with (a addressManager.HTTPGeocoder if none is
+// configured), waiting for the limiter before each lookup if there is one. o may be nil.
+func (o *geocodeOptions) lookupGeocoder(dbCon *sql.DB) (geocoder addressManager.Geocoder) {
+	if o != nil {
+		geocoder = o.geocoder
+	}
+	if geocoder == nil {
+		geocoder = addressManager.NewHTTPGeocoder("", nil, dbCon)
+	}
+	if o != nil && o.limiter != nil {
+		// addresses found in the database or the geocode cache don't need to wait
+		geocoder = &limitedGeocoder{Geocoder: geocoder, limiter: o.limiter}
+	}
+	return
+}
+
+// retryGeocodeJobs retries the expired GeocodeJobs of earlier imports with the Geocoder of the given options
+// (see addressManager.RetryGeocodeJobsWithGeocoder). Call it without holding a dbLock, as the retries work with the
+// database.
+func retryGeocodeJobs(uId int64, options *geocodeOptions, dbCon *sql.DB) {
+	done, err := addressManager.RetryGeocodeJobsWithGeocoder(options.lookupGeocoder(dbCon), uId, dbCon)
+	if err != nil {
+		dbg.E(bpTag, "Error retrying GeocodeJobs : ", err)
+		return
+	}
+	if done > 0 {
+		dbg.I(bpTag, "Found the addresses of %d GeocodeJobs", done)
+	}
+}
+
+// geocodeKeyPoints sets the AddressId of all given KeyPoints, returning the failed lookups. dbLock (if not nil) is
+// held while looking up or inserting addresses, but not while waiting for the Geocoder.
+func geocodeKeyPoints(keyPoints []*KeyPoint, uId int64, options *geocodeOptions, dbLock sync.Locker, dbCon *sql.DB) []AddressError {
+	workers := 1
+	if options != nil && options.workers > 1 {
+		workers = options.workers
+	}
+	geocoder := options.lookupGeocoder(dbCon)
+
+	errs := make([]AddressError, 0)
+	var errsMutex sync.Mutex
+	c := make(chan *KeyPoint)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for kp := range c {
+				addrId, err := addressManager.GetAddressIdForLatLngWithLock(kp.Latitude.Float64, kp.Longitude.Float64, geocoder, uId, dbLock, dbCon)
+				if err != nil {
+					dbg.W(pdTag, "Error getting addressId for [%d, %d]", kp.Latitude.Float64, kp.Longitude.Float64, err)
+					errsMutex.Lock()
+					errs = append(errs, AddressError{Error: err, KeyPoint: kp})
+					errsMutex.Unlock()
+				}
+				kp.AddressId = sql.NullInt64{Int64: addrId, Valid: true}
+			}
+		}()
+	}
+	for _, kp := range keyPoints {
+		c <- kp
+	}
+	close(c)
+	wg.Wait()
+	return errs
+}
+
+// limitedGeocoder is a Geocoder waiting for its rateLimiter before each lookup.
+type limitedGeocoder struct {
+	addressManager.Geocoder
+	limiter *rateLimiter
+}
+
+func (g *limitedGeocoder) Reverse(addr *addressManager.Address, lat float64, lng float64, uId int64) error {
+	g.limiter.wait()
+	return g.Geocoder.Reverse(addr, lat, lng, uId)
+}
+
+func (g *limitedGeocoder) Forward(query string, uId int64) (*addressManager.Address, error) {
+	g.limiter.wait()
+	return g.Geocoder.Forward(query, uId)
+}
+
+// rateLimiter makes sure there is at least the given interval between two calls of wait returning.
+type rateLimiter struct {
+	interval time.Duration
+	mutex    sync.Mutex
+	next     time.Time
+}
+
+// wait blocks until the next call is allowed. Does nothing for a nil rateLimiter.
+func (l *rateLimiter) wait() {
+	if l == nil || l.interval <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	sleep := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mutex.Unlock()
+	time.Sleep(sleep)
+}
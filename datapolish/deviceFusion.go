@@ -0,0 +1,232 @@
+package datapolish
+
+import (
+	"database/sql"
+	"sort"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	. "github.com/OpenDriversLog/goodl-lib/models/geo"
+	"github.com/OpenDriversLog/goodl-lib/tools"
+)
+
+const dfTag = "glib/dp/deviceFusion.go"
+
+// FuseTrackRecords fuses the Locations of multiple devices (by device ID), each sorted by time, into one list
+// sorted by time. The time is split into segments of FusionSegmentLength and for each segment the Locations
+// of the device with the best median accuracy are taken, preferring the one with more Locations on equal accuracy.
+// Returns the count of Locations taken from each device.
+func FuseTrackRecords(sources map[int64][]Location, config *LocationConfig) (fused []Location, contributions map[int64]int) {
+	if config == nil {
+		config = GetDefaultLocationConfig()
+	}
+	segment := int64(config.FusionSegmentLength)
+	if segment <= 0 {
+		segment = int64(GetDefaultLocationConfig().FusionSegmentLength)
+	}
+	fused = make([]Location, 0)
+	contributions = make(map[int64]int)
+
+	deviceIds := make([]int64, 0, len(sources))
+	minTime, maxTime := int64(-1), int64(-1)
+	for devId, locs := range sources {
+		if len(locs) == 0 {
+			continue
+		}
+		deviceIds = append(deviceIds, devId)
+		if minTime == -1 || locs[0].TimeMillis.Int64 < minTime {
+			minTime = locs[0].TimeMillis.Int64
+		}
+		if locs[len(locs)-1].TimeMillis.Int64 > maxTime {
+			maxTime = locs[len(locs)-1].TimeMillis.Int64
+		}
+	}
+	sort.Sort(int64s(deviceIds))
+	if len(deviceIds) == 0 {
+		return
+	}
+
+	next := make(map[int64]int)
+	for start := minTime; start <= maxTime; start += segment {
+		var best []Location
+		var bestDevice int64
+		bestAccuracy := 0.0
+		for _, devId := range deviceIds {
+			locs := sources[devId]
+			from := next[devId]
+			to := from
+			for to < len(locs) && locs[to].TimeMillis.Int64 < start+segment {
+				to++
+			}
+			next[devId] = to
+			if to == from {
+				continue
+			}
+			accuracy := medianAccuracy(locs[from:to], config)
+			if best == nil || accuracy < bestAccuracy || (accuracy == bestAccuracy && to-from > len(best)) {
+				best, bestDevice, bestAccuracy = locs[from:to], devId, accuracy
+			}
+		}
+		if best == nil {
+			continue
+		}
+		fused = append(fused, best...)
+		contributions[bestDevice] += len(best)
+	}
+	return
+}
+
+// medianAccuracy returns the median accuracy (in meters) of the given Locations, considering Locations
+// without accuracy as accurate as AccuracyThreshold.
+func medianAccuracy(locs []Location, config *LocationConfig) float64 {
+	accuracies := make([]float64, len(locs))
+	for i, l := range locs {
+		if l.Accuracy.Valid && l.Accuracy.Float64 > 0 {
+			accuracies[i] = l.Accuracy.Float64
+		} else {
+			accuracies[i] = float64(config.AccuracyThreshold)
+		}
+	}
+	sort.Float64s(accuracies)
+	return accuracies[len(accuracies)/2]
+}
+
+// getTrackRecordsForTrack returns the trackRecords between startTime and endTime of the given track,
+// fused from all contributing devices if it is fused (with the count of trackRecords taken from each),
+// otherwise the ones of deviceId.
+func getTrackRecordsForTrack(trackId int64, startTime int64, endTime int64, deviceId int, config *LocationConfig, dbCon tools.DbRunner) (recs []Location, contributions map[int64]int, err error) {
+	deviceIds, err := tripMan.GetDeviceIdsForTrack(dbCon, trackId)
+	if err != nil {
+		return
+	}
+	if len(deviceIds) == 0 {
+		recs, err = GetTrackRecordsForDevice(startTime, endTime, deviceId, dbCon)
+		return
+	}
+	sources := make(map[int64][]Location)
+	for _, devId := range deviceIds {
+		sources[devId], err = GetTrackRecordsForDevice(startTime, endTime, int(devId), dbCon)
+		if err != nil {
+			dbg.E(dfTag, "Failed to get trackRecords of device %d for track %d : ", devId, trackId, err)
+			return
+		}
+	}
+	recs, contributions = FuseTrackRecords(sources, config)
+	return
+}
+
+// FuseOverlappingTrack fuses the given track of deviceId with the track of another device of the same car
+// it overlaps most (at least FusionMinOverlap), so the car does not get duplicate trips.
+// The other track is kept, as it might already be reviewed. It is extended to cover both tracks, its trackPoints
+// and statistics get recalculated from the fused trackRecords and the given track is marked as fused into it,
+// all in one transaction.
+// Returns the ID of the other track, 0 if there is none to fuse with.
+func FuseOverlappingTrack(trackId int64, deviceId int, carId int64, startTime int64, endTime int64, config *LocationConfig, dbCon *sql.DB) (fusedTrackId int64, err error) {
+	tx, err := dbCon.Begin()
+	if err != nil {
+		dbg.E(dfTag, "Error starting transaction : ", err)
+		return
+	}
+	fusedTrackId, err = fuseOverlappingTrack(trackId, deviceId, carId, startTime, endTime, config, tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		dbg.E(dfTag, "Failed to commit fusion of track %d : ", trackId, err)
+		return 0, err
+	}
+	return
+}
+
+// fuseOverlappingTrack implements FuseOverlappingTrack in the given transaction.
+func fuseOverlappingTrack(trackId int64, deviceId int, carId int64, startTime int64, endTime int64, config *LocationConfig, tx *sql.Tx) (fusedTrackId int64, err error) {
+	if config == nil {
+		config = GetDefaultLocationConfig()
+	}
+	if carId <= 0 || endTime <= startTime {
+		return
+	}
+	rows, err := tx.Query(`SELECT t._trackId, t.deviceId, skp.endTime, ekp.startTime, t.startKeyPointId, t.endKeyPointId FROM Tracks t
+		JOIN KeyPoints skp ON skp._keyPointId=t.startKeyPointId
+		JOIN KeyPoints ekp ON ekp._keyPointId=t.endKeyPointId
+		WHERE t.carId=? AND t.deviceId!=? AND t._trackId!=? AND t.fusedIntoTrackId IS NULL
+		AND skp.endTime<? AND ekp.startTime>?`, carId, deviceId, trackId, endTime, startTime)
+	if err != nil {
+		dbg.E(dfTag, "Failed to get overlapping tracks for track %d : ", trackId, err)
+		return
+	}
+	var otherDeviceId int64
+	var otherStart, otherEnd, bestOverlap int64
+	var otherStartKp, otherEndKp int64
+	for rows.Next() {
+		var tId, devId, start, end, startKp, endKp int64
+		err = rows.Scan(&tId, &devId, &start, &end, &startKp, &endKp)
+		if err != nil {
+			dbg.E(dfTag, "Failed to scan overlapping track for track %d : ", trackId, err)
+			rows.Close()
+			return
+		}
+		overlap := timeOverlap(startTime, endTime, start, end)
+		shorter := endTime - startTime
+		if end-start < shorter {
+			shorter = end - start
+		}
+		if shorter <= 0 || float64(overlap) < config.FusionMinOverlap*float64(shorter) || overlap <= bestOverlap {
+			continue
+		}
+		fusedTrackId, otherDeviceId, otherStart, otherEnd, bestOverlap = tId, devId, start, end, overlap
+		otherStartKp, otherEndKp = startKp, endKp
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || fusedTrackId == 0 {
+		return
+	}
+	dbg.I(dfTag, "Fusing track %d of device %d into track %d of device %d", trackId, deviceId, fusedTrackId, otherDeviceId)
+
+	// the fused track covers both tracks, so nothing driven before or after the other track gets lost
+	fusedStart, fusedEnd := otherStart, otherEnd
+	if startTime < otherStart || endTime > otherEnd {
+		var startKp, endKp int64
+		err = tx.QueryRow("SELECT startKeyPointId, endKeyPointId FROM Tracks WHERE _trackId=?", trackId).Scan(&startKp, &endKp)
+		if err != nil {
+			dbg.E(dfTag, "Failed to get KeyPoints of track %d : ", trackId, err)
+			return
+		}
+		if startTime < otherStart {
+			fusedStart, otherStartKp = startTime, startKp
+		}
+		if endTime > otherEnd {
+			fusedEnd, otherEndKp = endTime, endKp
+		}
+		_, err = tx.Exec("UPDATE Tracks SET startKeyPointId=?, endKeyPointId=? WHERE _trackId=?", otherStartKp, otherEndKp, fusedTrackId)
+		if err != nil {
+			dbg.E(dfTag, "Failed to extend track %d to %d - %d : ", fusedTrackId, fusedStart, fusedEnd, err)
+			return
+		}
+	}
+
+	_, err = tx.Exec(`INSERT OR IGNORE INTO TrackDevices (trackId, deviceId) VALUES (?,?);
+INSERT OR IGNORE INTO TrackDevices (trackId, deviceId) VALUES (?,?);
+UPDATE Tracks SET fusedIntoTrackId=? WHERE _trackId=?;`,
+		fusedTrackId, otherDeviceId, fusedTrackId, deviceId, fusedTrackId, trackId)
+	if err != nil {
+		dbg.E(dfTag, "Failed to fuse track %d into track %d : ", trackId, fusedTrackId, err)
+		return
+	}
+
+	contributions, err := recalculateTrackData(fusedTrackId, fusedStart, fusedEnd, int(otherDeviceId), config, tx)
+	if err != nil {
+		dbg.E(dfTag, "Failed to recalculate fused track %d : ", fusedTrackId, err)
+		return
+	}
+	for devId, points := range contributions {
+		_, err = tx.Exec("UPDATE TrackDevices SET points=? WHERE trackId=? AND deviceId=?", points, fusedTrackId, devId)
+		if err != nil {
+			dbg.E(dfTag, "Failed to update contribution of device %d to track %d : ", devId, fusedTrackId, err)
+			return
+		}
+	}
+	return
+}
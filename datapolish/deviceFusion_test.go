@@ -0,0 +1,146 @@
+package datapolish_test
+
+import (
+	"database/sql"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/datapolish"
+	"github.com/OpenDriversLog/goodl-lib/dbMan"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	"github.com/OpenDriversLog/goodl-lib/translate"
+)
+
+var _ = Describe("DeviceFusion", func() {
+	config := datapolish.GetDefaultLocationConfig()
+
+	// withAccuracy returns a copy of the given Locations, the ones from index from to to with the given accuracy
+	withAccuracy := func(locs []Location, from int, to int, accuracy float64) []Location {
+		res := make([]Location, len(locs))
+		copy(res, locs)
+		for i := from; i < to && i < len(res); i++ {
+			res[i].Accuracy = sql.NullFloat64{Float64: accuracy, Valid: true}
+		}
+		return res
+	}
+
+	It("should take the most accurate device per segment", func() {
+		trace := newTrace(stopA.Lat, stopA.Lng).drive(stopB.Lat, stopB.Lng, 14, 5).locs
+		// 6 points per segment, the phone is inaccurate in the first minute, the tracker in the second one
+		phone := withAccuracy(withAccuracy(trace, 0, len(trace), 5), 0, 12, 50)
+		tracker := withAccuracy(withAccuracy(trace, 0, len(trace), 5), 12, 24, 50)
+
+		fused, contributions := datapolish.FuseTrackRecords(map[int64][]Location{1: phone, 2: tracker}, config)
+		Expect(fused).To(HaveLen(len(trace)))
+		Expect(fused[0].Accuracy.Float64).To(Equal(5.0))
+		Expect(fused[15].Accuracy.Float64).To(Equal(5.0))
+		Expect(contributions[1]).To(BeNumerically(">=", 12))
+		Expect(contributions[2]).To(BeNumerically(">=", 12))
+		Expect(contributions[1] + contributions[2]).To(Equal(len(trace)))
+		for i := 1; i < len(fused); i++ {
+			Expect(fused[i].TimeMillis.Int64).To(BeNumerically(">", fused[i-1].TimeMillis.Int64))
+		}
+	})
+
+	It("should fill segments only one device recorded", func() {
+		trace := withAccuracy(newTrace(stopA.Lat, stopA.Lng).drive(stopB.Lat, stopB.Lng, 14, 5).locs, 0, 1000, 50)
+		// the tracker only recorded the first minute
+		tracker := withAccuracy(trace[:12], 0, 12, 5)
+
+		fused, contributions := datapolish.FuseTrackRecords(map[int64][]Location{1: trace, 2: tracker}, config)
+		Expect(fused).To(HaveLen(len(trace)))
+		Expect(contributions[1]).To(Equal(len(trace) - 12))
+		Expect(contributions[2]).To(Equal(12))
+	})
+})
+
+var _ = Describe("FuseOverlappingTrack", func() {
+	var (
+		dbCon     *sql.DB
+		deviceId  int64
+		trackerId int64
+		carId     int64
+	)
+	process := func(devId int64) {
+		_, err := datapolish.ProcessGPSDataWithGeocoder(reportTestStart-3600*1000, reportTestStart+3600*1000, int(devId), false, 1, failingGeocoder{}, nil, &translate.Translater{}, dbCon)
+		Expect(err).To(BeNil())
+	}
+	trackOf := func(devId int64) (trackId int64, fusedInto sql.NullInt64, start int64, end int64) {
+		err := dbCon.QueryRow(`SELECT t._trackId, t.fusedIntoTrackId, s.endTime, e.startTime FROM Tracks t
+			JOIN KeyPoints s ON s._keyPointId=t.startKeyPointId JOIN KeyPoints e ON e._keyPointId=t.endKeyPointId
+			WHERE t.deviceId=?`, devId).Scan(&trackId, &fusedInto, &start, &end)
+		Expect(err).To(BeNil())
+		return
+	}
+
+	BeforeEach(func() {
+		dbCon, _ = dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+		deviceId, carId = insertTestDrive(dbCon)
+		res, err := dbCon.Exec("INSERT INTO Devices (desc, colorId, carId) VALUES ('Fusionstest', 1, ?)", carId)
+		Expect(err).To(BeNil())
+		trackerId, _ = res.LastInsertId()
+		// the tracker of the same car only recorded the middle of the drive
+		t := reportTestStart + 5*30*1000
+		insert := func(lat float64, speed float64) {
+			_, err := dbCon.Exec("INSERT INTO TrackRecords (deviceId, timeMillis, latitude, longitude, altitude, accuracy, provider, source, accuracyRating, speed) VALUES (?,?,?,13.73,100,10,'gps',0,0,?)",
+				trackerId, t, lat, speed)
+			Expect(err).To(BeNil())
+			t += 30 * 1000
+		}
+		for i := 0; i < 20; i++ {
+			insert(51.06, 0)
+		}
+		for i := 1; i < 10; i++ {
+			insert(51.06+0.002*float64(i), 7.5)
+		}
+		for i := 0; i < 20; i++ {
+			insert(51.08, 0)
+		}
+		process(trackerId)
+	})
+
+	AfterEach(func() {
+		dbCon.Exec("DROP TRIGGER IF EXISTS test_fail_fusion")
+		deleteTestDrive(trackerId, carId, dbCon)
+		deleteTestDrive(deviceId, carId, dbCon)
+		dbCon.Close()
+	})
+
+	It("should extend the other track to both tracks", func() {
+		trackerTrack, _, trackerStart, trackerEnd := trackOf(trackerId)
+		process(deviceId)
+
+		trackId, fusedInto, start, end := trackOf(deviceId)
+		Expect(fusedInto.Valid).To(BeTrue())
+		Expect(fusedInto.Int64).To(Equal(trackerTrack))
+		fusedTrack, _, fusedStart, fusedEnd := trackOf(trackerId)
+		Expect(fusedTrack).To(Equal(trackerTrack))
+		Expect(fusedStart).To(Equal(start))
+		Expect(fusedEnd).To(Equal(end))
+		Expect(fusedStart).To(BeNumerically("<", trackerStart))
+		Expect(fusedEnd).To(BeNumerically(">", trackerEnd))
+
+		var trips int
+		err := dbCon.QueryRow("SELECT COUNT(*) FROM Tracks_Trips WHERE trackId IN (?,?)", trackId, trackerTrack).Scan(&trips)
+		Expect(err).To(BeNil())
+		Expect(trips).To(Equal(1))
+	})
+
+	It("should not mark the track as fused if the fused track can't be recalculated", func() {
+		trackerTrack, _, trackerStart, trackerEnd := trackOf(trackerId)
+		_, err := dbCon.Exec("CREATE TRIGGER test_fail_fusion BEFORE UPDATE OF points ON TrackDevices BEGIN SELECT RAISE(ABORT, 'test'); END")
+		Expect(err).To(BeNil())
+		process(deviceId)
+
+		_, fusedInto, _, _ := trackOf(deviceId)
+		Expect(fusedInto.Valid).To(BeFalse())
+		_, _, start, end := trackOf(trackerId)
+		Expect(start).To(Equal(trackerStart))
+		Expect(end).To(Equal(trackerEnd))
+		var devices int
+		err = dbCon.QueryRow("SELECT COUNT(*) FROM TrackDevices WHERE trackId=?", trackerTrack).Scan(&devices)
+		Expect(err).To(BeNil())
+		Expect(devices).To(Equal(0))
+	})
+})
@@ -0,0 +1,303 @@
+package datapolish
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/addressManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan"
+	tripModels "github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan/models"
+	"github.com/OpenDriversLog/goodl-lib/translate"
+)
+
+const drTag = "glib/dp/dryRun.go"
+
+const (
+	// TripDiffUnchanged means the trip would survive reprocessing.
+	TripDiffUnchanged = "unchanged"
+	// TripDiffRemoved means the trip would be removed without replacement.
+	TripDiffRemoved = "removed"
+	// TripDiffCreated means a new trip would be created where there was none.
+	TripDiffCreated = "created"
+	// TripDiffReplaced means the trip would be replaced by exactly one new trip.
+	TripDiffReplaced = "replaced"
+	// TripDiffSplit means the trip would be split into multiple new trips.
+	TripDiffSplit = "split"
+	// TripDiffMerged means multiple trips would be merged into one new trip.
+	TripDiffMerged = "merged"
+	// TripDiffRegrouped means multiple trips would become multiple differently cut trips.
+	TripDiffRegrouped = "regrouped"
+)
+
+// ReprocessDiff describes what reprocessing the data of a device in a time range would change.
+type ReprocessDiff struct {
+	DeviceId  int
+	StartTime int64
+	EndTime   int64
+	Trips     []*TripDiff
+	// Report is the report of the processing done on the copy of the database
+	Report *ProcessingReport
+}
+
+// TripDiff describes what happens to a group of overlapping trips before and after reprocessing.
+type TripDiff struct {
+	Kind     string
+	Before   []*TripSummary
+	After    []*TripSummary
+	Metadata []*MetadataChange `json:",omitempty"`
+}
+
+// TripSummary contains the data of a trip relevant for deciding if reprocessing is ok.
+type TripSummary struct {
+	Id             int64
+	TrackIds       []int64
+	StartTime      int64
+	EndTime        int64
+	Type           int
+	Title          string
+	Description    string
+	DriverId       int64
+	ContactId      int64
+	StartContactId int64
+	EndContactId   int64
+	Reviewed       int64
+}
+
+// MetadataChange is a user entered value of a trip that would be carried over to all resulting trips or lost.
+type MetadataChange struct {
+	TripId      int64
+	Field       string
+	OldValue    interface{}
+	CarriedOver bool
+}
+
+// ErrNotGeocodedInDryRun is the error of address lookups skipped in dry runs, so they don't use up the quota.
+var ErrNotGeocodedInDryRun = errors.New("Address lookups are skipped in dry runs")
+
+// DryRunReprocessDataForDeviceInTimeRange runs ReprocessDataForDeviceInTimeRange against a temporary copy of the
+// database dbCon is connected to and returns what would change. The real data is not touched and the Geocoder is
+// not asked, new KeyPoints only get addresses already known (see ErrNotGeocodedInDryRun).
+func DryRunReprocessDataForDeviceInTimeRange(startTime int64, endTime int64, deviceId int, uId int64, T *translate.Translater, dbCon *sql.DB) (diff *ReprocessDiff, err error) {
+	copyDir, copyPath, err := copyDatabase(dbCon)
+	if err != nil {
+		dbg.E(drTag, "Error copying database for dry run : ", err)
+		return
+	}
+	defer os.RemoveAll(copyDir)
+	copyCon, err := sql.Open("SQLITE", "file:"+copyPath)
+	if err != nil {
+		dbg.E(drTag, "Error opening copy of database : ", err)
+		return
+	}
+	defer copyCon.Close()
+
+	existingTripIds := make(map[int64]bool)
+	rows, err := copyCon.Query("SELECT _tripId FROM Trips")
+	if err != nil {
+		dbg.E(drTag, "Error getting existing trip ids : ", err)
+		return
+	}
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			dbg.E(drTag, "Error scanning trip id : ", err)
+			return
+		}
+		existingTripIds[id] = true
+	}
+	rows.Close()
+
+	// not GetTripsInTimeRange, it would retry pending addresses
+	filter := &tripModels.TripFilter{MinTime: startTime, MaxTime: endTime, DeviceIds: []int64{int64(deviceId)}}
+	before, err := tripMan.GetTripsByFilter(filter, false, false, false, nil, T, false, copyCon)
+	if err != nil {
+		dbg.E(drTag, "Error getting trips before reprocessing : ", err)
+		return
+	}
+
+	diff = &ReprocessDiff{DeviceId: deviceId, StartTime: startTime, EndTime: endTime}
+	diff.Report, err = ProcessGPSDataWithGeocoder(startTime, endTime, deviceId, true, uId, dryRunGeocoder{}, nil, T, copyCon)
+	if err != nil {
+		dbg.E(drTag, "Error reprocessing copy of database : ", err)
+		return
+	}
+
+	filter.MinTime, filter.MaxTime = diff.Report.StartTime, diff.Report.EndTime
+	after, err := tripMan.GetTripsByFilter(filter, false, false, false, nil, T, false, copyCon)
+	if err != nil {
+		dbg.E(drTag, "Error getting trips after reprocessing : ", err)
+		return
+	}
+	// trips around the time range that were neither part of it before nor got created are not interesting
+	beforeIds := make(map[int64]bool)
+	for _, t := range before {
+		beforeIds[t.Id] = true
+	}
+	relevant := make([]*tripModels.Trip, 0, len(after))
+	for _, t := range after {
+		if !existingTripIds[t.Id] || beforeIds[t.Id] {
+			relevant = append(relevant, t)
+		}
+	}
+
+	diff.Trips = DiffTrips(before, relevant)
+	return
+}
+
+// DiffTrips groups the given trips by overlapping time ranges and describes what happened to each group.
+func DiffTrips(before []*tripModels.Trip, after []*tripModels.Trip) []*TripDiff {
+	// union-find over before (0..len(before)-1) and after (len(before)..) trips
+	parent := make([]int, len(before)+len(after))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i, b := range before {
+		for j, a := range after {
+			if b.Id == a.Id || timeOverlap(int64(b.StartTime), int64(b.EndTime), int64(a.StartTime), int64(a.EndTime)) > 0 {
+				parent[find(i)] = find(len(before) + j)
+			}
+		}
+	}
+
+	groups := make(map[int]*TripDiff)
+	res := make([]*TripDiff, 0)
+	get := func(i int) *TripDiff {
+		root := find(i)
+		d, ok := groups[root]
+		if !ok {
+			d = &TripDiff{Before: make([]*TripSummary, 0), After: make([]*TripSummary, 0)}
+			groups[root] = d
+			res = append(res, d)
+		}
+		return d
+	}
+	for i, b := range before {
+		d := get(i)
+		d.Before = append(d.Before, summarizeTrip(b))
+	}
+	for j, a := range after {
+		d := get(len(before) + j)
+		d.After = append(d.After, summarizeTrip(a))
+	}
+
+	for _, d := range res {
+		d.Kind = tripDiffKind(d)
+		if d.Kind != TripDiffUnchanged {
+			d.Metadata = metadataChanges(d)
+		}
+	}
+	return res
+}
+
+// tripDiffKind returns the TripDiff* kind for the given group of trips.
+func tripDiffKind(d *TripDiff) string {
+	switch {
+	case len(d.After) == 0:
+		return TripDiffRemoved
+	case len(d.Before) == 0:
+		return TripDiffCreated
+	case len(d.Before) == 1 && len(d.After) == 1:
+		if d.Before[0].Id == d.After[0].Id {
+			return TripDiffUnchanged
+		}
+		return TripDiffReplaced
+	case len(d.Before) == 1:
+		return TripDiffSplit
+	case len(d.After) == 1:
+		return TripDiffMerged
+	}
+	return TripDiffRegrouped
+}
+
+// metadataChanges returns all user entered values of the trips before, and if they are the same in all trips after.
+func metadataChanges(d *TripDiff) []*MetadataChange {
+	res := make([]*MetadataChange, 0)
+	add := func(tripId int64, field string, old interface{}, isSet bool, value func(t *TripSummary) interface{}) {
+		if !isSet {
+			return
+		}
+		carried := len(d.After) > 0
+		for _, a := range d.After {
+			if value(a) != old {
+				carried = false
+			}
+		}
+		res = append(res, &MetadataChange{TripId: tripId, Field: field, OldValue: old, CarriedOver: carried})
+	}
+	for _, b := range d.Before {
+		add(b.Id, "Title", b.Title, b.Title != "", func(t *TripSummary) interface{} { return t.Title })
+		add(b.Id, "Description", b.Description, b.Description != "", func(t *TripSummary) interface{} { return t.Description })
+		add(b.Id, "Type", b.Type, b.Type != tripMan.PRIVATE, func(t *TripSummary) interface{} { return t.Type })
+		add(b.Id, "DriverId", b.DriverId, b.DriverId > 0, func(t *TripSummary) interface{} { return t.DriverId })
+		add(b.Id, "ContactId", b.ContactId, b.ContactId > 0, func(t *TripSummary) interface{} { return t.ContactId })
+		add(b.Id, "StartContactId", b.StartContactId, b.StartContactId > 0, func(t *TripSummary) interface{} { return t.StartContactId })
+		add(b.Id, "EndContactId", b.EndContactId, b.EndContactId > 0, func(t *TripSummary) interface{} { return t.EndContactId })
+		add(b.Id, "Reviewed", b.Reviewed, b.Reviewed > 0, func(t *TripSummary) interface{} { return t.Reviewed })
+	}
+	return res
+}
+
+// summarizeTrip returns the TripSummary for the given trip.
+func summarizeTrip(t *tripModels.Trip) *TripSummary {
+	return &TripSummary{
+		Id:             t.Id,
+		TrackIds:       t.TrackIdInts,
+		StartTime:      int64(t.StartTime),
+		EndTime:        int64(t.EndTime),
+		Type:           t.Type,
+		Title:          string(t.Title),
+		Description:    string(t.Description),
+		DriverId:       int64(t.DriverId),
+		ContactId:      int64(t.ContactId),
+		StartContactId: int64(t.StartContactId),
+		EndContactId:   int64(t.EndContactId),
+		Reviewed:       t.Reviewed,
+	}
+}
+
+// copyDatabase writes a consistent copy of the database dbCon is connected to into a new temporary directory,
+// returning the directory & the path of the copy.
+func copyDatabase(dbCon *sql.DB) (copyDir string, copyPath string, err error) {
+	copyDir, err = ioutil.TempDir("", "odl-dryrun-")
+	if err != nil {
+		return
+	}
+	copyPath = filepath.Join(copyDir, "copy.db")
+	// unlike copying the files, VACUUM INTO sees a single transaction, even if others write meanwhile
+	_, err = dbCon.Exec("VACUUM INTO ?", copyPath)
+	if err != nil {
+		os.RemoveAll(copyDir)
+	}
+	return
+}
+
+// dryRunGeocoder finds no address, so dry runs only use the addresses already known and don't use up the quota.
+type dryRunGeocoder struct{}
+
+// Name returns "dry-run".
+func (dryRunGeocoder) Name() string {
+	return "dry-run"
+}
+
+// Reverse fills addr with the placeholder of FillUnknownAddress.
+func (dryRunGeocoder) Reverse(addr *addressManager.Address, lat float64, lng float64, uId int64) error {
+	addressManager.FillUnknownAddress(addr)
+	return ErrNotGeocodedInDryRun
+}
+
+// Forward finds nothing.
+func (dryRunGeocoder) Forward(query string, uId int64) (*addressManager.Address, error) {
+	return nil, ErrNotGeocodedInDryRun
+}
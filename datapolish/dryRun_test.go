@@ -0,0 +1,104 @@
+package datapolish_test
+
+import (
+	"database/sql"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/datapolish"
+	"github.com/OpenDriversLog/goodl-lib/dbMan"
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan/models"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	"github.com/OpenDriversLog/goodl-lib/translate"
+)
+
+func testTrip(id int64, start int64, end int64) *Trip {
+	return &Trip{Id: id, StartTime: NInt64(start), EndTime: NInt64(end), Type: 1}
+}
+
+var _ = Describe("DryRun", func() {
+	Describe("DiffTrips", func() {
+		It("should group overlapping trips and classify them", func() {
+			edited := testTrip(2, 200, 400)
+			edited.Title = "Kundentermin"
+			edited.Type = 3
+			edited.DriverId = 5
+
+			before := []*Trip{testTrip(1, 0, 100), edited, testTrip(3, 500, 600), testTrip(4, 650, 700), testTrip(5, 800, 900)}
+			splitA := testTrip(11, 200, 300)
+			splitA.DriverId = 5
+			splitB := testTrip(12, 310, 400)
+			splitB.DriverId = 5
+			after := []*Trip{testTrip(1, 0, 100), splitA, splitB, testTrip(13, 500, 700), testTrip(14, 1000, 1100)}
+
+			diffs := datapolish.DiffTrips(before, after)
+			kinds := make(map[string][]*datapolish.TripDiff)
+			for _, d := range diffs {
+				kinds[d.Kind] = append(kinds[d.Kind], d)
+			}
+			Expect(kinds[datapolish.TripDiffUnchanged]).To(HaveLen(1))
+			Expect(kinds[datapolish.TripDiffSplit]).To(HaveLen(1))
+			Expect(kinds[datapolish.TripDiffMerged]).To(HaveLen(1))
+			Expect(kinds[datapolish.TripDiffRemoved]).To(HaveLen(1))
+			Expect(kinds[datapolish.TripDiffCreated]).To(HaveLen(1))
+			Expect(kinds[datapolish.TripDiffRemoved][0].Before[0].Id).To(Equal(int64(5)))
+
+			split := kinds[datapolish.TripDiffSplit][0]
+			Expect(split.After).To(HaveLen(2))
+			changes := make(map[string]bool)
+			for _, m := range split.Metadata {
+				changes[m.Field] = m.CarriedOver
+			}
+			Expect(changes).To(Equal(map[string]bool{"Title": false, "Type": false, "DriverId": true}))
+			Expect(kinds[datapolish.TripDiffUnchanged][0].Metadata).To(BeEmpty())
+		})
+	})
+
+	Describe("DryRunReprocessDataForDeviceInTimeRange", func() {
+		var (
+			dbCon    *sql.DB
+			deviceId int64
+			carId    int64
+		)
+		T := &translate.Translater{}
+		endTime := reportTestStart + 3600*1000
+
+		BeforeEach(func() {
+			dbCon, _ = dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+			deviceId, carId = insertTestDrive(dbCon)
+			_, err := datapolish.ProcessGPSDataWithGeocoder(reportTestStart, endTime, int(deviceId), false, 1, failingGeocoder{}, nil, T, dbCon)
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			deleteTestDrive(deviceId, carId, dbCon)
+			dbCon.Close()
+		})
+
+		It("should neither change the database nor ask the geocoder", func() {
+			counts := func() (kps int, trips int) {
+				err := dbCon.QueryRow("SELECT COUNT(*) FROM KeyPoints WHERE deviceId=?", deviceId).Scan(&kps)
+				Expect(err).To(BeNil())
+				err = dbCon.QueryRow("SELECT COUNT(*) FROM Tracks_Trips WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?)", deviceId).Scan(&trips)
+				Expect(err).To(BeNil())
+				return
+			}
+			kpsBefore, tripsBefore := counts()
+			Expect(tripsBefore).To(Equal(1))
+
+			diff, err := datapolish.DryRunReprocessDataForDeviceInTimeRange(reportTestStart, endTime, int(deviceId), 1, T, dbCon)
+			Expect(err).To(BeNil())
+			Expect(diff.Report.DeletedTracks).To(Equal(1))
+			Expect(diff.Report.NewKeyPoints).To(BeNumerically(">=", 2))
+			for _, addrErr := range diff.Report.AddressErrors {
+				Expect(addrErr.Error).To(Equal(datapolish.ErrNotGeocodedInDryRun))
+			}
+			Expect(diff.Trips).To(HaveLen(1))
+
+			kpsAfter, tripsAfter := counts()
+			Expect(kpsAfter).To(Equal(kpsBefore))
+			Expect(tripsAfter).To(Equal(tripsBefore))
+		})
+	})
+})
@@ -0,0 +1,132 @@
+package datapolish
+
+import (
+	"math"
+	"sort"
+
+	"github.com/Compufreak345/dbg"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	. "github.com/OpenDriversLog/goodl-lib/models/geo"
+	"github.com/OpenDriversLog/goodl-lib/tools"
+)
+
+const elTag = "glib/dp/elevation.go"
+
+// CalcElevationProfile returns the climbs & altitudes and the elevation profile, downsampled to
+// ElevationProfilePoints, of the given Locations, which should be sorted by time.
+// Locations without altitude (0 is considered as unknown) or less accurate than AccuracyThreshold are ignored,
+// the altitudes are averaged over ElevationSmoothingWindow to remove GPS noise.
+// Returns an empty profile if there are no usable altitudes.
+func CalcElevationProfile(raw []Location, config *LocationConfig) (stats ElevationStats, profile []*ElevationPoint) {
+	if config == nil {
+		config = GetDefaultLocationConfig()
+	}
+	defaults := GetDefaultLocationConfig()
+	window := int64(config.ElevationSmoothingWindow)
+	if window < 0 {
+		window = int64(defaults.ElevationSmoothingWindow)
+	}
+	minChange := float64(config.MinElevationChange)
+	if minChange < 0 {
+		minChange = float64(defaults.MinElevationChange)
+	}
+	maxPoints := config.ElevationProfilePoints
+	if maxPoints <= 1 {
+		maxPoints = defaults.ElevationProfilePoints
+	}
+
+	points := make([]*ElevationPoint, 0, len(raw))
+	var last *Location
+	var dist float64
+	for i := range raw {
+		l := &raw[i]
+		if !l.Altitude.Valid || l.Altitude.Float64 == 0 ||
+			(l.Accuracy.Valid && config.AccuracyThreshold > 0 && l.Accuracy.Float64 > float64(config.AccuracyThreshold)) {
+			continue
+		}
+		if last != nil {
+			dist += locationDistance(*last, *l)
+		}
+		last = l
+		points = append(points, &ElevationPoint{Time: l.TimeMillis.Int64, Distance: dist, Altitude: l.Altitude.Float64})
+	}
+	if len(points) == 0 {
+		profile = points
+		return
+	}
+
+	// moving average over the time window, using the raw altitudes
+	smoothed := make([]float64, len(points))
+	from, to := 0, 0
+	var sum float64
+	for i, p := range points {
+		for to < len(points) && points[to].Time <= p.Time+window/2 {
+			sum += points[to].Altitude
+			to++
+		}
+		for points[from].Time < p.Time-window/2 {
+			sum -= points[from].Altitude
+			from++
+		}
+		smoothed[i] = sum / float64(to-from)
+	}
+
+	stats.MinAltitude, stats.MaxAltitude = math.Inf(1), math.Inf(-1)
+	ref := smoothed[0]
+	for i, alt := range smoothed {
+		points[i].Altitude = alt
+		stats.MinAltitude = math.Min(stats.MinAltitude, alt)
+		stats.MaxAltitude = math.Max(stats.MaxAltitude, alt)
+		// only count changes above minChange, so the remaining noise does not add up
+		if alt-ref >= minChange {
+			stats.Ascent += alt - ref
+			ref = alt
+		} else if ref-alt >= minChange {
+			stats.Descent += ref - alt
+			ref = alt
+		}
+	}
+
+	profile = downsampleElevationProfile(points, maxPoints)
+	return
+}
+
+// downsampleElevationProfile returns at most maxPoints evenly distributed points of the given profile,
+// always including the first and the last one.
+func downsampleElevationProfile(points []*ElevationPoint, maxPoints int) []*ElevationPoint {
+	if len(points) <= maxPoints {
+		return points
+	}
+	res := make([]*ElevationPoint, maxPoints)
+	for i := 0; i < maxPoints; i++ {
+		res[i] = points[i*(len(points)-1)/(maxPoints-1)]
+	}
+	return res
+}
+
+// StoreTrackElevation calculates the elevation profile of the given track from the Locations between
+// startTime and endTime and saves it.
+func StoreTrackElevation(trackId int64, startTime int64, endTime int64, raw []Location, config *LocationConfig, dbCon tools.DbRunner) (err error) {
+	first := sort.Search(len(raw), func(i int) bool { return raw[i].TimeMillis.Int64 >= startTime })
+	last := sort.Search(len(raw), func(i int) bool { return raw[i].TimeMillis.Int64 > endTime })
+
+	stats, profile := CalcElevationProfile(raw[first:last], config)
+	if len(profile) == 0 {
+		return
+	}
+	_, err = dbCon.Exec("UPDATE Tracks SET ascent=?,descent=?,minAltitude=?,maxAltitude=? WHERE _trackId=?",
+		stats.Ascent, stats.Descent, stats.MinAltitude, stats.MaxAltitude, trackId)
+	if err != nil {
+		dbg.E(elTag, "Failed to update elevation of track %d : ", trackId, err)
+		return
+	}
+	for seq, p := range profile {
+		_, err = dbCon.Exec("INSERT INTO ElevationProfiles (trackId, seq, timeMillis, distance, altitude) VALUES (?,?,?,?,?)",
+			trackId, seq, p.Time, p.Distance, p.Altitude)
+		if err != nil {
+			dbg.E(elTag, "Failed to insert elevation profile for track %d : ", trackId, err)
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,49 @@
+package datapolish_test
+
+import (
+	"database/sql"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/datapolish"
+)
+
+var _ = Describe("Elevation", func() {
+	config := datapolish.GetDefaultLocationConfig()
+
+	// climbs 50m and descends 20m, with +-4m of GPS noise
+	hill := newTrace(stopA.Lat, stopA.Lng).drive(stopB.Lat, stopB.Lng, 14, 1).locs
+	for i := range hill {
+		alt := 300 + 0.5*float64(i)
+		if i > 100 {
+			alt = 350 - 0.4*float64(i-100)
+		}
+		if i%2 == 0 {
+			alt += 4
+		} else {
+			alt -= 4
+		}
+		hill[i].Altitude = sql.NullFloat64{Float64: alt, Valid: true}
+	}
+
+	It("should calculate climbs without adding up the noise", func() {
+		stats, profile := datapolish.CalcElevationProfile(hill, config)
+		Expect(stats.Ascent).To(BeNumerically("~", 50, 8))
+		Expect(stats.Descent).To(BeNumerically("~", 20, 8))
+		Expect(stats.MinAltitude).To(BeNumerically("~", 300, 5))
+		Expect(stats.MaxAltitude).To(BeNumerically("~", 350, 5))
+
+		Expect(profile).To(HaveLen(config.ElevationProfilePoints))
+		Expect(profile[0].Time).To(Equal(hill[0].TimeMillis.Int64))
+		Expect(profile[0].Distance).To(Equal(0.0))
+		Expect(profile[len(profile)-1].Time).To(Equal(hill[len(hill)-1].TimeMillis.Int64))
+		Expect(profile[len(profile)-1].Distance).To(BeNumerically("~", 2224, 20))
+	})
+
+	It("should ignore locations without altitude", func() {
+		stats, profile := datapolish.CalcElevationProfile(newTrace(stopA.Lat, stopA.Lng).drive(stopB.Lat, stopB.Lng, 14, 5).locs, config)
+		Expect(profile).To(BeEmpty())
+		Expect(stats.Ascent).To(Equal(0.0))
+	})
+})
@@ -0,0 +1,221 @@
+package datapolish
+
+import (
+	"database/sql"
+	"math"
+
+	"github.com/Compufreak345/dbg"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	. "github.com/OpenDriversLog/goodl-lib/models/geo"
+	"github.com/OpenDriversLog/goodl-lib/tools"
+)
+
+const gdgTag = "glib/dp/gapDetection.go"
+
+// GPSGap is a TrackGap found in a list of Locations.
+type GPSGap struct {
+	TrackGap
+	// StartIndex is the index of the last Location before the gap
+	StartIndex int
+	// EndIndex is the index of the first Location after the gap
+	EndIndex int
+	// IsStop is true if we assume that there was a stop during the gap
+	IsStop bool
+}
+
+// DetectGaps finds all gaps (missing data for more than MaxTimeGap or implausible jumps) in the given Locations,
+// which should be sorted by time. Single outliers are ignored, they are removed by CreateFilteredTrackPoints anyway.
+func DetectGaps(raw []Location, config *LocationConfig) []*GPSGap {
+	if config == nil {
+		config = GetDefaultLocationConfig()
+	}
+	defaults := GetDefaultLocationConfig()
+	maxTimeGap := int64(config.MaxTimeGap)
+	if maxTimeGap <= 0 {
+		maxTimeGap = int64(defaults.MaxTimeGap)
+	}
+	maxSpeed := float64(config.MaxPlausibleSpeed) / 3.6
+	if maxSpeed <= 0 {
+		maxSpeed = float64(defaults.MaxPlausibleSpeed) / 3.6
+	}
+
+	gaps := make([]*GPSGap, 0)
+	idx := accurateLocationIndexes(raw, config)
+	prev := -1
+	for k, i := range idx {
+		if prev < 0 {
+			prev = i
+			continue
+		}
+		dt := raw[i].TimeMillis.Int64 - raw[prev].TimeMillis.Int64
+		dist := locationDistance(raw[prev], raw[i])
+		jump := dist > float64(config.MinMoveDist) && locationSpeed(raw[prev], raw[i]) > maxSpeed
+		if jump && k+1 < len(idx) && locationSpeed(raw[prev], raw[idx[k+1]]) <= maxSpeed {
+			// outlier, the next location fits to the previous one
+			continue
+		}
+		if dt > maxTimeGap || jump {
+			if gap := classifyGap(raw, prev, i, jump, config); gap != nil {
+				gaps = append(gaps, gap)
+			}
+		}
+		prev = i
+	}
+	return gaps
+}
+
+// classifyGap decides what most likely happened between the Locations at index from and to.
+// Returns nil if nothing relevant got lost.
+func classifyGap(raw []Location, from int, to int, jump bool, config *LocationConfig) *GPSGap {
+	a, b := raw[from], raw[to]
+	gap := &GPSGap{
+		TrackGap: TrackGap{
+			StartTime: a.TimeMillis.Int64,
+			EndTime:   b.TimeMillis.Int64,
+			StartLat:  a.Latitude.Float64,
+			StartLng:  a.Longitude.Float64,
+			EndLat:    b.Latitude.Float64,
+			EndLng:    b.Longitude.Float64,
+			Distance:  locationDistance(a, b),
+		},
+		StartIndex: from,
+		EndIndex:   to,
+	}
+	dt := gap.EndTime - gap.StartTime
+
+	switch {
+	case jump:
+		gap.Kind = TrackGapUnknown
+	case gap.Distance <= float64(config.MinMoveDist):
+		// we did not move, so this is a stop if it was long enough - otherwise we did not miss anything
+		if dt < int64(config.MinMoveTime) {
+			return nil
+		}
+		gap.Kind = TrackGapInterpolated
+		gap.IsStop = true
+	default:
+		minSpeed := float64(config.MinGapTravelSpeed) / 3.6
+		if minSpeed <= 0 {
+			minSpeed = float64(GetDefaultLocationConfig().MinGapTravelSpeed) / 3.6
+		}
+		travelTime := int64(gap.Distance / minSpeed * 1000)
+		if dt-travelTime >= int64(config.MinMoveTime) {
+			// even driving slowly we had enough time left for a stop somewhere
+			gap.Kind = TrackGapUnknown
+			gap.IsStop = true
+		} else {
+			gap.Kind = TrackGapInterpolated
+		}
+	}
+	return gap
+}
+
+// ApplyGapsToKeyPoints corrects the KeyPoints found by a StopDetector using the given gaps:
+// stops that only exist because we had no data while moving are removed, and gaps where
+// we must have stopped somewhere get a KeyPoint at their start if no StopDetector found one.
+// The first and the last KeyPoint are never removed.
+func ApplyGapsToKeyPoints(keyPoints []*KeyPoint, gaps []*GPSGap, config *LocationConfig) []*KeyPoint {
+	if len(keyPoints) < 2 || len(gaps) == 0 {
+		return keyPoints
+	}
+	if config == nil {
+		config = GetDefaultLocationConfig()
+	}
+
+	res := make([]*KeyPoint, 0, len(keyPoints))
+	res = append(res, keyPoints[0])
+	for _, kp := range keyPoints[1 : len(keyPoints)-1] {
+		var missing int64
+		for _, g := range gaps {
+			if !g.IsStop {
+				missing += timeOverlap(kp.StartTime.Int64, kp.EndTime.Int64, g.StartTime, g.EndTime)
+			}
+		}
+		if missing > 0 && kp.EndTime.Int64-kp.StartTime.Int64-missing < int64(config.MinMoveTime) {
+			dbg.D(gdgTag, "Removing keypoint at %d, it only exists because of a gap in the GPS data", kp.StartTime.Int64)
+			continue
+		}
+		res = append(res, kp)
+	}
+	res = append(res, keyPoints[len(keyPoints)-1])
+
+	for _, g := range gaps {
+		if !g.IsStop || g.Distance <= float64(config.MinMoveDist) {
+			continue
+		}
+		pos := -1
+		for i, kp := range res {
+			if timeOverlap(kp.StartTime.Int64, kp.EndTime.Int64, g.StartTime, g.EndTime) > 0 {
+				pos = -1
+				break
+			}
+			if i > 0 && pos < 0 && kp.StartTime.Int64 >= g.EndTime {
+				pos = i
+			}
+		}
+		if pos <= 0 {
+			continue
+		}
+		dbg.D(gdgTag, "Adding keypoint at %d for a gap in the GPS data", g.StartTime)
+		kp := &KeyPoint{
+			Latitude:  sql.NullFloat64{Float64: g.StartLat, Valid: true},
+			Longitude: sql.NullFloat64{Float64: g.StartLng, Valid: true},
+			StartTime: sql.NullInt64{Int64: g.StartTime, Valid: true},
+			EndTime:   sql.NullInt64{Int64: g.EndTime, Valid: true},
+		}
+		res = append(res[:pos], append([]*KeyPoint{kp}, res[pos:]...)...)
+	}
+	return res
+}
+
+// StoreTrackGaps saves all gaps within the given time range for the given track and updates the tracks dataQuality.
+func StoreTrackGaps(trackId int64, startTime int64, endTime int64, gaps []*GPSGap, dbCon tools.DbRunner) (err error) {
+	quality := DataQualityOk
+	for _, g := range gaps {
+		if timeOverlap(startTime, endTime, g.StartTime, g.EndTime) <= 0 {
+			continue
+		}
+		_, err = dbCon.Exec(`INSERT INTO TrackGaps (trackId, startTime, endTime, startLatitude, startLongitude,
+endLatitude, endLongitude, distance, kind) VALUES (?,?,?,?,?,?,?,?,?)`,
+			trackId, g.StartTime, g.EndTime, g.StartLat, g.StartLng, g.EndLat, g.EndLng, g.Distance, g.Kind)
+		if err != nil {
+			dbg.E(gdgTag, "Failed to insert gap for track %d : ", trackId, err)
+			return
+		}
+		if g.Kind == TrackGapUnknown {
+			quality = DataQualityGap
+		} else if quality == DataQualityOk {
+			quality = DataQualityInterpolated
+		}
+	}
+	_, err = dbCon.Exec("UPDATE Tracks SET dataQuality=? WHERE _trackId=?", quality, trackId)
+	if err != nil {
+		dbg.E(gdgTag, "Failed to update dataQuality for track %d : ", trackId, err)
+	}
+	return
+}
+
+// timeOverlap returns the duration both time ranges have in common.
+func timeOverlap(start1 int64, end1 int64, start2 int64, end2 int64) int64 {
+	start := start1
+	if start2 > start {
+		start = start2
+	}
+	end := end1
+	if end2 < end {
+		end = end2
+	}
+	if end < start {
+		return 0
+	}
+	return end - start
+}
+
+// locationSpeed returns the speed (in m/s) needed to get from a to b.
+func locationSpeed(a Location, b Location) float64 {
+	dt := float64(b.TimeMillis.Int64-a.TimeMillis.Int64) / 1000
+	if dt <= 0 {
+		return math.Inf(1)
+	}
+	return locationDistance(a, b) / dt
+}
@@ -0,0 +1,118 @@
+package datapolish_test
+
+import (
+	"database/sql"
+
+	geo "github.com/kellydunn/golang-geo"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/datapolish"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	. "github.com/OpenDriversLog/goodl-lib/models/geo"
+)
+
+// skip adds no points while moving to the given position within duration (seconds), e.g. in a tunnel.
+func (t *traceBuilder) skip(lat float64, lng float64, duration int64) *traceBuilder {
+	t.time += duration * 1000
+	t.lat, t.lng = lat, lng
+	return t
+}
+
+var _ = Describe("GapDetection", func() {
+	config := datapolish.GetDefaultLocationConfig()
+
+	tunnel := newTrace(stopA.Lat, stopA.Lng).stay(300, 10, 5, 10).
+		drive(stopL.Lat, stopL.Lng, 14, 5).skip(stopB.Lat, stopB.Lng, 180).
+		drive(stopC.Lat, stopC.Lng, 14, 5).stay(300, 10, 5, 10).locs
+	phoneOff := newTrace(stopA.Lat, stopA.Lng).stay(300, 10, 5, 10).
+		drive(stopL.Lat, stopL.Lng, 14, 5).skip(stopB.Lat, stopB.Lng, 3600).
+		drive(stopC.Lat, stopC.Lng, 14, 5).stay(300, 10, 5, 10).locs
+
+	Describe("DetectGaps", func() {
+		It("should find no gaps in continuous data", func() {
+			Expect(datapolish.DetectGaps(stopDetectionCorpus[0].Trace, config)).To(BeEmpty())
+		})
+
+		It("should interpolate short gaps while driving", func() {
+			gaps := datapolish.DetectGaps(tunnel, config)
+			Expect(gaps).To(HaveLen(1))
+			Expect(gaps[0].Kind).To(Equal(TrackGapInterpolated))
+			Expect(gaps[0].IsStop).To(BeFalse())
+			Expect(gaps[0].Distance).To(BeNumerically("~", 1112, 10))
+		})
+
+		It("should assume a stop if the gap is too long for the distance", func() {
+			gaps := datapolish.DetectGaps(phoneOff, config)
+			Expect(gaps).To(HaveLen(1))
+			Expect(gaps[0].Kind).To(Equal(TrackGapUnknown))
+			Expect(gaps[0].IsStop).To(BeTrue())
+		})
+
+		It("should treat a long gap without movement as stop", func() {
+			gaps := datapolish.DetectGaps(stopDetectionCorpus[3].Trace, config)
+			Expect(gaps).To(HaveLen(1))
+			Expect(gaps[0].Kind).To(Equal(TrackGapInterpolated))
+			Expect(gaps[0].IsStop).To(BeTrue())
+		})
+
+		It("should ignore single outliers but report implausible jumps", func() {
+			trace := newTrace(stopA.Lat, stopA.Lng).stay(300, 10, 5, 10)
+			trace.add(stopC.Lat, stopC.Lng, 10)
+			trace.time += 10000
+			trace.stay(300, 10, 5, 10)
+			Expect(datapolish.DetectGaps(trace.locs, config)).To(BeEmpty())
+
+			trace = newTrace(stopA.Lat, stopA.Lng).stay(300, 10, 5, 10).skip(stopC.Lat, stopC.Lng, 10).stay(300, 10, 5, 10)
+			gaps := datapolish.DetectGaps(trace.locs, config)
+			Expect(gaps).To(HaveLen(1))
+			Expect(gaps[0].Kind).To(Equal(TrackGapUnknown))
+			Expect(gaps[0].IsStop).To(BeFalse())
+		})
+	})
+
+	Describe("ApplyGapsToKeyPoints", func() {
+		expectStops := func(kps []*KeyPoint, expected []expectedStop) {
+			Expect(kps).To(HaveLen(len(expected)))
+			for i, kp := range kps {
+				p := geo.NewPoint(kp.Latitude.Float64, kp.Longitude.Float64)
+				dist := p.GreatCircleDistance(geo.NewPoint(expected[i].Lat, expected[i].Lng)) * 1000
+				Expect(dist).To(BeNumerically("<", float64(config.MinMoveDist)), "keypoint %d", i)
+			}
+		}
+
+		for _, name := range datapolish.GetStopDetectorNames() {
+			name := name
+			detector := datapolish.GetStopDetector(name)
+
+			It("should not stop in a tunnel using "+name, func() {
+				kps, err := detector.DetectStops(tunnel, config)
+				Expect(err).ToNot(HaveOccurred())
+				kps = datapolish.ApplyGapsToKeyPoints(kps, datapolish.DetectGaps(tunnel, config), config)
+				expectStops(kps, []expectedStop{stopA, stopC})
+			})
+
+			It("should stop at the start of a long gap using "+name, func() {
+				kps, err := detector.DetectStops(phoneOff, config)
+				Expect(err).ToNot(HaveOccurred())
+				kps = datapolish.ApplyGapsToKeyPoints(kps, datapolish.DetectGaps(phoneOff, config), config)
+				expectStops(kps, []expectedStop{stopA, stopL, stopC})
+			})
+		}
+
+		It("should remove stops caused by gaps while moving", func() {
+			kp := func(lat float64, lng float64, start int64, end int64) *KeyPoint {
+				return &KeyPoint{
+					Latitude:  sql.NullFloat64{Float64: lat, Valid: true},
+					Longitude: sql.NullFloat64{Float64: lng, Valid: true},
+					StartTime: sql.NullInt64{Int64: start, Valid: true},
+					EndTime:   sql.NullInt64{Int64: end, Valid: true},
+				}
+			}
+			kps := []*KeyPoint{kp(stopA.Lat, stopA.Lng, 0, 1000), kp(stopL.Lat, stopL.Lng, 5000, 400000),
+				kp(stopC.Lat, stopC.Lng, 900000, 1000000)}
+			gaps := []*datapolish.GPSGap{{TrackGap: TrackGap{StartTime: 10000, EndTime: 400000, Kind: TrackGapInterpolated}}}
+			expectStops(datapolish.ApplyGapsToKeyPoints(kps, gaps, config), []expectedStop{stopA, stopC})
+		})
+	})
+})
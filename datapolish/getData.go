@@ -8,6 +8,7 @@ import (
 	"math"
 
 	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/tools"
 	geo "github.com/kellydunn/golang-geo"
 	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
 	. "github.com/OpenDriversLog/goodl-lib/models/geo"
@@ -23,9 +24,23 @@ var geoCoder geo.MapQuestGeocoder
 // GetDefaultLocationConfig returns the default Location-config
 func GetDefaultLocationConfig() *LocationConfig {
 	return &LocationConfig{
-		MinMoveDist:       70,
-		MinMoveTime:       3 * 60 * 1000, // ms
-		AccuracyThreshold: 200,
+		MinMoveDist:                70,
+		MinMoveTime:                3 * 60 * 1000, // ms
+		AccuracyThreshold:          200,
+		MaxTimeGap:                 2 * 60 * 1000, // ms
+		MaxPlausibleSpeed:          250,           // km/h
+		MinGapTravelSpeed:          18,            // km/h
+		SpeedingThreshold:          130,           // km/h
+		MinSpeedingDuration:        30 * 1000,     // ms
+		MinMovingSpeed:             5,             // km/h
+		HarshAccelerationThreshold: 3.5,           // m/s²
+		HarshBrakingThreshold:      4,             // m/s²
+		HarshCorneringThreshold:    4,             // m/s²
+		ElevationSmoothingWindow:   30 * 1000,     // ms
+		MinElevationChange:         3,             // m
+		ElevationProfilePoints:     100,
+		FusionSegmentLength:        30 * 1000,     // ms
+		FusionMinOverlap:           0.5,
 		// TODO: add map for show at zoomstage, @see geo-enhanced
 		// minDistAtZoom := make map specific size
 	}
@@ -86,13 +101,13 @@ func GetDeviceTimeRange(deviceId int, dbCon *sql.DB) (minTime int64, maxTime int
 }
 
 // GetTrackRecordsForDevice gets trackRecords for a specific deviceId (key)
-func GetTrackRecordsForDevice(startTime int64, endTime int64, deviceId int, dbCon *sql.DB) ([]Location, error) {
+func GetTrackRecordsForDevice(startTime int64, endTime int64, deviceId int, dbCon tools.DbRunner) ([]Location, error) {
 
 	var loc Location
 	tr := make([]Location, 0)
 
 	// TODO: CS use crossplattform DB stuff
-	rows2, err := dbCon.Query("SELECT _id,timeMillis,latitude,longitude,altitude,accuracy,provider,source,accuracyrating,speed FROM trackRecords WHERE ( timeMillis >= ? AND timeMillis <= ? AND deviceId=?) ORDER BY timeMillis ASC", startTime, endTime, deviceId)
+	rows2, err := dbCon.Query("SELECT _id,timeMillis,latitude,longitude,altitude,accuracy,provider,source,accuracyrating,speed,accelLongitudinal,accelLateral FROM trackRecords WHERE ( timeMillis >= ? AND timeMillis <= ? AND deviceId=?) ORDER BY timeMillis ASC", startTime, endTime, deviceId)
 	if err != nil {
 		dbg.E(gdTag, "failed to get rows from trackrecords", err)
 		return nil, err
@@ -105,7 +120,7 @@ func GetTrackRecordsForDevice(startTime int64, endTime int64, deviceId int, dbCo
 		err = rows2.Scan(&loc.Id, &loc.TimeMillis, &loc.Latitude,
 			&loc.Longitude, &loc.Altitude, &loc.Accuracy,
 			&loc.Provider, &loc.Source, &loc.AccuracyRating,
-			&loc.Speed)
+			&loc.Speed, &loc.AccelLongitudinal, &loc.AccelLateral)
 		tr = append(tr, loc)
 	}
 	// dbg.I(gdTag, "got the trackrecords... resultsize for device", deviceId, len(tr))
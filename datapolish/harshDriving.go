@@ -0,0 +1,190 @@
+package datapolish
+
+import (
+	"math"
+	"sort"
+
+	"github.com/Compufreak345/dbg"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	. "github.com/OpenDriversLog/goodl-lib/models/geo"
+	"github.com/OpenDriversLog/goodl-lib/tools"
+	geo "github.com/kellydunn/golang-geo"
+)
+
+const hdTag = "glib/dp/harshDriving.go"
+
+// harshMaxInterval is the maximum time (in milliseconds) between two Locations to derive accelerations from them.
+const harshMaxInterval = 10 * 1000
+
+// maxPlausibleAcceleration is the acceleration (in m/s²) above which we consider a value as measurement error.
+const maxPlausibleAcceleration = 12
+
+// accelerationSample is an acceleration (in m/s²) at a Location.
+type accelerationSample struct {
+	Kind  string
+	Value float64
+	Start int64
+	End   int64
+	// Index is the index of the Location the acceleration was measured at
+	Index int
+}
+
+// harshThresholds returns the configured thresholds (in m/s²) by the kind of HarshEvent,
+// using the defaults for unset ones.
+func harshThresholds(config *LocationConfig) map[string]float64 {
+	defaults := GetDefaultLocationConfig()
+	thresholds := map[string]float64{
+		HarshAcceleration: config.HarshAccelerationThreshold,
+		HarshBraking:      config.HarshBrakingThreshold,
+		HarshCornering:    config.HarshCorneringThreshold,
+	}
+	if thresholds[HarshAcceleration] <= 0 {
+		thresholds[HarshAcceleration] = defaults.HarshAccelerationThreshold
+	}
+	if thresholds[HarshBraking] <= 0 {
+		thresholds[HarshBraking] = defaults.HarshBrakingThreshold
+	}
+	if thresholds[HarshCornering] <= 0 {
+		thresholds[HarshCornering] = defaults.HarshCorneringThreshold
+	}
+	return thresholds
+}
+
+// pointSpeed returns the speed (in m/s) at the Location with the given index, preferring the speed reported
+// by the device. Returns false if it can not be determined.
+func pointSpeed(raw []Location, i int, maxSpeed float64) (speed float64, ok bool) {
+	if raw[i].Speed.Valid && raw[i].Speed.Float64 > 0 {
+		speed = raw[i].Speed.Float64
+	} else {
+		if i == 0 || raw[i].TimeMillis.Int64-raw[i-1].TimeMillis.Int64 > harshMaxInterval {
+			return
+		}
+		speed = locationSpeed(raw[i-1], raw[i])
+	}
+	return speed, !math.IsInf(speed, 0) && speed*3.6 <= maxSpeed
+}
+
+// accelerationSamples returns the longitudinal & lateral accelerations above the configured thresholds
+// in the given Locations, which should be sorted by time.
+// Accelerations measured by the device are preferred, otherwise they are derived from the speed deltas
+// and heading changes between consecutive Locations.
+func accelerationSamples(raw []Location, config *LocationConfig) (samples []accelerationSample) {
+	defaults := GetDefaultLocationConfig()
+	thresholds := harshThresholds(config)
+	maxSpeed := float64(config.MaxPlausibleSpeed)
+	if maxSpeed <= 0 {
+		maxSpeed = float64(defaults.MaxPlausibleSpeed)
+	}
+	minMoving := float64(config.MinMovingSpeed) / 3.6
+
+	samples = make([]accelerationSample, 0)
+	add := func(kind string, value float64, start int64, end int64, idx int) {
+		if value > maxPlausibleAcceleration {
+			return
+		}
+		samples = append(samples, accelerationSample{Kind: kind, Value: value, Start: start, End: end, Index: idx})
+	}
+	for i := 1; i < len(raw); i++ {
+		prev, cur := raw[i-1], raw[i]
+		dt := cur.TimeMillis.Int64 - prev.TimeMillis.Int64
+		if dt <= 0 {
+			continue
+		}
+		speed, speedOk := pointSpeed(raw, i, maxSpeed)
+
+		a := math.NaN()
+		if cur.AccelLongitudinal.Valid {
+			a = cur.AccelLongitudinal.Float64
+		} else if prevSpeed, ok := pointSpeed(raw, i-1, maxSpeed); ok && speedOk && dt <= harshMaxInterval {
+			a = (speed - prevSpeed) / (float64(dt) / 1000)
+		}
+		if a > thresholds[HarshAcceleration] {
+			add(HarshAcceleration, a, prev.TimeMillis.Int64, cur.TimeMillis.Int64, i)
+		} else if -a > thresholds[HarshBraking] {
+			add(HarshBraking, -a, prev.TimeMillis.Int64, cur.TimeMillis.Int64, i)
+		}
+
+		lateral := math.NaN()
+		if cur.AccelLateral.Valid {
+			lateral = math.Abs(cur.AccelLateral.Float64)
+		} else if i+1 < len(raw) && speedOk && speed >= minMoving && dt <= harshMaxInterval {
+			next := raw[i+1]
+			dtNext := next.TimeMillis.Int64 - cur.TimeMillis.Int64
+			if dtNext > 0 && dtNext <= harshMaxInterval {
+				p := geo.NewPoint(cur.Latitude.Float64, cur.Longitude.Float64)
+				in := geo.NewPoint(prev.Latitude.Float64, prev.Longitude.Float64).BearingTo(p)
+				out := p.BearingTo(geo.NewPoint(next.Latitude.Float64, next.Longitude.Float64))
+				turn := math.Mod(out-in+540, 360) - 180
+				// the heading changes between the middles of both segments
+				lateral = speed * math.Abs(turn) * math.Pi / 180 / (float64(dt+dtNext) / 2000)
+			}
+		}
+		if lateral > thresholds[HarshCornering] {
+			add(HarshCornering, lateral, prev.TimeMillis.Int64, cur.TimeMillis.Int64, i)
+		}
+	}
+	return
+}
+
+// DetectHarshEvents finds all times of harsh acceleration, braking and cornering in the given Locations,
+// which should be sorted by time. Consecutive Locations above the threshold are merged into one event.
+func DetectHarshEvents(raw []Location, config *LocationConfig) (events []*HarshEvent) {
+	if config == nil {
+		config = GetDefaultLocationConfig()
+	}
+	defaults := GetDefaultLocationConfig()
+	thresholds := harshThresholds(config)
+	maxSpeed := float64(config.MaxPlausibleSpeed)
+	if maxSpeed <= 0 {
+		maxSpeed = float64(defaults.MaxPlausibleSpeed)
+	}
+
+	events = make([]*HarshEvent, 0)
+	current := make(map[string]*HarshEvent)
+	lastIdx := make(map[string]int)
+	for _, s := range accelerationSamples(raw, config) {
+		e := current[s.Kind]
+		if e == nil || lastIdx[s.Kind] != s.Index-1 {
+			e = &HarshEvent{Kind: s.Kind, StartTime: s.Start}
+			current[s.Kind] = e
+			events = append(events, e)
+		}
+		lastIdx[s.Kind] = s.Index
+		e.EndTime = s.End
+		if s.Value > e.PeakAcceleration {
+			loc := raw[s.Index]
+			e.PeakAcceleration = s.Value
+			e.Severity = s.Value / thresholds[s.Kind]
+			e.Lat = loc.Latitude.Float64
+			e.Lng = loc.Longitude.Float64
+			speed, _ := pointSpeed(raw, s.Index, maxSpeed)
+			e.Speed = speed * 3.6
+		}
+	}
+	sort.Sort(harshEventsByTime(events))
+	return
+}
+
+type harshEventsByTime []*HarshEvent
+
+func (e harshEventsByTime) Len() int           { return len(e) }
+func (e harshEventsByTime) Less(i, j int) bool { return e[i].StartTime < e[j].StartTime }
+func (e harshEventsByTime) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// StoreTrackHarshEvents detects the harsh driving events of the given track in the Locations between
+// startTime and endTime and saves them.
+func StoreTrackHarshEvents(trackId int64, startTime int64, endTime int64, raw []Location, config *LocationConfig, dbCon tools.DbRunner) (err error) {
+	first := sort.Search(len(raw), func(i int) bool { return raw[i].TimeMillis.Int64 >= startTime })
+	last := sort.Search(len(raw), func(i int) bool { return raw[i].TimeMillis.Int64 > endTime })
+
+	for _, e := range DetectHarshEvents(raw[first:last], config) {
+		_, err = dbCon.Exec(`INSERT INTO HarshEvents (trackId, startTime, endTime, kind, peakAcceleration, latitude, longitude,
+speed, severity) VALUES (?,?,?,?,?,?,?,?,?)`,
+			trackId, e.StartTime, e.EndTime, e.Kind, e.PeakAcceleration, e.Lat, e.Lng, e.Speed, e.Severity)
+		if err != nil {
+			dbg.E(hdTag, "Failed to insert harsh event for track %d : ", trackId, err)
+			return
+		}
+	}
+	return
+}
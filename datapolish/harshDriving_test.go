@@ -0,0 +1,61 @@
+package datapolish_test
+
+import (
+	"database/sql"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/datapolish"
+	. "github.com/OpenDriversLog/goodl-lib/models/geo"
+)
+
+// withSpeeds sets the speed (m/s) reported by the device for the Locations starting at the given index.
+func withSpeeds(t *traceBuilder, from int, speeds ...float64) *traceBuilder {
+	for i, s := range speeds {
+		t.locs[from+i].Speed = sql.NullFloat64{Float64: s, Valid: true}
+	}
+	return t
+}
+
+var _ = Describe("HarshDriving", func() {
+	config := datapolish.GetDefaultLocationConfig()
+
+	It("should find harsh acceleration & braking from the speed deltas", func() {
+		trace := newTrace(stopA.Lat, stopA.Lng).drive(stopB.Lat, stopB.Lng, 14, 1)
+		withSpeeds(trace, 0, 1, 6, 11, 14, 14, 14, 14, 9, 4)
+
+		events := datapolish.DetectHarshEvents(trace.locs[:9], config)
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Kind).To(Equal(HarshAcceleration))
+		Expect(events[0].EndTime - events[0].StartTime).To(Equal(int64(2000)))
+		Expect(events[0].PeakAcceleration).To(BeNumerically("~", 5, 0.01))
+		Expect(events[0].Severity).To(BeNumerically("~", 5/config.HarshAccelerationThreshold, 0.01))
+		Expect(events[1].Kind).To(Equal(HarshBraking))
+		Expect(events[1].PeakAcceleration).To(BeNumerically("~", 5, 0.01))
+		Expect(events[1].Speed).To(BeNumerically("~", 9*3.6, 0.01))
+	})
+
+	It("should find sharp corners from the heading change", func() {
+		corner := newTrace(stopA.Lat, stopA.Lng).drive(stopB.Lat, stopB.Lng, 14, 5).drive(stopC.Lat, stopC.Lng, 14, 5).locs
+		events := datapolish.DetectHarshEvents(corner, config)
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Kind).To(Equal(HarshCornering))
+		Expect(events[0].Lat).To(BeNumerically("~", stopB.Lat, 0.0001))
+		Expect(events[0].Lng).To(BeNumerically("~", stopB.Lng, 0.0001))
+
+		Expect(datapolish.DetectHarshEvents(newTrace(stopA.Lat, stopA.Lng).drive(stopB.Lat, stopB.Lng, 14, 5).locs, config)).To(BeEmpty())
+	})
+
+	It("should prefer the accelerations measured by the device", func() {
+		trace := newTrace(stopA.Lat, stopA.Lng).drive(stopB.Lat, stopB.Lng, 14, 5).locs
+		trace[3].AccelLateral = sql.NullFloat64{Float64: -6, Valid: true}
+		trace[4].AccelLongitudinal = sql.NullFloat64{Float64: -8, Valid: true}
+		events := datapolish.DetectHarshEvents(trace, config)
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Kind).To(Equal(HarshCornering))
+		Expect(events[0].PeakAcceleration).To(Equal(6.0))
+		Expect(events[1].Kind).To(Equal(HarshBraking))
+		Expect(events[1].Severity).To(Equal(2.0))
+	})
+})
@@ -0,0 +1,350 @@
+package datapolish
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+)
+
+const mmTag = "glib/dp/mapMatching.go"
+
+var ErrMapMatchingFailed = errors.New("Unable to match track to the road graph")
+
+// MapMatchConfig configures the HMM map matching (Newson & Krumm, "Hidden Markov Map Matching Through Noise and Sparseness").
+type MapMatchConfig struct {
+	// SearchRadius is the radius (in meters) around a trackPoint in which road candidates are searched.
+	SearchRadius float64
+	// MaxCandidates is the maximum number of road candidates per trackPoint.
+	MaxCandidates int
+	// Sigma is the standard deviation (in meters) of the GPS noise, used for the emission probabilities.
+	Sigma float64
+	// Beta (in meters) controls how strongly routes longer than the great circle distance are punished.
+	Beta float64
+	// MaxRouteFactor limits the route search between two trackPoints to MaxRouteFactor times their distance.
+	MaxRouteFactor float64
+}
+
+// matchCandidate is a possible position on the road graph for a trackPoint.
+type matchCandidate struct {
+	edge      *RoadEdge
+	frac      float64
+	lat       float64
+	lng       float64
+	logEm     float64
+	score     float64
+	prev      int     // index of the best candidate of the previous step
+	prevRoute float64 // route distance from the best candidate of the previous step
+}
+
+// candidatesByEmission sorts matchCandidates by descending emission probability.
+type candidatesByEmission []*matchCandidate
+
+func (c candidatesByEmission) Len() int           { return len(c) }
+func (c candidatesByEmission) Less(i, j int) bool { return c[i].logEm > c[j].logEm }
+func (c candidatesByEmission) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+var mapMatchingMutex sync.RWMutex
+var mapMatchingGraph *RoadGraph
+
+// GetDefaultMapMatchConfig returns the default configuration for map matching.
+func GetDefaultMapMatchConfig() *MapMatchConfig {
+	return &MapMatchConfig{
+		SearchRadius:   50,
+		MaxCandidates:  8,
+		Sigma:          10,
+		Beta:           30,
+		MaxRouteFactor: 4,
+	}
+}
+
+// EnableMapMatching loads the OSM extract (PBF or XML) at the given path and enables map matching
+// of new tracks in ProcessGPSData. An empty path disables map matching.
+func EnableMapMatching(osmPath string) (err error) {
+	var graph *RoadGraph
+	if osmPath != "" {
+		graph, err = LoadRoadGraph(osmPath)
+		if err != nil {
+			return
+		}
+	}
+	mapMatchingMutex.Lock()
+	mapMatchingGraph = graph
+	mapMatchingMutex.Unlock()
+	return
+}
+
+// GetMapMatchingGraph returns the road graph used for map matching or nil if map matching is disabled.
+func GetMapMatchingGraph() *RoadGraph {
+	mapMatchingMutex.RLock()
+	defer mapMatchingMutex.RUnlock()
+	return mapMatchingGraph
+}
+
+// MatchTrackPoints snaps the given trackPoints to the given road graph using a hidden markov model
+// and returns the matched geometry and its length in meters.
+// Points without road candidates are skipped, if no route between two points is found, the matching restarts.
+func MatchTrackPoints(graph *RoadGraph, points []TrackPoint, config *MapMatchConfig) (matched []MatchedTrackPoint, distance float64, err error) {
+	if config == nil {
+		config = GetDefaultMapMatchConfig()
+	}
+	matched = make([]MatchedTrackPoint, 0)
+	var steps [][]*matchCandidate
+	var stepPoints []TrackPoint
+	var lastEnd *MatchedTrackPoint
+
+	// finishSegment backtracks the best path of the current steps and appends it to the result.
+	finishSegment := func() {
+		if len(steps) == 0 {
+			return
+		}
+		best := 0
+		last := steps[len(steps)-1]
+		for i, c := range last {
+			if c.score > last[best].score {
+				best = i
+			}
+		}
+		chosen := make([]*matchCandidate, len(steps))
+		for s := len(steps) - 1; s >= 0; s-- {
+			chosen[s] = steps[s][best]
+			best = chosen[s].prev
+		}
+		if lastEnd != nil {
+			// bridge the gap between two segments with a straight line
+			distance += haversineDistance(lastEnd.Latitude.Float64, lastEnd.Longitude.Float64, chosen[0].lat, chosen[0].lng)
+		}
+		for s, c := range chosen {
+			if s > 0 {
+				path, d := graph.routeBetween(chosen[s-1], c, c.prevRoute)
+				distance += d
+				for _, n := range path {
+					matched = append(matched, newMatchedTrackPoint(n.Lat, n.Lng, sql.NullInt64{}, c.edge.WayId))
+				}
+			}
+			matched = append(matched, newMatchedTrackPoint(c.lat, c.lng, stepPoints[s].TrackPointId, c.edge.WayId))
+		}
+		end := matched[len(matched)-1]
+		lastEnd = &end
+		steps = nil
+		stepPoints = nil
+	}
+
+	for _, p := range points {
+		lat, lng := p.Latitude.Float64, p.Longitude.Float64
+		cands := graph.findCandidates(lat, lng, config)
+		if len(cands) == 0 {
+			continue
+		}
+		if len(steps) == 0 {
+			for _, c := range cands {
+				c.score = c.logEm
+				c.prev = -1
+			}
+			steps = append(steps, cands)
+			stepPoints = append(stepPoints, p)
+			continue
+		}
+		prevPoint := stepPoints[len(stepPoints)-1]
+		prevCands := steps[len(steps)-1]
+		gcDist := haversineDistance(prevPoint.Latitude.Float64, prevPoint.Longitude.Float64, lat, lng)
+		maxRoute := gcDist*config.MaxRouteFactor + 2*config.SearchRadius
+		reachable := false
+		for _, c := range cands {
+			c.score = math.Inf(-1)
+			c.prev = -1
+		}
+		for pi, pc := range prevCands {
+			if math.IsInf(pc.score, -1) {
+				continue
+			}
+			routes := graph.routeDistances(pc, cands, maxRoute)
+			for ci, routeDist := range routes {
+				c := cands[ci]
+				logTr := -math.Log(config.Beta) - math.Abs(gcDist-routeDist)/config.Beta
+				if s := pc.score + logTr + c.logEm; s > c.score {
+					c.score = s
+					c.prev = pi
+					c.prevRoute = routeDist
+					reachable = true
+				}
+			}
+		}
+		if !reachable {
+			dbg.D(mmTag, "No route found to trackPoint %d, restarting matching", p.TrackPointId.Int64)
+			finishSegment()
+			for _, c := range cands {
+				c.score = c.logEm
+				c.prev = -1
+			}
+		}
+		steps = append(steps, cands)
+		stepPoints = append(stepPoints, p)
+	}
+	finishSegment()
+
+	if len(matched) < 2 {
+		err = ErrMapMatchingFailed
+		return
+	}
+	for i := range matched {
+		matched[i].Seq = sql.NullInt64{Int64: int64(i), Valid: true}
+	}
+	return
+}
+
+func newMatchedTrackPoint(lat float64, lng float64, trackPointId sql.NullInt64, wayId int64) MatchedTrackPoint {
+	return MatchedTrackPoint{
+		Latitude:     sql.NullFloat64{Float64: lat, Valid: true},
+		Longitude:    sql.NullFloat64{Float64: lng, Valid: true},
+		TrackPointId: trackPointId,
+		WayId:        sql.NullInt64{Int64: wayId, Valid: true},
+	}
+}
+
+// findCandidates returns the closest road positions within the search radius for the given position.
+func (g *RoadGraph) findCandidates(lat float64, lng float64, config *MapMatchConfig) (cands []*matchCandidate) {
+	for _, e := range g.edgesNear(lat, lng, config.SearchRadius) {
+		pLat, pLng, frac, dist := g.projectOnEdge(e, lat, lng)
+		if dist > config.SearchRadius {
+			continue
+		}
+		cands = append(cands, &matchCandidate{
+			edge:  e,
+			frac:  frac,
+			lat:   pLat,
+			lng:   pLng,
+			logEm: -math.Log(math.Sqrt(2*math.Pi)*config.Sigma) - 0.5*(dist/config.Sigma)*(dist/config.Sigma),
+		})
+	}
+	sort.Sort(candidatesByEmission(cands))
+	if len(cands) > config.MaxCandidates {
+		cands = cands[:config.MaxCandidates]
+	}
+	return
+}
+
+// routeDistances returns the route distances (in meters) from the candidate "from" to all reachable candidates in "to".
+func (g *RoadGraph) routeDistances(from *matchCandidate, to []*matchCandidate, maxDist float64) (res map[int]float64) {
+	res = make(map[int]float64)
+	rest := (1 - from.frac) * from.edge.Length
+	dists, _ := g.shortestPaths(from.edge.To, maxDist)
+	for i, c := range to {
+		if c.edge == from.edge && c.frac >= from.frac {
+			res[i] = (c.frac - from.frac) * c.edge.Length
+			continue
+		}
+		if d, ok := dists[c.edge.From]; ok {
+			res[i] = rest + d + c.frac*c.edge.Length
+		}
+	}
+	return
+}
+
+// routeBetween returns the road nodes passed on the shortest route between two candidates and the route length in meters.
+// routeDist is the known route length, used to limit the search.
+func (g *RoadGraph) routeBetween(from *matchCandidate, to *matchCandidate, routeDist float64) (path []*RoadNode, dist float64) {
+	if to.edge == from.edge && to.frac >= from.frac {
+		return nil, (to.frac - from.frac) * to.edge.Length
+	}
+	dists, prev := g.shortestPaths(from.edge.To, routeDist+1)
+	d, ok := dists[to.edge.From]
+	if !ok {
+		// can not happen for candidates chosen by viterbi, fall back to a straight line
+		return nil, haversineDistance(from.lat, from.lng, to.lat, to.lng)
+	}
+	dist = (1-from.frac)*from.edge.Length + d + to.frac*to.edge.Length
+	for n := to.edge.From; ; {
+		path = append([]*RoadNode{g.Nodes[n]}, path...)
+		e, ok := prev[n]
+		if !ok {
+			break
+		}
+		n = e.From
+	}
+	return
+}
+
+// MatchTrack matches the trackPoints of the given track to the given road graph and stores the
+// matched geometry in MatchedTrackPoints and its length in Tracks.matchedDistance, all in one transaction.
+func MatchTrack(trackId int64, graph *RoadGraph, config *MapMatchConfig, dbCon *sql.DB) (matched []MatchedTrackPoint, distance float64, err error) {
+	tx, err := dbCon.Begin()
+	if err != nil {
+		dbg.E(mmTag, "MatchTrack: error starting transaction : ", err)
+		return
+	}
+	matched, distance, err = matchTrack(trackId, graph, config, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		dbg.E(mmTag, "MatchTrack: failed to commit matching of track %d : ", trackId, err)
+		return nil, 0, err
+	}
+	return
+}
+
+// matchTrack implements MatchTrack inside the given transaction. The changes are made in a savepoint, so a failed
+// match leaves the previous MatchedTrackPoints and the rest of the transaction intact.
+func matchTrack(trackId int64, graph *RoadGraph, config *MapMatchConfig, tx *sql.Tx) (matched []MatchedTrackPoint, distance float64, err error) {
+	points, err := tripMan.GetTrackPointsForTrack(tx, trackId)
+	if err != nil {
+		dbg.E(mmTag, "MatchTrack: unable to get trackPoints for track %d : ", trackId, err)
+		return
+	}
+	matched, distance, err = MatchTrackPoints(graph, *points, config)
+	if err != nil {
+		dbg.W(mmTag, "MatchTrack: unable to match track %d : ", trackId, err)
+		return
+	}
+
+	if _, err = tx.Exec("SAVEPOINT matchTrack"); err != nil {
+		dbg.E(mmTag, "MatchTrack: unable to create savepoint for track %d : ", trackId, err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Exec("ROLLBACK TO matchTrack")
+		}
+		tx.Exec("RELEASE matchTrack")
+	}()
+	_, err = tx.Exec("DELETE FROM MatchedTrackPoints WHERE trackId=?", trackId)
+	if err != nil {
+		dbg.E(mmTag, "MatchTrack: unable to delete old MatchedTrackPoints for track %d : ", trackId, err)
+		return
+	}
+	valueStrings := make([]string, 0)
+	valueArgs := make([]interface{}, 0)
+	for idx := range matched {
+		mp := &matched[idx]
+		mp.TrackId = sql.NullInt64{Int64: trackId, Valid: true}
+		valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?)")
+		valueArgs = append(valueArgs, trackId, mp.Seq, mp.Latitude, mp.Longitude, mp.TrackPointId, mp.WayId)
+		if len(valueArgs) > 990 || idx == len(matched)-1 {
+			stmt := fmt.Sprintf("INSERT INTO `MatchedTrackPoints` (trackId, seq, latitude, longitude, trackPointId, wayId) VALUES %s", strings.Join(valueStrings, ","))
+			_, err = tx.Exec(stmt, valueArgs...)
+			if err != nil {
+				dbg.E(mmTag, "MatchTrack: unable to insert %d MatchedTrackPoints for track %d : ", len(valueStrings), trackId, err)
+				return
+			}
+			valueStrings = make([]string, 0)
+			valueArgs = make([]interface{}, 0)
+		}
+	}
+
+	_, err = tx.Exec("UPDATE `Tracks` SET matchedDistance=? WHERE _trackId=?", distance, trackId)
+	if err != nil {
+		dbg.E(mmTag, "MatchTrack: unable to update matchedDistance for track %d : ", trackId, err)
+		return
+	}
+	dbg.I(mmTag, "MatchTrack: matched track %d with %d points, %f m", trackId, len(matched), distance)
+	return
+}
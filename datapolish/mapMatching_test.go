@@ -0,0 +1,245 @@
+package datapolish_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"database/sql"
+	"encoding/binary"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/datapolish"
+	"github.com/OpenDriversLog/goodl-lib/dbMan"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+)
+
+// An L-shaped residential road 1 -> 2 -> 3 (~700m east, then ~1100m north) and a footway that should be ignored.
+const testOsmXml = `<?xml version="1.0" encoding="UTF-8"?>
+<osm version="0.6">
+ <node id="1" lat="50.8000" lon="12.9000"/>
+ <node id="2" lat="50.8000" lon="12.9100"/>
+ <node id="3" lat="50.8100" lon="12.9100"/>
+ <node id="4" lat="50.8050" lon="12.9000"/>
+ <way id="100">
+  <nd ref="1"/>
+  <nd ref="2"/>
+  <nd ref="3"/>
+  <tag k="highway" v="residential"/>
+ </way>
+ <way id="101">
+  <nd ref="1"/>
+  <nd ref="4"/>
+  <nd ref="3"/>
+  <tag k="highway" v="footway"/>
+ </way>
+</osm>`
+
+func testTrackPoint(id int64, lat float64, lng float64) TrackPoint {
+	return TrackPoint{
+		TrackPointId: sql.NullInt64{Int64: id, Valid: true},
+		Latitude:     sql.NullFloat64{Float64: lat, Valid: true},
+		Longitude:    sql.NullFloat64{Float64: lng, Valid: true},
+	}
+}
+
+// noisy points along the L-shaped road, cutting the corner at node 2
+var testMatchPoints = []TrackPoint{
+	testTrackPoint(1, 50.80010, 12.90050),
+	testTrackPoint(2, 50.79985, 12.90400),
+	testTrackPoint(3, 50.80015, 12.90800),
+	testTrackPoint(4, 50.80150, 12.90990),
+	testTrackPoint(5, 50.80500, 12.91020),
+	testTrackPoint(6, 50.80900, 12.90985),
+}
+
+func pbfVarint(v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, v)]
+}
+
+func pbfKey(field int, wireType int) []byte {
+	return pbfVarint(uint64(field<<3 | wireType))
+}
+
+func pbfBytes(field int, data []byte) []byte {
+	res := append(pbfKey(field, 2), pbfVarint(uint64(len(data)))...)
+	return append(res, data...)
+}
+
+func pbfPackedSint(field int, vals []int64) []byte {
+	var data []byte
+	for _, v := range vals {
+		data = append(data, pbfVarint(uint64((v<<1)^(v>>63)))...)
+	}
+	return pbfBytes(field, data)
+}
+
+// testOsmPbf encodes the road of testOsmXml as OSM PBF.
+func testOsmPbf() []byte {
+	var strTable []byte
+	for _, s := range []string{"", "highway", "residential"} {
+		strTable = append(strTable, pbfBytes(1, []byte(s))...)
+	}
+	dense := pbfPackedSint(1, []int64{1, 1, 1})
+	dense = append(dense, pbfPackedSint(8, []int64{508000000, 0, 100000})...)
+	dense = append(dense, pbfPackedSint(9, []int64{129000000, 100000, 0})...)
+	way := append(pbfKey(1, 0), pbfVarint(100)...)
+	way = append(way, pbfBytes(2, pbfVarint(1))...)
+	way = append(way, pbfBytes(3, pbfVarint(2))...)
+	way = append(way, pbfPackedSint(8, []int64{1, 1, 1})...)
+	group := append(pbfBytes(2, dense), pbfBytes(3, way)...)
+	block := append(pbfBytes(1, strTable), pbfBytes(2, group)...)
+
+	var zBuf bytes.Buffer
+	zw := zlib.NewWriter(&zBuf)
+	zw.Write(block)
+	zw.Close()
+	blob := append(pbfKey(2, 0), pbfVarint(uint64(len(block)))...)
+	blob = append(blob, pbfBytes(3, zBuf.Bytes())...)
+
+	header := pbfBytes(1, []byte("OSMData"))
+	header = append(header, pbfKey(3, 0)...)
+	header = append(header, pbfVarint(uint64(len(blob)))...)
+	lenBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(lenBuf, uint32(len(header)))
+	res := append(lenBuf, header...)
+	return append(res, blob...)
+}
+
+var _ = Describe("MapMatching", func() {
+
+	Describe("LoadRoadGraph", func() {
+		It("should only load drivable ways from OSM XML", func() {
+			graph, err := datapolish.LoadRoadGraphFromXML(strings.NewReader(testOsmXml))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(graph.Nodes).To(HaveLen(3))
+			Expect(graph.Edges).To(HaveLen(4)) // 2 segments in both directions
+		})
+
+		It("should load the same graph from OSM PBF", func() {
+			graph, err := datapolish.LoadRoadGraphFromPBF(bytes.NewReader(testOsmPbf()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(graph.Nodes).To(HaveLen(3))
+			Expect(graph.Edges).To(HaveLen(4))
+			Expect(graph.Nodes[3].Lat).To(BeNumerically("~", 50.81, 0.000001))
+			Expect(graph.Nodes[3].Lng).To(BeNumerically("~", 12.91, 0.000001))
+		})
+
+		It("should fail for extracts without roads", func() {
+			_, err := datapolish.LoadRoadGraphFromXML(strings.NewReader(`<osm><node id="1" lat="1" lon="1"/></osm>`))
+			Expect(err).To(Equal(datapolish.ErrEmptyRoadGraph))
+		})
+	})
+
+	Describe("MatchTrackPoints", func() {
+		var graph *datapolish.RoadGraph
+
+		BeforeEach(func() {
+			var err error
+			graph, err = datapolish.LoadRoadGraphFromXML(strings.NewReader(testOsmXml))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should snap all points onto the road and follow it around the corner", func() {
+			matched, distance, err := datapolish.MatchTrackPoints(graph, testMatchPoints, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			matchedTps := 0
+			passedCorner := false
+			for i, mp := range matched {
+				Expect(mp.Seq.Int64).To(Equal(int64(i)))
+				Expect(mp.WayId.Int64).To(Equal(int64(100)))
+				onEastPart := mp.Latitude.Float64 > 50.79999 && mp.Latitude.Float64 < 50.80001
+				onNorthPart := mp.Longitude.Float64 > 12.90999 && mp.Longitude.Float64 < 12.91001
+				Expect(onEastPart || onNorthPart).To(BeTrue())
+				if mp.TrackPointId.Valid {
+					matchedTps++
+				} else if onEastPart && onNorthPart {
+					passedCorner = true
+				}
+			}
+			Expect(matchedTps).To(Equal(len(testMatchPoints)))
+			Expect(passedCorner).To(BeTrue())
+
+			// from 12.9005 to the corner and from the corner to 50.809
+			Expect(distance).To(BeNumerically("~", 668+1001, 10))
+		})
+
+		It("should skip points far away from any road", func() {
+			points := append([]TrackPoint{testTrackPoint(7, 50.9, 13.1)}, testMatchPoints...)
+			matched, _, err := datapolish.MatchTrackPoints(graph, points, nil)
+			Expect(err).ToNot(HaveOccurred())
+			for _, mp := range matched {
+				Expect(mp.TrackPointId.Int64).ToNot(Equal(int64(7)))
+			}
+		})
+
+		It("should fail if no point is near a road", func() {
+			_, _, err := datapolish.MatchTrackPoints(graph, []TrackPoint{testTrackPoint(7, 50.9, 13.1)}, nil)
+			Expect(err).To(Equal(datapolish.ErrMapMatchingFailed))
+		})
+	})
+
+	Describe("MatchTrack", func() {
+		var (
+			dbCon   *sql.DB
+			graph   *datapolish.RoadGraph
+			trackId int64
+		)
+		matchedState := func() (points int, distance float64) {
+			Expect(dbCon.QueryRow("SELECT COUNT(*) FROM MatchedTrackPoints WHERE trackId=?", trackId).Scan(&points)).To(BeNil())
+			Expect(dbCon.QueryRow("SELECT IFNULL(matchedDistance,0) FROM Tracks WHERE _trackId=?", trackId).Scan(&distance)).To(BeNil())
+			return
+		}
+
+		BeforeEach(func() {
+			var err error
+			graph, err = datapolish.LoadRoadGraphFromXML(strings.NewReader(testOsmXml))
+			Expect(err).ToNot(HaveOccurred())
+			dbCon, _ = dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+			res, err := dbCon.Exec("INSERT INTO Tracks (deviceId, startKeyPointId, endKeyPointId, distance) VALUES (-47, 0, 0, 1700)")
+			Expect(err).To(BeNil())
+			trackId, _ = res.LastInsertId()
+			for i, tp := range testMatchPoints {
+				_, err = dbCon.Exec("INSERT INTO trackPoints (trackId, timeMillis, latitude, longitude, accuracy, speed, minZoomLevel, maxZoomLevel) VALUES (?,?,?,?,10,10,0,20)",
+					trackId, i*1000, tp.Latitude.Float64, tp.Longitude.Float64)
+				Expect(err).To(BeNil())
+			}
+			_, _, err = datapolish.MatchTrack(trackId, graph, nil, dbCon)
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			dbCon.Exec("DROP TRIGGER IF EXISTS test_fail_match")
+			for _, q := range []string{
+				"DELETE FROM MatchedTrackPoints WHERE trackId=?",
+				"DELETE FROM trackPoints WHERE trackId=?",
+				"DELETE FROM Tracks WHERE _trackId=?",
+			} {
+				_, err := dbCon.Exec(q, trackId)
+				Expect(err).To(BeNil())
+			}
+			dbCon.Close()
+		})
+
+		It("should store the matched geometry and its length", func() {
+			points, distance := matchedState()
+			Expect(points).To(BeNumerically(">", len(testMatchPoints)))
+			Expect(distance).To(BeNumerically("~", 668+1001, 10))
+		})
+
+		It("should keep the previous match if storing the new one fails", func() {
+			points, distance := matchedState()
+			_, err := dbCon.Exec(`CREATE TRIGGER test_fail_match BEFORE INSERT ON MatchedTrackPoints
+				BEGIN SELECT RAISE(ABORT, 'test'); END`)
+			Expect(err).To(BeNil())
+			_, _, err = datapolish.MatchTrack(trackId, graph, nil, dbCon)
+			Expect(err).ToNot(BeNil())
+			newPoints, newDistance := matchedState()
+			Expect(newPoints).To(Equal(points))
+			Expect(newDistance).To(Equal(distance))
+		})
+	})
+})
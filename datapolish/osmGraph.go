@@ -0,0 +1,355 @@
+package datapolish
+
+import (
+	"container/heap"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Compufreak345/dbg"
+)
+
+const ogTag = "glib/dp/osmGraph.go"
+
+// earthRadius is the mean earth radius in meters.
+const earthRadius = 6371008.8
+
+// gridCellSize is the size (in degrees) of the cells of the spatial index of a RoadGraph.
+const gridCellSize = 0.002
+
+var ErrEmptyRoadGraph = errors.New("The OSM extract does not contain any drivable roads")
+
+// drivableHighways are the OSM highway-values we consider for map matching.
+var drivableHighways = map[string]bool{
+	"motorway": true, "motorway_link": true,
+	"trunk": true, "trunk_link": true,
+	"primary": true, "primary_link": true,
+	"secondary": true, "secondary_link": true,
+	"tertiary": true, "tertiary_link": true,
+	"unclassified": true, "residential": true,
+	"living_street": true, "service": true, "road": true,
+}
+
+// RoadNode represents a node of the road graph.
+type RoadNode struct {
+	Id  int64
+	Lat float64
+	Lng float64
+}
+
+// RoadEdge represents a directed road segment between two RoadNodes.
+type RoadEdge struct {
+	Id     int
+	WayId  int64
+	From   int64
+	To     int64
+	Length float64 // in meters
+}
+
+// RoadGraph is the drivable road network of an OSM extract, used for map matching.
+type RoadGraph struct {
+	Nodes    map[int64]*RoadNode
+	Edges    []*RoadEdge
+	outEdges map[int64][]*RoadEdge
+	grid     map[gridCell][]*RoadEdge
+}
+
+type gridCell struct {
+	X int
+	Y int
+}
+
+// osmWay is a way as read from an OSM extract.
+type osmWay struct {
+	Id      int64
+	NodeIds []int64
+	Tags    map[string]string
+}
+
+// LoadRoadGraph loads the drivable road network from the OSM extract at the given path.
+// Files ending with ".pbf" are read as OSM PBF, everything else as OSM XML.
+func LoadRoadGraph(path string) (graph *RoadGraph, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		dbg.E(ogTag, "Unable to open OSM extract %s : ", path, err)
+		return
+	}
+	defer f.Close()
+	if strings.HasSuffix(strings.ToLower(path), ".pbf") {
+		graph, err = LoadRoadGraphFromPBF(f)
+	} else {
+		graph, err = LoadRoadGraphFromXML(f)
+	}
+	if err != nil {
+		dbg.E(ogTag, "Unable to load road graph from %s : ", path, err)
+		return
+	}
+	dbg.I(ogTag, "Loaded road graph from %s with %d nodes and %d edges", path, len(graph.Nodes), len(graph.Edges))
+	return
+}
+
+// LoadRoadGraphFromXML loads the drivable road network from an OSM XML document.
+func LoadRoadGraphFromXML(r io.Reader) (graph *RoadGraph, err error) {
+	nodes := make(map[int64][2]float64)
+	ways := make([]*osmWay, 0)
+	dec := xml.NewDecoder(r)
+	var curWay *osmWay
+	for {
+		var tok xml.Token
+		tok, err = dec.Token()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		switch el := tok.(type) {
+		case xml.StartElement:
+			switch el.Name.Local {
+			case "node":
+				var id int64
+				var lat, lng float64
+				for _, a := range el.Attr {
+					switch a.Name.Local {
+					case "id":
+						id, err = strconv.ParseInt(a.Value, 10, 64)
+					case "lat":
+						lat, err = strconv.ParseFloat(a.Value, 64)
+					case "lon":
+						lng, err = strconv.ParseFloat(a.Value, 64)
+					}
+					if err != nil {
+						return
+					}
+				}
+				nodes[id] = [2]float64{lat, lng}
+			case "way":
+				curWay = &osmWay{Tags: make(map[string]string)}
+				for _, a := range el.Attr {
+					if a.Name.Local == "id" {
+						curWay.Id, err = strconv.ParseInt(a.Value, 10, 64)
+						if err != nil {
+							return
+						}
+					}
+				}
+			case "nd":
+				if curWay == nil {
+					continue
+				}
+				for _, a := range el.Attr {
+					if a.Name.Local == "ref" {
+						var ref int64
+						ref, err = strconv.ParseInt(a.Value, 10, 64)
+						if err != nil {
+							return
+						}
+						curWay.NodeIds = append(curWay.NodeIds, ref)
+					}
+				}
+			case "tag":
+				if curWay == nil {
+					continue
+				}
+				var k, v string
+				for _, a := range el.Attr {
+					switch a.Name.Local {
+					case "k":
+						k = a.Value
+					case "v":
+						v = a.Value
+					}
+				}
+				curWay.Tags[k] = v
+			}
+		case xml.EndElement:
+			if el.Name.Local == "way" && curWay != nil {
+				if drivableHighways[curWay.Tags["highway"]] {
+					ways = append(ways, curWay)
+				}
+				curWay = nil
+			}
+		}
+	}
+	return newRoadGraph(nodes, ways)
+}
+
+// newRoadGraph builds a RoadGraph from the given nodes (id -> lat,lng) and ways.
+func newRoadGraph(nodes map[int64][2]float64, ways []*osmWay) (graph *RoadGraph, err error) {
+	graph = &RoadGraph{
+		Nodes:    make(map[int64]*RoadNode),
+		Edges:    make([]*RoadEdge, 0),
+		outEdges: make(map[int64][]*RoadEdge),
+		grid:     make(map[gridCell][]*RoadEdge),
+	}
+	for _, w := range ways {
+		forward, backward := wayDirections(w.Tags)
+		for i := 1; i < len(w.NodeIds); i++ {
+			from, okFrom := graph.getOrAddNode(w.NodeIds[i-1], nodes)
+			to, okTo := graph.getOrAddNode(w.NodeIds[i], nodes)
+			if !okFrom || !okTo {
+				dbg.W(ogTag, "Way %d references unknown nodes, skipping segment", w.Id)
+				continue
+			}
+			length := haversineDistance(from.Lat, from.Lng, to.Lat, to.Lng)
+			if forward {
+				graph.addEdge(w.Id, from, to, length)
+			}
+			if backward {
+				graph.addEdge(w.Id, to, from, length)
+			}
+		}
+	}
+	if len(graph.Edges) == 0 {
+		err = ErrEmptyRoadGraph
+	}
+	return
+}
+
+// wayDirections returns in which directions the way with the given tags may be driven.
+func wayDirections(tags map[string]string) (forward bool, backward bool) {
+	switch tags["oneway"] {
+	case "yes", "1", "true":
+		return true, false
+	case "-1", "reverse":
+		return false, true
+	case "no", "0", "false":
+		return true, true
+	}
+	if tags["junction"] == "roundabout" || tags["highway"] == "motorway" || tags["highway"] == "motorway_link" {
+		return true, false
+	}
+	return true, true
+}
+
+func (g *RoadGraph) getOrAddNode(id int64, nodes map[int64][2]float64) (n *RoadNode, ok bool) {
+	if n, ok = g.Nodes[id]; ok {
+		return
+	}
+	pos, ok := nodes[id]
+	if !ok {
+		return
+	}
+	n = &RoadNode{Id: id, Lat: pos[0], Lng: pos[1]}
+	g.Nodes[id] = n
+	return
+}
+
+func (g *RoadGraph) addEdge(wayId int64, from *RoadNode, to *RoadNode, length float64) {
+	e := &RoadEdge{Id: len(g.Edges), WayId: wayId, From: from.Id, To: to.Id, Length: length}
+	g.Edges = append(g.Edges, e)
+	g.outEdges[from.Id] = append(g.outEdges[from.Id], e)
+	minX, minY := toGridCell(math.Min(from.Lat, to.Lat), math.Min(from.Lng, to.Lng))
+	maxX, maxY := toGridCell(math.Max(from.Lat, to.Lat), math.Max(from.Lng, to.Lng))
+	for x := minX; x <= maxX; x++ {
+		for y := minY; y <= maxY; y++ {
+			c := gridCell{X: x, Y: y}
+			g.grid[c] = append(g.grid[c], e)
+		}
+	}
+}
+
+func toGridCell(lat float64, lng float64) (x int, y int) {
+	return int(math.Floor(lng / gridCellSize)), int(math.Floor(lat / gridCellSize))
+}
+
+// edgesNear returns all edges whose bounding box lies within the given radius (in meters) around the given position.
+func (g *RoadGraph) edgesNear(lat float64, lng float64, radius float64) (edges []*RoadEdge) {
+	dLat := radius / earthRadius * 180 / math.Pi
+	dLng := dLat / math.Max(math.Cos(lat*math.Pi/180), 0.01)
+	minX, minY := toGridCell(lat-dLat, lng-dLng)
+	maxX, maxY := toGridCell(lat+dLat, lng+dLng)
+	seen := make(map[int]bool)
+	for x := minX; x <= maxX; x++ {
+		for y := minY; y <= maxY; y++ {
+			for _, e := range g.grid[gridCell{X: x, Y: y}] {
+				if !seen[e.Id] {
+					seen[e.Id] = true
+					edges = append(edges, e)
+				}
+			}
+		}
+	}
+	return
+}
+
+// projectOnEdge returns the position on the given edge closest to the given position,
+// its fraction of the edge length and its distance (in meters) to the position.
+func (g *RoadGraph) projectOnEdge(e *RoadEdge, lat float64, lng float64) (pLat float64, pLng float64, frac float64, dist float64) {
+	from := g.Nodes[e.From]
+	to := g.Nodes[e.To]
+	// local equirectangular projection around the given position is exact enough for road segments
+	cosLat := math.Cos(lat * math.Pi / 180)
+	ax, ay := (from.Lng-lng)*cosLat, from.Lat-lat
+	bx, by := (to.Lng-lng)*cosLat, to.Lat-lat
+	dx, dy := bx-ax, by-ay
+	l2 := dx*dx + dy*dy
+	if l2 > 0 {
+		frac = -(ax*dx + ay*dy) / l2
+	}
+	frac = math.Max(0, math.Min(1, frac))
+	pLat = from.Lat + frac*(to.Lat-from.Lat)
+	pLng = from.Lng + frac*(to.Lng-from.Lng)
+	dist = haversineDistance(lat, lng, pLat, pLng)
+	return
+}
+
+// shortestPaths runs Dijkstra from the given node and returns the distances (in meters) to all nodes
+// reachable within maxDist and the predecessor edge for each of them.
+func (g *RoadGraph) shortestPaths(start int64, maxDist float64) (dists map[int64]float64, prev map[int64]*RoadEdge) {
+	dists = map[int64]float64{start: 0}
+	prev = make(map[int64]*RoadEdge)
+	q := &nodeQueue{{node: start, dist: 0}}
+	for q.Len() > 0 {
+		cur := heap.Pop(q).(nodeQueueItem)
+		if cur.dist > dists[cur.node] {
+			continue
+		}
+		for _, e := range g.outEdges[cur.node] {
+			d := cur.dist + e.Length
+			if d > maxDist {
+				continue
+			}
+			if old, ok := dists[e.To]; !ok || d < old {
+				dists[e.To] = d
+				prev[e.To] = e
+				heap.Push(q, nodeQueueItem{node: e.To, dist: d})
+			}
+		}
+	}
+	return
+}
+
+type nodeQueueItem struct {
+	node int64
+	dist float64
+}
+
+// nodeQueue implements heap.Interface for Dijkstra.
+type nodeQueue []nodeQueueItem
+
+func (q nodeQueue) Len() int            { return len(q) }
+func (q nodeQueue) Less(i, j int) bool  { return q[i].dist < q[j].dist }
+func (q nodeQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *nodeQueue) Push(x interface{}) { *q = append(*q, x.(nodeQueueItem)) }
+func (q *nodeQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	it := old[n-1]
+	*q = old[:n-1]
+	return it
+}
+
+// haversineDistance returns the great circle distance between two positions in meters.
+func haversineDistance(lat1 float64, lng1 float64, lat2 float64, lng2 float64) float64 {
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLng := (lng2 - lng1) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
@@ -0,0 +1,340 @@
+package datapolish
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// This file contains a minimal reader for the OSM PBF format (http://wiki.openstreetmap.org/wiki/PBF_Format),
+// only decoding what we need for building a RoadGraph: nodes, dense nodes and ways.
+
+// maxPbfBlobSize is the maximum size of a blob allowed by the PBF specification.
+const maxPbfBlobSize = 32 * 1024 * 1024
+
+var ErrInvalidPbf = errors.New("Invalid OSM PBF data")
+
+// LoadRoadGraphFromPBF loads the drivable road network from an OSM PBF stream.
+func LoadRoadGraphFromPBF(r io.Reader) (graph *RoadGraph, err error) {
+	nodes := make(map[int64][2]float64)
+	ways := make([]*osmWay, 0)
+	lenBuf := make([]byte, 4)
+	for {
+		_, err = io.ReadFull(r, lenBuf)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		headerLen := binary.BigEndian.Uint32(lenBuf)
+		if headerLen > 64*1024 {
+			err = ErrInvalidPbf
+			return
+		}
+		header := make([]byte, headerLen)
+		if _, err = io.ReadFull(r, header); err != nil {
+			return
+		}
+		var blobType string
+		var blobSize uint64
+		msg := pbfMessage(header)
+		for msg.hasNext() {
+			var f pbfField
+			if f, err = msg.next(); err != nil {
+				return
+			}
+			switch f.num {
+			case 1:
+				blobType = string(f.data)
+			case 3:
+				blobSize = f.varint
+			}
+		}
+		if blobSize > maxPbfBlobSize {
+			err = ErrInvalidPbf
+			return
+		}
+		blob := make([]byte, blobSize)
+		if _, err = io.ReadFull(r, blob); err != nil {
+			return
+		}
+		if blobType != "OSMData" {
+			continue
+		}
+		var data []byte
+		if data, err = decodePbfBlob(blob); err != nil {
+			return
+		}
+		if err = decodePbfPrimitiveBlock(data, nodes, &ways); err != nil {
+			return
+		}
+	}
+	return newRoadGraph(nodes, ways)
+}
+
+// decodePbfBlob returns the uncompressed content of a Blob message.
+func decodePbfBlob(blob []byte) (data []byte, err error) {
+	msg := pbfMessage(blob)
+	for msg.hasNext() {
+		var f pbfField
+		if f, err = msg.next(); err != nil {
+			return
+		}
+		switch f.num {
+		case 1: // raw
+			data = f.data
+			return
+		case 3: // zlib_data
+			var zr io.ReadCloser
+			if zr, err = zlib.NewReader(bytes.NewReader(f.data)); err != nil {
+				return
+			}
+			defer zr.Close()
+			data, err = ioutil.ReadAll(io.LimitReader(zr, maxPbfBlobSize))
+			return
+		case 4, 5, 6, 7: // lzma, bzip2, lz4, zstd
+			err = fmt.Errorf("Unsupported PBF blob compression (field %d)", f.num)
+			return
+		}
+	}
+	err = ErrInvalidPbf
+	return
+}
+
+// decodePbfPrimitiveBlock decodes a PrimitiveBlock, adding all nodes and drivable ways to the given collections.
+func decodePbfPrimitiveBlock(data []byte, nodes map[int64][2]float64, ways *[]*osmWay) (err error) {
+	var strTable []string
+	groups := make([][]byte, 0)
+	granularity := int64(100)
+	var latOffset, lngOffset int64
+	msg := pbfMessage(data)
+	for msg.hasNext() {
+		var f pbfField
+		if f, err = msg.next(); err != nil {
+			return
+		}
+		switch f.num {
+		case 1:
+			st := pbfMessage(f.data)
+			for st.hasNext() {
+				var s pbfField
+				if s, err = st.next(); err != nil {
+					return
+				}
+				if s.num == 1 {
+					strTable = append(strTable, string(s.data))
+				}
+			}
+		case 2:
+			groups = append(groups, f.data)
+		case 17:
+			granularity = int64(f.varint)
+		case 19:
+			latOffset = int64(f.varint)
+		case 20:
+			lngOffset = int64(f.varint)
+		}
+	}
+	toDeg := func(offset int64, v int64) float64 {
+		return 1e-9 * float64(offset+granularity*v)
+	}
+
+	for _, g := range groups {
+		gm := pbfMessage(g)
+		for gm.hasNext() {
+			var f pbfField
+			if f, err = gm.next(); err != nil {
+				return
+			}
+			switch f.num {
+			case 1: // Node
+				var id, lat, lng int64
+				nm := pbfMessage(f.data)
+				for nm.hasNext() {
+					var nf pbfField
+					if nf, err = nm.next(); err != nil {
+						return
+					}
+					switch nf.num {
+					case 1:
+						id = zigzag(nf.varint)
+					case 8:
+						lat = zigzag(nf.varint)
+					case 9:
+						lng = zigzag(nf.varint)
+					}
+				}
+				nodes[id] = [2]float64{toDeg(latOffset, lat), toDeg(lngOffset, lng)}
+			case 2: // DenseNodes
+				var ids, lats, lngs []int64
+				dm := pbfMessage(f.data)
+				for dm.hasNext() {
+					var df pbfField
+					if df, err = dm.next(); err != nil {
+						return
+					}
+					switch df.num {
+					case 1:
+						ids, err = df.packedSint64(ids)
+					case 8:
+						lats, err = df.packedSint64(lats)
+					case 9:
+						lngs, err = df.packedSint64(lngs)
+					}
+					if err != nil {
+						return
+					}
+				}
+				if len(ids) != len(lats) || len(ids) != len(lngs) {
+					err = ErrInvalidPbf
+					return
+				}
+				var id, lat, lng int64
+				for i := range ids {
+					id += ids[i]
+					lat += lats[i]
+					lng += lngs[i]
+					nodes[id] = [2]float64{toDeg(latOffset, lat), toDeg(lngOffset, lng)}
+				}
+			case 3: // Way
+				w := &osmWay{Tags: make(map[string]string)}
+				var keys, vals []uint64
+				var refs []int64
+				wm := pbfMessage(f.data)
+				for wm.hasNext() {
+					var wf pbfField
+					if wf, err = wm.next(); err != nil {
+						return
+					}
+					switch wf.num {
+					case 1:
+						w.Id = int64(wf.varint)
+					case 2:
+						keys, err = wf.packedUint64(keys)
+					case 3:
+						vals, err = wf.packedUint64(vals)
+					case 8:
+						refs, err = wf.packedSint64(refs)
+					}
+					if err != nil {
+						return
+					}
+				}
+				for i := 0; i < len(keys) && i < len(vals); i++ {
+					if keys[i] >= uint64(len(strTable)) || vals[i] >= uint64(len(strTable)) {
+						err = ErrInvalidPbf
+						return
+					}
+					w.Tags[strTable[keys[i]]] = strTable[vals[i]]
+				}
+				if !drivableHighways[w.Tags["highway"]] {
+					continue
+				}
+				var ref int64
+				for _, r := range refs {
+					ref += r
+					w.NodeIds = append(w.NodeIds, ref)
+				}
+				*ways = append(*ways, w)
+			}
+		}
+	}
+	return
+}
+
+// pbfMessage is an encoded protobuf message which is consumed field by field.
+type pbfMessage []byte
+
+// pbfField is a single decoded protobuf field.
+type pbfField struct {
+	num      int
+	wireType int
+	varint   uint64
+	data     []byte
+}
+
+func (m *pbfMessage) hasNext() bool {
+	return len(*m) > 0
+}
+
+func (m *pbfMessage) next() (f pbfField, err error) {
+	key, err := m.readVarint()
+	if err != nil {
+		return
+	}
+	f.num = int(key >> 3)
+	f.wireType = int(key & 7)
+	switch f.wireType {
+	case 0:
+		f.varint, err = m.readVarint()
+	case 1:
+		if len(*m) < 8 {
+			return f, ErrInvalidPbf
+		}
+		f.varint = binary.LittleEndian.Uint64(*m)
+		*m = (*m)[8:]
+	case 2:
+		var l uint64
+		if l, err = m.readVarint(); err != nil {
+			return
+		}
+		if l > uint64(len(*m)) {
+			return f, ErrInvalidPbf
+		}
+		f.data = (*m)[:l]
+		*m = (*m)[l:]
+	case 5:
+		if len(*m) < 4 {
+			return f, ErrInvalidPbf
+		}
+		f.varint = uint64(binary.LittleEndian.Uint32(*m))
+		*m = (*m)[4:]
+	default:
+		err = ErrInvalidPbf
+	}
+	return
+}
+
+func (m *pbfMessage) readVarint() (v uint64, err error) {
+	v, n := binary.Uvarint(*m)
+	if n <= 0 {
+		return 0, ErrInvalidPbf
+	}
+	*m = (*m)[n:]
+	return
+}
+
+// packedUint64 appends the values of a (packed or unpacked) repeated varint field.
+func (f pbfField) packedUint64(res []uint64) ([]uint64, error) {
+	if f.wireType == 0 {
+		return append(res, f.varint), nil
+	}
+	pm := pbfMessage(f.data)
+	for pm.hasNext() {
+		v, err := pm.readVarint()
+		if err != nil {
+			return res, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+// packedSint64 appends the values of a (packed or unpacked) repeated sint64 field.
+func (f pbfField) packedSint64(res []int64) ([]int64, error) {
+	vals, err := f.packedUint64(nil)
+	for _, v := range vals {
+		res = append(res, zigzag(v))
+	}
+	return res, err
+}
+
+func zigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
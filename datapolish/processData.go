@@ -7,7 +7,6 @@ import (
 	"fmt"
 	geo "github.com/kellydunn/golang-geo"
 	"math"
-	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +20,7 @@ import (
 	"github.com/OpenDriversLog/goodl-lib/tools"
 	"github.com/OpenDriversLog/goodl-lib/jsonapi/carManager"
 	"github.com/OpenDriversLog/goodl-lib/jsonapi/notificationManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/periodManager"
 	"github.com/OpenDriversLog/goodl-lib/translate"
 )
 
@@ -36,7 +36,44 @@ func init() {
 var ErrGpsDataAlreadyImported = errors.New("ProcessGPSData: KeyPoints & Tracks already imported!")
 // ProcessGPSData does all the processing from trackRecords to Tracks, TrackPoints and KeyPoints
 // where maxTime is optional
+// Returns periodManager.ErrPeriodClosed without changing anything if the time range or the recalculated tracks are
+// in a closed period, the KeyPoints & Tracks are replaced in one transaction.
 func ProcessGPSData(startTime int64, endTime int64, deviceId int, recalculate bool, uId int64,activeNotifications *[]*notificationManager.Notification,T *translate.Translater, dbCon *sql.DB) (err error) {
+	_, err = ProcessGPSDataWithReport(startTime, endTime, deviceId, recalculate, uId, activeNotifications, T, dbCon)
+	return
+}
+
+// ProcessGPSDataWithReport works like ProcessGPSData, returning a ProcessingReport of what has been done.
+// The report is also returned (as far as we got) if an error occured.
+func ProcessGPSDataWithReport(startTime int64, endTime int64, deviceId int, recalculate bool, uId int64,activeNotifications *[]*notificationManager.Notification,T *translate.Translater, dbCon *sql.DB) (report *ProcessingReport, err error) {
+	return ProcessGPSDataWithGeocoder(startTime, endTime, deviceId, recalculate, uId, nil, activeNotifications, T, dbCon)
+}
+
+// ProcessGPSDataWithGeocoder is ProcessGPSDataWithReport looking up the addresses of new KeyPoints with the given
+// Geocoder (a addressManager.HTTPGeocoder if nil). Afterwards the expired GeocodeJobs of earlier imports are retried
+// with the same Geocoder.
+func ProcessGPSDataWithGeocoder(startTime int64, endTime int64, deviceId int, recalculate bool, uId int64, geocoder addressManager.Geocoder, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (report *ProcessingReport, err error) {
+	geocoding := &geocodeOptions{geocoder: geocoder}
+	report, err = processGPSData(startTime, endTime, deviceId, recalculate, uId, activeNotifications, T, dbCon, nil, geocoding)
+	retryGeocodeJobs(uId, geocoding, dbCon)
+	return
+}
+
+// processGPSData implements ProcessGPSDataWithReport. If dbLock is given, it is held while working with the database
+// and released while detecting stops & geocoding, so multiple devices can be processed in parallel.
+// geocoding configures how addresses are looked up, nil for one after another.
+func processGPSData(startTime int64, endTime int64, deviceId int, recalculate bool, uId int64,activeNotifications *[]*notificationManager.Notification,T *translate.Translater, dbCon *sql.DB, dbLock sync.Locker, geocoding *geocodeOptions) (report *ProcessingReport, err error) {
+	report = newProcessingReport(deviceId, startTime, endTime)
+	// address lookups only need to care about others if there are any
+	geocodeLock := dbLock
+	if dbLock == nil {
+		dbLock = tools.NoLock{}
+	}
+	dbLock.Lock()
+	defer func() {
+		dbLock.Unlock()
+	}()
+	phaseStart := time.Now()
 
 	var device *deviceManager.Device
 	devices, err := deviceManager.GetDevices(dbCon)
@@ -55,6 +92,7 @@ func ProcessGPSData(startTime int64, endTime int64, deviceId int, recalculate bo
 	}
 	carId := device.CarId
 	config := GetDefaultLocationConfig()
+	config.SkipNonCarTracks = device.SkipNonCarTracks != nil && *device.SkipNonCarTracks
 	car, err := carManager.GetCarById(dbCon,int64(carId))
 	if err != nil {
 		dbg.E(pdTag,"Error getting car for device %d with carId %d: ",device.Id,carId,err)
@@ -62,14 +100,11 @@ func ProcessGPSData(startTime int64, endTime int64, deviceId int, recalculate bo
 	}
 	if car.Owner.Id<0 {
 		dbg.E(pdTag,"No carOwner defined for car %d ", car.Id)
-		return errors.New("Empty car owner")
+		err = errors.New("Empty car owner")
+		return
 	}
 	driverId := int64(car.Owner.Id)
 	// var startKeyPointId int64
-	var kpEnd *KeyPoint
-	var countNewTracks int64
-	var countNewKPs int
-	var countNewTPs int
 	createFirst := false
 
 	if endTime == 0 || endTime <= startTime {
@@ -86,28 +121,44 @@ func ProcessGPSData(startTime int64, endTime int64, deviceId int, recalculate bo
 	trackrecords, err := GetTrackRecordsForDevice(startTime, endTime, deviceId, dbCon)
 	if len(trackrecords) <= 0 {
 		dbg.W(pdTag, "no trackRecords for this device : %v (%s), aborting ProcessGPSData ", deviceId, device.Description, startTime, endTime, (endTime-startTime)/1000, err)
-		trips, err := tripMan.GetTripsInTimeRange(startTime, endTime, []interface{}{deviceId}, false, false, false,uId,activeNotifications,T,true, dbCon)
+		tripIds, err := tripMan.GetTripIdsInTimeRange(startTime, endTime, []interface{}{deviceId}, dbCon)
 		if err != nil {
 			dbg.E(pdTag, "Error getting trips", err)
-			return err
-		}
-		if len(trips) != 0 {
-			dbg.WTF(pdTag, "How can we have trips without trackrecords for device %d in timerange from %d to %d??? Will delete them", deviceId, startTime, endTime)
-			for _, t := range trips {
-				_, err = dbCon.Exec("DELETE FROM Tracks_Trips WHERE tripId=?;DELETE FROM Trips WHERE _tripId=?", t.Id, t.Id)
-				if err != nil {
-					dbg.E(pdTag, "Error deleting trip %d : ", t.Id, err)
-				}
+			return report, err
+		}
+		if len(tripIds) != 0 {
+			dbg.WTF(pdTag, "How can we have trips %v without trackrecords for device %d in timerange from %d to %d??? Will delete them", tripIds, deviceId, startTime, endTime)
+			// records tombstones in the hash chain, so verifying it doesn't report the trips as tampered
+			if _, err = tripMan.DeleteTrips(tripIds, dbCon); err != nil {
+				dbg.E(pdTag, "Error deleting trips %v : ", tripIds, err)
 			}
 		}
-		return nil
+		return report, nil
 	}
 
-	tx, err := dbCon.Begin()
-	if err != nil {
-		dbg.E(pdTag, "Error starting transaction : ", err)
-		return
+	if activeNotifications == nil {
+		// load them once, so we know which notifications got created while processing
+		nots, errNots := notificationManager.GetActiveNotifications(true, dbCon)
+		if errNots != nil {
+			dbg.W(pdTag, "Error getting active notifications : ", errNots)
+		} else {
+			activeNotifications = &nots
+		}
+	}
+	knownNotifications := make(map[int64]bool)
+	if activeNotifications != nil {
+		for _, n := range *activeNotifications {
+			knownNotifications[n.Id] = true
+		}
+		defer func() {
+			for _, n := range *activeNotifications {
+				if !knownNotifications[n.Id] {
+					report.Notifications = append(report.Notifications, n)
+				}
+			}
+		}()
 	}
+
 	// 2.find all the keypoints
 	// check if there are already KeyPoints from this device in the given time
 	prevKP := KeyPoint{}
@@ -122,19 +173,250 @@ func ProcessGPSData(startTime int64, endTime int64, deviceId int, recalculate bo
 		createFirst = true
 	} else if err != nil {
 		dbg.E(pdTag, "Failed to get kp id count in time range...", err)
-		return err
+		return
 	} else {
 		dbg.I(pdTag, "got previous keypoint...", prevKP)
 		createFirst = false
 	}
+	if prevKP.StartTime.Int64 >= startTime && !recalculate {
+		dbg.W(pdTag, "Recalculate NOT active AND there are alreadyKPs in time range since  %d (%d) for deviceId %d...", startTime, prevKP.StartTime.Int64, deviceId)
+		return report, ErrGpsDataAlreadyImported
+	}
+	// nothing may be added to or replaced in closed periods, the triggers would reject it anyway
+	if err = periodManager.CheckTimeRangeOpen(int64(carId), startTime, endTime, dbCon); err != nil {
+		return
+	}
+	report.addPhase(PhasePrepare, phaseStart)
+	phaseStart = time.Now()
+	var replacedTrackIds []int64
 	if prevKP.StartTime.Int64 >= startTime {
 		// Ok, we got a keypoint in the imported time range
-		if recalculate {
-			dbg.I(pdTag, "Recalculate active & there are alreadyKPs in time range since  %d (%d) (until %d) for deviceId %d...", startTime, prevKP.StartTime.Int64, endTime, deviceId)
-			trackIds, err := tripMan.GetTrackIdsInTimeRange(startTime, endTime, []interface{}{int64(deviceId)}, dbCon)
+		dbg.I(pdTag, "Recalculate active & there are alreadyKPs in time range since  %d (%d) (until %d) for deviceId %d...", startTime, prevKP.StartTime.Int64, endTime, deviceId)
+		replacedTrackIds, err = tripMan.GetTrackIdsInTimeRange(startTime, endTime, []interface{}{int64(deviceId)}, dbCon)
+		if err != nil {
+			return
+		}
+		// the replaced tracks may reach into a closed period or belong to another car
+		if err = periodManager.CheckTracksOpen(replacedTrackIds, dbCon); err != nil {
+			return
+		}
+		startTime, endTime, err = getRecalculationTimeRange(startTime, endTime, deviceId, dbCon)
+		if err != nil {
+			return
+		}
+		report.addPhase(PhaseCleanup, phaseStart)
+	}
+	report.StartTime, report.EndTime = startTime, endTime
+	dbg.I(pdTag, "Reget trackrecords for device")
+	trackrecords, err = GetTrackRecordsForDevice(startTime, endTime, deviceId, dbCon)
+	report.TrackRecords = len(trackrecords)
+	dbg.I(pdTag, "Call FindKeyPoints")
+	dbLock.Unlock()
+	kps, addrErrs, err := findKeyPoints(dbCon, trackrecords, nil, GetStopDetector(string(device.StopDetector)), uId, report, geocoding, geocodeLock)
+	dbLock.Lock()
+	if activeNotifications != nil {
+		// others might have created notifications while we did not hold the lock
+		for _, n := range *activeNotifications {
+			knownNotifications[n.Id] = true
+		}
+	}
+	if err != nil && len(addrErrs) == 0 {
+		return
+	}
+	// failed address lookups are reported & retried later, no reason to stop
+	err = nil
+	report.AddressErrors = append(report.AddressErrors, addrErrs...)
+	gaps := DetectGaps(trackrecords, config)
+	phaseStart = time.Now()
+
+	dbg.I(pdTag, "ProcessGPSData: found %d keypoints in %d trackrecords...", len(kps), len(trackrecords))
+	// 3. replace the old tracks by a new track for each new KeyPoint, all or nothing
+	tx, err := dbCon.Begin()
+	if err != nil {
+		dbg.E(pdTag, "Error starting transaction : ", err)
+		return
+	}
+	newTrackIds, addedKps, err := storeTracks(kps, &prevKP, createFirst, replacedTrackIds, deviceId, carId, config, report, tx)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		dbg.E(pdTag, "Error commiting transaction : ", err)
+		return
+	}
+	report.addPhase(PhaseTracks, phaseStart)
+
+	// 3a. the GeoZones of the KeyPoints are needed by the TripRules
+	if len(addedKps) != 0 {
+		phaseStart = time.Now()
+		errZones := addressManager.UpdateKeyPointsForAllGeozones(addedKps, dbCon)
+		if errZones != nil {
+			dbg.E(pdTag, "Error updating KeyPoints for all GeoZones : ", errZones)
+		}
+		report.addPhase(PhaseGeoZones, phaseStart)
+	}
+
+	for idx, newTrackId := range newTrackIds {
+		trackStart, trackEnd := kps[idx].EndTime.Int64, kps[idx+1].StartTime.Int64
+
+		// 4. create filtered Trackpoints for each track, together with the data derived from them
+		phaseStart = time.Now()
+		trackTx, err := dbCon.Begin()
+		if err != nil {
+			dbg.E(pdTag, "Error starting transaction for Track %d : ", newTrackId, err)
+			return report, err
+		}
+		newTPs, skippedTPs, err := createFilteredTrackPoints(newTrackId, nil, trackTx)
+		if err != nil {
+			dbg.E(pdTag, "Failed to createFilteredTrackPoint for Track %d", newTrackId)
+			trackTx.Rollback()
+			return report, err
+		}
+		report.NewTrackPoints += len(newTPs)
+		report.SkippedTrackPoints += skippedTPs
+
+		// 4a. remember where the GPS data of this track has gaps
+		errGaps := StoreTrackGaps(newTrackId, trackStart, trackEnd, gaps, trackTx)
+		if errGaps != nil {
+			dbg.W(pdTag, "Failed to store gaps for Track %d : ", newTrackId, errGaps)
+		}
+		// 4c. remember how fast we were driving
+		errSpeed := StoreTrackSpeed(newTrackId, trackStart, trackEnd, trackrecords, config, trackTx)
+		if errSpeed != nil {
+			dbg.W(pdTag, "Failed to store speed for Track %d : ", newTrackId, errSpeed)
+		}
+		// 4d. remember harsh acceleration, braking & cornering
+		errHarsh := StoreTrackHarshEvents(newTrackId, trackStart, trackEnd, trackrecords, config, trackTx)
+		if errHarsh != nil {
+			dbg.W(pdTag, "Failed to store harsh events for Track %d : ", newTrackId, errHarsh)
+		}
+		// 4e. remember the elevation profile
+		errElevation := StoreTrackElevation(newTrackId, trackStart, trackEnd, trackrecords, config, trackTx)
+		if errElevation != nil {
+			dbg.W(pdTag, "Failed to store elevation for Track %d : ", newTrackId, errElevation)
+		}
+		// 4f. find out if we were driving at all
+		mode, errMode := StoreTrackTransportMode(newTrackId, trackStart, trackEnd, trackrecords, config, trackTx)
+		if errMode != nil {
+			dbg.W(pdTag, "Failed to store transport mode for Track %d : ", newTrackId, errMode)
+		}
+		report.addPhase(PhaseTrackPoints, phaseStart)
+
+		// 4b. optionally snap the trackPoints to the road graph
+		if graph := GetMapMatchingGraph(); graph != nil {
+			phaseStart = time.Now()
+			_, _, errMatch := matchTrack(newTrackId, graph, nil, trackTx)
+			if errMatch != nil {
+				dbg.W(pdTag, "Failed to match Track %d to road graph, keeping raw geometry only : ", newTrackId, errMatch)
+			}
+			report.addPhase(PhaseMapMatching, phaseStart)
+		}
+		if err = trackTx.Commit(); err != nil {
+			dbg.E(pdTag, "Error commiting data of Track %d : ", newTrackId, err)
+			return report, err
+		}
+
+		// 4g. fuse with the track of another device of the same car
+		phaseStart = time.Now()
+		tripTrackId := newTrackId
+		fusedTrackId, errFuse := FuseOverlappingTrack(newTrackId, deviceId, int64(carId), trackStart, trackEnd, config, dbCon)
+		if errFuse != nil {
+			dbg.W(pdTag, "Failed to fuse Track %d with tracks of other devices : ", newTrackId, errFuse)
+		} else if fusedTrackId != 0 {
+			report.FusedTracks++
+			tripTrackId = fusedTrackId
+		}
+		report.addPhase(PhaseFusion, phaseStart)
+
+		// 5. create default Trip for this Track
+		phaseStart = time.Now()
+		var fusedTrips int
+		if tripTrackId != newTrackId {
+			// the fused track usually has its trip already
+			dbCon.QueryRow("SELECT COUNT(*) FROM Tracks_Trips WHERE trackId=?", tripTrackId).Scan(&fusedTrips)
+		}
+		if config.SkipNonCarTracks && mode != TransportCar {
+			dbg.I(pdTag, "Not creating a trip for Track %d as it was classified as %s", newTrackId, mode)
+		} else if fusedTrips != 0 {
+			dbg.I(pdTag, "Not creating a trip for Track %d as it was fused into Track %d", newTrackId, tripTrackId)
+		} else {
+			tripTracks := []int64{tripTrackId}
+			_, affectedTripIds, _, err := tripMan.CreateOrReviveTripByTracks(tripTracks, 0, "", "",driverId, -1, false, false, true,activeNotifications,T, dbCon)
+			if err == nil {
+				report.NewTrips++
+				report.UpdatedTrips += len(affectedTripIds)
+			}
+		}
+		report.addPhase(PhaseTrips, phaseStart)
+	} // for range newTrackIds ~ derived data & trip of each track
+
+	dbg.I(pdTag, "ProcessGPSData: inserted %d KeyPoints, %d Tracks and %d TrackPoints...", report.NewKeyPoints, report.NewTracks, report.NewTrackPoints)
+
+	// 6. remember failed address lookups of inserted KeyPoints, so they get retried later
+	for _, addrErr := range addrErrs {
+		if !addrErr.KeyPoint.KeyPointId.Valid { // merged into an existing KeyPoint
+			continue
+		}
+		_, errJob := addressManager.CreateGeocodeJob(addrErr.KeyPoint.KeyPointId.Int64, addrErr.KeyPoint.Latitude.Float64, addrErr.KeyPoint.Longitude.Float64, addrErr.Error, dbCon)
+		if errJob != nil {
+			dbg.E(pdTag, "Failed to create GeocodeJob for KeyPoint %d : ", addrErr.KeyPoint.KeyPointId.Int64, errJob)
+		}
+	}
+	return report, nil
+}
+
+// getRecalculationTimeRange widens the time range to recalculate to the KeyPoints before and after the tracks in it,
+// as they are replaced by the recalculated ones.
+func getRecalculationTimeRange(startTime int64, endTime int64, deviceId int, dbCon *sql.DB) (newStart int64, newEnd int64, err error) {
+	newStart, newEnd = startTime, endTime
+	// Determine new start- and endTime by first keyPoint before replaced tracks and first keyPoint after replaced Tracks
+	var newStartTime sql.NullInt64
+	err = dbCon.QueryRow(`SELECT kp.endTime FROM KeyPoints kp JOIN Tracks t ON t.startKeyPointId=kp._keyPointId
+ JOIN KeyPoints e ON e._keyPointId=t.endKeyPointId
+ WHERE kp.endTime<=?1 AND NOT (t.deviceId=?3 AND kp.endTime<=?2 AND e.startTime>=?1) ORDER BY kp.endTime DESC LIMIT 1`,
+		startTime, endTime, deviceId).Scan(&newStartTime)
+	if err != nil && err != sql.ErrNoRows {
+		dbg.E(pdTag, "Error querying new start time : ", err)
+		return
+	}
+	if newStartTime.Valid {
+		newStart = newStartTime.Int64
+	} else {
+		dbg.I(pdTag, "No keypoint found before ", startTime)
+	}
+
+	var newEndTime sql.NullInt64
+	err = dbCon.QueryRow(`SELECT kp.startTime FROM KeyPoints kp JOIN Tracks t ON t.endKeyPointId=kp._keyPointId
+ JOIN KeyPoints s ON s._keyPointId=t.startKeyPointId
+ WHERE kp.startTime>=?2 AND NOT (t.deviceId=?3 AND s.endTime<=?2 AND kp.startTime>=?1) ORDER BY kp.startTime ASC LIMIT 1`,
+		startTime, endTime, deviceId).Scan(&newEndTime)
+	if err != nil && err != sql.ErrNoRows {
+		dbg.E(pdTag, "Error querying new end time : ", err)
+		return
+	}
+	err = nil
+	if newEndTime.Valid {
+		newEnd = newEndTime.Int64
+	} else {
+		dbg.I(pdTag, "No keypoint found after ", endTime)
+	}
+	return
+}
 
-			for _, tId := range trackIds {
-				_, err := dbCon.Exec(`
+// storeTracks deletes the replaced tracks and inserts the given KeyPoints & the tracks between them in tx. The first
+// KeyPoint is merged into prevKP if it did not move. Returns the IDs of the new tracks & KeyPoints.
+func storeTracks(kps []*KeyPoint, prevKP *KeyPoint, createFirst bool, replacedTrackIds []int64, deviceId int, carId NInt64, config *LocationConfig, report *ProcessingReport, tx *sql.Tx) (newTrackIds []int64, addedKps []int64, err error) {
+	newTrackIds = make([]int64, 0, len(kps))
+	addedKps = make([]int64, 0, len(kps))
+	for _, tId := range replacedTrackIds {
+		_, err = tx.Exec(`
+					DELETE FROM GeocodeJobs WHERE keyPointId IN (
+SELECT endKeyPointId FROM Tracks WHERE _trackId=? AND
+(
+SELECT COUNT(_trackId) FROM Tracks B WHERE Tracks.endKeyPointId=B.startKeyPointId
+) = 0
+);
 					DELETE FROM KeyPoints WHERE _keyPointId IN (
 SELECT endKeyPointId FROM Tracks WHERE _trackId=? AND
 (
@@ -142,165 +424,98 @@ SELECT COUNT(_trackId) FROM Tracks B WHERE Tracks.endKeyPointId=B.startKeyPointI
 ) = 0
 );
 DELETE FROM trackPoints WHERE trackId=?;
+DELETE FROM MatchedTrackPoints WHERE trackId=?;
+DELETE FROM TrackGaps WHERE trackId=?;
+DELETE FROM SpeedingEvents WHERE trackId=?;
+DELETE FROM HarshEvents WHERE trackId=?;
+DELETE FROM ElevationProfiles WHERE trackId=?;
+DELETE FROM TrackDevices WHERE trackId=?;
+UPDATE Tracks SET fusedIntoTrackId=NULL WHERE fusedIntoTrackId=?;
 DELETE FROM Tracks_Trips WHERE trackId=?;
 DELETE FROM Tracks WHERE _trackId=?;
-				`, tId, tId, tId, tId)
-				if err != nil {
-					dbg.E(pdTag, " Error while deleting trackId %d", tId)
-					return err
-				}
-
-			}
-
-			// Determine new start- and endTime by first keyPoint before deleted tracks and first keyPoint after deleted Tracks
-			var newStartTime sql.NullInt64
-			err = dbCon.QueryRow(`SELECT endTime FROM KeyPoints LEFT JOIN Tracks ON startKeyPointId=_keyPointId
- WHERE endTime<=? AND startKeyPointId IS NOT NULL ORDER BY endTime DESC LIMIT 1`, startTime).Scan(&newStartTime)
-			if err != nil && err != sql.ErrNoRows {
-				dbg.E(pdTag, "Error querying new start time : ", err)
-				return err
-			}
-			if newStartTime.Valid {
-				startTime = newStartTime.Int64
-			} else {
-				dbg.I(pdTag, "No keypoint found before ", startTime)
-			}
-
-			var newEndTime sql.NullInt64
-			err = dbCon.QueryRow(`SELECT startTime FROM KeyPoints LEFT JOIN Tracks ON endKeyPointId=_keyPointId
- WHERE startTime>=? AND endKeyPointId IS NOT NULL ORDER BY startTime ASC LIMIT 1`, endTime).Scan(&newEndTime)
-			if err != nil && err != sql.ErrNoRows {
-				dbg.E(pdTag, "Error querying new end time : ", err)
-				return err
-			}
-			if newEndTime.Valid {
-				endTime = newEndTime.Int64
-			} else {
-				dbg.I(pdTag, "No keypoint found after ", endTime)
-			}
-		} else {
-			dbg.W(pdTag, "Recalculate NOT active AND there are alreadyKPs in time range since  %d (%d) for deviceId %d...", startTime, prevKP.StartTime.Int64, deviceId)
-			return ErrGpsDataAlreadyImported
-
+				`, tId, tId, tId, tId, tId, tId, tId, tId, tId, tId, tId, tId)
+		if err != nil {
+			dbg.E(pdTag, " Error while deleting trackId %d", tId, err)
+			return
 		}
-
+		report.DeletedTracks++
 	}
-	dbg.I(pdTag, "Reget trackrecords for device")
-	trackrecords, err = GetTrackRecordsForDevice(startTime, endTime, deviceId, dbCon)
-	dbg.I(pdTag, "Call FindKeyPoints")
-	kps, err := FindKeyPoints(dbCon, trackrecords, nil,uId)
 
-	dbg.I(pdTag, "ProcessGPSData: found %d keypoints in %d trackrecords...", len(kps), len(trackrecords))
 	p := geo.NewPoint((kps)[0].Latitude.Float64, (kps)[0].Longitude.Float64)
 	lastPoint := geo.NewPoint(prevKP.Latitude.Float64, prevKP.Longitude.Float64)
 
 	var newTrackId sql.NullInt64
 	var startKpId int64
-	addedKps := make([]int64, 0)
-	defer func() { // Last step : For all added KeyPoints insert GeoZone-information
-		if len(addedKps) != 0 {
-			err = addressManager.UpdateKeyPointsForAllGeozones(addedKps, dbCon)
-			if err != nil {
-				dbg.E(pdTag, "Error updating KeyPoints for all GeoZones : ", err)
-			}
-		}
-	}()
 	if p.GreatCircleDistance(lastPoint)*1000 > float64(config.MinMoveDist) || createFirst {
 		newTrackId.Int64 = -1
-		res, errKp := dbCon.Exec("INSERT INTO `keyPoints` (latitude, longitude, startTime, endTime, previousTrackId, nextTrackId, deviceId, addressId,carId) VALUES(?,?,?,?,?,?,?,?,?)",
+		res, errKp := tx.Exec("INSERT INTO `keyPoints` (latitude, longitude, startTime, endTime, previousTrackId, nextTrackId, deviceId, addressId,carId) VALUES(?,?,?,?,?,?,?,?,?)",
 			(kps)[0].Latitude, (kps)[0].Longitude, (kps)[0].StartTime, (kps)[0].EndTime, (kps)[0].PreviousTrackId, newTrackId, deviceId, (kps)[0].AddressId, carId)
 
 		if errKp != nil {
 			dbg.E(pdTag, "Failed to insert KeyPoint into DB", errKp)
-			return errKp
+			return newTrackIds, addedKps, errKp
 		}
 
 		startKpId, _ = res.LastInsertId()
+		(kps)[0].KeyPointId = sql.NullInt64{Int64: startKpId, Valid: true}
 		addedKps = append(addedKps, startKpId)
-		// If we experience performance issues we could first bundle all KeyPoints and then do this.
-		errKp = addressManager.UpdateKeyPointsForAllGeozones([]int64{startKpId}, dbCon)
-		if err != nil {
-			dbg.E(pdTag, "Failed to calculate GeoZones for KeyPoint", errKp)
-			return errKp
-		}
+		report.NewKeyPoints++
 	} else { // last point we got seems not to be starting KeyPoint of this track
 		(kps)[0].PreviousTrackId = prevKP.PreviousTrackId
 		(kps)[0].StartTime = prevKP.StartTime
 		startKpId = prevKP.KeyPointId.Int64
-		_, errKp := dbCon.Exec("UPDATE `keyPoints` SET endTime=? WHERE _keyPointId=?", (kps)[0].EndTime, startKpId)
+		_, errKp := tx.Exec("UPDATE `keyPoints` SET endTime=? WHERE _keyPointId=?", (kps)[0].EndTime, startKpId)
 		if errKp != nil {
 			dbg.E(pdTag, "Failed to insert KeyPoint into DB", errKp)
-			return errKp
+			return newTrackIds, addedKps, errKp
 		}
+		report.UpdatedKeyPoints++
 	}
 
-	// 3. creates a new track for each new KeyPoint
 	for idx := 1; idx < len(kps); idx++ { // skip 1st, we already handled it
-		kpEnd = (kps)[idx]
+		kpEnd := (kps)[idx]
 		// TODO: CS use crossplattform DB stuff
-		resEndKP, errKp2 := dbCon.Exec("INSERT INTO `keyPoints` (latitude, longitude, startTime, endTime, previousTrackId, nextTrackId, deviceId, addressId) VALUES(?,?,?,?,?,?,?,?)",
+		resEndKP, errKp2 := tx.Exec("INSERT INTO `keyPoints` (latitude, longitude, startTime, endTime, previousTrackId, nextTrackId, deviceId, addressId) VALUES(?,?,?,?,?,?,?,?)",
 			kpEnd.Latitude, kpEnd.Longitude, kpEnd.StartTime, kpEnd.EndTime, kpEnd.PreviousTrackId, sql.NullInt64{Int64: 0, Valid: false}, deviceId, kpEnd.AddressId)
 		if errKp2 != nil {
 			dbg.E(pdTag, "Failed to insert KeyPoint into DB", errKp2)
-			return errKp2
+			return newTrackIds, addedKps, errKp2
 		}
 
 		endKpId, _ := resEndKP.LastInsertId()
+		kpEnd.KeyPointId = sql.NullInt64{Int64: endKpId, Valid: true}
 		addedKps = append(addedKps, endKpId)
 		// dbg.V(pdTag, "inserted KeyPoints %d + %d into DB...doing Tracks now", startKpId, endKpId, idx, idx-1)
-		countNewKPs += 1
+		report.NewKeyPoints++
 
 		// TODO: CS use crossplattform DB stuff
-		resTrack, errTrack := dbCon.Exec("INSERT INTO `tracks` (deviceId, startKeyPointId, endKeyPointId, distance,carId) VALUES(?, ?, ?, -1,?)",
+		resTrack, errTrack := tx.Exec("INSERT INTO `tracks` (deviceId, startKeyPointId, endKeyPointId, distance,carId) VALUES(?, ?, ?, -1,?)",
 			deviceId, startKpId, endKpId, carId)
 		if errTrack != nil {
 			dbg.E(pdTag, "Failed to insert track into DB", errTrack)
-			return errTrack
+			return newTrackIds, addedKps, errTrack
 		}
 
 		newTrackId, _ := resTrack.LastInsertId()
-		countNewTracks += 1
+		newTrackIds = append(newTrackIds, newTrackId)
+		report.NewTracks++
 
 		// TODO: CS use crossplattform DB stuff
-		_, errUpNextTId := dbCon.Exec("UPDATE `keyPoints` SET nextTrackId=? WHERE _keyPointId=?", newTrackId, startKpId)
+		_, errUpNextTId := tx.Exec("UPDATE `keyPoints` SET nextTrackId=? WHERE _keyPointId=?", newTrackId, startKpId)
 		if errUpNextTId != nil {
 			dbg.E(pdTag, "Failed to update NextTrackId of StartKeyPoint", errUpNextTId)
-			return errUpNextTId
+			return newTrackIds, addedKps, errUpNextTId
 		}
 
 		// TODO: CS use crossplattform DB stuff
-		_, errUpPrevKpId := dbCon.Exec("UPDATE `keyPoints` SET previousTrackId=? WHERE _keyPointId=?", newTrackId, endKpId)
+		_, errUpPrevKpId := tx.Exec("UPDATE `keyPoints` SET previousTrackId=? WHERE _keyPointId=?", newTrackId, endKpId)
 		if errUpPrevKpId != nil {
 			dbg.E(pdTag, "Failed to update PreviousTrackId of EndKeyPoint", errUpPrevKpId)
-			return errUpPrevKpId
+			return newTrackIds, addedKps, errUpPrevKpId
 		}
-
-		// 4. create filtered Trackpoints for each track
-		newTPs, err := CreateFilteredTrackPoints(newTrackId, nil, dbCon)
-		if err != nil {
-			dbg.E(pdTag, "Failed to createFilteredTrackPoint for Track %d", newTrackId)
-			return err
-		}
-		countNewTPs += len(newTPs)
-
-		// 5. create default Trip for this Track
-		// TODO: implement
-		// tracks = []int
-		// tracks = append(tracks, newTrackId)
-		tripTracks := []int64{newTrackId}
-		_, _, _, err = tripMan.CreateOrReviveTripByTracks(tripTracks, 0, "", "",driverId, -1, false, false, false,activeNotifications,T, dbCon)
-
 		startKpId = endKpId
-	} // for range kps ~ create track for each KP
-
-	dbg.I(pdTag, "ProcessGPSData: inserted %d KeyPoints, %d Tracks and %d TrackPoints...", countNewKPs, countNewTracks, countNewTPs)
-
-	err = tx.Commit()
-	if err != nil {
-		dbg.E(pdTag, "Error commiting transaction : ", err)
 	}
-	// TODO: maybe refactor: move DB index inserts/updates to extra function
-	return nil
+	return
 }
 
 type AddressError struct {
@@ -312,168 +527,40 @@ type AddressError struct {
 // expects array of Location for a specific device
 // locations should be sorted by time and are from the same device
 func FindKeyPoints(dbCon *sql.DB, raw []Location, config *LocationConfig, uId int64) ([]*KeyPoint, error) {
-	cKpForAddresses := make(chan *KeyPoint)
-	client := &http.Client{
-		Timeout: time.Duration(10 * time.Second),
-	}
-	done := make(chan struct{})
-	errs := make([]AddressError, 0)
-	var wg sync.WaitGroup
-	defer close(done)
-	go func() {
-		defer close(cKpForAddresses)
-		defer func() {
-			if err := recover(); err != nil {
-				dbg.WTF(pdTag, "Fatal error finding keypoint addresses:", err)
-				dbg.E(pdTag, "Fatal error finding keypoint addresses:", err)
-			}
-		}()
-		var err error
-
-		reqCount := 0 // TODO: REMOVE!
-		for {
-			select {
-			case kp := <-cKpForAddresses:
-				{
-					var addrId int64 = -1
-					reqCount++
-					/*	if reqCount>1 { // TODO: Remove
-						wg.Done()
-						continue
-					}*/
-					addrId, err = addressManager.GetAddressIdForLatLng(kp.Latitude.Float64, kp.Longitude.Float64, client,uId, dbCon)
-					if err != nil {
-
-						dbg.W(pdTag, "Error getting addressId for [%d, %d]", kp.Latitude.Float64, kp.Longitude.Float64, err)
-						errs = append(errs, AddressError{Error: err, KeyPoint: kp})
-						if err != nil {
-							dbg.E(pdTag, "Error creating unknown address - this is not good!!", err)
-						}
-
-					}
-					kp.AddressId = sql.NullInt64{Int64: addrId, Valid: true}
-
-					wg.Done()
-				}
-			case <-done:
-				{
-					return
-				}
-			}
-		}
-	}()
-	keyPoints := make([]*KeyPoint, 0)
-	candidates := make([]Location, 0)
-	var p *geo.Point
-	var lastLocation Location
-	var currentLocation Location
-	isFirst := true
-	inaccuratePoints := 0 // not sure what we could use this for...
+	return FindKeyPointsWithDetector(dbCon, raw, config, nil, uId)
+}
+
+// FindKeyPointsWithDetector finds the KeyPoints in a list of Locations with the given StopDetector
+// (the DefaultStopDetector if nil) and resolves their addresses.
+func FindKeyPointsWithDetector(dbCon *sql.DB, raw []Location, config *LocationConfig, detector StopDetector, uId int64) ([]*KeyPoint, error) {
+	keyPoints, _, err := findKeyPoints(dbCon, raw, config, detector, uId, nil, nil, nil)
+	return keyPoints, err
+}
 
+// findKeyPoints implements FindKeyPointsWithDetector, additionally returning all failed address lookups and
+// adding the time needed to the given ProcessingReport (if not nil). Addresses are looked up as configured in
+// geocoding, one after another if nil, holding dbLock (if not nil) while working with the database.
+func findKeyPoints(dbCon *sql.DB, raw []Location, config *LocationConfig, detector StopDetector, uId int64, report *ProcessingReport, geocoding *geocodeOptions, dbLock sync.Locker) ([]*KeyPoint, []AddressError, error) {
 	if config == nil {
 		config = GetDefaultLocationConfig()
 	}
+	if detector == nil {
+		detector = &DefaultStopDetector{}
+	}
 
 	if raw == nil || len(raw) < 1 {
 		dbg.E(pdTag, "FindKeyPoints: got no correct locations-array", raw)
-		return nil, errors.New("FindKeyPoints: got no correct locations-array")
+		return nil, nil, ErrNoLocations
 	}
 
-	// dbg.I(pdTag, "fkp..running through %d locations...", len(*raw))
-
-	// set up first Points to compare
-	currentLocation = (raw)[0]
-	lastLocation = currentLocation
-	var nextLocation *Location
-	p = geo.NewPoint(0, 0)
-	lastPoint := p
-
-	// assume 1st point is candidate for keyPoint (because we started here)...
-	candidates = append(candidates, raw[0])
-	pointCount := len(raw)
-
-	for idx := 1; idx < pointCount; idx++ { // start going through the raw points
-		currentLocation = (raw)[idx]
-
-		if pointCount == idx+1 {
-			nextLocation = nil
-		} else {
-			nextLocation = &(raw[idx+1])
-		}
-		if currentLocation.Accuracy.Float64 > float64(config.AccuracyThreshold) {
-			inaccuratePoints++
-			continue // dont worry about inaccurate points at all
-		}
-
-		// check distance
-		p = geo.NewPoint(currentLocation.Latitude.Float64, currentLocation.Longitude.Float64)
-		// avgPointFromCandidates := interpolateLocations(&candidates)
-		// lastPoint = geo.NewPoint(candidates[0].Latitude.Float64, candidates[0].Longitude.Float64)
-		lastPoint = geo.NewPoint(lastLocation.Latitude.Float64, lastLocation.Longitude.Float64)
-
-		// dbg.E(pdTag, "dist was %f at %d", lastPoint.GreatCircleDistance(p)*1000, idx)
-
-		// dist := p.GreatCircleDistance(avgPointFromCandidates) * 1000
-		dist := p.GreatCircleDistance(lastPoint) * 1000
-
-		// if float64(config.MinMoveDist) < dist && currentLocation.Accuracy.Float64 < dist && lastLocation.Accuracy.Float64 < dist { // we moved
-		if float64(config.MinMoveDist) < dist &&
-			currentLocation.Accuracy.Float64 < dist && lastLocation.Accuracy.Float64 < dist &&
-			(nextLocation == nil ||
-				(lastPoint.GreatCircleDistance(geo.NewPoint(nextLocation.Latitude.Float64, nextLocation.Longitude.Float64))*1000 > float64(config.MinMoveDist) &&
-					currentLocation.TimeMillis.Int64-nextLocation.TimeMillis.Int64 < 1000*60)) { // we moved and did not move back again in the next point (if during one minute)
-			if len(candidates) > 0 {
-
-				// create a keypoint from the candidates
-
-				// if int64(config.MinMoveTime) < (currentLocation.TimeMillis.Int64-lastLocation.TimeMillis.Int64)
-				if int64(config.MinMoveTime) < (currentLocation.TimeMillis.Int64-candidates[0].TimeMillis.Int64) || isFirst { // firstKeyPoint of track does not need to have minMoveTime
-
-					//dbg.WTF(pdTag, "KeyPoint created because of distance moved : %d", dist)
-					// check distance to last KeyPoint
-					// if len(keyPoints) > 0 {
-					//	curKPcand := geo.NewPoint(currentLocation.Latitude.Float64, currrentLocation.Longitude.Float64)
-					//	lastKP := geo.NewPoint(keyPoints[len(keyPoints)-1].Latitude.Float64, keyPoints[len(keyPoints)-1].Longitude.Float64)
-					// distlastKP := curKPcand.GreatCircleDistance(lastKP) * 1000
-
-					// dbg.I(pdTag, "fkp.. in step %d added KP #%d (dur=%d s) after %d cands %f m away (acc=%f) from lastKP...", idx, len(keyPoints), (currentLocation.TimeMillis.Int64-candidates[0].TimeMillis.Int64)/1000, len(candidates), dist, currentLocation.Accuracy.Float64, currentLocation)
-
-					newKP := interpolateLocationsToKeyPoint(candidates)
-					// set the endtime to the time of the point that was distant - this is not 100% accurate, but we can't get it 100% accurate :/
-					newKP.EndTime = currentLocation.TimeMillis
-					wg.Add(1)
-					cKpForAddresses <- newKP
-					keyPoints = append(keyPoints, newKP)
-
-					isFirst = false
-
-				} // stay time > minMoveTime
-			} //  we have candidates
-			candidates = make([]Location, 0)
-			candidates = append(candidates, currentLocation)
-			lastLocation = currentLocation
-		} else { // we did NOT move since last time
-			candidates = append(candidates, currentLocation)
-			// dbg.D(pdTag, "fkp..appended to candidate...", currentLocation)
-		}
-	} // we're done iterating
-
-	// check if there are candidates left, which weren't made a keypoint yet
-	// the last fix should be (part of) a KeyPoint too
-	if len(candidates) > 0 { // create a keypoint from the candidates
-		// TODO: make interpolation of average point
-		newKP := interpolateLocationsToKeyPoint(candidates)
-		wg.Add(1)
-		cKpForAddresses <- newKP
-
-		keyPoints = append(keyPoints, newKP)
-		// dbg.I(pdTag, "fkp.. at the end added as KP (dur=%d sec) after %d cands...", (newKP.EndTime.Int64-newKP.StartTime.Int64)/1000, len(candidates), newKP)
-	} else {
-		keyPoints[len(keyPoints)-1].EndTime = (raw)[len(raw)-1].TimeMillis
-		// dbg.I(pdTag, "fkp.. at the end updated endTime for last KP in list")
+	phaseStart := time.Now()
+	keyPoints, err := detector.DetectStops(raw, config)
+	if err != nil {
+		dbg.E(pdTag, "FindKeyPoints: StopDetector %s failed : ", detector.Name(), err)
+		return nil, nil, err
 	}
-
-	dbg.I(pdTag, "FindKeyPoints: found %d inaccureate and %d keypoints...", inaccuratePoints, len(keyPoints)) //, keyPoints)
+	dbg.I(pdTag, "FindKeyPoints: %s found %d keypoints...", detector.Name(), len(keyPoints))
+	keyPoints = ApplyGapsToKeyPoints(keyPoints, DetectGaps(raw, config), config)
 
 	// make sure we have at least 2 keypoints in this timeframe,
 	// TODO: if the last one is no real keypoint(moving) mark him as "notFinal"
@@ -481,16 +568,28 @@ func FindKeyPoints(dbCon *sql.DB, raw []Location, config *LocationConfig, uId in
 		dbg.W(pdTag, "we got only 1 keypoint...AAAALERT")
 	}
 
-	wg.Wait()
-	if len(errs) != 0 { // TODO: Save failed stuff into database for later reprocessing???
+	report.addPhase(PhaseStopDetect, phaseStart)
+
+	phaseStart = time.Now()
+	defer report.addPhase(PhaseGeocoding, phaseStart)
+	errs := geocodeKeyPoints(keyPoints, uId, geocoding, dbLock, dbCon)
+
+	if len(errs) != 0 { // ProcessGPSData stores them as GeocodeJobs as soon as the KeyPoints are inserted
 		dbg.E(pdTag, "Errors occured getting keypoints addresses")
-		return keyPoints, errors.New("Errors occured getting keypoint addresses")
+		return keyPoints, errs, errors.New("Errors occured getting keypoint addresses")
 	}
-	return keyPoints, nil
+	return keyPoints, errs, nil
 }
 
 // CreateFilteredTrackPoints links a filtered list of trackpoints to a track using data from trackRecords
-func CreateFilteredTrackPoints(trackId int64, config *LocationConfig, dbCon *sql.DB) ([]TrackPoint, error) {
+func CreateFilteredTrackPoints(trackId int64, config *LocationConfig, dbCon tools.DbRunner) ([]TrackPoint, error) {
+	trackPoints, _, err := createFilteredTrackPoints(trackId, config, dbCon)
+	return trackPoints, err
+}
+
+// createFilteredTrackPoints implements CreateFilteredTrackPoints, additionally returning the count of
+// trackRecords skipped because they were inaccurate.
+func createFilteredTrackPoints(trackId int64, config *LocationConfig, dbCon tools.DbRunner) ([]TrackPoint, int, error) {
 
 	var inaccuratePoints int
 	var startTime sql.NullInt64
@@ -524,7 +623,7 @@ func CreateFilteredTrackPoints(trackId int64, config *LocationConfig, dbCon *sql
 
 	if err != nil {
 		dbg.E(pdTag, "CreateFilteredTrackPoints: Failed to get trackData for %d from DB...", trackId, err)
-		return nil, err
+		return nil, inaccuratePoints, err
 	}
 
 	// check if trackPoints for track already there
@@ -533,13 +632,14 @@ func CreateFilteredTrackPoints(trackId int64, config *LocationConfig, dbCon *sql
 	if oldTPsCount > 0 {
 		dbg.I(pdTag, "there are already %d TrackPoints for Track %d...abort CreateFilteredTrackPoints", oldTPsCount, trackId)
 		errStr := fmt.Sprintf("CreateFilteredTrackPoints:already %d TrackPoints imported for Track %d", oldTPsCount, trackId)
-		return nil, errors.New(errStr)
+		return nil, inaccuratePoints, errors.New(errStr)
 	}
 
-	trackRecs, err := GetTrackRecordsForDevice(startTime.Int64, endTime.Int64, int(deviceId.Int64), dbCon)
+	// fused tracks use the most accurate trackRecords of all contributing devices
+	trackRecs, _, err := getTrackRecordsForTrack(trackId, startTime.Int64, endTime.Int64, int(deviceId.Int64), config, dbCon)
 	if err != nil {
 		dbg.E(pdTag, "CreateFilteredTrackPoints: Failed to get trackrecords...", err)
-		return nil, err
+		return nil, inaccuratePoints, err
 	}
 
 	startPoint := TrackPoint{
@@ -639,7 +739,7 @@ func CreateFilteredTrackPoints(trackId int64, config *LocationConfig, dbCon *sql
 			_, err := dbCon.Exec(stmt, valueArgs...)
 			if err != nil {
 				dbg.E(pdTag, "idx: %d unable to insert %d TrackPoints for Track %d to DB", idx, len(valueArgs), trackId)
-				return nil, err
+				return nil, inaccuratePoints, err
 			}
 			valueArgs = make([]interface{}, 0)
 			valueStrings = make([]string, 0)
@@ -654,7 +754,7 @@ func CreateFilteredTrackPoints(trackId int64, config *LocationConfig, dbCon *sql
 		_, err := dbCon.Exec(stmt, valueArgs...)
 		if err != nil {
 			dbg.E(pdTag, "unable to insert LAST %d TrackPoints for Track %d to DB", len(valueArgs), trackId)
-			return nil, err
+			return nil, inaccuratePoints, err
 		}
 	}
 
@@ -662,11 +762,57 @@ func CreateFilteredTrackPoints(trackId int64, config *LocationConfig, dbCon *sql
 	_, err = dbCon.Exec("UPDATE `Tracks` SET distance=? WHERE _trackId=?", distance, trackId)
 	if err != nil {
 		dbg.E(pdTag, "unable to update distance %d for Track %d to DB", distance, trackId)
-		return nil, err
+		return nil, inaccuratePoints, err
 	}
 	// TODO: after successful inserts, we could remove all this shit from trackRecords
 
-	return trackPoints, nil
+	return trackPoints, inaccuratePoints, nil
+}
+
+// recalculateTrackData replaces the trackPoints, gaps, speed, harsh events, elevation and transport mode of the
+// given track after its KeyPoints or trackRecords changed. startTime & endTime are the times the track starts & ends.
+// Returns the count of trackRecords taken from each device if the track is fused.
+func recalculateTrackData(trackId int64, startTime int64, endTime int64, deviceId int, config *LocationConfig, dbCon *sql.Tx) (contributions map[int64]int, err error) {
+	_, err = dbCon.Exec(`DELETE FROM trackPoints WHERE trackId=?;
+DELETE FROM MatchedTrackPoints WHERE trackId=?;
+DELETE FROM TrackGaps WHERE trackId=?;
+DELETE FROM SpeedingEvents WHERE trackId=?;
+DELETE FROM HarshEvents WHERE trackId=?;
+DELETE FROM ElevationProfiles WHERE trackId=?;`, trackId, trackId, trackId, trackId, trackId, trackId)
+	if err != nil {
+		dbg.E(pdTag, "Failed to delete track data of track %d : ", trackId, err)
+		return
+	}
+	_, _, err = createFilteredTrackPoints(trackId, config, dbCon)
+	if err != nil {
+		return
+	}
+	recs, contributions, err := getTrackRecordsForTrack(trackId, startTime, endTime, deviceId, config, dbCon)
+	if err != nil {
+		return
+	}
+	if err = StoreTrackGaps(trackId, startTime, endTime, DetectGaps(recs, config), dbCon); err != nil {
+		return
+	}
+	if err = StoreTrackSpeed(trackId, startTime, endTime, recs, config, dbCon); err != nil {
+		return
+	}
+	if err = StoreTrackHarshEvents(trackId, startTime, endTime, recs, config, dbCon); err != nil {
+		return
+	}
+	if err = StoreTrackElevation(trackId, startTime, endTime, recs, config, dbCon); err != nil {
+		return
+	}
+	if _, err = StoreTrackTransportMode(trackId, startTime, endTime, recs, config, dbCon); err != nil {
+		return
+	}
+	if graph := GetMapMatchingGraph(); graph != nil {
+		_, _, errMatch := matchTrack(trackId, graph, nil, dbCon)
+		if errMatch != nil {
+			dbg.W(pdTag, "Failed to match Track %d to road graph, keeping raw geometry only : ", trackId, errMatch)
+		}
+	}
+	return
 }
 
 // interpolateLocationsToKeyPoint takes a bunch of Locations, returns a KeyPoint for them
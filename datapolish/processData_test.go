@@ -11,6 +11,7 @@ import (
 	"github.com/Compufreak345/dbg"
 	"github.com/OpenDriversLog/goodl-lib/datapolish"
 	"github.com/OpenDriversLog/goodl-lib/dbMan"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/periodManager"
 	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
 	"github.com/OpenDriversLog/goodl-lib/translate"
 )
@@ -239,3 +240,83 @@ var _ = Describe("ProcessData", func() {
 	}) // Describe CreateFilteredTrackPoints
 
 })
+
+var _ = Describe("ProcessGPSData in closed periods", func() {
+	var (
+		dbCon    *sql.DB
+		deviceId int64
+		carId    int64
+	)
+	endTime := reportTestStart + 3600*1000
+
+	process := func(recalculate bool) (*datapolish.ProcessingReport, error) {
+		return datapolish.ProcessGPSDataWithGeocoder(reportTestStart, endTime, int(deviceId), recalculate, 1, failingGeocoder{}, nil, &translate.Translater{}, dbCon)
+	}
+	// ids returns the IDs of the tracks & keypoints of the test drive
+	ids := func() (ids []int64) {
+		rows, err := dbCon.Query("SELECT _trackId FROM Tracks WHERE deviceId=?1 UNION ALL SELECT -_keyPointId FROM KeyPoints WHERE deviceId=?1 ORDER BY 1", deviceId)
+		Expect(err).To(BeNil())
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			Expect(rows.Scan(&id)).To(BeNil())
+			ids = append(ids, id)
+		}
+		return
+	}
+
+	BeforeEach(func() {
+		dbCon, _ = dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+		deviceId, carId = insertTestDrive(dbCon)
+	})
+
+	AfterEach(func() {
+		dbCon.Exec("DROP TRIGGER IF EXISTS test_fail_tracks")
+		dbCon.Exec("DELETE FROM ClosedPeriods WHERE carId=?", carId)
+		deleteTestDrive(deviceId, carId, dbCon)
+		dbCon.Close()
+	})
+
+	It("should not add tracks to closed periods", func() {
+		_, err := periodManager.ClosePeriod(carId, reportTestStart-1000, endTime, "test", 1, dbCon)
+		Expect(err).To(BeNil())
+		_, err = process(false)
+		Expect(err).To(Equal(periodManager.ErrPeriodClosed))
+		Expect(ids()).To(BeEmpty())
+	})
+
+	It("should not recalculate tracks of closed periods", func() {
+		_, err := process(false)
+		Expect(err).To(BeNil())
+		before := ids()
+		Expect(before).NotTo(BeEmpty())
+
+		_, err = periodManager.ClosePeriod(carId, reportTestStart+5*60*1000, reportTestStart+10*60*1000, "test", 1, dbCon)
+		Expect(err).To(BeNil())
+		_, err = process(true)
+		Expect(err).To(Equal(periodManager.ErrPeriodClosed))
+		Expect(ids()).To(Equal(before))
+	})
+
+	It("should replace the tracks all or nothing when recalculating", func() {
+		_, err := process(false)
+		Expect(err).To(BeNil())
+		before := ids()
+
+		_, err = dbCon.Exec("CREATE TRIGGER test_fail_tracks BEFORE INSERT ON Tracks BEGIN SELECT RAISE(ABORT, 'test'); END")
+		Expect(err).To(BeNil())
+		_, err = process(true)
+		Expect(err).NotTo(BeNil())
+		Expect(ids()).To(Equal(before))
+
+		_, err = dbCon.Exec("DROP TRIGGER test_fail_tracks")
+		Expect(err).To(BeNil())
+		report, err := process(true)
+		Expect(err).To(BeNil())
+		Expect(report.DeletedTracks).To(Equal(1))
+		Expect(report.NewTracks).To(Equal(1))
+		var tracks int
+		Expect(dbCon.QueryRow("SELECT COUNT(*) FROM Tracks WHERE deviceId=?", deviceId).Scan(&tracks)).To(BeNil())
+		Expect(tracks).To(Equal(1))
+	})
+})
@@ -0,0 +1,99 @@
+package datapolish
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/notificationManager"
+)
+
+// ProcessingReport describes what ProcessGPSDataWithReport did.
+type ProcessingReport struct {
+	DeviceId  int
+	StartTime int64
+	EndTime   int64
+	// TrackRecords is the count of trackRecords that were processed
+	TrackRecords int
+
+	NewKeyPoints     int
+	UpdatedKeyPoints int
+	NewTracks        int
+	DeletedTracks    int
+	NewTrips         int
+	UpdatedTrips     int
+	NewTrackPoints   int
+	// FusedTracks is the count of new tracks fused into a track of another device of the same car
+	FusedTracks int
+	// SkippedTrackPoints is the count of trackRecords not used for trackPoints because they were inaccurate
+	SkippedTrackPoints int
+
+	AddressErrors []AddressError
+	// Notifications are the notifications created while processing
+	Notifications []*notificationManager.Notification
+	Phases        []*ProcessingPhase
+}
+
+// ProcessingPhase is the time spent in one phase of ProcessGPSDataWithReport.
+type ProcessingPhase struct {
+	Name     string
+	Duration int64 // ms
+}
+
+const (
+	PhasePrepare     = "prepare"
+	PhaseCleanup     = "cleanup"
+	PhaseStopDetect  = "stopDetection"
+	PhaseGeocoding   = "geocoding"
+	PhaseTracks      = "tracks"
+	PhaseTrackPoints = "trackPoints"
+	PhaseMapMatching = "mapMatching"
+	PhaseFusion      = "fusion"
+	PhaseTrips       = "trips"
+	PhaseGeoZones    = "geoZones"
+)
+
+// newProcessingReport returns an empty ProcessingReport for the given device and time range.
+func newProcessingReport(deviceId int, startTime int64, endTime int64) *ProcessingReport {
+	return &ProcessingReport{
+		DeviceId:      deviceId,
+		StartTime:     startTime,
+		EndTime:       endTime,
+		AddressErrors: make([]AddressError, 0),
+		Notifications: make([]*notificationManager.Notification, 0),
+		Phases:        make([]*ProcessingPhase, 0),
+	}
+}
+
+// addPhase adds the time since start to the phase with the given name. Does nothing for a nil report.
+func (r *ProcessingReport) addPhase(name string, start time.Time) {
+	if r == nil {
+		return
+	}
+	d := int64(time.Since(start) / time.Millisecond)
+	for _, p := range r.Phases {
+		if p.Name == name {
+			p.Duration += d
+			return
+		}
+	}
+	r.Phases = append(r.Phases, &ProcessingPhase{Name: name, Duration: d})
+}
+
+// MarshalJSON encodes the AddressError with its error message, as errors themselves have no JSON representation.
+func (e AddressError) MarshalJSON() ([]byte, error) {
+	msg := ""
+	if e.Error != nil {
+		msg = e.Error.Error()
+	}
+	var lat, lng float64
+	var t int64
+	if e.KeyPoint != nil {
+		lat, lng, t = e.KeyPoint.Latitude.Float64, e.KeyPoint.Longitude.Float64, e.KeyPoint.StartTime.Int64
+	}
+	return json.Marshal(struct {
+		Error     string
+		Latitude  float64
+		Longitude float64
+		StartTime int64
+	}{msg, lat, lng, t})
+}
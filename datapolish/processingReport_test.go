@@ -0,0 +1,143 @@
+package datapolish_test
+
+import (
+	"database/sql"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/datapolish"
+	"github.com/OpenDriversLog/goodl-lib/dbMan"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/addressManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/notificationManager"
+	"github.com/OpenDriversLog/goodl-lib/translate"
+)
+
+// reportTestStart is the time the test drive starts, far away from all other data in tests.db.
+const reportTestStart = int64(946684800000)
+
+// insertTestDrive inserts a driver, car & device with trackRecords of a stay, a drive of about 4 km and another stay.
+func insertTestDrive(dbCon *sql.DB) (deviceId int64, carId int64) {
+	res, err := dbCon.Exec("INSERT INTO Drivers (name) VALUES ('Berichtstest')")
+	Expect(err).To(BeNil())
+	driverId, _ := res.LastInsertId()
+	res, err = dbCon.Exec("INSERT INTO Cars (type, ownerId, plate) VALUES ('Testwagen', ?, 'DD-RT 29')", driverId)
+	Expect(err).To(BeNil())
+	carId, _ = res.LastInsertId()
+	res, err = dbCon.Exec("INSERT INTO Devices (desc, colorId, carId) VALUES ('Berichtstest', 1, ?)", carId)
+	Expect(err).To(BeNil())
+	deviceId, _ = res.LastInsertId()
+
+	t := reportTestStart
+	insert := func(lat float64, lng float64, speed float64) {
+		_, err := dbCon.Exec("INSERT INTO TrackRecords (deviceId, timeMillis, latitude, longitude, altitude, accuracy, provider, source, accuracyRating, speed) VALUES (?,?,?,?,100,10,'gps',0,0,?)",
+			deviceId, t, lat, lng, speed)
+		Expect(err).To(BeNil())
+		t += 30 * 1000
+	}
+	for i := 0; i < 20; i++ {
+		insert(51.05, 13.73, 0)
+	}
+	for i := 1; i < 20; i++ {
+		insert(51.05+0.002*float64(i), 13.73, 7.5)
+	}
+	for i := 0; i < 20; i++ {
+		insert(51.09, 13.73, 0)
+	}
+	return
+}
+
+// deleteTestDrive removes everything inserted by insertTestDrive & processing it.
+func deleteTestDrive(deviceId int64, carId int64, dbCon *sql.DB) {
+	for _, q := range []string{
+		"DELETE FROM GeocodeJobs WHERE keyPointId IN (SELECT _keyPointId FROM KeyPoints WHERE deviceId=?)",
+		"DELETE FROM NotificationData WHERE tripID IN (SELECT tripId FROM Tracks_Trips WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?))",
+		"DELETE FROM Trip_History WHERE tripId IN (SELECT tripId FROM Tracks_Trips WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?))",
+		"DELETE FROM Trips WHERE _tripId IN (SELECT tripId FROM Tracks_Trips WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?))",
+		"DELETE FROM Tracks_Trips WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?)",
+		"DELETE FROM Tracks_Trips_History WHERE trackIdNEW IN (SELECT _trackId FROM Tracks WHERE deviceId=?1) OR trackIdOLD IN (SELECT _trackId FROM Tracks WHERE deviceId=?1)",
+		"DELETE FROM TrackPoints WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?)",
+		"DELETE FROM TrackGaps WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?)",
+		"DELETE FROM SpeedingEvents WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?)",
+		"DELETE FROM HarshEvents WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?)",
+		"DELETE FROM ElevationProfiles WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?)",
+		"DELETE FROM TrackDevices WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?)",
+		"DELETE FROM Tracks WHERE deviceId=?",
+		"DELETE FROM Addresses WHERE _addressId IN (SELECT addressId FROM KeyPoints WHERE deviceId=?)",
+		"DELETE FROM KeyPoints WHERE deviceId=?",
+		"DELETE FROM TrackRecords WHERE deviceId=?",
+		"DELETE FROM Devices WHERE _deviceId=?",
+	} {
+		_, err := dbCon.Exec(q, deviceId)
+		Expect(err).To(BeNil())
+	}
+	_, err := dbCon.Exec("DELETE FROM Drivers WHERE _driverId=(SELECT ownerId FROM Cars WHERE _carId=?)", carId)
+	Expect(err).To(BeNil())
+	_, err = dbCon.Exec("DELETE FROM Cars WHERE _carId=?", carId)
+	Expect(err).To(BeNil())
+}
+
+var _ = Describe("ProcessingReport", func() {
+	var (
+		dbCon    *sql.DB
+		deviceId int64
+		carId    int64
+	)
+
+	BeforeEach(func() {
+		dbCon, _ = dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+		deviceId, carId = insertTestDrive(dbCon)
+	})
+
+	AfterEach(func() {
+		deleteTestDrive(deviceId, carId, dbCon)
+		dbCon.Close()
+	})
+
+	It("should report failed address lookups and create geocode jobs for them", func() {
+		config := datapolish.GetDefaultBatchConfig()
+		config.Geocoder = failingGeocoder{}
+		jobs := []datapolish.BatchJob{{DeviceId: int(deviceId), StartTime: reportTestStart, EndTime: reportTestStart + 3600*1000}}
+		report := datapolish.ProcessGPSDataBatch(jobs, config, 1, nil, &translate.Translater{}, dbCon)
+		Expect(report.Failed).To(Equal(0))
+		Expect(report.NewKeyPoints).To(BeNumerically(">=", 2))
+
+		res := report.Results[0].Report
+		Expect(res.AddressErrors).To(HaveLen(res.NewKeyPoints))
+		Expect(report.AddressErrors).To(Equal(res.NewKeyPoints))
+		for _, addrErr := range res.AddressErrors {
+			Expect(addrErr.Error).To(Equal(addressManager.ErrEmptyResult))
+		}
+
+		var jobCount int
+		err := dbCon.QueryRow("SELECT COUNT(*) FROM GeocodeJobs WHERE keyPointId IN (SELECT _keyPointId FROM KeyPoints WHERE deviceId=?)", deviceId).Scan(&jobCount)
+		Expect(err).To(BeNil())
+		Expect(jobCount).To(Equal(res.NewKeyPoints))
+	})
+
+	It("should not report existing notifications as created if nothing was processed", func() {
+		_, err := datapolish.ProcessGPSDataWithGeocoder(reportTestStart, reportTestStart+3600*1000, int(deviceId), false, 1, failingGeocoder{}, nil, &translate.Translater{}, dbCon)
+		Expect(err).To(BeNil())
+		active, err := notificationManager.GetActiveNotifications(true, dbCon)
+		Expect(err).To(BeNil())
+		Expect(active).NotTo(BeEmpty())
+
+		report, err := datapolish.ProcessGPSDataWithGeocoder(reportTestStart, reportTestStart+3600*1000, int(deviceId), false, 1, failingGeocoder{}, nil, &translate.Translater{}, dbCon)
+		Expect(err).To(Equal(datapolish.ErrGpsDataAlreadyImported))
+		Expect(report.Notifications).To(BeEmpty())
+	})
+})
+
+// failingGeocoder finds nothing anywhere.
+type failingGeocoder struct{}
+
+func (failingGeocoder) Name() string { return "failing" }
+
+func (failingGeocoder) Reverse(addr *addressManager.Address, lat float64, lng float64, uId int64) error {
+	addressManager.FillUnknownAddress(addr)
+	return addressManager.ErrEmptyResult
+}
+
+func (failingGeocoder) Forward(query string, uId int64) (*addressManager.Address, error) {
+	return nil, addressManager.ErrEmptyResult
+}
@@ -0,0 +1,171 @@
+package datapolish
+
+import (
+	"math"
+	"sort"
+
+	"github.com/Compufreak345/dbg"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	. "github.com/OpenDriversLog/goodl-lib/models/geo"
+	"github.com/OpenDriversLog/goodl-lib/tools"
+)
+
+const ssTag = "glib/dp/speedStats.go"
+
+// speedSample is the speed (in km/h) driven between two Locations.
+type speedSample struct {
+	Speed    float64
+	Duration int64 // ms
+	// Index is the index of the later Location
+	Index int
+}
+
+type speedSamplesBySpeed []speedSample
+
+func (s speedSamplesBySpeed) Len() int           { return len(s) }
+func (s speedSamplesBySpeed) Less(i, j int) bool { return s[i].Speed < s[j].Speed }
+func (s speedSamplesBySpeed) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// speedSamples returns the speeds between all consecutive Locations, which should be sorted by time.
+// The speed reported by the device is preferred, otherwise it is calculated from the positions.
+// Implausible speeds and gaps longer than MaxTimeGap are left out.
+func speedSamples(raw []Location, config *LocationConfig) (samples []speedSample) {
+	defaults := GetDefaultLocationConfig()
+	maxTimeGap := int64(config.MaxTimeGap)
+	if maxTimeGap <= 0 {
+		maxTimeGap = int64(defaults.MaxTimeGap)
+	}
+	maxSpeed := float64(config.MaxPlausibleSpeed)
+	if maxSpeed <= 0 {
+		maxSpeed = float64(defaults.MaxPlausibleSpeed)
+	}
+	samples = make([]speedSample, 0, len(raw))
+	for i := 1; i < len(raw); i++ {
+		dt := raw[i].TimeMillis.Int64 - raw[i-1].TimeMillis.Int64
+		if dt <= 0 || dt > maxTimeGap {
+			continue
+		}
+		var speed float64
+		if raw[i].Speed.Valid && raw[i].Speed.Float64 > 0 {
+			speed = raw[i].Speed.Float64 * 3.6
+		} else {
+			speed = locationSpeed(raw[i-1], raw[i]) * 3.6
+		}
+		if math.IsInf(speed, 0) || math.IsNaN(speed) || speed > maxSpeed {
+			continue
+		}
+		samples = append(samples, speedSample{Speed: speed, Duration: dt, Index: i})
+	}
+	return
+}
+
+// CalcSpeedStats returns the maximum speed and the average & median speed while moving (faster than
+// MinMovingSpeed) for the given Locations, which should be sorted by time.
+func CalcSpeedStats(raw []Location, config *LocationConfig) (stats SpeedStats) {
+	if config == nil {
+		config = GetDefaultLocationConfig()
+	}
+	minMoving := float64(config.MinMovingSpeed)
+
+	moving := make([]speedSample, 0)
+	var sum float64
+	for _, s := range speedSamples(raw, config) {
+		if s.Speed > stats.MaxSpeed {
+			stats.MaxSpeed = s.Speed
+		}
+		if s.Speed < minMoving {
+			continue
+		}
+		moving = append(moving, s)
+		stats.MovingTime += s.Duration
+		sum += s.Speed * float64(s.Duration)
+	}
+	if stats.MovingTime == 0 {
+		return
+	}
+	stats.AvgMovingSpeed = sum / float64(stats.MovingTime)
+
+	// the median is weighted by time, so dense sampling at some parts does not distort it
+	sort.Sort(speedSamplesBySpeed(moving))
+	var passed int64
+	for _, s := range moving {
+		passed += s.Duration
+		if passed*2 >= stats.MovingTime {
+			stats.MedianSpeed = s.Speed
+			break
+		}
+	}
+	return
+}
+
+// DetectSpeedingEvents finds all times the speed stayed above SpeedingThreshold for at least MinSpeedingDuration
+// in the given Locations, which should be sorted by time.
+func DetectSpeedingEvents(raw []Location, config *LocationConfig) (events []*SpeedingEvent) {
+	if config == nil {
+		config = GetDefaultLocationConfig()
+	}
+	defaults := GetDefaultLocationConfig()
+	threshold := float64(config.SpeedingThreshold)
+	if threshold <= 0 {
+		threshold = float64(defaults.SpeedingThreshold)
+	}
+	minDuration := int64(config.MinSpeedingDuration)
+	if minDuration <= 0 {
+		minDuration = int64(defaults.MinSpeedingDuration)
+	}
+
+	events = make([]*SpeedingEvent, 0)
+	var cur *SpeedingEvent
+	lastIdx := -1
+	finish := func() {
+		if cur != nil && cur.EndTime-cur.StartTime >= minDuration {
+			events = append(events, cur)
+		}
+		cur = nil
+	}
+	for _, s := range speedSamples(raw, config) {
+		if s.Speed <= threshold || (cur != nil && s.Index != lastIdx+1) {
+			finish()
+		}
+		if s.Speed > threshold {
+			loc := raw[s.Index]
+			if cur == nil {
+				cur = &SpeedingEvent{StartTime: raw[s.Index-1].TimeMillis.Int64, Threshold: threshold}
+			}
+			cur.EndTime = loc.TimeMillis.Int64
+			if s.Speed > cur.PeakSpeed {
+				cur.PeakSpeed = s.Speed
+				cur.Lat = loc.Latitude.Float64
+				cur.Lng = loc.Longitude.Float64
+			}
+		}
+		lastIdx = s.Index
+	}
+	finish()
+	return
+}
+
+// StoreTrackSpeed calculates the speed statistics & speeding events of the given track from the
+// Locations between startTime and endTime and saves them.
+func StoreTrackSpeed(trackId int64, startTime int64, endTime int64, raw []Location, config *LocationConfig, dbCon tools.DbRunner) (err error) {
+	first := sort.Search(len(raw), func(i int) bool { return raw[i].TimeMillis.Int64 >= startTime })
+	last := sort.Search(len(raw), func(i int) bool { return raw[i].TimeMillis.Int64 > endTime })
+	locs := raw[first:last]
+
+	stats := CalcSpeedStats(locs, config)
+	_, err = dbCon.Exec("UPDATE Tracks SET maxSpeed=?,avgMovingSpeed=?,medianSpeed=?,movingTime=? WHERE _trackId=?",
+		stats.MaxSpeed, stats.AvgMovingSpeed, stats.MedianSpeed, stats.MovingTime, trackId)
+	if err != nil {
+		dbg.E(ssTag, "Failed to update speed of track %d : ", trackId, err)
+		return
+	}
+	for _, e := range DetectSpeedingEvents(locs, config) {
+		_, err = dbCon.Exec(`INSERT INTO SpeedingEvents (trackId, startTime, endTime, peakSpeed, latitude, longitude, threshold)
+VALUES (?,?,?,?,?,?,?)`, trackId, e.StartTime, e.EndTime, e.PeakSpeed, e.Lat, e.Lng, e.Threshold)
+		if err != nil {
+			dbg.E(ssTag, "Failed to insert speeding event for track %d : ", trackId, err)
+			return
+		}
+	}
+	return
+}
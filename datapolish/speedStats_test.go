@@ -0,0 +1,50 @@
+package datapolish_test
+
+import (
+	"database/sql"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/datapolish"
+)
+
+var _ = Describe("SpeedStats", func() {
+	config := datapolish.GetDefaultLocationConfig()
+	config.MinSpeedingDuration = 20 * 1000
+
+	highway := newTrace(stopA.Lat, stopA.Lng).stay(300, 10, 5, 10).
+		drive(stopL.Lat, stopL.Lng, 14, 5).drive(stopB.Lat, stopB.Lng, 40, 5).
+		drive(stopC.Lat, stopC.Lng, 14, 5).stay(300, 10, 5, 10).locs
+
+	It("should calculate the speeds while moving", func() {
+		stats := datapolish.CalcSpeedStats(highway, config)
+		Expect(stats.MaxSpeed).To(BeNumerically("~", 160, 1))
+		Expect(stats.MedianSpeed).To(BeNumerically("~", 50.5, 1))
+		Expect(stats.AvgMovingSpeed).To(BeNumerically(">", stats.MedianSpeed))
+		Expect(stats.AvgMovingSpeed).To(BeNumerically("<", stats.MaxSpeed))
+		Expect(stats.MovingTime).To(BeNumerically("~", 250*1000, 10*1000))
+	})
+
+	It("should report sustained speeding only", func() {
+		events := datapolish.DetectSpeedingEvents(highway, config)
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].EndTime - events[0].StartTime).To(Equal(int64(25 * 1000)))
+		Expect(events[0].PeakSpeed).To(BeNumerically("~", 160, 1))
+		Expect(events[0].Lat).To(BeNumerically(">", stopL.Lat))
+		Expect(events[0].Threshold).To(Equal(float64(config.SpeedingThreshold)))
+
+		short := *config
+		short.MinSpeedingDuration = 30 * 1000
+		Expect(datapolish.DetectSpeedingEvents(highway, &short)).To(BeEmpty())
+	})
+
+	It("should prefer the speed reported by the device", func() {
+		trace := newTrace(stopA.Lat, stopA.Lng).drive(stopB.Lat, stopB.Lng, 14, 5).locs
+		for i := range trace {
+			trace[i].Speed = sql.NullFloat64{Float64: 37.5, Valid: true}
+		}
+		Expect(datapolish.CalcSpeedStats(trace, config).MaxSpeed).To(BeNumerically("~", 135, 0.01))
+		Expect(datapolish.DetectSpeedingEvents(trace, config)).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,428 @@
+package datapolish
+
+import (
+	"errors"
+	"sort"
+
+	geo "github.com/kellydunn/golang-geo"
+
+	"github.com/Compufreak345/dbg"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	. "github.com/OpenDriversLog/goodl-lib/models/geo"
+)
+
+const sdTag = "glib/dp/stopDetection.go"
+
+// Names of the available StopDetectors, as stored in Devices.stopDetector.
+const (
+	StopDetectorDefault    = "default"
+	StopDetectorSTDBSCAN   = "stdbscan"
+	StopDetectorSpeedDwell = "speeddwell"
+)
+
+var ErrNoLocations = errors.New("FindKeyPoints: got no correct locations-array")
+
+// StopDetector finds the stops (KeyPoints) in the Locations of a device.
+type StopDetector interface {
+	// Name returns the name the detector is selected by.
+	Name() string
+	// DetectStops returns the KeyPoints (without addresses) for the given Locations,
+	// which are sorted by time and are from the same device.
+	// The first and the last Location are always part of a KeyPoint.
+	DetectStops(raw []Location, config *LocationConfig) ([]*KeyPoint, error)
+}
+
+// GetStopDetector returns the StopDetector with the given name, falling back to the DefaultStopDetector.
+func GetStopDetector(name string) StopDetector {
+	switch name {
+	case StopDetectorSTDBSCAN:
+		return &STDBSCANStopDetector{}
+	case StopDetectorSpeedDwell:
+		return &SpeedDwellStopDetector{}
+	case StopDetectorDefault, "":
+	default:
+		dbg.W(sdTag, "Unknown StopDetector %s, using default", name)
+	}
+	return &DefaultStopDetector{}
+}
+
+// GetStopDetectorNames returns the names of all available StopDetectors.
+func GetStopDetectorNames() []string {
+	return []string{StopDetectorDefault, StopDetectorSTDBSCAN, StopDetectorSpeedDwell}
+}
+
+// DefaultStopDetector detects a stop when the device moved more than MinMoveDist and did not move back
+// with the next point, after staying at least MinMoveTime at the previous position.
+type DefaultStopDetector struct{}
+
+// Name implements StopDetector.
+func (d *DefaultStopDetector) Name() string {
+	return StopDetectorDefault
+}
+
+// DetectStops implements StopDetector.
+func (d *DefaultStopDetector) DetectStops(raw []Location, config *LocationConfig) ([]*KeyPoint, error) {
+	keyPoints := make([]*KeyPoint, 0)
+	candidates := make([]Location, 0)
+	var p *geo.Point
+	var lastLocation Location
+	var currentLocation Location
+	isFirst := true
+	inaccuratePoints := 0 // not sure what we could use this for...
+
+	if raw == nil || len(raw) < 1 {
+		return nil, ErrNoLocations
+	}
+
+	// set up first Points to compare
+	currentLocation = (raw)[0]
+	lastLocation = currentLocation
+	var nextLocation *Location
+	p = geo.NewPoint(0, 0)
+	lastPoint := p
+
+	// assume 1st point is candidate for keyPoint (because we started here)...
+	candidates = append(candidates, raw[0])
+	pointCount := len(raw)
+
+	for idx := 1; idx < pointCount; idx++ { // start going through the raw points
+		currentLocation = (raw)[idx]
+
+		if pointCount == idx+1 {
+			nextLocation = nil
+		} else {
+			nextLocation = &(raw[idx+1])
+		}
+		if currentLocation.Accuracy.Float64 > float64(config.AccuracyThreshold) {
+			inaccuratePoints++
+			continue // dont worry about inaccurate points at all
+		}
+
+		// check distance
+		p = geo.NewPoint(currentLocation.Latitude.Float64, currentLocation.Longitude.Float64)
+		lastPoint = geo.NewPoint(lastLocation.Latitude.Float64, lastLocation.Longitude.Float64)
+
+		dist := p.GreatCircleDistance(lastPoint) * 1000
+
+		if float64(config.MinMoveDist) < dist &&
+			currentLocation.Accuracy.Float64 < dist && lastLocation.Accuracy.Float64 < dist &&
+			(nextLocation == nil ||
+				(lastPoint.GreatCircleDistance(geo.NewPoint(nextLocation.Latitude.Float64, nextLocation.Longitude.Float64))*1000 > float64(config.MinMoveDist) &&
+					currentLocation.TimeMillis.Int64-nextLocation.TimeMillis.Int64 < 1000*60)) { // we moved and did not move back again in the next point (if during one minute)
+			if len(candidates) > 0 {
+				// create a keypoint from the candidates
+				if int64(config.MinMoveTime) < (currentLocation.TimeMillis.Int64-candidates[0].TimeMillis.Int64) || isFirst { // firstKeyPoint of track does not need to have minMoveTime
+					newKP := interpolateLocationsToKeyPoint(candidates)
+					// set the endtime to the time of the point that was distant - this is not 100% accurate, but we can't get it 100% accurate :/
+					newKP.EndTime = currentLocation.TimeMillis
+					keyPoints = append(keyPoints, newKP)
+
+					isFirst = false
+
+				} // stay time > minMoveTime
+			} //  we have candidates
+			candidates = make([]Location, 0)
+			candidates = append(candidates, currentLocation)
+			lastLocation = currentLocation
+		} else { // we did NOT move since last time
+			candidates = append(candidates, currentLocation)
+		}
+	} // we're done iterating
+
+	// check if there are candidates left, which weren't made a keypoint yet
+	// the last fix should be (part of) a KeyPoint too
+	if len(candidates) > 0 { // create a keypoint from the candidates
+		newKP := interpolateLocationsToKeyPoint(candidates)
+		keyPoints = append(keyPoints, newKP)
+	} else {
+		keyPoints[len(keyPoints)-1].EndTime = (raw)[len(raw)-1].TimeMillis
+	}
+
+	dbg.I(sdTag, "DefaultStopDetector: found %d inaccureate and %d keypoints...", inaccuratePoints, len(keyPoints))
+	return keyPoints, nil
+}
+
+// STDBSCANStopDetector detects stops by spatio-temporal density based clustering (ST-DBSCAN).
+// A Location is a core point if at least MinPoints Locations within Eps meters and TimeEps milliseconds
+// cover at least MinCoreTime milliseconds. Clusters lasting at least MinMoveTime are stops.
+// Zero values are replaced by defaults derived from the LocationConfig.
+type STDBSCANStopDetector struct {
+	Eps         float64 // meters, default MinMoveDist/2
+	TimeEps     int64   // milliseconds, default MinMoveTime
+	MinPoints   int     // default 3
+	MinCoreTime int64   // milliseconds, default MinMoveTime/3
+}
+
+// Name implements StopDetector.
+func (d *STDBSCANStopDetector) Name() string {
+	return StopDetectorSTDBSCAN
+}
+
+// DetectStops implements StopDetector.
+func (d *STDBSCANStopDetector) DetectStops(raw []Location, config *LocationConfig) ([]*KeyPoint, error) {
+	if len(raw) < 1 {
+		return nil, ErrNoLocations
+	}
+	eps := d.Eps
+	if eps <= 0 {
+		eps = float64(config.MinMoveDist) / 2
+	}
+	timeEps := d.TimeEps
+	if timeEps <= 0 {
+		timeEps = int64(config.MinMoveTime)
+	}
+	minPoints := d.MinPoints
+	if minPoints <= 0 {
+		minPoints = 3
+	}
+	minCoreTime := d.MinCoreTime
+	if minCoreTime <= 0 {
+		minCoreTime = int64(config.MinMoveTime) / 3
+	}
+
+	acc := accurateLocationIndexes(raw, config)
+	// neighbours returns the positions (in acc) of all Locations within eps and timeEps of acc[i], including itself
+	neighbours := func(i int) []int {
+		res := []int{i}
+		li := raw[acc[i]]
+		for j := i - 1; j >= 0 && li.TimeMillis.Int64-raw[acc[j]].TimeMillis.Int64 <= timeEps; j-- {
+			if locationDistance(li, raw[acc[j]]) <= eps {
+				res = append(res, j)
+			}
+		}
+		for j := i + 1; j < len(acc) && raw[acc[j]].TimeMillis.Int64-li.TimeMillis.Int64 <= timeEps; j++ {
+			if locationDistance(li, raw[acc[j]]) <= eps {
+				res = append(res, j)
+			}
+		}
+		return res
+	}
+	isCore := func(nb []int) bool {
+		if len(nb) < minPoints {
+			return false
+		}
+		minT, maxT := raw[acc[nb[0]]].TimeMillis.Int64, raw[acc[nb[0]]].TimeMillis.Int64
+		for _, j := range nb {
+			t := raw[acc[j]].TimeMillis.Int64
+			if t < minT {
+				minT = t
+			}
+			if t > maxT {
+				maxT = t
+			}
+		}
+		return maxT-minT >= minCoreTime
+	}
+
+	const unvisited, noise = 0, -1
+	labels := make([]int, len(acc))
+	cluster := 0
+	for i := range acc {
+		if labels[i] != unvisited {
+			continue
+		}
+		nb := neighbours(i)
+		if !isCore(nb) {
+			labels[i] = noise
+			continue
+		}
+		cluster++
+		labels[i] = cluster
+		queue := nb
+		for len(queue) > 0 {
+			j := queue[0]
+			queue = queue[1:]
+			if labels[j] == noise {
+				labels[j] = cluster // border point
+			}
+			if labels[j] != unvisited {
+				continue
+			}
+			labels[j] = cluster
+			if jnb := neighbours(j); isCore(jnb) {
+				queue = append(queue, jnb...)
+			}
+		}
+	}
+
+	// every cluster becomes the index range it covers in raw
+	ranges := make(map[int]*stopSegment)
+	for i, l := range labels {
+		if l <= 0 {
+			continue
+		}
+		if s, ok := ranges[l]; ok {
+			s.last = acc[i]
+		} else {
+			ranges[l] = &stopSegment{first: acc[i], last: acc[i]}
+		}
+	}
+	segments := make([]stopSegment, 0, len(ranges))
+	for _, s := range ranges {
+		if raw[s.last].TimeMillis.Int64-raw[s.first].TimeMillis.Int64 >= int64(config.MinMoveTime) {
+			segments = append(segments, *s)
+		}
+	}
+	// no density without points - standing still while not recording is a stop too
+	for n := 1; n < len(acc); n++ {
+		prev, cur := raw[acc[n-1]], raw[acc[n]]
+		if cur.TimeMillis.Int64-prev.TimeMillis.Int64 >= int64(config.MinMoveTime) && locationDistance(prev, cur) <= float64(config.MinMoveDist) {
+			segments = append(segments, stopSegment{first: acc[n-1], last: acc[n]})
+		}
+	}
+	keyPoints := buildKeyPointsFromStops(raw, mergeStopSegments(segments), config)
+	dbg.I(sdTag, "STDBSCANStopDetector: found %d clusters and %d keypoints...", cluster, len(keyPoints))
+	return keyPoints, nil
+}
+
+// SpeedDwellStopDetector detects a stop when the device is slower than MaxStopSpeed and then stays
+// within MinMoveDist of the center of its positions for at least MinMoveTime.
+type SpeedDwellStopDetector struct {
+	MaxStopSpeed float64 // meters per second, default 1.5
+}
+
+// Name implements StopDetector.
+func (d *SpeedDwellStopDetector) Name() string {
+	return StopDetectorSpeedDwell
+}
+
+// DetectStops implements StopDetector.
+func (d *SpeedDwellStopDetector) DetectStops(raw []Location, config *LocationConfig) ([]*KeyPoint, error) {
+	if len(raw) < 1 {
+		return nil, ErrNoLocations
+	}
+	maxSpeed := d.MaxStopSpeed
+	if maxSpeed <= 0 {
+		maxSpeed = 1.5
+	}
+
+	acc := accurateLocationIndexes(raw, config)
+	segments := make([]stopSegment, 0)
+	seg := stopSegment{first: -1}
+	// the centroid of the current segment, positions scatter around it while standing
+	var cLat, cLng, cCount float64
+	startSegment := func(i int) {
+		seg = stopSegment{first: i, last: i}
+		cLat, cLng, cCount = raw[i].Latitude.Float64, raw[i].Longitude.Float64, 1
+	}
+	closeSegment := func() {
+		if seg.first >= 0 && raw[seg.last].TimeMillis.Int64-raw[seg.first].TimeMillis.Int64 >= int64(config.MinMoveTime) {
+			segments = append(segments, seg)
+		}
+		seg = stopSegment{first: -1}
+	}
+	for n, i := range acc {
+		cur := raw[i]
+		if seg.first >= 0 {
+			if haversineDistance(cLat, cLng, cur.Latitude.Float64, cur.Longitude.Float64) <= float64(config.MinMoveDist) {
+				seg.last = i
+				cLat = (cLat*cCount + cur.Latitude.Float64) / (cCount + 1)
+				cLng = (cLng*cCount + cur.Longitude.Float64) / (cCount + 1)
+				cCount++
+				continue
+			}
+			closeSegment()
+		}
+		speed := 0.0
+		if n > 0 {
+			prev := raw[acc[n-1]]
+			if dt := cur.TimeMillis.Int64 - prev.TimeMillis.Int64; dt > 0 {
+				speed = locationDistance(prev, cur) / (float64(dt) / 1000)
+			}
+		}
+		if speed <= maxSpeed {
+			if n > 0 && locationDistance(raw[acc[n-1]], cur) <= float64(config.MinMoveDist) {
+				// we were already standing at the previous point
+				startSegment(acc[n-1])
+				seg.last = i
+			} else {
+				startSegment(i)
+			}
+		}
+	}
+	closeSegment()
+
+	keyPoints := buildKeyPointsFromStops(raw, segments, config)
+	dbg.I(sdTag, "SpeedDwellStopDetector: found %d keypoints...", len(keyPoints))
+	return keyPoints, nil
+}
+
+// stopSegment is a stop covering the Locations raw[first] to raw[last].
+type stopSegment struct {
+	first int
+	last  int
+}
+
+type stopSegmentsByStart []stopSegment
+
+func (s stopSegmentsByStart) Len() int           { return len(s) }
+func (s stopSegmentsByStart) Less(i, j int) bool { return s[i].first < s[j].first }
+func (s stopSegmentsByStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// mergeStopSegments sorts the given segments and merges overlapping ones.
+func mergeStopSegments(segments []stopSegment) []stopSegment {
+	sort.Sort(stopSegmentsByStart(segments))
+	res := make([]stopSegment, 0, len(segments))
+	for _, s := range segments {
+		if len(res) > 0 && s.first <= res[len(res)-1].last {
+			if s.last > res[len(res)-1].last {
+				res[len(res)-1].last = s.last
+			}
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// buildKeyPointsFromStops creates the KeyPoints for the given (sorted) stops. The start and the end of raw
+// always become KeyPoints. The EndTime of a KeyPoint is the time of the first Location after the stop.
+func buildKeyPointsFromStops(raw []Location, stops []stopSegment, config *LocationConfig) []*KeyPoint {
+	keyPoints := make([]*KeyPoint, 0, len(stops)+2)
+	last := len(raw) - 1
+	if len(stops) == 0 || stops[0].first > 0 {
+		kp := interpolateLocationsToKeyPoint(raw[:1])
+		if last > 0 {
+			kp.EndTime = raw[1].TimeMillis
+		}
+		keyPoints = append(keyPoints, kp)
+	}
+	for _, s := range stops {
+		locs := make([]Location, 0, s.last-s.first+1)
+		for _, l := range raw[s.first : s.last+1] {
+			if l.Accuracy.Float64 <= float64(config.AccuracyThreshold) {
+				locs = append(locs, l)
+			}
+		}
+		if len(locs) == 0 {
+			locs = raw[s.first : s.last+1]
+		}
+		kp := interpolateLocationsToKeyPoint(locs)
+		if s.last < last {
+			kp.EndTime = raw[s.last+1].TimeMillis
+		} else {
+			kp.EndTime = raw[last].TimeMillis
+		}
+		keyPoints = append(keyPoints, kp)
+	}
+	if len(stops) == 0 || stops[len(stops)-1].last < last {
+		keyPoints = append(keyPoints, interpolateLocationsToKeyPoint(raw[last:]))
+	}
+	return keyPoints
+}
+
+// accurateLocationIndexes returns the indexes of all Locations with an accuracy within the AccuracyThreshold.
+func accurateLocationIndexes(raw []Location, config *LocationConfig) []int {
+	res := make([]int, 0, len(raw))
+	for i, l := range raw {
+		if l.Accuracy.Float64 <= float64(config.AccuracyThreshold) {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// locationDistance returns the distance between two Locations in meters.
+func locationDistance(a Location, b Location) float64 {
+	return haversineDistance(a.Latitude.Float64, a.Longitude.Float64, b.Latitude.Float64, b.Longitude.Float64)
+}
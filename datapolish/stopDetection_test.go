@@ -0,0 +1,162 @@
+package datapolish_test
+
+import (
+	"database/sql"
+	"math"
+
+	geo "github.com/kellydunn/golang-geo"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/datapolish"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+)
+
+// traceBuilder creates synthetic traces for the stop detection corpus.
+type traceBuilder struct {
+	lat  float64
+	lng  float64
+	time int64
+	locs []Location
+	// jitter is used to create deterministic noise while standing
+	jitter int
+}
+
+func newTrace(lat float64, lng float64) *traceBuilder {
+	return &traceBuilder{lat: lat, lng: lng, time: 1457680000000}
+}
+
+func (t *traceBuilder) add(lat float64, lng float64, accuracy float64) {
+	t.locs = append(t.locs, Location{
+		Id:         sql.NullInt64{Int64: int64(len(t.locs) + 1), Valid: true},
+		TimeMillis: sql.NullInt64{Int64: t.time, Valid: true},
+		Latitude:   sql.NullFloat64{Float64: lat, Valid: true},
+		Longitude:  sql.NullFloat64{Float64: lng, Valid: true},
+		Accuracy:   sql.NullFloat64{Float64: accuracy, Valid: true},
+	})
+}
+
+// stay adds points every interval seconds for the given duration (seconds), scattered up to noise meters.
+func (t *traceBuilder) stay(duration int64, interval int64, noise float64, accuracy float64) *traceBuilder {
+	for s := int64(0); s < duration; s += interval {
+		t.jitter++
+		dLat := noise * math.Sin(float64(t.jitter)*2.3) / 111195
+		dLng := noise * math.Cos(float64(t.jitter)*1.7) / (111195 * math.Cos(t.lat*math.Pi/180))
+		t.add(t.lat+dLat, t.lng+dLng, accuracy)
+		t.time += interval * 1000
+	}
+	return t
+}
+
+// drive adds points every interval seconds while driving straight to the given position with the given speed (m/s).
+func (t *traceBuilder) drive(lat float64, lng float64, speed float64, interval int64) *traceBuilder {
+	dist := geo.NewPoint(t.lat, t.lng).GreatCircleDistance(geo.NewPoint(lat, lng)) * 1000
+	steps := int(dist / (speed * float64(interval)))
+	for s := 1; s <= steps; s++ {
+		f := float64(s) / float64(steps)
+		t.time += interval * 1000
+		t.add(t.lat+f*(lat-t.lat), t.lng+f*(lng-t.lng), 10)
+	}
+	t.lat, t.lng = lat, lng
+	return t
+}
+
+// pause adds no points for the given duration (seconds), e.g. because the phone was turned off.
+func (t *traceBuilder) pause(duration int64) *traceBuilder {
+	t.time += duration * 1000
+	return t
+}
+
+type expectedStop struct {
+	Lat float64
+	Lng float64
+}
+
+type stopCorpusEntry struct {
+	Name     string
+	Trace    []Location
+	Expected []expectedStop
+}
+
+var (
+	stopA = expectedStop{50.8300, 12.9200}
+	stopB = expectedStop{50.8500, 12.9200}
+	stopC = expectedStop{50.8500, 12.9500}
+	stopL = expectedStop{50.8400, 12.9200} // traffic light
+)
+
+// stopDetectionCorpus is shared by all StopDetectors.
+var stopDetectionCorpus = []stopCorpusEntry{
+	{
+		Name: "two trips with a long stop",
+		Trace: newTrace(stopA.Lat, stopA.Lng).stay(300, 10, 5, 10).
+			drive(stopB.Lat, stopB.Lng, 14, 5).stay(900, 10, 5, 10).
+			drive(stopC.Lat, stopC.Lng, 14, 5).stay(300, 10, 5, 10).locs,
+		Expected: []expectedStop{stopA, stopB, stopC},
+	},
+	{
+		Name: "waiting at a traffic light is no stop",
+		Trace: newTrace(stopA.Lat, stopA.Lng).stay(300, 10, 5, 10).
+			drive(stopL.Lat, stopL.Lng, 14, 2).stay(90, 2, 2, 5).
+			drive(stopB.Lat, stopB.Lng, 14, 2).stay(300, 10, 5, 10).locs,
+		Expected: []expectedStop{stopA, stopB},
+	},
+	{
+		Name: "parking garage with poor reception is one stop",
+		Trace: newTrace(stopA.Lat, stopA.Lng).stay(300, 10, 5, 10).
+			drive(stopB.Lat, stopB.Lng, 14, 5).stay(1800, 20, 45, 40).
+			drive(stopC.Lat, stopC.Lng, 14, 5).stay(300, 10, 5, 10).locs,
+		Expected: []expectedStop{stopA, stopB, stopC},
+	},
+	{
+		Name: "phone turned off while parking",
+		Trace: newTrace(stopA.Lat, stopA.Lng).stay(300, 10, 5, 10).
+			drive(stopB.Lat, stopB.Lng, 14, 5).pause(3600).stay(20, 10, 5, 10).
+			drive(stopC.Lat, stopC.Lng, 14, 5).stay(300, 10, 5, 10).locs,
+		Expected: []expectedStop{stopA, stopB, stopC},
+	},
+}
+
+var _ = Describe("StopDetection", func() {
+	config := datapolish.GetDefaultLocationConfig()
+
+	for _, name := range datapolish.GetStopDetectorNames() {
+		name := name
+		detector := datapolish.GetStopDetector(name)
+		Describe(name, func() {
+			It("should be returned by its name", func() {
+				Expect(detector.Name()).To(Equal(name))
+			})
+
+			for _, entry := range stopDetectionCorpus {
+				entry := entry
+				It("should find the expected keypoints for trace '"+entry.Name+"'", func() {
+					kps, err := detector.DetectStops(entry.Trace, config)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(kps).To(HaveLen(len(entry.Expected)))
+					for i, kp := range kps {
+						p := geo.NewPoint(kp.Latitude.Float64, kp.Longitude.Float64)
+						dist := p.GreatCircleDistance(geo.NewPoint(entry.Expected[i].Lat, entry.Expected[i].Lng)) * 1000
+						Expect(dist).To(BeNumerically("<", float64(config.MinMoveDist)), "keypoint %d", i)
+						Expect(kp.EndTime.Int64).To(BeNumerically(">=", kp.StartTime.Int64))
+						if i > 0 {
+							Expect(kp.StartTime.Int64).To(BeNumerically(">=", kps[i-1].EndTime.Int64))
+						}
+					}
+				})
+			}
+		})
+	}
+
+	It("should fall back to the default detector for unknown names", func() {
+		Expect(datapolish.GetStopDetector("unknown").Name()).To(Equal(datapolish.StopDetectorDefault))
+		Expect(datapolish.GetStopDetector("").Name()).To(Equal(datapolish.StopDetectorDefault))
+	})
+
+	It("should fail without locations", func() {
+		for _, name := range datapolish.GetStopDetectorNames() {
+			_, err := datapolish.GetStopDetector(name).DetectStops(nil, config)
+			Expect(err).To(Equal(datapolish.ErrNoLocations))
+		}
+	})
+})
@@ -0,0 +1,257 @@
+package datapolish
+
+import (
+	"database/sql"
+	"sort"
+
+	"github.com/Compufreak345/dbg"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+)
+
+const tnTag = "glib/dp/timeNormalization.go"
+
+// ProviderGPS is the provider of Locations with timestamps from the GPS clock instead of the device clock.
+const ProviderGPS = "gps"
+
+// providerOffsetWindow is the maximum time (in milliseconds) between two GPS Locations to estimate the
+// offset of the device clock from the Locations uploaded between them.
+const providerOffsetWindow = 20 * 1000
+
+// ClockOffsetThreshold is the offset (in milliseconds) between device & GPS clock above which we correct
+// the timestamps of non-GPS Locations.
+var ClockOffsetThreshold int64 = 15 * 1000
+
+// FutureTolerance is the time (in milliseconds) Locations may be newer than their upload before we assume
+// the device clock to be ahead.
+var FutureTolerance int64 = 60 * 1000
+
+// TimeCorrection describes how NormalizeTrackRecords corrected the timestamps of an upload.
+type TimeCorrection struct {
+	DeviceId   int
+	UploadTime int64
+	// Records is the count of uploaded Locations
+	Records int
+	MinTime int64
+	MaxTime int64
+	// ClockOffset is the time (in milliseconds) added to non-GPS Locations because the device clock was ahead
+	ClockOffset int64
+	// ProviderOffset is the time (in milliseconds) added to non-GPS Locations to match the GPS clock
+	ProviderOffset int64
+	// Reordered is the count of Locations uploaded out of order
+	Reordered int
+	// DroppedRepeats is the count of Locations dropped because they were uploaded twice, or before (see DropStoredRepeats)
+	DroppedRepeats int
+}
+
+// NormalizeTrackRecords corrects the timestamps of the given Locations, which need to be in upload order,
+// and returns them sorted by time without exact repeats. uploadTime (unix millis, ignored if 0) is used to
+// detect device clocks running ahead. The Ids of the Locations are kept, so they can be mapped to their source.
+//  1. the timestamps of Locations of other known providers are corrected by the median offset to the GPS Locations
+//     uploaded around them
+//  2. the timestamps of non-GPS Locations are moved back if the newest one is after the upload, the GPS clock is right
+//  3. the Locations are sorted by time and exact repeats (same time & position) within the upload are dropped
+func NormalizeTrackRecords(locs []Location, uploadTime int64) (res []Location, c *TimeCorrection) {
+	c = &TimeCorrection{UploadTime: uploadTime, Records: len(locs)}
+	res = make([]Location, len(locs))
+	copy(res, locs)
+	if len(res) == 0 {
+		return
+	}
+
+	if offset := providerClockOffset(res); offset > ClockOffsetThreshold || offset < -ClockOffsetThreshold {
+		c.ProviderOffset = -offset
+		for i := range res {
+			if hasProviderOffset(&res[i]) {
+				res[i].TimeMillis.Int64 -= offset
+			}
+		}
+	}
+
+	maxTime := res[0].TimeMillis.Int64
+	var maxDeviceTime int64
+	for i, l := range res {
+		if i != 0 && l.TimeMillis.Int64 < maxTime {
+			c.Reordered++
+		}
+		if l.TimeMillis.Int64 > maxTime {
+			maxTime = l.TimeMillis.Int64
+		}
+		if l.Provider.String != ProviderGPS && l.TimeMillis.Int64 > maxDeviceTime {
+			maxDeviceTime = l.TimeMillis.Int64
+		}
+	}
+	if uploadTime > 0 && maxDeviceTime > uploadTime+FutureTolerance {
+		c.ClockOffset = uploadTime - maxDeviceTime
+		for i := range res {
+			if res[i].Provider.String != ProviderGPS {
+				res[i].TimeMillis.Int64 += c.ClockOffset
+			}
+		}
+	}
+
+	sort.Stable(locationsByTime(res))
+	unique := res[:1]
+	for _, l := range res[1:] {
+		last := unique[len(unique)-1]
+		if l.TimeMillis.Int64 == last.TimeMillis.Int64 && l.Latitude.Float64 == last.Latitude.Float64 &&
+			l.Longitude.Float64 == last.Longitude.Float64 {
+			c.DroppedRepeats++
+			continue
+		}
+		unique = append(unique, l)
+	}
+	res = unique
+	c.MinTime = res[0].TimeMillis.Int64
+	c.MaxTime = res[len(res)-1].TimeMillis.Int64
+	return
+}
+
+// providerClockOffset returns the median offset (in milliseconds) of the non-GPS Locations to the middle of
+// the GPS Locations uploaded before & after them, 0 if there are not enough of them.
+func providerClockOffset(locs []Location) int64 {
+	offsets := make([]int64, 0)
+	prevGps := -1
+	for i := range locs {
+		if locs[i].Provider.String != ProviderGPS {
+			continue
+		}
+		if prevGps >= 0 && i-prevGps > 1 {
+			before, after := locs[prevGps].TimeMillis.Int64, locs[i].TimeMillis.Int64
+			if after >= before && after-before <= providerOffsetWindow {
+				for j := prevGps + 1; j < i; j++ {
+					if hasProviderOffset(&locs[j]) {
+						offsets = append(offsets, locs[j].TimeMillis.Int64-(before+after)/2)
+					}
+				}
+			}
+		}
+		prevGps = i
+	}
+	if len(offsets) < 3 {
+		return 0
+	}
+	sort.Sort(int64s(offsets))
+	return offsets[len(offsets)/2]
+}
+
+// hasProviderOffset returns if the given Location is corrected by the ProviderOffset: Locations of known providers
+// other than GPS. Without a provider we can't tell which clock the timestamp is from.
+func hasProviderOffset(l *Location) bool {
+	return l.Provider.String != "" && l.Provider.String != ProviderGPS
+}
+
+type locationsByTime []Location
+
+func (l locationsByTime) Len() int           { return len(l) }
+func (l locationsByTime) Less(i, j int) bool { return l[i].TimeMillis.Int64 < l[j].TimeMillis.Int64 }
+func (l locationsByTime) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// DropStoredRepeats drops the Locations of the given device which are already stored in TrackRecords with the same
+// time & position, e.g. because an upload was repeated after a lost answer, and counts them in c.DroppedRepeats.
+// The time uploaded by the device is compared, as a repeated upload may be corrected differently (the ClockOffset
+// depends on the time of the upload) - deviceTimes are the uploaded times of locs in the same order. Records stored
+// without their uploaded time are compared by their corrected time.
+// locs need to be sorted by time, see NormalizeTrackRecords.
+func DropStoredRepeats(deviceId int, locs []Location, deviceTimes []int64, c *TimeCorrection, dbCon *sql.DB) (res []Location, err error) {
+	res = locs
+	if len(locs) == 0 {
+		return
+	}
+	minDeviceTime, maxDeviceTime := deviceTimes[0], deviceTimes[0]
+	for _, t := range deviceTimes {
+		if t < minDeviceTime {
+			minDeviceTime = t
+		}
+		if t > maxDeviceTime {
+			maxDeviceTime = t
+		}
+	}
+	rows, err := dbCon.Query(`SELECT deviceTimeMillis, timeMillis, latitude, longitude FROM TrackRecords WHERE deviceId=?
+		AND (deviceTimeMillis BETWEEN ? AND ? OR (deviceTimeMillis IS NULL AND timeMillis BETWEEN ? AND ?))`,
+		deviceId, minDeviceTime, maxDeviceTime, locs[0].TimeMillis.Int64, locs[len(locs)-1].TimeMillis.Int64)
+	if err != nil {
+		dbg.E(tnTag, "Failed to get stored TrackRecords of device %d : ", deviceId, err)
+		return
+	}
+	defer rows.Close()
+	type recordKey struct {
+		time     int64
+		lat, lng float64
+	}
+	// by the uploaded time and - for records stored without it - by the corrected time
+	byDeviceTime := make(map[recordKey]bool)
+	byTime := make(map[recordKey]bool)
+	for rows.Next() {
+		var deviceTime sql.NullInt64
+		var k recordKey
+		err = rows.Scan(&deviceTime, &k.time, &k.lat, &k.lng)
+		if err != nil {
+			dbg.E(tnTag, "Failed to scan stored TrackRecord of device %d : ", deviceId, err)
+			return
+		}
+		if deviceTime.Valid {
+			k.time = deviceTime.Int64
+			byDeviceTime[k] = true
+		} else {
+			byTime[k] = true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if len(byDeviceTime) == 0 && len(byTime) == 0 {
+		return
+	}
+	res = make([]Location, 0, len(locs))
+	for i, l := range locs {
+		if byDeviceTime[recordKey{deviceTimes[i], l.Latitude.Float64, l.Longitude.Float64}] ||
+			byTime[recordKey{l.TimeMillis.Int64, l.Latitude.Float64, l.Longitude.Float64}] {
+			c.DroppedRepeats++
+			continue
+		}
+		res = append(res, l)
+	}
+	return
+}
+
+// StoreTimeCorrection saves the correction applied to an upload of the given device.
+func StoreTimeCorrection(deviceId int, c *TimeCorrection, dbCon *sql.DB) (err error) {
+	c.DeviceId = deviceId
+	_, err = dbCon.Exec(`INSERT INTO TrackRecordUploads (deviceId, uploadTime, records, minTime, maxTime, clockOffset,
+providerOffset, reordered, droppedRepeats) VALUES (?,?,?,?,?,?,?,?,?)`,
+		deviceId, c.UploadTime, c.Records, c.MinTime, c.MaxTime, c.ClockOffset, c.ProviderOffset, c.Reordered, c.DroppedRepeats)
+	if err != nil {
+		dbg.E(tnTag, "Failed to store time correction for device %d : ", deviceId, err)
+	}
+	return
+}
+
+// GetTimeCorrections returns the corrections applied to the uploads of the given device, newest first.
+func GetTimeCorrections(deviceId int, dbCon *sql.DB) (corrections []*TimeCorrection, err error) {
+	corrections = make([]*TimeCorrection, 0)
+	rows, err := dbCon.Query(`SELECT deviceId, uploadTime, records, minTime, maxTime, clockOffset, providerOffset, reordered,
+droppedRepeats FROM TrackRecordUploads WHERE deviceId=? ORDER BY uploadTime DESC`, deviceId)
+	if err != nil {
+		dbg.E(tnTag, "Failed to get time corrections for device %d : ", deviceId, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := &TimeCorrection{}
+		err = rows.Scan(&c.DeviceId, &c.UploadTime, &c.Records, &c.MinTime, &c.MaxTime, &c.ClockOffset, &c.ProviderOffset,
+			&c.Reordered, &c.DroppedRepeats)
+		if err != nil {
+			dbg.E(tnTag, "Failed to scan time correction : ", err)
+			return
+		}
+		corrections = append(corrections, c)
+	}
+	err = rows.Err()
+	return
+}
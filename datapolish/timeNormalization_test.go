@@ -0,0 +1,142 @@
+package datapolish_test
+
+import (
+	"database/sql"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/datapolish"
+	"github.com/OpenDriversLog/goodl-lib/dbMan"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+)
+
+var _ = Describe("TimeNormalization", func() {
+	const start = int64(1457680000000)
+
+	// upload returns Locations in upload order with the given providers (g for gps, n for network, - for none) &
+	// times (relative to start, in seconds)
+	upload := func(providers string, times ...int64) []Location {
+		locs := make([]Location, len(times))
+		for i, t := range times {
+			provider := "gps"
+			if providers[i] == 'n' {
+				provider = "network"
+			} else if providers[i] == '-' {
+				provider = ""
+			}
+			locs[i] = Location{
+				Id:         sql.NullInt64{Int64: int64(i), Valid: true},
+				TimeMillis: sql.NullInt64{Int64: start + t*1000, Valid: true},
+				Latitude:   sql.NullFloat64{Float64: stopA.Lat + float64(i)/10000, Valid: true},
+				Longitude:  sql.NullFloat64{Float64: stopA.Lng, Valid: true},
+				Provider:   sql.NullString{String: provider, Valid: true},
+			}
+		}
+		return locs
+	}
+	times := func(locs []Location) []int64 {
+		res := make([]int64, len(locs))
+		for i, l := range locs {
+			res[i] = (l.TimeMillis.Int64 - start) / 1000
+		}
+		return res
+	}
+
+	It("should sort records uploaded out of order and drop exact repeats", func() {
+		locs := upload("ggggg", 0, 10, 5, 15, 20)
+		locs = append(locs, locs[1])
+		res, c := datapolish.NormalizeTrackRecords(locs, 0)
+		Expect(times(res)).To(Equal([]int64{0, 5, 10, 15, 20}))
+		Expect(res[1].Id.Int64).To(Equal(int64(2)))
+		Expect(c.Records).To(Equal(6))
+		Expect(c.Reordered).To(Equal(2))
+		Expect(c.DroppedRepeats).To(Equal(1))
+		Expect(c.MinTime).To(Equal(start))
+		Expect(c.MaxTime).To(Equal(start + 20000))
+	})
+
+	It("should correct the device clock of network records by the gps time", func() {
+		// the device clock is 60 seconds ahead of the gps clock
+		res, c := datapolish.NormalizeTrackRecords(upload("gngngng", 0, 65, 10, 75, 20, 85, 30), 0)
+		Expect(c.ProviderOffset).To(Equal(int64(-60000)))
+		Expect(times(res)).To(Equal([]int64{0, 5, 10, 15, 20, 25, 30}))
+	})
+
+	It("should only correct records of known providers by the gps time", func() {
+		res, c := datapolish.NormalizeTrackRecords(upload("gngngng-", 0, 65, 10, 75, 20, 85, 30, 40), 0)
+		Expect(c.ProviderOffset).To(Equal(int64(-60000)))
+		Expect(times(res)).To(Equal([]int64{0, 5, 10, 15, 20, 25, 30, 40}))
+	})
+
+	It("should move records from the future back to the upload time", func() {
+		res, c := datapolish.NormalizeTrackRecords(upload("nnn", 0, 10, 20), start-100000)
+		Expect(c.ClockOffset).To(Equal(int64(-120000)))
+		Expect(times(res)).To(Equal([]int64{-120, -110, -100}))
+
+		_, c = datapolish.NormalizeTrackRecords(upload("nnn", 0, 10, 20), start)
+		Expect(c.ClockOffset).To(BeZero())
+	})
+
+	It("should not move gps records, as their clock is right", func() {
+		res, c := datapolish.NormalizeTrackRecords(upload("gn", 0, 200), start+60000)
+		Expect(c.ClockOffset).To(Equal(int64(-140000)))
+		Expect(times(res)).To(Equal([]int64{0, 60}))
+		Expect(res[0].Provider.String).To(Equal("gps"))
+
+		_, c = datapolish.NormalizeTrackRecords(upload("gg", 0, 200), start+60000)
+		Expect(c.ClockOffset).To(BeZero())
+	})
+
+	Describe("DropStoredRepeats", func() {
+		var (
+			dbCon    *sql.DB
+			deviceId int64
+			carId    int64
+		)
+
+		BeforeEach(func() {
+			dbCon, _ = dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+			deviceId, carId = insertTestDrive(dbCon)
+		})
+
+		AfterEach(func() {
+			deleteTestDrive(deviceId, carId, dbCon)
+			dbCon.Close()
+		})
+
+		It("should drop records uploaded before", func() {
+			stored := Location{TimeMillis: sql.NullInt64{Int64: reportTestStart + 30*1000, Valid: true},
+				Latitude: sql.NullFloat64{Float64: 51.05, Valid: true}, Longitude: sql.NullFloat64{Float64: 13.73, Valid: true}}
+			moved := stored
+			moved.Latitude.Float64 = 51.06
+			later := stored
+			later.TimeMillis.Int64 = reportTestStart - 30*1000
+
+			c := &datapolish.TimeCorrection{DroppedRepeats: 1}
+			deviceTimes := []int64{later.TimeMillis.Int64, stored.TimeMillis.Int64, moved.TimeMillis.Int64}
+			res, err := datapolish.DropStoredRepeats(int(deviceId), []Location{later, stored, moved}, deviceTimes, c, dbCon)
+			Expect(err).To(BeNil())
+			Expect(res).To(Equal([]Location{later, moved}))
+			Expect(c.DroppedRepeats).To(Equal(2))
+		})
+
+		It("should drop records uploaded before with another clock correction", func() {
+			// uploaded by the device at deviceTime and moved back by an hour the first time
+			deviceTime := reportTestStart + 2*3600*1000
+			_, err := dbCon.Exec("INSERT INTO TrackRecords (deviceId, timeMillis, deviceTimeMillis, latitude, longitude, altitude, accuracy, provider, source, accuracyRating, speed) VALUES (?,?,?,51.07,13.75,100,10,'network',0,0,0)",
+				deviceId, deviceTime-3600*1000, deviceTime)
+			Expect(err).To(BeNil())
+			retried := Location{TimeMillis: sql.NullInt64{Int64: deviceTime - 3599*1000, Valid: true},
+				Latitude: sql.NullFloat64{Float64: 51.07, Valid: true}, Longitude: sql.NullFloat64{Float64: 13.75, Valid: true}}
+			other := retried
+			other.Longitude.Float64 = 13.76
+
+			c := &datapolish.TimeCorrection{}
+			res, err := datapolish.DropStoredRepeats(int(deviceId), []Location{retried, other}, []int64{deviceTime, deviceTime}, c, dbCon)
+			Expect(err).To(BeNil())
+			Expect(res).To(Equal([]Location{other}))
+			Expect(c.DroppedRepeats).To(Equal(1))
+		})
+	})
+})
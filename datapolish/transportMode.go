@@ -0,0 +1,134 @@
+package datapolish
+
+import (
+	"math"
+	"sort"
+
+	"github.com/Compufreak345/dbg"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	. "github.com/OpenDriversLog/goodl-lib/models/geo"
+	"github.com/OpenDriversLog/goodl-lib/tools"
+)
+
+const tmTag = "glib/dp/transportMode.go"
+
+// TransportFeatures are the characteristics of a list of Locations used by ClassifyTransportMode.
+type TransportFeatures struct {
+	// Distance is the length (in meters) of the path
+	Distance float64
+	// MovingTime is the time (in milliseconds) spent faster than MinMovingSpeed
+	MovingTime int64
+	// MaxSpeed, MedianSpeed and P85Speed (the speed not exceeded 85% of the moving time) are in km/h
+	MaxSpeed    float64
+	MedianSpeed float64
+	P85Speed    float64
+	// AccelerationStdDev is the standard deviation (in m/s²) of the longitudinal acceleration while moving
+	AccelerationStdDev float64
+	// StopsPerKm is the count of stops (falling below MinMovingSpeed) per km
+	StopsPerKm float64
+	// Straightness is the direct distance between start & end relative to the Distance, 1 for a straight line
+	Straightness float64
+}
+
+// CalcTransportFeatures returns the features of the given Locations, which should be sorted by time.
+func CalcTransportFeatures(raw []Location, config *LocationConfig) (f TransportFeatures) {
+	if config == nil {
+		config = GetDefaultLocationConfig()
+	}
+	if len(raw) < 2 {
+		return
+	}
+	for i := 1; i < len(raw); i++ {
+		f.Distance += locationDistance(raw[i-1], raw[i])
+	}
+	if f.Distance > 0 {
+		f.Straightness = locationDistance(raw[0], raw[len(raw)-1]) / f.Distance
+	}
+
+	minMoving := float64(config.MinMovingSpeed)
+	moving := make([]speedSample, 0)
+	var sum, sumSq float64
+	var accelCount int
+	var stops int
+	var prev *speedSample
+	for _, s := range speedSamples(raw, config) {
+		s := s
+		if s.Speed > f.MaxSpeed {
+			f.MaxSpeed = s.Speed
+		}
+		if s.Speed >= minMoving {
+			moving = append(moving, s)
+			f.MovingTime += s.Duration
+		}
+		if prev != nil && prev.Speed >= minMoving && s.Speed < minMoving {
+			stops++
+		}
+		if prev != nil && prev.Index == s.Index-1 && s.Speed >= minMoving {
+			a := (s.Speed - prev.Speed) / 3.6 / (float64(s.Duration) / 1000)
+			sum += a
+			sumSq += a * a
+			accelCount++
+		}
+		prev = &s
+	}
+	if accelCount > 0 {
+		mean := sum / float64(accelCount)
+		f.AccelerationStdDev = math.Sqrt(math.Max(0, sumSq/float64(accelCount)-mean*mean))
+	}
+	if f.Distance > 0 {
+		f.StopsPerKm = float64(stops) / (f.Distance / 1000)
+	}
+
+	sort.Sort(speedSamplesBySpeed(moving))
+	var passed int64
+	for _, s := range moving {
+		passed += s.Duration
+		if f.MedianSpeed == 0 && passed*2 >= f.MovingTime {
+			f.MedianSpeed = s.Speed
+		}
+		if passed*100 >= f.MovingTime*85 {
+			f.P85Speed = s.Speed
+			break
+		}
+	}
+	return
+}
+
+// ClassifyTransportMode returns the most likely Transport* mode for the given Locations, which should be sorted by time.
+// Tracks with too little data are classified as car, so they are never hidden by mistake.
+//   - walk: hardly ever faster than 9 km/h
+//   - bicycle: mostly slower than 30 km/h and never faster than 45 km/h
+//   - rail: faster than cars usually drive with very smooth acceleration, or long straight parts
+//     with constantly high speed & hardly any stops
+//   - car: everything else
+func ClassifyTransportMode(raw []Location, config *LocationConfig) (mode string, f TransportFeatures) {
+	f = CalcTransportFeatures(raw, config)
+	switch {
+	case f.MovingTime < 60*1000 || f.Distance < 200:
+		mode = TransportCar
+	case f.P85Speed <= 9 && f.MaxSpeed <= 20:
+		mode = TransportWalk
+	case f.P85Speed <= 30 && f.MaxSpeed <= 45:
+		mode = TransportBicycle
+	case f.MaxSpeed > 200 && f.AccelerationStdDev < 0.5,
+		f.MedianSpeed >= 60 && f.Straightness >= 0.9 && f.AccelerationStdDev < 0.25 && f.StopsPerKm < 0.05:
+		mode = TransportRail
+	default:
+		mode = TransportCar
+	}
+	return
+}
+
+// StoreTrackTransportMode classifies the given track by the Locations between startTime and endTime and saves the result.
+func StoreTrackTransportMode(trackId int64, startTime int64, endTime int64, raw []Location, config *LocationConfig, dbCon tools.DbRunner) (mode string, err error) {
+	first := sort.Search(len(raw), func(i int) bool { return raw[i].TimeMillis.Int64 >= startTime })
+	last := sort.Search(len(raw), func(i int) bool { return raw[i].TimeMillis.Int64 > endTime })
+
+	mode, f := ClassifyTransportMode(raw[first:last], config)
+	dbg.D(tmTag, "Classified track %d as %s : %+v", trackId, mode, f)
+	_, err = dbCon.Exec("UPDATE Tracks SET transportMode=? WHERE _trackId=?", mode, trackId)
+	if err != nil {
+		dbg.E(tmTag, "Failed to update transportMode of track %d : ", trackId, err)
+	}
+	return
+}
@@ -0,0 +1,107 @@
+package datapolish_test
+
+import (
+	"database/sql"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/datapolish"
+	"github.com/OpenDriversLog/goodl-lib/dbMan"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/deviceManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan"
+	S "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	. "github.com/OpenDriversLog/goodl-lib/models/geo"
+	"github.com/OpenDriversLog/goodl-lib/translate"
+)
+
+var _ = Describe("TransportMode", func() {
+	config := datapolish.GetDefaultLocationConfig()
+
+	classify := func(t *traceBuilder) string {
+		mode, _ := datapolish.ClassifyTransportMode(t.locs, config)
+		return mode
+	}
+
+	It("should recognize walks and bicycle rides", func() {
+		Expect(classify(newTrace(stopA.Lat, stopA.Lng).drive(stopL.Lat, stopL.Lng, 1.4, 5))).To(Equal(TransportWalk))
+		Expect(classify(newTrace(stopA.Lat, stopA.Lng).drive(stopB.Lat, stopB.Lng, 5, 5))).To(Equal(TransportBicycle))
+	})
+
+	It("should recognize car drives with stops", func() {
+		city := newTrace(stopA.Lat, stopA.Lng).drive(stopL.Lat, stopL.Lng, 14, 5).stay(30, 5, 2, 10).
+			drive(stopB.Lat, stopB.Lng, 14, 5).drive(stopC.Lat, stopC.Lng, 14, 5)
+		Expect(classify(city)).To(Equal(TransportCar))
+		_, f := datapolish.ClassifyTransportMode(city.locs, config)
+		Expect(f.StopsPerKm).To(BeNumerically(">", 0))
+		Expect(f.Straightness).To(BeNumerically("<", 0.9))
+	})
+
+	It("should recognize fast straight rides without stops as rail", func() {
+		Expect(classify(newTrace(stopA.Lat, stopA.Lng).drive(50.93, 12.92, 33, 5))).To(Equal(TransportRail))
+	})
+
+	It("should not classify tracks with too little data", func() {
+		Expect(classify(newTrace(stopA.Lat, stopA.Lng).stay(300, 10, 5, 10))).To(Equal(TransportCar))
+	})
+})
+
+var _ = Describe("SkipNonCarTracks", func() {
+	var (
+		dbCon    *sql.DB
+		deviceId int64
+		carId    int64
+	)
+
+	BeforeEach(func() {
+		dbCon, _ = dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+		deviceId, carId = insertTestDrive(dbCon)
+	})
+
+	AfterEach(func() {
+		deleteTestDrive(deviceId, carId, dbCon)
+		dbCon.Close()
+	})
+
+	It("should leave non-car tracks without trip for review and be switched off again", func() {
+		skip, keep := true, false
+		_, err := deviceManager.UpdateDevice(&deviceManager.Device{Id: S.NInt64(deviceId), Description: "Berichtstest", SkipNonCarTracks: &skip}, dbCon)
+		Expect(err).To(BeNil())
+
+		report, err := datapolish.ProcessGPSDataWithGeocoder(reportTestStart, reportTestStart+3600*1000, int(deviceId), false, 1, failingGeocoder{}, nil, &translate.Translater{}, dbCon)
+		Expect(err).To(BeNil())
+		Expect(report.NewTracks).To(Equal(1))
+		Expect(report.NewTrips).To(Equal(0))
+
+		tracks, err := tripMan.GetNonCarTracksWithoutTrip(reportTestStart, reportTestStart+3600*1000, []interface{}{deviceId}, dbCon)
+		Expect(err).To(BeNil())
+		Expect(tracks).To(HaveLen(1))
+		Expect(string(tracks[0].TransportMode)).To(Equal(TransportBicycle))
+
+		// not given, so not changed
+		_, err = deviceManager.UpdateDevice(&deviceManager.Device{Id: S.NInt64(deviceId), Description: "Berichtstest"}, dbCon)
+		Expect(err).To(BeNil())
+		devices, err := deviceManager.GetDevicesByWhere(dbCon, "_deviceId=?", deviceId)
+		Expect(err).To(BeNil())
+		Expect(*devices[0].SkipNonCarTracks).To(BeTrue())
+
+		_, err = deviceManager.UpdateDevice(&deviceManager.Device{Id: S.NInt64(deviceId), Description: "Berichtstest", SkipNonCarTracks: &keep}, dbCon)
+		Expect(err).To(BeNil())
+		devices, err = deviceManager.GetDevicesByWhere(dbCon, "_deviceId=?", deviceId)
+		Expect(err).To(BeNil())
+		Expect(*devices[0].SkipNonCarTracks).To(BeFalse())
+	})
+	It("should reset the stop detector of the device to the default", func() {
+		_, err := deviceManager.UpdateDevice(&deviceManager.Device{Id: S.NInt64(deviceId), Description: "Berichtstest", StopDetector: datapolish.StopDetectorSTDBSCAN}, dbCon)
+		Expect(err).To(BeNil())
+		devices, err := deviceManager.GetDevicesByWhere(dbCon, "_deviceId=?", deviceId)
+		Expect(err).To(BeNil())
+		Expect(string(devices[0].StopDetector)).To(Equal(datapolish.StopDetectorSTDBSCAN))
+
+		_, err = deviceManager.UpdateDevice(&deviceManager.Device{Id: S.NInt64(deviceId), Description: "Berichtstest", StopDetector: "-"}, dbCon)
+		Expect(err).To(BeNil())
+		devices, err = deviceManager.GetDevicesByWhere(dbCon, "_deviceId=?", deviceId)
+		Expect(err).To(BeNil())
+		Expect(string(devices[0].StopDetector)).To(BeEmpty())
+	})
+})
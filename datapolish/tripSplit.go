@@ -0,0 +1,235 @@
+package datapolish
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/addressManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/notificationManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/periodManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	"github.com/OpenDriversLog/goodl-lib/translate"
+)
+
+const tsTag = "glib/dp/tripSplit.go"
+
+// errSplitWithoutAddress is remembered as geocoding error for KeyPoints created by a split, so their address
+// gets looked up by the geocode jobs.
+var errSplitWithoutAddress = errors.New("KeyPoint created by split")
+
+// trackSplit is a track split by splitTrack, whose data still needs to be recalculated by finishTrackSplit.
+type trackSplit struct {
+	trackId    int64
+	newTrackId int64
+	keyPointId int64
+	deviceId   int64
+	startTime  int64
+	endTime    int64
+	timeMillis int64
+	position   *Location
+}
+
+// SplitTrackAt splits the given track at timeMillis into two tracks. A new KeyPoint is created at the position
+// recorded closest to timeMillis, the first track ends there and the new one continues to the old end.
+// The new track belongs to the same trip & devices, the tracks are split in one transaction and the data of both is
+// recalculated afterwards. Returns the IDs of the new KeyPoint and the new track.
+func SplitTrackAt(trackId int64, timeMillis int64, dbCon *sql.DB) (keyPointId int64, newTrackId int64, err error) {
+	tx, err := dbCon.Begin()
+	if err != nil {
+		dbg.E(tsTag, "Error starting transaction : ", err)
+		return
+	}
+	split, err := splitTrack(trackId, timeMillis, tx, dbCon)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		dbg.E(tsTag, "Failed to commit split of track %d : ", trackId, err)
+		return
+	}
+	err = finishTrackSplit(split, dbCon)
+	return split.keyPointId, split.newTrackId, err
+}
+
+// splitTrack inserts the KeyPoint & track splitting the given track at timeMillis in tx, see SplitTrackAt.
+func splitTrack(trackId int64, timeMillis int64, tx *sql.Tx, dbCon *sql.DB) (split *trackSplit, err error) {
+	config := GetDefaultLocationConfig()
+	split = &trackSplit{trackId: trackId, timeMillis: timeMillis}
+	var endKpId int64
+	var carId sql.NullInt64
+	err = dbCon.QueryRow(`SELECT t.deviceId, t.carId, t.endKeyPointId, skp.endTime, ekp.startTime FROM Tracks t
+		JOIN KeyPoints skp ON skp._keyPointId=t.startKeyPointId
+		JOIN KeyPoints ekp ON ekp._keyPointId=t.endKeyPointId
+		WHERE t._trackId=?`, trackId).Scan(&split.deviceId, &carId, &endKpId, &split.startTime, &split.endTime)
+	if err != nil {
+		dbg.E(tsTag, "Failed to get track %d to split : ", trackId, err)
+		return
+	}
+	if timeMillis <= split.startTime || timeMillis >= split.endTime {
+		dbg.I(tsTag, "Time %d is not inside track %d (%d - %d)", timeMillis, trackId, split.startTime, split.endTime)
+		err = tripMan.ErrInvalidSplitPoint
+		return
+	}
+	if err = periodManager.CheckTimeRangeOpen(carId.Int64, split.startTime, split.endTime, dbCon); err != nil {
+		return
+	}
+
+	recs, _, err := getTrackRecordsForTrack(trackId, split.startTime, split.endTime, int(split.deviceId), config, dbCon)
+	if err != nil {
+		return
+	}
+	for i := range recs {
+		if recs[i].Accuracy.Float64 > float64(config.AccuracyThreshold) {
+			continue
+		}
+		if split.position == nil || math.Abs(float64(recs[i].TimeMillis.Int64-timeMillis)) < math.Abs(float64(split.position.TimeMillis.Int64-timeMillis)) {
+			split.position = &recs[i]
+		}
+	}
+	if split.position == nil {
+		dbg.W(tsTag, "No accurate trackRecords to split track %d at %d", trackId, timeMillis)
+		err = tripMan.ErrInvalidSplitPoint
+		return
+	}
+
+	res, err := tx.Exec("INSERT INTO `keyPoints` (latitude, longitude, startTime, endTime, previousTrackId, deviceId, carId) VALUES(?,?,?,?,?,?,?)",
+		split.position.Latitude, split.position.Longitude, timeMillis, timeMillis, trackId, split.deviceId, carId)
+	if err != nil {
+		dbg.E(tsTag, "Failed to insert KeyPoint to split track %d : ", trackId, err)
+		return
+	}
+	split.keyPointId, _ = res.LastInsertId()
+
+	res, err = tx.Exec("INSERT INTO `tracks` (deviceId, startKeyPointId, endKeyPointId, distance, carId) VALUES(?, ?, ?, -1, ?)",
+		split.deviceId, split.keyPointId, endKpId, carId)
+	if err != nil {
+		dbg.E(tsTag, "Failed to insert second track of track %d : ", trackId, err)
+		return
+	}
+	split.newTrackId, _ = res.LastInsertId()
+
+	for _, q := range []struct {
+		query  string
+		params []interface{}
+	}{
+		{"UPDATE Tracks SET endKeyPointId=? WHERE _trackId=?", []interface{}{split.keyPointId, trackId}},
+		{"UPDATE KeyPoints SET nextTrackId=? WHERE _keyPointId=?", []interface{}{split.newTrackId, split.keyPointId}},
+		{"UPDATE KeyPoints SET previousTrackId=? WHERE _keyPointId=?", []interface{}{split.newTrackId, endKpId}},
+		{"INSERT INTO TrackDevices (trackId, deviceId, points) SELECT ?, deviceId, points FROM TrackDevices WHERE trackId=?", []interface{}{split.newTrackId, trackId}},
+		{"INSERT INTO Tracks_Trips (trackId, tripId) SELECT ?, tripId FROM Tracks_Trips WHERE trackId=?", []interface{}{split.newTrackId, trackId}},
+	} {
+		if _, err = tx.Exec(q.query, q.params...); err != nil {
+			dbg.E(tsTag, "Failed to link tracks %d and %d : ", trackId, split.newTrackId, err)
+			return
+		}
+	}
+	return
+}
+
+// finishTrackSplit recalculates the data of both tracks in one transaction after splitTrack has been committed and
+// lets the geocode jobs look up the address of the new KeyPoint.
+func finishTrackSplit(split *trackSplit, dbCon *sql.DB) (err error) {
+	config := GetDefaultLocationConfig()
+	tx, err := dbCon.Begin()
+	if err != nil {
+		dbg.E(tsTag, "Error starting transaction : ", err)
+		return
+	}
+	if _, err = recalculateTrackData(split.trackId, split.startTime, split.timeMillis, int(split.deviceId), config, tx); err != nil {
+		dbg.E(tsTag, "Failed to recalculate track %d after split : ", split.trackId, err)
+		tx.Rollback()
+		return
+	}
+	if _, err = recalculateTrackData(split.newTrackId, split.timeMillis, split.endTime, int(split.deviceId), config, tx); err != nil {
+		dbg.E(tsTag, "Failed to recalculate track %d after split : ", split.newTrackId, err)
+		tx.Rollback()
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		dbg.E(tsTag, "Failed to commit recalculating tracks %d and %d : ", split.trackId, split.newTrackId, err)
+		return
+	}
+
+	_, errJob := addressManager.CreateGeocodeJob(split.keyPointId, split.position.Latitude.Float64, split.position.Longitude.Float64, errSplitWithoutAddress, dbCon)
+	if errJob != nil {
+		dbg.E(tsTag, "Failed to create GeocodeJob for KeyPoint %d : ", split.keyPointId, errJob)
+	}
+	err = addressManager.UpdateKeyPointsForAllGeozones([]int64{split.keyPointId}, dbCon)
+	if err != nil {
+		dbg.E(tsTag, "Failed to calculate GeoZones for KeyPoint %d : ", split.keyPointId, err)
+	}
+	return
+}
+
+// SplitTripAt splits the given trip at timeMillis. If it is the time of a stop between two tracks of the trip,
+// it is split at this KeyPoint, otherwise the track driven at this time is split as well (see SplitTrackAt).
+// Both splits are done in one transaction, so the track stays whole if the trip can't be split.
+// Returns the ID of the new trip with the tracks after timeMillis, the IDs of the affected trips and if
+// notifications were changed.
+func SplitTripAt(tripId int64, timeMillis int64, isAdmin bool, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (newTripId int64, affectedTripIds []int64, notificationsChanged bool, err error) {
+	trip, tracks, err := tripMan.GetSortedTripTracks(tripId, activeNotifications, T, dbCon)
+	if err != nil {
+		return
+	}
+	if err = tripMan.CheckTripEditable(trip, isAdmin, dbCon); err != nil {
+		return
+	}
+
+	splitIdx := -1
+	splitTrackId := int64(0)
+	for i, t := range tracks {
+		if i > 0 && timeMillis >= tracks[i-1].EndTime && timeMillis <= t.StartTime {
+			splitIdx = i
+			break
+		}
+		if timeMillis > t.StartTime && timeMillis < t.EndTime {
+			splitIdx = i + 1
+			splitTrackId = t.TrackId
+			break
+		}
+	}
+	if splitIdx == -1 {
+		err = tripMan.ErrInvalidSplitPoint
+		return
+	}
+	trackIds := make([]int64, 0, len(tracks)-splitIdx+1)
+
+	tx, err := dbCon.Begin()
+	if err != nil {
+		dbg.E(tsTag, "Error starting transaction : ", err)
+		return
+	}
+	var split *trackSplit
+	if splitTrackId != 0 {
+		split, err = splitTrack(splitTrackId, timeMillis, tx, dbCon)
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		trackIds = append(trackIds, split.newTrackId)
+	}
+	for _, t := range tracks[splitIdx:] {
+		trackIds = append(trackIds, t.TrackId)
+	}
+	newTripId, err = tripMan.MoveTracksToNewTrip(trip, trackIds, tx)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		dbg.E(tsTag, "Failed to commit split of trip %d : ", tripId, err)
+		return
+	}
+
+	if split != nil {
+		if err = finishTrackSplit(split, dbCon); err != nil {
+			return
+		}
+	}
+	affectedTripIds, notificationsChanged, err = tripMan.FinishTripSplit(tripId, newTripId, activeNotifications, T, dbCon)
+	return
+}
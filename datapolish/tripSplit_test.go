@@ -0,0 +1,70 @@
+package datapolish_test
+
+import (
+	"database/sql"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/datapolish"
+	"github.com/OpenDriversLog/goodl-lib/dbMan"
+	"github.com/OpenDriversLog/goodl-lib/translate"
+)
+
+var _ = Describe("SplitTripAt", func() {
+	var (
+		dbCon    *sql.DB
+		deviceId int64
+		carId    int64
+		tripId   int64
+	)
+	// splitTime is while driving from the first to the second stop of the test drive
+	splitTime := reportTestStart + 29*30*1000
+
+	count := func(q string) (n int) {
+		Expect(dbCon.QueryRow(q, deviceId).Scan(&n)).To(BeNil())
+		return
+	}
+
+	BeforeEach(func() {
+		dbCon, _ = dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+		deviceId, carId = insertTestDrive(dbCon)
+		_, err := datapolish.ProcessGPSDataWithGeocoder(reportTestStart, reportTestStart+3600*1000, int(deviceId), false, 1, failingGeocoder{}, nil, &translate.Translater{}, dbCon)
+		Expect(err).To(BeNil())
+		err = dbCon.QueryRow("SELECT tripId FROM Tracks_Trips WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?)", deviceId).Scan(&tripId)
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		dbCon.Exec("DROP TRIGGER IF EXISTS test_fail_split")
+		deleteTestDrive(deviceId, carId, dbCon)
+		dbCon.Close()
+	})
+
+	It("should split the trip and the track driven at the given time", func() {
+		newTripId, affected, _, err := datapolish.SplitTripAt(tripId, splitTime, true, nil, &translate.Translater{}, dbCon)
+		Expect(err).To(BeNil())
+		Expect(newTripId).NotTo(Equal(tripId))
+		Expect(affected).To(Equal([]int64{tripId}))
+
+		Expect(count("SELECT COUNT(*) FROM Tracks WHERE deviceId=?")).To(Equal(2))
+		Expect(count("SELECT COUNT(DISTINCT tripId) FROM Tracks_Trips WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?)")).To(Equal(2))
+		var secondTrip int64
+		err = dbCon.QueryRow(`SELECT tripId FROM Tracks_Trips WHERE trackId=(SELECT _trackId FROM Tracks WHERE deviceId=?
+			AND startKeyPointId=(SELECT _keyPointId FROM KeyPoints WHERE deviceId=? AND startTime=?))`, deviceId, deviceId, splitTime).Scan(&secondTrip)
+		Expect(err).To(BeNil())
+		Expect(secondTrip).To(Equal(newTripId))
+	})
+
+	It("should keep the track whole if the trip can't be split", func() {
+		keyPoints := count("SELECT COUNT(*) FROM KeyPoints WHERE deviceId=?")
+		_, err := dbCon.Exec("CREATE TRIGGER test_fail_split BEFORE INSERT ON Trips BEGIN SELECT RAISE(ABORT, 'test'); END")
+		Expect(err).To(BeNil())
+
+		_, _, _, err = datapolish.SplitTripAt(tripId, splitTime, true, nil, &translate.Translater{}, dbCon)
+		Expect(err).NotTo(BeNil())
+		Expect(count("SELECT COUNT(*) FROM Tracks WHERE deviceId=?")).To(Equal(1))
+		Expect(count("SELECT COUNT(*) FROM KeyPoints WHERE deviceId=?")).To(Equal(keyPoints))
+		Expect(count("SELECT COUNT(*) FROM Tracks_Trips WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?)")).To(Equal(1))
+	})
+})
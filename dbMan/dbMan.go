@@ -240,25 +240,25 @@ func InsertCSVToDb(data string, key string, usrId int64, dbCon *sql.DB) (cnt int
 	}
 	var curInsCnt = 0
 
-	// TODO : Remove duplicates here or in a daily cleanup job or sth.?
 	rd := csv.NewReader(strings.NewReader(data))
 
-	headings := make(map[string]*int)
+	headings := make(map[string]int)
 	requiredHeadings := []string{"timeMillis", "latitude", "longitude", "altitude", "accuracy", "speed"}
 	allowedHeadings := map[string]struct{}{"timeMillis": struct{}{}, "latitude": struct{}{}, "longitude": struct{}{},
 		"altitude": struct{}{}, "accuracy": struct{}{}, "provider": struct{}{}, "source": struct{}{},
-		"accuracyRating": struct{}{}, "speed": struct{}{}}
+		"accuracyRating": struct{}{}, "speed": struct{}{}, "accelLongitudinal": struct{}{}, "accelLateral": struct{}{}}
 	var qmString = "("
 
 	first := true
 	rCount := 0
-	// http://stackoverflow.com/a/25192138/3085985 - insert performance
-	valueStrings := make([]string, 0)
-	valueArgs := make([]interface{}, 0)
+	records := make([][]string, 0)
+	// the uploaded timeMillis of each record
+	deviceTimes := make([]int64, 0)
+	locs := make([]Location, 0)
 	var recLen = 0
 	var headingsString = ""
 	var timeIdx = 0
-	cnt = -1
+	cnt = 0
 	for {
 		rCount++
 		var record []string
@@ -282,7 +282,7 @@ func InsertCSVToDb(data string, key string, usrId int64, dbCon *sql.DB) (cnt int
 				if h == "timeMillis" {
 					timeIdx = i
 				}
-				headings[h] = &i
+				headings[h] = i
 				if i != 0 {
 					headingsString += ","
 				}
@@ -293,48 +293,79 @@ func InsertCSVToDb(data string, key string, usrId int64, dbCon *sql.DB) (cnt int
 				}
 				headingsString += h
 			}
-			headingsString += ",deviceId"
-			qmString += ",?)"
+			headingsString += ",deviceId,deviceTimeMillis"
+			qmString += ",?,?)"
 			for _, h := range requiredHeadings {
-				if headings[h] == nil {
+				if _, ok := headings[h]; !ok {
 					dbg.I(dTag, "Missing header %v", h)
 					err = EMissingHeading
 					return
 				}
 			}
 			first = false
-		} else {
-			valueStrings = append(valueStrings, qmString)
-			new := make([]interface{}, recLen+1)
-			for i, v := range record {
-				if i > recLen-1 {
-					err = EMissingHeading
-					return
-				}
-				new[i] = v
-			}
-			curTime, _err := strconv.ParseInt(record[timeIdx], 10, 64)
-			if _err != nil {
-				err = _err
-				dbg.E(dTag, "Could not parse time %s at row %d : %s", record[timeIdx], rCount, err)
-				return
-			}
-			if curTime == 0 {
-				dbg.WTF(dTag, "How can a record have a timestamp of zero?", record)
-				err = errors.New("Invalid data")
-				return
-			}
-			if curTime < minTime {
-				minTime = curTime
-			}
-			if curTime > maxTime {
-				maxTime = curTime
-			}
-			curInsCnt += recLen + 1
-			new[recLen] = deviceId
-			valueArgs = append(valueArgs, new...)
+			continue
+		}
+		if len(record) > recLen {
+			err = EMissingHeading
+			return
+		}
+		curTime, _err := strconv.ParseInt(record[timeIdx], 10, 64)
+		if _err != nil {
+			err = _err
+			dbg.E(dTag, "Could not parse time %s at row %d : %s", record[timeIdx], rCount, err)
+			return
+		}
+		if curTime == 0 {
+			dbg.WTF(dTag, "How can a record have a timestamp of zero?", record)
+			err = errors.New("Invalid data")
+			return
+		}
+		// the Id is the index of the record, so we can find it again after normalization
+		l := Location{Id: sql.NullInt64{Int64: int64(len(records)), Valid: true}, TimeMillis: sql.NullInt64{Int64: curTime, Valid: true}}
+		l.Latitude.Float64, _ = strconv.ParseFloat(record[headings["latitude"]], 64)
+		l.Longitude.Float64, _ = strconv.ParseFloat(record[headings["longitude"]], 64)
+		if i, ok := headings["provider"]; ok && i < len(record) {
+			l.Provider = sql.NullString{String: record[i], Valid: true}
+		}
+		records = append(records, record)
+		deviceTimes = append(deviceTimes, curTime)
+		locs = append(locs, l)
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	// correct clock drift, sort by time & remove repeats before inserting
+	locs, correction := datapolish.NormalizeTrackRecords(locs, time.Now().UnixNano()/int64(time.Millisecond))
+	sortedDeviceTimes := make([]int64, len(locs))
+	for i, l := range locs {
+		sortedDeviceTimes[i] = deviceTimes[l.Id.Int64]
+	}
+	locs, err = datapolish.DropStoredRepeats(deviceId, locs, sortedDeviceTimes, correction, dbCon)
+	if err != nil {
+		return
+	}
+	if correction.ClockOffset != 0 || correction.ProviderOffset != 0 || correction.Reordered != 0 || correction.DroppedRepeats != 0 {
+		dbg.I(dTag, "Normalized upload of device %d : %+v", deviceId, correction)
+	}
+
+	// http://stackoverflow.com/a/25192138/3085985 - insert performance
+	valueStrings := make([]string, 0)
+	valueArgs := make([]interface{}, 0)
+	for _, l := range locs {
+		record := records[l.Id.Int64]
+		new := make([]interface{}, recLen+2)
+		for i, v := range record {
+			new[i] = v
 		}
-		if curInsCnt+recLen+1 > 999 {
+		new[timeIdx] = l.TimeMillis.Int64
+		new[recLen] = deviceId
+		new[recLen+1] = deviceTimes[l.Id.Int64]
+		valueStrings = append(valueStrings, qmString)
+		valueArgs = append(valueArgs, new...)
+		curInsCnt += recLen + 2
+		cnt++
+		if curInsCnt+recLen+2 > 999 {
 			err = commitInsertCsv(headingsString, valueArgs, valueStrings, dbCon)
 			curInsCnt = 0
 			valueStrings = make([]string, 0)
@@ -343,13 +374,21 @@ func InsertCSVToDb(data string, key string, usrId int64, dbCon *sql.DB) (cnt int
 				return 0, 0, 0, err
 			}
 		}
-		cnt++
 	}
 
 	if curInsCnt != 0 {
 		err = commitInsertCsv(headingsString, valueArgs, valueStrings, dbCon)
+		if err != nil {
+			return
+		}
 	}
+	minTime = correction.MinTime
+	maxTime = correction.MaxTime
 
+	// the records are already inserted, so a missing correction log should not fail the upload
+	if errCorrection := datapolish.StoreTimeCorrection(deviceId, correction, dbCon); errCorrection != nil {
+		dbg.W(dTag, "Upload of device %d inserted without logging its time correction : ", deviceId, errCorrection)
+	}
 	return
 }
 
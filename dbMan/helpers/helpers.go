@@ -7,6 +7,7 @@ import (
 	"database/sql"
 
 	"github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	"github.com/OpenDriversLog/goodl-lib/tools"
 )
 
 // USAGE:
@@ -24,11 +25,11 @@ type UpdateHelper struct {
 	values    []interface{}
 	firstVal  bool
 	valString string
-	dbCon     *sql.DB
+	dbCon     tools.DbRunner
 }
 
-// NewUpdateHelper initializes a new UpdateHelper
-func NewUpdateHelper(dbCon *sql.DB) (u *UpdateHelper) {
+// NewUpdateHelper initializes a new UpdateHelper, running the update on dbCon (a *sql.DB or *sql.Tx).
+func NewUpdateHelper(dbCon tools.DbRunner) (u *UpdateHelper) {
 	return &UpdateHelper{
 		values:    []interface{}{},
 		firstVal:  true,
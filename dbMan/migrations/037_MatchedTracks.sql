@@ -0,0 +1,16 @@
+-- +migrate Up
+ALTER TABLE Tracks ADD matchedDistance DOUBLE;
+
+CREATE TABLE IF NOT EXISTS `MatchedTrackPoints` (
+    _matchedTrackPointId INTEGER PRIMARY KEY,
+    trackId INTEGER NOT NULL, -- which track it belongs to
+    seq INTEGER NOT NULL, -- position in the matched geometry
+    latitude DOUBLE,
+    longitude DOUBLE,
+    trackPointId INTEGER, -- the trackPoint snapped to this position, NULL for road vertices in between
+    wayId INTEGER, -- OSM way the position lies on
+    FOREIGN KEY (trackId) REFERENCES Tracks(_trackId),
+    FOREIGN KEY (trackPointId) REFERENCES trackPoints(_trackPointId)
+);
+
+CREATE INDEX IF NOT EXISTS IDX_MTP_TrackId ON MatchedTrackPoints(trackId);
@@ -0,0 +1,2 @@
+-- +migrate Up
+ALTER TABLE Devices ADD stopDetector TEXT DEFAULT "";
@@ -0,0 +1,18 @@
+-- +migrate Up
+ALTER TABLE Tracks ADD dataQuality INTEGER DEFAULT 0; -- 0 = ok, 1 = interpolated gaps, 2 = unknown gaps
+
+CREATE TABLE IF NOT EXISTS `TrackGaps` (
+    _trackGapId INTEGER PRIMARY KEY,
+    trackId INTEGER NOT NULL,
+    startTime INTEGER, -- time of the last location before the gap
+    endTime INTEGER, -- time of the first location after the gap
+    startLatitude DOUBLE,
+    startLongitude DOUBLE,
+    endLatitude DOUBLE,
+    endLongitude DOUBLE,
+    distance DOUBLE, -- direct distance between start and end in meters
+    kind TEXT, -- "interpolated" or "gap"
+    FOREIGN KEY (trackId) REFERENCES Tracks(_trackId)
+);
+
+CREATE INDEX IF NOT EXISTS IDX_TG_TrackId ON TrackGaps(trackId);
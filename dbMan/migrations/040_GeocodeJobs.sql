@@ -0,0 +1,14 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS `GeocodeJobs` (
+    _geocodeJobId INTEGER PRIMARY KEY,
+    keyPointId INTEGER NOT NULL,
+    latitude DOUBLE,
+    longitude DOUBLE,
+    tryCount INTEGER DEFAULT 1,
+    retryTime INTEGER, -- unix time of the next try, see addressManager.CalcRetryTime
+    lastError TEXT,
+    FOREIGN KEY (keyPointId) REFERENCES KeyPoints(_keyPointId)
+);
+
+CREATE INDEX IF NOT EXISTS IDX_GJ_KeyPointId ON GeocodeJobs(keyPointId);
+CREATE INDEX IF NOT EXISTS IDX_GJ_RetryTime ON GeocodeJobs(retryTime);
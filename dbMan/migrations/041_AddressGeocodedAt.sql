@@ -0,0 +1,4 @@
+-- +migrate Up
+ALTER TABLE Addresses ADD geocodedAt INTEGER DEFAULT 0; -- unix time the address was last filled by a geocoder, 0 if unknown
+ALTER TABLE Addresses ADD userEdited INTEGER DEFAULT 0; -- 1 if the address was entered by the user (e.g. for a contact)
+UPDATE Addresses SET userEdited=1 WHERE _addressId IN (SELECT addressId FROM Contacts WHERE addressId IS NOT NULL);
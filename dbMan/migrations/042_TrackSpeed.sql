@@ -0,0 +1,19 @@
+-- +migrate Up
+ALTER TABLE Tracks ADD maxSpeed DOUBLE; -- km/h
+ALTER TABLE Tracks ADD avgMovingSpeed DOUBLE; -- km/h, only counting the time spent moving
+ALTER TABLE Tracks ADD medianSpeed DOUBLE; -- km/h, only counting the time spent moving
+ALTER TABLE Tracks ADD movingTime INTEGER; -- ms
+
+CREATE TABLE IF NOT EXISTS `SpeedingEvents` (
+    _speedingEventId INTEGER PRIMARY KEY,
+    trackId INTEGER NOT NULL,
+    startTime INTEGER,
+    endTime INTEGER,
+    peakSpeed DOUBLE, -- km/h
+    latitude DOUBLE, -- position of the peak speed
+    longitude DOUBLE,
+    threshold DOUBLE, -- km/h
+    FOREIGN KEY (trackId) REFERENCES Tracks(_trackId)
+);
+
+CREATE INDEX IF NOT EXISTS IDX_SE_TrackId ON SpeedingEvents(trackId);
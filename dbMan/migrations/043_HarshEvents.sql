@@ -0,0 +1,19 @@
+-- +migrate Up
+ALTER TABLE TrackRecords ADD accelLongitudinal DOUBLE; -- m/s², measured by the device if available
+ALTER TABLE TrackRecords ADD accelLateral DOUBLE; -- m/s², measured by the device if available
+
+CREATE TABLE IF NOT EXISTS `HarshEvents` (
+    _harshEventId INTEGER PRIMARY KEY,
+    trackId INTEGER NOT NULL,
+    startTime INTEGER,
+    endTime INTEGER,
+    kind TEXT, -- "acceleration", "braking" or "cornering"
+    peakAcceleration DOUBLE, -- m/s²
+    latitude DOUBLE, -- position of the peak
+    longitude DOUBLE,
+    speed DOUBLE, -- km/h at the peak
+    severity DOUBLE, -- peakAcceleration relative to the threshold
+    FOREIGN KEY (trackId) REFERENCES Tracks(_trackId)
+);
+
+CREATE INDEX IF NOT EXISTS IDX_HE_TrackId ON HarshEvents(trackId);
@@ -0,0 +1,17 @@
+-- +migrate Up
+ALTER TABLE Tracks ADD ascent DOUBLE; -- m
+ALTER TABLE Tracks ADD descent DOUBLE; -- m
+ALTER TABLE Tracks ADD minAltitude DOUBLE; -- m
+ALTER TABLE Tracks ADD maxAltitude DOUBLE; -- m
+
+CREATE TABLE IF NOT EXISTS `ElevationProfiles` (
+    _elevationProfileId INTEGER PRIMARY KEY,
+    trackId INTEGER NOT NULL,
+    seq INTEGER NOT NULL,
+    timeMillis INTEGER,
+    distance DOUBLE, -- m from the start of the track
+    altitude DOUBLE, -- m, smoothed
+    FOREIGN KEY (trackId) REFERENCES Tracks(_trackId)
+);
+
+CREATE INDEX IF NOT EXISTS IDX_EP_TrackId ON ElevationProfiles(trackId);
@@ -0,0 +1,3 @@
+-- +migrate Up
+ALTER TABLE Tracks ADD transportMode TEXT; -- "car", "walk", "bicycle" or "rail", NULL if not classified
+ALTER TABLE Devices ADD skipNonCarTracks INTEGER DEFAULT 0; -- 1 to not create trips for tracks not driven by car
@@ -0,0 +1,16 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS `TrackRecordUploads` (
+    _uploadId INTEGER PRIMARY KEY,
+    deviceId INTEGER NOT NULL,
+    uploadTime INTEGER, -- unix millis
+    records INTEGER, -- count of uploaded trackRecords
+    minTime INTEGER, -- corrected time range of the upload
+    maxTime INTEGER,
+    clockOffset INTEGER, -- ms added to all trackRecords because the device clock was ahead
+    providerOffset INTEGER, -- ms added to non-gps trackRecords to match the gps clock
+    reordered INTEGER, -- count of trackRecords uploaded out of order
+    droppedRepeats INTEGER, -- count of dropped duplicate trackRecords
+    FOREIGN KEY (deviceId) REFERENCES devices(id)
+);
+
+CREATE INDEX IF NOT EXISTS IDX_TRU_DeviceId ON TrackRecordUploads(deviceId);
@@ -0,0 +1,13 @@
+-- +migrate Up
+ALTER TABLE Tracks ADD fusedIntoTrackId INTEGER; -- the track of another device of the same car this track got fused into
+
+CREATE TABLE IF NOT EXISTS `TrackDevices` (
+    trackId INTEGER NOT NULL,
+    deviceId INTEGER NOT NULL,
+    points INTEGER, -- count of trackRecords of this device used for the fused track
+    PRIMARY KEY (trackId, deviceId),
+    FOREIGN KEY (trackId) REFERENCES Tracks(_trackId),
+    FOREIGN KEY (deviceId) REFERENCES devices(id)
+);
+
+CREATE INDEX IF NOT EXISTS IDX_Tracks_FusedIntoTrackId ON Tracks(fusedIntoTrackId);
@@ -0,0 +1,34 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS `TripRules` (
+    _tripRuleId INTEGER PRIMARY KEY,
+    title TEXT,
+    priority INTEGER DEFAULT 0,
+    disabled INTEGER DEFAULT 0,
+    -- conditions, 0 or NULL matches every trip
+    startContactId INTEGER,
+    endContactId INTEGER,
+    startGeoZoneId INTEGER,
+    endGeoZoneId INTEGER,
+    weekdays INTEGER, -- bitmask, 1 = sunday, 2 = monday, ..., 64 = saturday
+    startMinute INTEGER, -- time window (minutes of the day) the trip starts in
+    endMinute INTEGER,
+    deviceId INTEGER,
+    carId INTEGER,
+    driverId INTEGER,
+    minDistance REAL, -- m
+    maxDistance REAL, -- m
+    -- actions, 0 or NULL does not change anything
+    setType INTEGER,
+    setTitle TEXT,
+    setDescription TEXT,
+    setDriverId INTEGER,
+    setContactId INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS `TripRuleApplications` (
+    tripId INTEGER PRIMARY KEY,
+    ruleIds TEXT, -- comma separated IDs of the applied rules
+    explanation TEXT,
+    appliedAt INTEGER, -- unix millis
+    FOREIGN KEY (tripId) REFERENCES Trips(_tripId)
+);
@@ -0,0 +1,8 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS `TripPolicies` (
+    _tripPolicyId INTEGER PRIMARY KEY,
+    carId INTEGER NOT NULL DEFAULT 0 UNIQUE, -- 0 for the default of the account
+    deadlineType TEXT, -- rolling, endOfDay, endOfMonth
+    deadlineOffset INTEGER, -- days (rolling, endOfDay) or months (endOfMonth) after the end of the trip
+    reminderOffsets TEXT -- comma separated hours before the deadline
+);
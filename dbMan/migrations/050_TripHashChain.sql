@@ -0,0 +1,12 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS `TripHashChain` (
+    id INTEGER PRIMARY KEY,
+    entryType TEXT, -- trip, tripHistory, tracksTripsHistory
+    entryId INTEGER, -- _tripId or id of the history entry
+    contentHash TEXT, -- hex SHA-256 over the content of the entry
+    prevHash TEXT, -- hash of the previous entry, empty for the first one
+    hash TEXT, -- hex SHA-256 over prevHash and contentHash
+    sealedAt INTEGER -- unix millis
+);
+
+CREATE INDEX IF NOT EXISTS IDX_TripHashChain_entry ON TripHashChain(entryType, entryId);
@@ -0,0 +1,85 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS `ClosedPeriods` (
+    _closedPeriodId INTEGER PRIMARY KEY,
+    carId INTEGER NOT NULL,
+    startTime INTEGER NOT NULL, -- unix millis
+    endTime INTEGER NOT NULL, -- unix millis
+    closedAt INTEGER NOT NULL,
+    closeReason TEXT NOT NULL,
+    reopenedAt INTEGER, -- NULL as long as the period is closed
+    reopenReason TEXT,
+    FOREIGN KEY (carId) REFERENCES Cars(_carId)
+);
+
+CREATE INDEX IF NOT EXISTS IDX_ClosedPeriods_carId ON ClosedPeriods(carId, reopenedAt);
+
+-- Trips & tracks are frozen if they overlap a closed period of their car, keypoints if they lie completely in it,
+-- so the stop at the end of a period can still be linked to the next track.
+-- Go code checks ClosedPeriods before changing anything, these triggers make sure nothing slips through.
+
+CREATE TRIGGER closedperiod_update_trips BEFORE UPDATE OF type, title, desc, driverId, contactId, startContactId,
+    endContactId, isReturnTrip, reviewed ON Trips
+WHEN EXISTS (SELECT 1 FROM Tracks_Trips tt JOIN Tracks t ON t._trackId=tt.trackId
+    JOIN KeyPoints s ON s._keyPointId=t.startKeyPointId JOIN KeyPoints e ON e._keyPointId=t.endKeyPointId
+    JOIN ClosedPeriods p ON p.carId=t.carId AND p.reopenedAt IS NULL AND s.endTime<=p.endTime AND e.startTime>=p.startTime
+    WHERE tt.tripId=old._tripId)
+BEGIN SELECT RAISE(ABORT, 'PERIOD_CLOSED'); END;
+
+CREATE TRIGGER closedperiod_delete_trips BEFORE DELETE ON Trips
+WHEN EXISTS (SELECT 1 FROM Tracks_Trips tt JOIN Tracks t ON t._trackId=tt.trackId
+    JOIN KeyPoints s ON s._keyPointId=t.startKeyPointId JOIN KeyPoints e ON e._keyPointId=t.endKeyPointId
+    JOIN ClosedPeriods p ON p.carId=t.carId AND p.reopenedAt IS NULL AND s.endTime<=p.endTime AND e.startTime>=p.startTime
+    WHERE tt.tripId=old._tripId)
+BEGIN SELECT RAISE(ABORT, 'PERIOD_CLOSED'); END;
+
+CREATE TRIGGER closedperiod_insert_trackstrips BEFORE INSERT ON Tracks_Trips
+WHEN EXISTS (SELECT 1 FROM Tracks t
+    JOIN KeyPoints s ON s._keyPointId=t.startKeyPointId JOIN KeyPoints e ON e._keyPointId=t.endKeyPointId
+    JOIN ClosedPeriods p ON p.carId=t.carId AND p.reopenedAt IS NULL AND s.endTime<=p.endTime AND e.startTime>=p.startTime
+    WHERE t._trackId=new.trackId OR t._trackId IN (SELECT trackId FROM Tracks_Trips WHERE tripId=new.tripId))
+BEGIN SELECT RAISE(ABORT, 'PERIOD_CLOSED'); END;
+
+CREATE TRIGGER closedperiod_update_trackstrips BEFORE UPDATE ON Tracks_Trips
+WHEN EXISTS (SELECT 1 FROM Tracks t
+    JOIN KeyPoints s ON s._keyPointId=t.startKeyPointId JOIN KeyPoints e ON e._keyPointId=t.endKeyPointId
+    JOIN ClosedPeriods p ON p.carId=t.carId AND p.reopenedAt IS NULL AND s.endTime<=p.endTime AND e.startTime>=p.startTime
+    WHERE t._trackId IN (old.trackId, new.trackId) OR t._trackId IN (SELECT trackId FROM Tracks_Trips WHERE tripId=new.tripId))
+BEGIN SELECT RAISE(ABORT, 'PERIOD_CLOSED'); END;
+
+CREATE TRIGGER closedperiod_delete_trackstrips BEFORE DELETE ON Tracks_Trips
+WHEN EXISTS (SELECT 1 FROM Tracks t
+    JOIN KeyPoints s ON s._keyPointId=t.startKeyPointId JOIN KeyPoints e ON e._keyPointId=t.endKeyPointId
+    JOIN ClosedPeriods p ON p.carId=t.carId AND p.reopenedAt IS NULL AND s.endTime<=p.endTime AND e.startTime>=p.startTime
+    WHERE t._trackId=old.trackId)
+BEGIN SELECT RAISE(ABORT, 'PERIOD_CLOSED'); END;
+
+CREATE TRIGGER closedperiod_update_tracks BEFORE UPDATE ON Tracks
+WHEN EXISTS (SELECT 1 FROM KeyPoints s JOIN KeyPoints e ON e._keyPointId=old.endKeyPointId
+    JOIN ClosedPeriods p ON p.carId=old.carId AND p.reopenedAt IS NULL AND s.endTime<=p.endTime AND e.startTime>=p.startTime
+    WHERE s._keyPointId=old.startKeyPointId)
+BEGIN SELECT RAISE(ABORT, 'PERIOD_CLOSED'); END;
+
+CREATE TRIGGER closedperiod_delete_tracks BEFORE DELETE ON Tracks
+WHEN EXISTS (SELECT 1 FROM KeyPoints s JOIN KeyPoints e ON e._keyPointId=old.endKeyPointId
+    JOIN ClosedPeriods p ON p.carId=old.carId AND p.reopenedAt IS NULL AND s.endTime<=p.endTime AND e.startTime>=p.startTime
+    WHERE s._keyPointId=old.startKeyPointId)
+BEGIN SELECT RAISE(ABORT, 'PERIOD_CLOSED'); END;
+
+-- not all KeyPoints know their car, fall back to the car of the device
+CREATE TRIGGER closedperiod_insert_keypoints BEFORE INSERT ON KeyPoints
+WHEN EXISTS (SELECT 1 FROM ClosedPeriods p
+    WHERE p.carId=IFNULL(new.carId, (SELECT carId FROM Devices WHERE _deviceId=new.deviceId))
+    AND p.reopenedAt IS NULL AND new.startTime>=p.startTime AND new.endTime<=p.endTime)
+BEGIN SELECT RAISE(ABORT, 'PERIOD_CLOSED'); END;
+
+CREATE TRIGGER closedperiod_update_keypoints BEFORE UPDATE ON KeyPoints
+WHEN EXISTS (SELECT 1 FROM ClosedPeriods p
+    WHERE p.carId=IFNULL(old.carId, (SELECT carId FROM Devices WHERE _deviceId=old.deviceId))
+    AND p.reopenedAt IS NULL AND old.startTime>=p.startTime AND old.endTime<=p.endTime)
+BEGIN SELECT RAISE(ABORT, 'PERIOD_CLOSED'); END;
+
+CREATE TRIGGER closedperiod_delete_keypoints BEFORE DELETE ON KeyPoints
+WHEN EXISTS (SELECT 1 FROM ClosedPeriods p
+    WHERE p.carId=IFNULL(old.carId, (SELECT carId FROM Devices WHERE _deviceId=old.deviceId))
+    AND p.reopenedAt IS NULL AND old.startTime>=p.startTime AND old.endTime<=p.endTime)
+BEGIN SELECT RAISE(ABORT, 'PERIOD_CLOSED'); END;
@@ -0,0 +1,17 @@
+-- +migrate Up
+-- quota usage reported by the odl-geocoder, one row per user, provider & window (one day, UTC)
+CREATE TABLE IF NOT EXISTS `GeocoderUsage` (
+    userId INTEGER NOT NULL,
+    provider TEXT NOT NULL,
+    windowStart INTEGER NOT NULL, -- unix time
+    maxRequestsPerDay INTEGER NOT NULL DEFAULT 0,
+    maxRequestsPerUser INTEGER NOT NULL DEFAULT 0,
+    curDailyRequestsUsed INTEGER NOT NULL DEFAULT 0,
+    curUserRequestsUsed INTEGER NOT NULL DEFAULT 0,
+    requests INTEGER NOT NULL DEFAULT 0,
+    deferred INTEGER NOT NULL DEFAULT 0,
+    updated INTEGER NOT NULL DEFAULT 0, -- unix time
+    PRIMARY KEY (userId, provider, windowStart)
+);
+
+CREATE INDEX IF NOT EXISTS IDX_GeocoderUsage_windowStart ON GeocoderUsage(windowStart);
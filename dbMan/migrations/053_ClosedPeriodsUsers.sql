@@ -0,0 +1,4 @@
+-- +migrate Up
+-- the users who closed & reopened a period, for the audit (NULL for periods closed before)
+ALTER TABLE ClosedPeriods ADD COLUMN closedBy INTEGER;
+ALTER TABLE ClosedPeriods ADD COLUMN reopenedBy INTEGER;
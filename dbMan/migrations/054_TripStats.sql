@@ -0,0 +1,88 @@
+-- +migrate Up
+-- speed & elevation of the tracks of each trip, so listing trips doesn't need to aggregate them on every read.
+-- Kept up to date by the triggers below whenever the tracks of a trip or their speed & elevation change.
+CREATE TABLE IF NOT EXISTS `TripStats` (
+    tripId INTEGER PRIMARY KEY,
+    maxSpeed DOUBLE, -- km/h
+    avgMovingSpeed DOUBLE, -- km/h, only counting the time spent moving
+    weightedMedianSpeed DOUBLE, -- km/h, the medianSpeed of the tracks weighted by their movingTime
+    movingTime INTEGER, -- ms
+    speedingEvents INTEGER,
+    ascent DOUBLE, -- m
+    descent DOUBLE, -- m
+    minAltitude DOUBLE, -- m
+    maxAltitude DOUBLE, -- m
+    FOREIGN KEY (tripId) REFERENCES Trips(_tripId)
+);
+
+INSERT INTO TripStats (tripId, maxSpeed, avgMovingSpeed, weightedMedianSpeed, movingTime, speedingEvents, ascent, descent, minAltitude, maxAltitude)
+SELECT tt.tripId, MAX(t.maxSpeed), SUM(t.avgMovingSpeed*t.movingTime)/SUM(t.movingTime), SUM(t.medianSpeed*t.movingTime)/SUM(t.movingTime),
+    SUM(t.movingTime), SUM((SELECT COUNT(*) FROM SpeedingEvents se WHERE se.trackId=t._trackId)),
+    SUM(t.ascent), SUM(t.descent), MIN(t.minAltitude), MAX(t.maxAltitude)
+FROM Tracks_Trips tt JOIN Trips tr ON tr._tripId=tt.tripId JOIN Tracks t ON t._trackId=tt.trackId GROUP BY tt.tripId;
+
+-- +migrate StatementBegin
+CREATE TRIGGER tripstats_insert_trackstrips AFTER INSERT ON Tracks_Trips BEGIN
+DELETE FROM TripStats WHERE tripId=new.tripId;
+INSERT INTO TripStats (tripId, maxSpeed, avgMovingSpeed, weightedMedianSpeed, movingTime, speedingEvents, ascent, descent, minAltitude, maxAltitude)
+SELECT tt.tripId, MAX(t.maxSpeed), SUM(t.avgMovingSpeed*t.movingTime)/SUM(t.movingTime), SUM(t.medianSpeed*t.movingTime)/SUM(t.movingTime),
+    SUM(t.movingTime), SUM((SELECT COUNT(*) FROM SpeedingEvents se WHERE se.trackId=t._trackId)),
+    SUM(t.ascent), SUM(t.descent), MIN(t.minAltitude), MAX(t.maxAltitude)
+FROM Tracks_Trips tt JOIN Trips tr ON tr._tripId=tt.tripId JOIN Tracks t ON t._trackId=tt.trackId WHERE tt.tripId=new.tripId GROUP BY tt.tripId;
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER tripstats_delete_trackstrips AFTER DELETE ON Tracks_Trips BEGIN
+DELETE FROM TripStats WHERE tripId=old.tripId;
+INSERT INTO TripStats (tripId, maxSpeed, avgMovingSpeed, weightedMedianSpeed, movingTime, speedingEvents, ascent, descent, minAltitude, maxAltitude)
+SELECT tt.tripId, MAX(t.maxSpeed), SUM(t.avgMovingSpeed*t.movingTime)/SUM(t.movingTime), SUM(t.medianSpeed*t.movingTime)/SUM(t.movingTime),
+    SUM(t.movingTime), SUM((SELECT COUNT(*) FROM SpeedingEvents se WHERE se.trackId=t._trackId)),
+    SUM(t.ascent), SUM(t.descent), MIN(t.minAltitude), MAX(t.maxAltitude)
+FROM Tracks_Trips tt JOIN Trips tr ON tr._tripId=tt.tripId JOIN Tracks t ON t._trackId=tt.trackId WHERE tt.tripId=old.tripId GROUP BY tt.tripId;
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER tripstats_update_trackstrips AFTER UPDATE ON Tracks_Trips BEGIN
+DELETE FROM TripStats WHERE tripId IN (old.tripId, new.tripId);
+INSERT INTO TripStats (tripId, maxSpeed, avgMovingSpeed, weightedMedianSpeed, movingTime, speedingEvents, ascent, descent, minAltitude, maxAltitude)
+SELECT tt.tripId, MAX(t.maxSpeed), SUM(t.avgMovingSpeed*t.movingTime)/SUM(t.movingTime), SUM(t.medianSpeed*t.movingTime)/SUM(t.movingTime),
+    SUM(t.movingTime), SUM((SELECT COUNT(*) FROM SpeedingEvents se WHERE se.trackId=t._trackId)),
+    SUM(t.ascent), SUM(t.descent), MIN(t.minAltitude), MAX(t.maxAltitude)
+FROM Tracks_Trips tt JOIN Trips tr ON tr._tripId=tt.tripId JOIN Tracks t ON t._trackId=tt.trackId WHERE tt.tripId IN (old.tripId, new.tripId) GROUP BY tt.tripId;
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER tripstats_update_tracks AFTER UPDATE OF maxSpeed, avgMovingSpeed, medianSpeed, movingTime, ascent,
+    descent, minAltitude, maxAltitude ON Tracks BEGIN
+DELETE FROM TripStats WHERE tripId IN (SELECT tripId FROM Tracks_Trips WHERE trackId=new._trackId);
+INSERT INTO TripStats (tripId, maxSpeed, avgMovingSpeed, weightedMedianSpeed, movingTime, speedingEvents, ascent, descent, minAltitude, maxAltitude)
+SELECT tt.tripId, MAX(t.maxSpeed), SUM(t.avgMovingSpeed*t.movingTime)/SUM(t.movingTime), SUM(t.medianSpeed*t.movingTime)/SUM(t.movingTime),
+    SUM(t.movingTime), SUM((SELECT COUNT(*) FROM SpeedingEvents se WHERE se.trackId=t._trackId)),
+    SUM(t.ascent), SUM(t.descent), MIN(t.minAltitude), MAX(t.maxAltitude)
+FROM Tracks_Trips tt JOIN Trips tr ON tr._tripId=tt.tripId JOIN Tracks t ON t._trackId=tt.trackId
+WHERE tt.tripId IN (SELECT tripId FROM Tracks_Trips WHERE trackId=new._trackId) GROUP BY tt.tripId;
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER tripstats_insert_speedingevents AFTER INSERT ON SpeedingEvents BEGIN
+UPDATE TripStats SET speedingEvents=IFNULL(speedingEvents,0)+1
+WHERE tripId IN (SELECT tripId FROM Tracks_Trips WHERE trackId=new.trackId);
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER tripstats_delete_speedingevents AFTER DELETE ON SpeedingEvents BEGIN
+UPDATE TripStats SET speedingEvents=speedingEvents-1
+WHERE tripId IN (SELECT tripId FROM Tracks_Trips WHERE trackId=old.trackId);
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER tripstats_delete_trips AFTER DELETE ON Trips BEGIN
+DELETE FROM TripStats WHERE tripId=old._tripId;
+END;
+-- +migrate StatementEnd
@@ -0,0 +1,6 @@
+-- +migrate Up
+-- the timeMillis as uploaded by the device, before NormalizeTrackRecords corrected it, so repeated uploads are
+-- recognized even if they got another correction. NULL for records uploaded before.
+ALTER TABLE TrackRecords ADD deviceTimeMillis INTEGER;
+
+CREATE INDEX IF NOT EXISTS IDX_TR_DeviceTime ON TrackRecords(deviceId, deviceTimeMillis);
@@ -14,12 +14,11 @@ import (
 	. "github.com/OpenDriversLog/goodl-lib/tools"
 	"math"
 	"net/http"
+	"sync"
 	"time"
 
 	"encoding/json"
-	"io/ioutil"
 	gc "github.com/OpenDriversLog/goodl-lib/models/odl-geocode"
-	"net/url"
 )
 
 const TAG = "goodl-lib/jsonApi/addressManager.go"
@@ -259,9 +258,9 @@ func GetPointsOfInterest(where string, dbCon *sql.DB, params ...interface{}) (po
 var GeoZoneSize = 0.1
 
 // CreateGeoZoneAddress creates a new Address and puts a default GeoZone of 50 meters in each direction around it if no geoZone is given
-func CreateGeoZoneAddress(address *Address, dbCon *sql.DB) (key int64, err error) {
-	insFields := "street,postal,city,additional1,additional2,HouseNumber,title,fuel,geoCoder"
-	valString := "?,?,?,?,?,?,?,?,?"
+func CreateGeoZoneAddress(address *Address, dbCon DbRunner) (key int64, err error) {
+	insFields := "street,postal,city,additional1,additional2,HouseNumber,title,fuel,geoCoder,userEdited"
+	valString := "?,?,?,?,?,?,?,?,?,1"
 	var gzKey int64 = 0
 	vals := []interface{}{address.Street, address.Postal, address.City, address.Additional1, address.Additional2, address.HouseNumber, address.Title, address.Fuel,address.GeoCoder}
 	if address.Latitude == 0 && address.Longitude == 0 {
@@ -339,7 +338,7 @@ func UpdateAddress(address *Address, dbCon *sql.DB) (err error) {
 		dbg.WTF(TAG, "Somebody tried to update an address (%d) with retryTime of 0 - this should not be possible",address.Id)
 		return errors.New("Not allowed")
 	}
-	_, err = dbCon.Exec("UPDATE Addresses SET street=?, postal=?, city=?,houseNumber=?,geoCoder=?,retryTime=0 WHERE _addressId=?", address.Street, address.Postal, address.City, address.HouseNumber,address.GeoCoder, address.Id)
+	_, err = dbCon.Exec("UPDATE Addresses SET street=?, postal=?, city=?,houseNumber=?,geoCoder=?,retryTime=0,geocodedAt=? WHERE _addressId=?", address.Street, address.Postal, address.City, address.HouseNumber,address.GeoCoder, time.Now().Unix(), address.Id)
 
 	return
 }
@@ -418,55 +417,68 @@ var ErrNeedFixBeforeRetry = errors.New("Need fix before retrying!")
 // if there already is a similar address in the users database, followed by asking the Geocoder if nothing was found.
 // If client is nil, it will be initialised automatically.
 func FillAddressForLatLng(addr *Address, lat float64, lng float64, client *http.Client,uId int64, dbCon *sql.DB) (err error) {
+	return FillAddressForLatLngWithGeocoder(addr, lat, lng, NewHTTPGeocoder("", client, dbCon), uId, dbCon)
+}
+
+// FillAddressForLatLngWithGeocoder is FillAddressForLatLng asking the given Geocoder (a HTTPGeocoder if nil).
+func FillAddressForLatLngWithGeocoder(addr *Address, lat float64, lng float64, geocoder Geocoder, uId int64, dbCon *sql.DB) (err error) {
+	geocoder = orDefaultGeocoder(geocoder, dbCon)
+	addr.Latitude = S.NFloat64(lat)
+	addr.Longitude = S.NFloat64(lng)
+
+	known, err := fillKnownAddress(addr, lat, lng, dbCon)
+	if err != nil || known {
+		return
+	}
+	dbg.I(TAG, "No corresponding address found - ask geocoder!")
+	return reverseGeocode(addr, lat, lng, geocoder, uId)
+}
+
+// fillKnownAddress fills addr with a geocoded address known within about 10 meters, known is false if there is none.
+func fillKnownAddress(addr *Address, lat float64, lng float64, dbCon *sql.DB) (known bool, err error) {
 	k := float64(10) / 111111
 	minLat := lat - k
 	maxLat := lat + k
 	minLng := lng - math.Cos(lat)/111111
 	maxLng := lng + math.Cos(lat)/111111
 
-	addr.Latitude = S.NFloat64(lat)
-	addr.Longitude = S.NFloat64(lng)
-
 	var addrId int64
 
 	//dbg.WTF(TAG,"Found minLat %f maxLat %f minLng %f maxLng %f for lat %lat and lng %lng ")
 	err = dbCon.QueryRow(`SELECT _addressId FROM Addresses WHERE HouseNumber!="" AND latitude>? AND longitude>? AND latitude<? AND longitude<?`, minLat, minLng, maxLat, maxLng).Scan(&addrId)
-	// returns models.Address
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
 	if err != nil {
-		if err != sql.ErrNoRows {
-			FillUnknownAddress(addr)
-			dbg.E(TAG, "Error querying for existing addressId : ", err)
-			return ErrNeedFixBeforeRetry
-		} else {
-
-			dbg.I(TAG, "No corresponding address found - ask geocoder!")
-			err = FillAddrFromGeocoder(addr,lat,lng,client, uId)
-			addr.Latitude = S.NFloat64(lat)
-			addr.Longitude = S.NFloat64(lng)
-			if err != nil {
-				dbg.W(TAG, "Error filling address : ", err)
-
-			}
-
-		}
-	} else { // We found an matching address in the database
-		dbg.V(TAG, "Matching address (+/-1 10m) with id %d found in DB!", addrId)
-		var ad *Address
-		ad, err = GetAddressById(addrId, dbCon)
-		if err != nil {
-			dbg.E(TAG, "Error getting known address", err)
-			FillUnknownAddress(addr)
-			return
-		}
-		addr.Street = ad.Street
-		addr.HouseNumber = ad.HouseNumber
-		addr.City = ad.City
-		addr.Postal = ad.Postal
-		addr.Fuel = ad.Fuel
-		addr.GeoCoder = ad.GeoCoder
-
+		FillUnknownAddress(addr)
+		dbg.E(TAG, "Error querying for existing addressId : ", err)
+		return false, ErrNeedFixBeforeRetry
+	}
+	// We found an matching address in the database
+	dbg.V(TAG, "Matching address (+/-1 10m) with id %d found in DB!", addrId)
+	ad, err := GetAddressById(addrId, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error getting known address", err)
+		FillUnknownAddress(addr)
 		return
 	}
+	addr.Street = ad.Street
+	addr.HouseNumber = ad.HouseNumber
+	addr.City = ad.City
+	addr.Postal = ad.Postal
+	addr.Fuel = ad.Fuel
+	addr.GeoCoder = ad.GeoCoder
+	return true, nil
+}
+
+// reverseGeocode fills addr with the address the given Geocoder found at the given latitude & longitude.
+func reverseGeocode(addr *Address, lat float64, lng float64, geocoder Geocoder, uId int64) (err error) {
+	err = geocoder.Reverse(addr, lat, lng, uId)
+	addr.Latitude = S.NFloat64(lat)
+	addr.Longitude = S.NFloat64(lng)
+	if err != nil {
+		dbg.W(TAG, "Error filling address : ", err)
+	}
 	return
 }
 
@@ -475,41 +487,16 @@ var GeoChainAddr = "http://127.0.0.1:6091"
 
 // FillAddrFromGeocoder fills an address - object with the address found at the given latitude & longitude by the Geocoder.
 // Please use FillAddressForLatLng to allow for address buffering.
-// If client is nil, it will be initialised automatically.
+// If client is nil, it will be initialised automatically. The geocoder quota is not checked, see
+// FillAddrFromGeocoderWithQuota.
 func FillAddrFromGeocoder(addr *Address,lat float64, lng float64, client *http.Client,uId int64) (err error){
-	var req *http.Request
-
-	req, err = http.NewRequest("GET", fmt.Sprintf(GeoChainAddr+"/reverse/%d/b/abc/%f/%f",uId, lat, lng), nil)
-	if err != nil {
-		dbg.E(TAG, "Error initializing httpRequest : ", err)
-		FillUnknownAddress(addr)
-		return
-	}
-	if client == nil {
-		client = &http.Client{
-			Timeout: time.Duration(10 * time.Second),
-		}
-	}
-	/* Get Details */
-	var resp *http.Response
-	resp, err = client.Do(req)
-	if err != nil {
-		dbg.E(TAG, "Error executing reverse geocoda request: %s", err)
-		FillUnknownAddress(addr)
-		return
-	}
-	var _body []byte
-	_body, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		if err != nil {
-			dbg.E(TAG, "Error reading reverse geocoda response: %s", err)
-			FillUnknownAddress(addr)
-			return ErrNeedFixBeforeRetry
-		}
-	}
-	err = FillAddrFromGeocoderResp(string(_body), addr, false)
+	return FillAddrFromGeocoderWithQuota(addr, lat, lng, client, uId, nil)
+}
 
-	return
+// FillAddrFromGeocoderWithQuota is FillAddrFromGeocoder counting the request against the geocoder quota of the user
+// kept in dbCon (see CheckGeocoderQuota), returning ErrQuotaExceeded if it is used up.
+func FillAddrFromGeocoderWithQuota(addr *Address,lat float64, lng float64, client *http.Client,uId int64, dbCon *sql.DB) (err error){
+	return NewHTTPGeocoder("", client, dbCon).Reverse(addr, lat, lng, uId)
 }
 
 // FillAddrFromGeocoderResp fills an address-object using the given GeoCoder-response.
@@ -555,11 +542,54 @@ const OneDay int64 = int64(60 * 60 * 24)
 
 // GetAddressIdForLatLng finds a given address by its lat-lng, creates it in the database and returns its primary key.
 // give nil client if it should be initialized automatically. But that way it needs to auth himself for each request.
+// If the lookup fails, a placeholder address is inserted (to be retried by RetryAddresses) and its ID is returned
+// together with the error, so err != nil doesn't mean there is no address ID.
 func GetAddressIdForLatLng(lat float64, lng float64, client *http.Client, uId int64, dbCon *sql.DB) (addrId int64, err error) {
+	return GetAddressIdForLatLngWithGeocoder(lat, lng, NewHTTPGeocoder("", client, dbCon), uId, dbCon)
+}
+
+// GetAddressIdForLatLngWithGeocoder is GetAddressIdForLatLng asking the given Geocoder (a HTTPGeocoder if nil).
+// Known addresses within GeocodeCacheRadius are reused (see FindCachedAddressId).
+// If the lookup fails, the ID of the inserted placeholder address is returned along with the error of the Geocoder.
+func GetAddressIdForLatLngWithGeocoder(lat float64, lng float64, geocoder Geocoder, uId int64, dbCon *sql.DB) (addrId int64, err error) {
+	return GetAddressIdForLatLngWithLock(lat, lng, geocoder, uId, nil, dbCon)
+}
+
+// GetAddressIdForLatLngWithLock is GetAddressIdForLatLngWithGeocoder holding dbLock (if not nil) while working with
+// the database, but not while waiting for the Geocoder. Addresses found by others meanwhile are reused, so parallel
+// lookups sharing dbLock don't insert the same address twice.
+func GetAddressIdForLatLngWithLock(lat float64, lng float64, geocoder Geocoder, uId int64, dbLock sync.Locker, dbCon *sql.DB) (addrId int64, err error) {
+	geocoder = orDefaultGeocoder(geocoder, dbCon)
+	concurrent := dbLock != nil
+	if !concurrent {
+		dbLock = NoLock{}
+	}
 
 	addrId = -1
 	var addr Address
-	err = FillAddressForLatLng(&addr, lat, lng, client,uId, dbCon)
+	addr.Latitude = S.NFloat64(lat)
+	addr.Longitude = S.NFloat64(lng)
+	dbLock.Lock()
+	cachedId, found := findCachedAddressIdOrLog(lat, lng, dbCon)
+	if found {
+		dbLock.Unlock()
+		return cachedId, nil
+	}
+	known, err := fillKnownAddress(&addr, lat, lng, dbCon)
+	dbLock.Unlock()
+	if err == nil && !known {
+		err = reverseGeocode(&addr, lat, lng, geocoder, uId)
+	}
+
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	if concurrent && err == nil && !known {
+		// someone else might have looked up an address close by while we were waiting for the Geocoder
+		cachedId, found = findCachedAddressIdOrLog(lat, lng, dbCon)
+		if found {
+			return cachedId, nil
+		}
+	}
 	var retryTime int64
 	if err != nil {
 		if err == ErrEmptyResult { // Our GeoCoder did not find anything at the given address - retry tomorrow.
@@ -568,30 +598,50 @@ func GetAddressIdForLatLng(lat float64, lng float64, client *http.Client, uId in
 		} else if err == ErrNeedFixBeforeRetry { // We probably got a bug - retry next day
 			dbg.WTF(TAG, "Issue initialising geoCoding! Please check!", lat, lng)
 			retryTime = int64(time.Now().Unix() + OneDay)
+		} else if err == ErrQuotaExceeded { // Retry when the quota is reset
+			retryTime = NextGeocoderQuotaWindow()
 		} else { // GeoCoding-service was probably not reachable - retry in 30 seconds.
 			dbg.E(TAG, "Error getting Address from location : ", err)
 			retryTime = int64(time.Now().Unix() + 30)
 		}
 	}
 
-	ires, errPTID := dbCon.Exec("INSERT INTO Addresses(street, postal, city,houseNumber,latitude,longitude,GeoCoder,retryTime,tryCount) VALUES (?, ?, ?,?,?,?,?,?,1)",
-		addr.Street, addr.Postal, addr.City, addr.HouseNumber, addr.Latitude, addr.Longitude,addr.GeoCoder, retryTime)
+	var geocodedAt int64
+	if err == nil {
+		geocodedAt = time.Now().Unix()
+	}
+	ires, errPTID := dbCon.Exec("INSERT INTO Addresses(street, postal, city,houseNumber,latitude,longitude,GeoCoder,retryTime,tryCount,geocodedAt) VALUES (?, ?, ?,?,?,?,?,?,1,?)",
+		addr.Street, addr.Postal, addr.City, addr.HouseNumber, addr.Latitude, addr.Longitude,addr.GeoCoder, retryTime, geocodedAt)
 	if errPTID != nil {
 		dbg.E(TAG, "Failed to insert newAddress..", errPTID)
 		return -1, errPTID
 	}
-	addrId, err = ires.LastInsertId()
-	if err != nil {
-		dbg.E(TAG, "Failed to get Id of just inserted Address...", err)
-		return -1, err
+	// keep the error of the geocoder, so the caller can retry the lookup for the placeholder (see CreateGeocodeJob)
+	addrId, errId := ires.LastInsertId()
+	if errId != nil {
+		dbg.E(TAG, "Failed to get Id of just inserted Address...", errId)
+		return -1, errId
 	}
 
 	return
 }
 
+// findCachedAddressIdOrLog is FindCachedAddressId only logging errors, so the Geocoder is asked in that case.
+func findCachedAddressIdOrLog(lat float64, lng float64, dbCon *sql.DB) (addrId int64, found bool) {
+	addrId, source, found, err := FindCachedAddressId(lat, lng, dbCon)
+	if err != nil {
+		dbg.W(TAG, "Error asking geocode cache, asking geocoder : ", err)
+		return -1, false
+	}
+	if found {
+		dbg.V(TAG, "Using %s address %d for %f,%f from geocode cache", source, addrId, lat, lng)
+	}
+	return
+}
+
 // CreateGeoZoneFromCoords creates a new Geozone in the given distance (size) (in km) around the coord center point.
 // e.g. distance of 50 meters diagonally in each direction
-func CreateGeoZoneFromCoords(latitude float64, longitude float64, size float64, dbCon *sql.DB) (key int64, geoZone *GeoFenceRegion, err error) {
+func CreateGeoZoneFromCoords(latitude float64, longitude float64, size float64, dbCon DbRunner) (key int64, geoZone *GeoFenceRegion, err error) {
 	p := geo.NewPoint(latitude, longitude)
 	pTopLeft := p.PointAtDistanceAndBearing(size, 225)
 	pBotRight := p.PointAtDistanceAndBearing(size, 45)
@@ -621,7 +671,7 @@ func CreateGeoZoneFromCoords(latitude float64, longitude float64, size float64,
 }
 
 // DeleteGeoZoneWithRectangle deletes the given GeoZone and the according GeoRectangle.
-func DeleteGeoZoneWithRectangle(geoZone *GeoFenceRegion, dbCon *sql.DB) (rowCount int64, err error) {
+func DeleteGeoZoneWithRectangle(geoZone *GeoFenceRegion, dbCon DbRunner) (rowCount int64, err error) {
 	var res sql.Result
 	if geoZone.Rectangle != nil && geoZone.Rectangle.Id != 0 {
 		_, err = DeleteRectangle(int64(geoZone.Rectangle.Id), dbCon)
@@ -656,7 +706,7 @@ func DeleteGeoZoneWithRectangle(geoZone *GeoFenceRegion, dbCon *sql.DB) (rowCoun
 }
 
 // DeleteRectangle deletes a GeoRectangle.
-func DeleteRectangle(id int64, dbCon *sql.DB) (rowCount int64, err error) {
+func DeleteRectangle(id int64, dbCon DbRunner) (rowCount int64, err error) {
 	var res sql.Result
 	res, err = dbCon.Exec("DELETE FROM Rectangles WHERE _rectangleId=?", id)
 	if err != nil {
@@ -672,7 +722,7 @@ func DeleteRectangle(id int64, dbCon *sql.DB) (rowCount int64, err error) {
 }
 
 // CreateGeoZone creates a new GeoZone, with a given GeoRectangle or a new one.
-func CreateGeoZone(geoZone *GeoFenceRegion, dbCon *sql.DB) (key int64, err error) {
+func CreateGeoZone(geoZone *GeoFenceRegion, dbCon DbRunner) (key int64, err error) {
 
 	var rectKey int64 = -1
 	if geoZone.Rectangle != nil {
@@ -717,7 +767,7 @@ func CreateGeoZone(geoZone *GeoFenceRegion, dbCon *sql.DB) (key int64, err error
 }
 
 // CreateGeoRectangle creates a new GeoRectangle.
-func CreateGeoRectangle(geoRectangle *GeoRectangle, dbCon *sql.DB) (key int64, err error) {
+func CreateGeoRectangle(geoRectangle *GeoRectangle, dbCon DbRunner) (key int64, err error) {
 	vals := []interface{}{geoRectangle.BotRightLat, geoRectangle.BotRightLon, geoRectangle.TopLeftLat, geoRectangle.TopLeftLon}
 	valString := "?,?,?,?"
 
@@ -736,10 +786,29 @@ func CreateGeoRectangle(geoRectangle *GeoRectangle, dbCon *sql.DB) (key int64, e
 
 // CreateContact creates a new contact.
 func CreateContact(contact *Contact, dbCon *sql.DB) (key int64, err error) {
+	tx, err := dbCon.Begin()
+	if err != nil {
+		dbg.E(TAG, "Error starting transaction for CreateContact : ", err)
+		return
+	}
+	key, err = CreateContactInTx(contact, tx)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		dbg.E(TAG, "Error commiting CreateContact : ", err)
+	}
+	return
+}
+
+// CreateContactInTx is CreateContact in the given transaction, so it can be rolled back with other changes.
+func CreateContactInTx(contact *Contact, tx *sql.Tx) (key int64, err error) {
 	var addrKey int64 = -1
 	if contact.Address != nil {
 		if contact.Address.Id < 1 { // no address existent ------ create it, El Duderino!
-			addrKey, err = CreateGeoZoneAddress(contact.Address, dbCon)
+			addrKey, err = CreateGeoZoneAddress(contact.Address, tx)
 			if err != nil {
 				dbg.E(TAG, "Error in 1st CreateGeoZoneAddress for CreateGeoRectangle: %v ", err)
 
@@ -781,9 +850,9 @@ func CreateContact(contact *Contact, dbCon *sql.DB) (key int64, err error) {
 	}
 	q := "INSERT INTO Contacts(" + insFields + ") VALUES(" + valString + ")"
 	var res sql.Result
-	res, err = dbCon.Exec(q, vals...)
+	res, err = tx.Exec(q, vals...)
 	if err != nil {
-		dbg.E(TAG, "Error in 2nd dbCon.Exec for CreateGeoRectangle: %v ", err)
+		dbg.E(TAG, "Error in 2nd tx.Exec for CreateGeoRectangle: %v ", err)
 
 		return
 	}
@@ -791,7 +860,7 @@ func CreateContact(contact *Contact, dbCon *sql.DB) (key int64, err error) {
 	contact.Id = S.NInt64(key)
 	if contact.Address != nil && len(contact.Address.GeoZones) != 0 {
 		for _, gz := range contact.Address.GeoZones {
-			err = UpdateAllKeyPointsForGeoZones([]int64{int64(gz.Id)}, dbCon)
+			err = updateAllKeyPointsForGeoZones([]int64{int64(gz.Id)}, tx)
 			if err != nil {
 				dbg.E(TAG, "Error in UpdateAllKeyPointsForGeoZones for CreateGeoZone: %v ", err)
 				return
@@ -1066,9 +1135,11 @@ func CalcRetryTime(tryCount int64, err error) (retryTime int64) {
 		retryTime = int64(time.Now().Unix() + OneDay)
 
 		dbg.I(TAG, "We will retry on next trip request after one day, at unix time %d", retryTime)
+	} else if err == ErrQuotaExceeded { // Our quota is used up - retry in the next window
+		retryTime = NextGeocoderQuotaWindow()
+		dbg.I(TAG, "Geocoder quota exceeded, we will retry at unix time %d", retryTime)
 	} else { // GeoCoding-service was probably not reachable - retry in 30 seconds * tryCount^1.6, max. 12 hours.
 		// so e.g. on the 20th try we are waiting one hour
-		// TODO : Factor in our allowed daily usage
 
 		repeatTime := int64(30 * math.Pow(float64(tryCount), 1.6))
 		if repeatTime > OneDay/2 {
@@ -1082,44 +1153,15 @@ func CalcRetryTime(tryCount int64, err error) (retryTime int64) {
 }
 
 // GetAdressFromString tries parsing an address string & returns a geocoded address.
+// The geocoder quota is not checked, see GetAddressFromStringWithQuota.
 func GetAddressFromString(addr string, client *http.Client,uId int64) (a *Address, err error) {
-	a = &Address{}
-	var req *http.Request
-	q := fmt.Sprintf(GeoChainAddr+"/forward/%d/b/abc/%s",uId, url.QueryEscape(addr))
-	req, err = http.NewRequest("GET", q, nil)
-	if err != nil {
-		dbg.E(TAG, "Error initializing httpRequest : ", err)
-		FillUnknownAddress(a)
-		return
-	}
-	if client == nil {
-		client = &http.Client{}
-	}
-	/* Get Details */
-	var resp *http.Response
-	resp, err = client.Do(req)
-	if err != nil {
-		dbg.E(TAG, "Error executing geocoda request: %s", err)
-		FillUnknownAddress(a)
-		return
-	}
-	var _body []byte
-	_body, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		if err != nil {
-			dbg.E(TAG, "Error reading geocoda response: %s", err)
-			FillUnknownAddress(a)
-			return nil, ErrNeedFixBeforeRetry
-		}
-	}
-	err = FillAddrFromGeocoderResp(string(_body), a,true)
-	if err != nil {
-		dbg.W(TAG, "Error filling address from resp : ", err)
-		if dbg.Debugging {
-			dbg.W(TAG, "Resp : %s", string(_body))
-		}
-	}
-	return
+	return GetAddressFromStringWithQuota(addr, client, uId, nil)
+}
+
+// GetAddressFromStringWithQuota is GetAddressFromString counting the request against the geocoder quota of the user
+// kept in dbCon (see CheckGeocoderQuota), returning ErrQuotaExceeded if it is used up.
+func GetAddressFromStringWithQuota(addr string, client *http.Client,uId int64, dbCon *sql.DB) (a *Address, err error) {
+	return NewHTTPGeocoder("", client, dbCon).Forward(addr, uId)
 }
 
 // GetAddressesByWhere returns the addresses matching the given where-string & parameters.
@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/periodManager"
 )
 
 var ErrEmptyFilter = errors.New("Empty filter")
@@ -23,6 +24,15 @@ func UpdateAllKeyPointsForGeoZones(geoZoneIds []int64, dbCon *sql.DB) (err error
 	return UpdateKeyPointsForGeoZonesByWhereQuery("KeyPoints_GeoFenceRegions.geoFenceRegionId IN ("+gInString+")", "G._geoFenceRegionId IN ("+gInString+")", dbCon)
 }
 
+// updateAllKeyPointsForGeoZones is UpdateAllKeyPointsForGeoZones in the given transaction.
+func updateAllKeyPointsForGeoZones(geoZoneIds []int64, tx *sql.Tx) (err error) {
+	if len(geoZoneIds) == 0 {
+		return ErrEmptyFilter
+	}
+	gInString := getInString(geoZoneIds)
+	return updateKeyPointsForGeoZonesByWhereQuery("KeyPoints_GeoFenceRegions.geoFenceRegionId IN ("+gInString+")", "G._geoFenceRegionId IN ("+gInString+")", tx)
+}
+
 // UpdateKeyPointsForAllGeozones updates the given KeyPoints for all GeoZones (for finding automatic contacts)
 func UpdateKeyPointsForAllGeozones(keyPointIds []int64, dbCon *sql.DB) (err error) {
 	if len(keyPointIds) == 0 {
@@ -52,6 +62,28 @@ func UpdateKeyPointsForGeoZones(geoZoneIds []int64, keyPointIds []int64, dbCon *
 // UpdateKeyPointsForGeoZonesByWhereQuery updates all keypoints matching the given geozones, updating the KeyPoint-GeofenceRegion-mapping-table.
 // firstWhere referencing table KeyPoints_GeoFenceRegions, secondWhere referencing Keypoints/GeoFenceRegions-Table directly - BOTH are required and need to contain the same results!
 func UpdateKeyPointsForGeoZonesByWhereQuery(firstWhere string, secondWhere string, dbCon *sql.DB) (err error) {
+	if (firstWhere != "" && secondWhere == "") || (secondWhere != "" && firstWhere == "") {
+		return ErrEmptyFilter
+	}
+	tx, err := dbCon.Begin()
+	if err != nil {
+		dbg.E(TAG, "Error starting transaction : ", err)
+		return
+	}
+	err = updateKeyPointsForGeoZonesByWhereQuery(firstWhere, secondWhere, tx)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		dbg.E(TAG, "Error commiting transaction : ", err)
+	}
+	return
+}
+
+// updateKeyPointsForGeoZonesByWhereQuery is UpdateKeyPointsForGeoZonesByWhereQuery in the given transaction.
+func updateKeyPointsForGeoZonesByWhereQuery(firstWhere string, secondWhere string, tx *sql.Tx) (err error) {
 	var cmd string
 	if (firstWhere != "" && secondWhere == "") || (secondWhere != "" && firstWhere == "") {
 		return ErrEmptyFilter
@@ -64,14 +96,9 @@ func UpdateKeyPointsForGeoZonesByWhereQuery(firstWhere string, secondWhere strin
 	}
 
 	var res sql.Result
-	tx, err := dbCon.Begin()
-	if err != nil {
-		dbg.E(TAG, "Error starting transaction : ", err)
-		return
-	}
 	cmd = strings.Replace(cmd, "\n", " ", -1)
 	dbg.D(TAG, "I will execute : ", cmd)
-	res, err = dbCon.Exec(cmd)
+	res, err = tx.Exec(cmd)
 
 	if err != nil {
 		dbg.E(TAG, "UpdateKeyPointsForGeoZonesByWhereQuery (%v,%v,dbCon) failed at deleting : %v", firstWhere, secondWhere, err)
@@ -110,114 +137,80 @@ LEFT JOIN Tracks T ON T.StartKeyPointId=KeyPoints_GeoFenceRegions.keyPointId
 	} else {
 		eContactsQuery = fmt.Sprintf(eContactsQuery, "")
 	}
-	var rows *sql.Rows
-
-	q := ""
-	var tIds string
-	var contactId int64
-	pms := make([]interface{}, 0)
-	var rc int64  //rowCount
-	var trc int64 //temporary rowCount
-	var r sql.Result
 
 	/**
 	Set StartContactId for Trips without StartContact, but matching the new/updated KeyPoint/GeoZone
 	*/
-	rows, err = dbCon.Query(sContactsQuery)
+	rc, skipped, err := setTripContacts(sContactsQuery, "startContactId", tx)
 	if err != nil {
-		dbg.E(TAG, "Error getting new StartContacts : ", err)
+		dbg.E(TAG, "Error setting new startContactIds : ", err)
 		return
 	}
-	for rows.Next() {
-		err = rows.Scan(&tIds, &contactId)
-		if err != nil {
-			dbg.E(TAG, "Error scanning StartContactsRow : ", err)
-			return
-		}
-		q += fmt.Sprintf("UPDATE TRIPS SET startContactId=? WHERE _tripId IN(%v) AND startContactId IS NULL;", tIds)
-		pms = append(pms, contactId)
-		if len(pms) > 500 {
-			r, err = dbCon.Exec(q, pms...)
-			if err != nil {
-				dbg.E(TAG, "Error setting new startContactIds : ", err)
-				return
-			}
-			trc, err = r.RowsAffected()
-			if err != nil {
-				dbg.E(TAG, "Error getting RosAffected for new startContactIds : ", err)
-				return
-			}
-			rc += trc
-			q = ""
-			pms = make([]interface{}, 0)
-		}
-	}
-	if len(pms) > 0 {
-		r, err = dbCon.Exec(q, pms...)
-		if err != nil {
-			dbg.E(TAG, "Error setting new startContactIds : ", err)
-			return
-		}
-		trc, err = r.RowsAffected()
-		if err != nil {
-			dbg.E(TAG, "Error getting RowsAffected for new startContactIds : ", err)
-			return
-		}
-		rc += trc
-	}
-	dbg.I(TAG, "Updated %d trips with new startContactIds ", rc)
+	dbg.I(TAG, "Updated %d trips with new startContactIds, skipped %d in closed periods", rc, skipped)
 
 	/**
 	Set EndContactId for Trips without EndContact, but matching the new/updated KeyPoint/GeoZone
 	*/
-	rows, err = dbCon.Query(eContactsQuery)
+	rc, skipped, err = setTripContacts(eContactsQuery, "endContactId", tx)
 	if err != nil {
-		dbg.E(TAG, "Error getting new EndContacts : ", err)
+		dbg.E(TAG, "Error setting new endContactIds : ", err)
 		return
 	}
+	dbg.I(TAG, "Updated %d trips with new endContactIds, skipped %d in closed periods", rc, skipped)
+	return
+}
+
+// setTripContacts sets the contacts returned by contactsQuery (rows of comma-separated tripIds & contactId) as
+// contactColumn of those trips still having none. Trips in closed periods are skipped and counted, as they
+// can't be changed anymore.
+func setTripContacts(contactsQuery string, contactColumn string, tx *sql.Tx) (rowCount int64, skipped int64, err error) {
+	rows, err := tx.Query(contactsQuery)
+	if err != nil {
+		dbg.E(TAG, "Error getting new contacts for %s : ", contactColumn, err)
+		return
+	}
+	tIds := make([]string, 0)
+	contactIds := make([]int64, 0)
 	for rows.Next() {
-		err = rows.Scan(&tIds, &contactId)
+		var t string
+		var contactId int64
+		err = rows.Scan(&t, &contactId)
 		if err != nil {
-			dbg.E(TAG, "Error scanning EndContactsRow : ", err)
+			rows.Close()
+			dbg.E(TAG, "Error scanning contacts row : ", err)
 			return
 		}
-		q += fmt.Sprintf("UPDATE TRIPS SET endContactId=? WHERE _tripId IN(%v) AND endContactId IS NULL;", tIds)
-		pms = append(pms, contactId)
-		if len(pms) > 500 {
-			r, err = dbCon.Exec(q, pms...)
-			if err != nil {
-				dbg.E(TAG, "Error setting new endContactIds : ", err)
-				return
-			}
-			trc, err = r.RowsAffected()
-			if err != nil {
-				dbg.E(TAG, "Error getting RosAffected for new endContactIds : ", err)
-				return
-			}
-			rc += trc
-			q = ""
-			pms = make([]interface{}, 0)
-		}
+		tIds = append(tIds, t)
+		contactIds = append(contactIds, contactId)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
 	}
-	if len(pms) > 0 {
-		r, err = dbCon.Exec(q, pms...)
+
+	closed := periodManager.ClosedTripCondition("_tripId")
+	for i, contactId := range contactIds {
+		where := fmt.Sprintf("_tripId IN(%v) AND %s IS NULL AND ", tIds[i], contactColumn)
+		var c int64
+		err = tx.QueryRow("SELECT COUNT(*) FROM Trips WHERE " + where + closed).Scan(&c)
 		if err != nil {
-			dbg.E(TAG, "Error setting new endContactIds : ", err)
+			dbg.E(TAG, "Error counting trips in closed periods : ", err)
 			return
 		}
-		trc, err = r.RowsAffected()
+		skipped += c
+
+		var r sql.Result
+		r, err = tx.Exec("UPDATE Trips SET "+contactColumn+"=? WHERE "+where+"NOT "+closed, contactId)
 		if err != nil {
-			dbg.E(TAG, "Error getting RowsAffected for new endContactIds : ", err)
 			return
 		}
-		rc += trc
-	}
-	dbg.I(TAG, "Updated %d trips with new endContactIds", rc)
-	err = tx.Commit()
-	if err != nil {
-		dbg.E(TAG, "Error commiting transaction : ", err)
+		c, err = r.RowsAffected()
+		if err != nil {
+			dbg.E(TAG, "Error getting RowsAffected for new %s : ", contactColumn, err)
+			return
+		}
+		rowCount += c
 	}
-
 	return
 }
 
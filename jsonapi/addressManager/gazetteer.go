@@ -0,0 +1,263 @@
+package addressManager
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/Compufreak345/dbg"
+	S "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	geo "github.com/kellydunn/golang-geo"
+)
+
+const gzTag = "goodl-lib/jsonApi/addressManager/gazetteer.go"
+
+// GazetteerProvider is the GeoCoder saved for addresses found by a GazetteerGeocoder.
+const GazetteerProvider = "gazetteer"
+
+// gazetteerCellSize is the size of a cell of the spatial index in degrees (~1km)
+const gazetteerCellSize = 0.01
+
+var ErrInvalidGazetteer = errors.New("Gazetteer needs at least a latitude and a longitude column")
+
+// GazetteerEntry is a single known address of a gazetteer.
+type GazetteerEntry struct {
+	Lat         float64
+	Lng         float64
+	Street      string
+	HouseNumber string
+	Postal      string
+	City        string
+	Title       string
+
+	// tokens are the lower case words of the entry, used for forward geocoding
+	tokens map[string]bool
+}
+
+type gazetteerCell struct {
+	X int
+	Y int
+}
+
+// GazetteerGeocoder is a Geocoder working offline on a list of known addresses, e.g. extracted from OpenStreetMap.
+type GazetteerGeocoder struct {
+	// MaxDistance is the maximum distance (km) of an entry to the requested location for reverse geocoding
+	MaxDistance float64
+
+	entries []*GazetteerEntry
+	grid    map[gazetteerCell][]*GazetteerEntry
+}
+
+// NewGazetteerGeocoder returns a GazetteerGeocoder for the given entries, with a MaxDistance of 100 meters.
+func NewGazetteerGeocoder(entries []*GazetteerEntry) *GazetteerGeocoder {
+	g := &GazetteerGeocoder{
+		MaxDistance: 0.1,
+		entries:     entries,
+		grid:        make(map[gazetteerCell][]*GazetteerEntry),
+	}
+	for _, e := range entries {
+		e.tokens = make(map[string]bool)
+		for _, t := range gazetteerTokens(e.Street + " " + e.HouseNumber + " " + e.Postal + " " + e.City + " " + e.Title) {
+			e.tokens[t] = true
+		}
+		c := gazetteerCellFor(e.Lat, e.Lng)
+		g.grid[c] = append(g.grid[c], e)
+	}
+	return g
+}
+
+// LoadGazetteer loads a GazetteerGeocoder from the CSV file at the given path (see LoadGazetteerFromCSV).
+func LoadGazetteer(path string) (g *GazetteerGeocoder, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		dbg.E(gzTag, "Error opening gazetteer %s : ", path, err)
+		return
+	}
+	defer f.Close()
+	return LoadGazetteerFromCSV(f)
+}
+
+// LoadGazetteerFromCSV loads a GazetteerGeocoder from CSV data separated by "," or ";". The first line is the header,
+// naming the columns lat/latitude, lon/lng/longitude, street, housenumber, postcode/postal, city and name/title
+// (case insensitive, "addr:"-prefixes of OSM are ignored). Other columns are ignored, rows without valid coordinates are skipped.
+func LoadGazetteerFromCSV(r io.Reader) (g *GazetteerGeocoder, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		dbg.E(gzTag, "Error reading gazetteer : ", err)
+		return
+	}
+	reader := csv.NewReader(bytes.NewReader(data))
+	header := data
+	if idx := bytes.IndexByte(data, '\n'); idx != -1 {
+		header = data[:idx]
+	}
+	if bytes.Count(header, []byte(";")) > bytes.Count(header, []byte(",")) {
+		reader.Comma = ';'
+	}
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	cols, err := reader.Read()
+	if err != nil {
+		dbg.E(gzTag, "Error reading gazetteer header : ", err)
+		return
+	}
+	idx := map[string]int{"lat": -1, "lng": -1, "street": -1, "housenumber": -1, "postal": -1, "city": -1, "title": -1}
+	for i, c := range cols {
+		c = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(c)), "addr:")
+		switch c {
+		case "lat", "latitude":
+			idx["lat"] = i
+		case "lon", "lng", "longitude":
+			idx["lng"] = i
+		case "street":
+			idx["street"] = i
+		case "housenumber", "house_number", "housenr":
+			idx["housenumber"] = i
+		case "postcode", "postal", "zip":
+			idx["postal"] = i
+		case "city", "town", "place":
+			idx["city"] = i
+		case "name", "title":
+			idx["title"] = i
+		}
+	}
+	if idx["lat"] == -1 || idx["lng"] == -1 {
+		err = ErrInvalidGazetteer
+		return
+	}
+
+	entries := make([]*GazetteerEntry, 0)
+	skipped := 0
+	for {
+		var rec []string
+		rec, err = reader.Read()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			dbg.E(gzTag, "Error reading gazetteer line : ", err)
+			return
+		}
+		field := func(name string) string {
+			i := idx[name]
+			if i == -1 || i >= len(rec) {
+				return ""
+			}
+			return strings.TrimSpace(rec[i])
+		}
+		lat, errLat := strconv.ParseFloat(field("lat"), 64)
+		lng, errLng := strconv.ParseFloat(field("lng"), 64)
+		if errLat != nil || errLng != nil {
+			skipped++
+			continue
+		}
+		entries = append(entries, &GazetteerEntry{
+			Lat:         lat,
+			Lng:         lng,
+			Street:      field("street"),
+			HouseNumber: field("housenumber"),
+			Postal:      field("postal"),
+			City:        field("city"),
+			Title:       field("title"),
+		})
+	}
+	if skipped != 0 {
+		dbg.W(gzTag, "Skipped %d gazetteer lines without valid coordinates", skipped)
+	}
+	dbg.I(gzTag, "Loaded %d gazetteer entries", len(entries))
+	g = NewGazetteerGeocoder(entries)
+	return
+}
+
+// Name returns GazetteerProvider.
+func (g *GazetteerGeocoder) Name() string {
+	return GazetteerProvider
+}
+
+// Reverse fills addr with the nearest entry within MaxDistance, returns ErrEmptyResult if there is none.
+func (g *GazetteerGeocoder) Reverse(addr *Address, lat float64, lng float64, uId int64) (err error) {
+	p := geo.NewPoint(lat, lng)
+	// the count of cells to look at in each direction, longitude degrees get smaller towards the poles
+	cosLat := math.Max(math.Cos(lat*math.Pi/180), 0.01)
+	rings := int(math.Ceil(g.MaxDistance / (111.32 * cosLat) / gazetteerCellSize))
+	center := gazetteerCellFor(lat, lng)
+
+	var best *GazetteerEntry
+	bestDist := g.MaxDistance
+	for x := center.X - rings; x <= center.X+rings; x++ {
+		for y := center.Y - rings; y <= center.Y+rings; y++ {
+			for _, e := range g.grid[gazetteerCell{X: x, Y: y}] {
+				d := p.GreatCircleDistance(geo.NewPoint(e.Lat, e.Lng))
+				if d <= bestDist {
+					best = e
+					bestDist = d
+				}
+			}
+		}
+	}
+	if best == nil {
+		FillUnknownAddress(addr)
+		return ErrEmptyResult
+	}
+	fillAddrFromGazetteerEntry(addr, best)
+	return
+}
+
+// Forward returns the entry matching most of the words of the given query, returns ErrEmptyResult if less than half of them match.
+func (g *GazetteerGeocoder) Forward(query string, uId int64) (a *Address, err error) {
+	a = &Address{}
+	tokens := gazetteerTokens(query)
+	var best *GazetteerEntry
+	bestScore := 0
+	for _, e := range g.entries {
+		score := 0
+		for _, t := range tokens {
+			if e.tokens[t] {
+				score++
+			}
+		}
+		if score > bestScore {
+			best = e
+			bestScore = score
+		}
+	}
+	if best == nil || bestScore*2 < len(tokens) {
+		FillUnknownAddress(a)
+		return a, ErrEmptyResult
+	}
+	fillAddrFromGazetteerEntry(a, best)
+	return
+}
+
+// fillAddrFromGazetteerEntry fills addr with the data of the given entry.
+func fillAddrFromGazetteerEntry(addr *Address, e *GazetteerEntry) {
+	addr.Street = S.NString(e.Street)
+	addr.HouseNumber = S.NString(e.HouseNumber)
+	addr.Postal = S.NString(e.Postal)
+	addr.City = S.NString(e.City)
+	addr.Title = S.NString(e.Title)
+	addr.Latitude = S.NFloat64(e.Lat)
+	addr.Longitude = S.NFloat64(e.Lng)
+	addr.GeoCoder = GazetteerProvider
+}
+
+// gazetteerCellFor returns the cell of the spatial index containing the given location.
+func gazetteerCellFor(lat float64, lng float64) gazetteerCell {
+	return gazetteerCell{X: int(math.Floor(lng / gazetteerCellSize)), Y: int(math.Floor(lat / gazetteerCellSize))}
+}
+
+// gazetteerTokens splits the given string into lower case words.
+func gazetteerTokens(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -0,0 +1,65 @@
+package addressManager_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/addressManager"
+	S "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+)
+
+const testGazetteer = `id;addr:street;addr:housenumber;addr:postcode;addr:city;name;lat;lon
+1;Hauptstraße;5;01067;Dresden;Bäckerei Müller;51.0500;13.7370
+2;Hauptstraße;7;01067;Dresden;;51.0502;13.7373
+3;Prager Straße;12;01069;Dresden;;51.0440;13.7370
+4;Kaputt;1;01069;Dresden;;keine;13.7
+`
+
+var _ = Describe("Gazetteer", func() {
+	var g *GazetteerGeocoder
+
+	BeforeEach(func() {
+		var err error
+		g, err = LoadGazetteerFromCSV(strings.NewReader(testGazetteer))
+		Expect(err).To(BeNil())
+	})
+
+	It("should find the nearest address within MaxDistance", func() {
+		var addr Address
+		Expect(g.Reverse(&addr, 51.05015, 13.73725, 1)).To(BeNil())
+		Expect(addr.Street).To(Equal(S.NString("Hauptstraße")))
+		Expect(addr.HouseNumber).To(Equal(S.NString("7")))
+		Expect(addr.GeoCoder).To(Equal(S.NString(GazetteerProvider)))
+
+		Expect(g.Reverse(&addr, 51.0470, 13.7370, 1)).To(Equal(ErrEmptyResult))
+		Expect(addr.City).To(Equal(S.NString("Unbekannt")))
+	})
+
+	It("should find addresses by their words", func() {
+		addr, err := g.Forward("Prager Str. 12, Dresden", 1)
+		Expect(err).To(BeNil())
+		Expect(addr.Postal).To(Equal(S.NString("01069")))
+		Expect(float64(addr.Latitude)).To(BeNumerically("~", 51.044, 0.0001))
+
+		addr, err = g.Forward("Bäckerei Müller", 1)
+		Expect(err).To(BeNil())
+		Expect(addr.HouseNumber).To(Equal(S.NString("5")))
+
+		_, err = g.Forward("Irgendwo in Leipzig", 1)
+		Expect(err).To(Equal(ErrEmptyResult))
+	})
+
+	It("should reject a gazetteer without coordinates", func() {
+		_, err := LoadGazetteerFromCSV(strings.NewReader("street,city\nHauptstraße,Dresden\n"))
+		Expect(err).To(Equal(ErrInvalidGazetteer))
+	})
+
+	It("should be usable as Geocoder", func() {
+		var geocoder Geocoder = g
+		addr, err := geocoder.Forward("Hauptstraße 7 Dresden", 1)
+		Expect(err).To(BeNil())
+		Expect(addr.HouseNumber).To(Equal(S.NString("7")))
+	})
+})
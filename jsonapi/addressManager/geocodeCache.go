@@ -0,0 +1,225 @@
+package addressManager
+
+import (
+	"database/sql"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/periodManager"
+	S "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	geo "github.com/kellydunn/golang-geo"
+)
+
+const gcTag = "goodl-lib/jsonApi/addressManager/geocodeCache.go"
+
+// GeocodeCacheRadius is the radius (meters) in which a known address is reused instead of asking the Geocoder.
+// 0 disables the cache.
+var GeocodeCacheRadius float64 = 50
+
+const (
+	// GeocodeCacheContact means the location is inside the GeoZone of a contact, so the contacts address is used.
+	GeocodeCacheContact = "contact"
+	// GeocodeCacheAddress means a known address was found within GeocodeCacheRadius.
+	GeocodeCacheAddress = "address"
+)
+
+// GeocodeCacheStats contains how often the geocode cache was asked and could answer since the last reset.
+type GeocodeCacheStats struct {
+	ContactHits int64
+	AddressHits int64
+	Misses      int64
+}
+
+var geocodeCacheContactHits, geocodeCacheAddressHits, geocodeCacheMisses int64
+
+// GetGeocodeCacheStats returns the statistics of the geocode cache since the start or ResetGeocodeCacheStats.
+func GetGeocodeCacheStats() GeocodeCacheStats {
+	return GeocodeCacheStats{
+		ContactHits: atomic.LoadInt64(&geocodeCacheContactHits),
+		AddressHits: atomic.LoadInt64(&geocodeCacheAddressHits),
+		Misses:      atomic.LoadInt64(&geocodeCacheMisses),
+	}
+}
+
+// ResetGeocodeCacheStats sets all statistics of the geocode cache to 0.
+func ResetGeocodeCacheStats() {
+	atomic.StoreInt64(&geocodeCacheContactHits, 0)
+	atomic.StoreInt64(&geocodeCacheAddressHits, 0)
+	atomic.StoreInt64(&geocodeCacheMisses, 0)
+}
+
+// FindCachedAddressId returns the id of a known address for the given location, or found=false if there is none.
+// Active contacts whose GeoZone contains the location win (the nearest one if there are multiple), otherwise the
+// nearest completely geocoded address within GeocodeCacheRadius is used. source is one of the GeocodeCache* constants.
+func FindCachedAddressId(lat float64, lng float64, dbCon *sql.DB) (addrId int64, source string, found bool, err error) {
+	if GeocodeCacheRadius <= 0 {
+		return
+	}
+	p := geo.NewPoint(lat, lng)
+	addrId, found, err = nearestAddressId(p, `SELECT C.addressId,A.latitude,A.longitude FROM Contacts C
+	LEFT JOIN Addresses A ON A._addressId=C.addressId
+	LEFT JOIN Address_GeoFenceRegion AG ON AG.addressId=C.addressId
+	LEFT JOIN GeoFenceRegions G ON G._geoFenceRegionId=AG.geoFenceRegionId
+	WHERE C.disabled=0 AND G.outerMinLat<? AND G.outerMaxLat>? AND G.outerMinLon<? AND G.outerMaxLon>?`,
+		math.MaxFloat64, dbCon, lat, lat, lng, lng)
+	if err != nil {
+		dbg.E(gcTag, "Error looking for contacts at %f,%f : ", lat, lng, err)
+		return
+	}
+	if found {
+		atomic.AddInt64(&geocodeCacheContactHits, 1)
+		return addrId, GeocodeCacheContact, true, nil
+	}
+
+	k := GeocodeCacheRadius / 111111
+	kLng := k / math.Max(math.Cos(lat*math.Pi/180), 0.01)
+	addrId, found, err = nearestAddressId(p, `SELECT _addressId,latitude,longitude FROM Addresses
+	WHERE retrytime=0 AND city!='Unbekannt' AND city!='' AND latitude>? AND latitude<? AND longitude>? AND longitude<?`,
+		GeocodeCacheRadius/1000, dbCon, lat-k, lat+k, lng-kLng, lng+kLng)
+	if err != nil {
+		dbg.E(gcTag, "Error looking for addresses near %f,%f : ", lat, lng, err)
+		return
+	}
+	if found {
+		atomic.AddInt64(&geocodeCacheAddressHits, 1)
+		return addrId, GeocodeCacheAddress, true, nil
+	}
+	atomic.AddInt64(&geocodeCacheMisses, 1)
+	return
+}
+
+// nearestAddressId returns the id of the address nearest to p within maxDist (km) out of the rows
+// (addressId,latitude,longitude) returned by the given query.
+func nearestAddressId(p *geo.Point, q string, maxDist float64, dbCon *sql.DB, params ...interface{}) (addrId int64, found bool, err error) {
+	rows, err := dbCon.Query(q, params...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	bestDist := maxDist
+	for rows.Next() {
+		var id sql.NullInt64
+		var lat, lng sql.NullFloat64
+		err = rows.Scan(&id, &lat, &lng)
+		if err != nil {
+			return
+		}
+		if !id.Valid {
+			continue
+		}
+		d := p.GreatCircleDistance(geo.NewPoint(lat.Float64, lng.Float64))
+		if d <= bestDist {
+			addrId, found, bestDist = id.Int64, true, d
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+// ReResolveResult is the result of ReResolveUnknownAddresses.
+type ReResolveResult struct {
+	KeyPoints    int
+	FromCache    int
+	FromGeocoder int
+	Failed       int
+	// Closed is the count of KeyPoints left out because they are in a closed period
+	Closed int
+}
+
+// ReResolveUnknownAddresses re-resolves all unknown addresses with a HTTPGeocoder
+// (see ReResolveUnknownAddressesWithGeocoder).
+func ReResolveUnknownAddresses(uId int64, dbCon *sql.DB) (res *ReResolveResult, err error) {
+	return ReResolveUnknownAddressesWithGeocoder(nil, uId, dbCon)
+}
+
+// ReResolveUnknownAddressesWithGeocoder looks for new addresses for all KeyPoints still having no address or the
+// placeholder of FillUnknownAddress, first in the geocode cache, then by asking the given Geocoder (a HTTPGeocoder
+// if nil). KeyPoints not found and KeyPoints in closed periods stay untouched.
+func ReResolveUnknownAddressesWithGeocoder(geocoder Geocoder, uId int64, dbCon *sql.DB) (res *ReResolveResult, err error) {
+	rows, err := dbCon.Query(`SELECT K._keyPointId,K.latitude,K.longitude,` + periodManager.ClosedKeyPointCondition("K") + ` FROM KeyPoints K
+	LEFT JOIN Addresses A ON A._addressId=K.addressId
+	WHERE A._addressId IS NULL OR (A.street='Unbekannt' AND A.city='Unbekannt')`)
+	if err != nil {
+		dbg.E(gcTag, "Error getting KeyPoints with unknown address : ", err)
+		return
+	}
+	kps := make([]*GeocodeJob, 0)
+	closed := 0
+	for rows.Next() {
+		kp := &GeocodeJob{}
+		var isClosed bool
+		err = rows.Scan(&kp.KeyPointId, &kp.Latitude, &kp.Longitude, &isClosed)
+		if err != nil {
+			rows.Close()
+			dbg.E(gcTag, "Error scanning KeyPoint : ", err)
+			return
+		}
+		if isClosed {
+			closed++
+			continue
+		}
+		kps = append(kps, kp)
+	}
+	rows.Close()
+
+	res = &ReResolveResult{KeyPoints: len(kps), Closed: closed}
+	geocoder = orDefaultGeocoder(geocoder, dbCon)
+	updated := make([]int64, 0)
+	for _, kp := range kps {
+		lat, lng := float64(kp.Latitude), float64(kp.Longitude)
+		addrId, _, found, errCache := FindCachedAddressId(lat, lng, dbCon)
+		if errCache != nil {
+			err = errCache
+			return
+		}
+		if found {
+			res.FromCache++
+		} else {
+			var addr Address
+			errGeo := geocoder.Reverse(&addr, lat, lng, uId)
+			if errGeo != nil {
+				res.Failed++
+				continue
+			}
+			addr.Latitude, addr.Longitude = S.NFloat64(lat), S.NFloat64(lng)
+			addrId, err = insertAddress(&addr, 0, 1, dbCon)
+			if err != nil {
+				return
+			}
+			res.FromGeocoder++
+		}
+		_, err = dbCon.Exec(`UPDATE KeyPoints SET addressId=? WHERE _keyPointId=?;
+		DELETE FROM GeocodeJobs WHERE keyPointId=?`, addrId, kp.KeyPointId, kp.KeyPointId)
+		if err != nil {
+			dbg.E(gcTag, "Error setting address of KeyPoint %d : ", kp.KeyPointId, err)
+			return
+		}
+		updated = append(updated, kp.KeyPointId)
+	}
+	if len(updated) != 0 {
+		err = UpdateKeyPointsForAllGeozones(updated, dbCon)
+		if err != nil {
+			dbg.E(gcTag, "Error updating GeoZones for re-resolved KeyPoints : ", err)
+			return
+		}
+	}
+	dbg.I(gcTag, "Re-resolved %d of %d unknown addresses, skipped %d in closed periods", len(updated), len(kps), closed)
+	return
+}
+
+// insertAddress inserts the given address, geocoded just now, returning its id.
+func insertAddress(addr *Address, retryTime int64, tryCount int64, dbCon *sql.DB) (addrId int64, err error) {
+	res, err := dbCon.Exec("INSERT INTO Addresses(street, postal, city,houseNumber,latitude,longitude,GeoCoder,retryTime,tryCount,geocodedAt) VALUES (?, ?, ?,?,?,?,?,?,?,?)",
+		addr.Street, addr.Postal, addr.City, addr.HouseNumber, addr.Latitude, addr.Longitude, addr.GeoCoder, retryTime, tryCount, time.Now().Unix())
+	if err != nil {
+		dbg.E(TAG, "Failed to insert address : ", err)
+		return
+	}
+	addrId, err = res.LastInsertId()
+	if err != nil {
+		dbg.E(TAG, "Failed to get Id of just inserted Address : ", err)
+	}
+	return
+}
@@ -0,0 +1,88 @@
+package addressManager_test
+
+import (
+	"database/sql"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/dbMan"
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/addressManager"
+)
+
+var _ = Describe("GeocodeCache", func() {
+	var (
+		dbCon  *sql.DB
+		addrId int64
+	)
+
+	BeforeEach(func() {
+		dbCon, _ = dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+		res, err := dbCon.Exec("INSERT INTO Addresses(street,postal,city,houseNumber,latitude,longitude,retryTime) VALUES('Zwischenspeicherweg','01337','Testhausen','3',0.7441,-0.7441,0)")
+		Expect(err).To(BeNil())
+		addrId, _ = res.LastInsertId()
+		ResetGeocodeCacheStats()
+	})
+
+	AfterEach(func() {
+		dbCon.Exec("DELETE FROM Addresses WHERE _addressId=? OR street='Parallelweg'", addrId)
+		dbCon.Close()
+	})
+
+	It("should reuse known addresses within GeocodeCacheRadius", func() {
+		id, source, found, err := FindCachedAddressId(0.7442, -0.7441, dbCon)
+		Expect(err).To(BeNil())
+		Expect(found).To(BeTrue())
+		Expect(id).To(Equal(addrId))
+		Expect(source).To(Equal(GeocodeCacheAddress))
+
+		_, _, found, err = FindCachedAddressId(0.7461, -0.7441, dbCon)
+		Expect(err).To(BeNil())
+		Expect(found).To(BeFalse())
+
+		Expect(GetGeocodeCacheStats()).To(Equal(GeocodeCacheStats{AddressHits: 1, Misses: 1}))
+	})
+
+	It("should not insert an address twice if it is looked up in parallel", func() {
+		var dbLock sync.Mutex
+		geocoder := &parallelGeocoder{}
+		geocoder.waiting.Add(2)
+		ids := make([]int64, 2)
+		var wg sync.WaitGroup
+		for i := range ids {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				var err error
+				ids[i], err = GetAddressIdForLatLngWithLock(0.7541, -0.7541+float64(i)/1000000, geocoder, 1, &dbLock, dbCon)
+				Expect(err).To(BeNil())
+			}(i)
+		}
+		wg.Wait()
+		Expect(ids[0]).To(Equal(ids[1]))
+		var count int
+		err := dbCon.QueryRow("SELECT COUNT(*) FROM Addresses WHERE street='Parallelweg'").Scan(&count)
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(1))
+	})
+})
+
+// parallelGeocoder answers as soon as two lookups wait for it.
+type parallelGeocoder struct {
+	waiting sync.WaitGroup
+}
+
+func (g *parallelGeocoder) Name() string { return "parallel" }
+
+func (g *parallelGeocoder) Reverse(addr *Address, lat float64, lng float64, uId int64) error {
+	g.waiting.Done()
+	g.waiting.Wait()
+	addr.Street, addr.HouseNumber, addr.Postal, addr.City = "Parallelweg", "1", "01337", "Testhausen"
+	return nil
+}
+
+func (g *parallelGeocoder) Forward(query string, uId int64) (*Address, error) {
+	return nil, ErrEmptyResult
+}
@@ -0,0 +1,192 @@
+package addressManager
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/periodManager"
+	S "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+)
+
+const gjTag = "goodl-lib/jsonApi/addressManager/geocodeJobs.go"
+
+const geocodeJobQueryFields = "_geocodeJobId,keyPointId,latitude,longitude,tryCount,retryTime,lastError"
+
+var retryingGeocodeJobs = make(map[int64]bool)
+var retryingGeocodeJobsMutex sync.Mutex
+
+// CreateGeocodeJob remembers the failed address lookup for the given KeyPoint, to be retried by RetryGeocodeJobs
+// at the time determined by CalcRetryTime. An existing job for the KeyPoint is replaced.
+func CreateGeocodeJob(keyPointId int64, lat float64, lng float64, geoErr error, dbCon *sql.DB) (key int64, err error) {
+	lastError := ""
+	if geoErr != nil {
+		lastError = geoErr.Error()
+	}
+	_, err = dbCon.Exec("DELETE FROM GeocodeJobs WHERE keyPointId=?", keyPointId)
+	if err != nil {
+		dbg.E(gjTag, "Error deleting previous GeocodeJob for KeyPoint %d : ", keyPointId, err)
+		return
+	}
+	res, err := dbCon.Exec("INSERT INTO GeocodeJobs(keyPointId,latitude,longitude,tryCount,retryTime,lastError) VALUES(?,?,?,1,?,?)",
+		keyPointId, lat, lng, CalcRetryTime(0, geoErr), lastError)
+	if err != nil {
+		dbg.E(gjTag, "Error inserting GeocodeJob for KeyPoint %d : ", keyPointId, err)
+		return
+	}
+	key, err = res.LastInsertId()
+	return
+}
+
+// GetGeocodeJobs returns the GeocodeJobs matching the given where-string & parameters (all if where is empty).
+func GetGeocodeJobs(where string, dbCon *sql.DB, params ...interface{}) (jobs []*GeocodeJob, err error) {
+	q := "SELECT " + geocodeJobQueryFields + " FROM GeocodeJobs"
+	if where != "" {
+		q += " WHERE " + where
+	}
+	q += " ORDER BY retryTime"
+	rows, err := dbCon.Query(q, params...)
+	if err != nil {
+		dbg.E(gjTag, "Error getting GeocodeJobs : ", err)
+		return
+	}
+	defer rows.Close()
+	jobs = make([]*GeocodeJob, 0)
+	for rows.Next() {
+		j := &GeocodeJob{}
+		err = rows.Scan(&j.Id, &j.KeyPointId, &j.Latitude, &j.Longitude, &j.TryCount, &j.RetryTime, &j.LastError)
+		if err != nil {
+			dbg.E(gjTag, "Error scanning GeocodeJob : ", err)
+			return
+		}
+		jobs = append(jobs, j)
+	}
+	return
+}
+
+// RetryGeocodeJobs retries all GeocodeJobs whose retryTime has expired with a HTTPGeocoder
+// (see RetryGeocodeJobsWithGeocoder).
+func RetryGeocodeJobs(uId int64, dbCon *sql.DB) (doneCount int, err error) {
+	return RetryGeocodeJobsWithGeocoder(nil, uId, dbCon)
+}
+
+// RetryGeocodeJobsWithGeocoder retries all GeocodeJobs whose retryTime has expired with the given Geocoder
+// (a HTTPGeocoder if nil). If the address is found, the KeyPoint gets it, its GeoZones are recalculated (which also
+// sets the start- and endContacts of the affected trips not having one yet) and the job is deleted. Otherwise the job
+// is postponed as determined by CalcRetryTime.
+func RetryGeocodeJobsWithGeocoder(geocoder Geocoder, uId int64, dbCon *sql.DB) (doneCount int, err error) {
+	retryingGeocodeJobsMutex.Lock()
+	if retryingGeocodeJobs[uId] {
+		retryingGeocodeJobsMutex.Unlock()
+		return
+	}
+	retryingGeocodeJobs[uId] = true
+	retryingGeocodeJobsMutex.Unlock()
+	defer func() {
+		retryingGeocodeJobsMutex.Lock()
+		retryingGeocodeJobs[uId] = false
+		retryingGeocodeJobsMutex.Unlock()
+	}()
+
+	jobs, err := GetGeocodeJobs("retryTime<=?", dbCon, time.Now().Unix())
+	if err != nil {
+		dbg.E(gjTag, "Error getting GeocodeJobs open for retry : ", err)
+		return
+	}
+	geocoder = orDefaultGeocoder(geocoder, dbCon)
+	for _, job := range jobs {
+		errJob := retryGeocodeJob(job, geocoder, uId, dbCon)
+		if errJob == nil {
+			doneCount++
+			continue
+		}
+		if errJob != ErrEmptyResult {
+			dbg.W(gjTag, "Retrying GeocodeJob %d for KeyPoint %d failed : ", job.Id, job.KeyPointId, errJob)
+		}
+		_, err = dbCon.Exec("UPDATE GeocodeJobs SET tryCount=?,retryTime=?,lastError=? WHERE _geocodeJobId=?",
+			int64(job.TryCount)+1, CalcRetryTime(int64(job.TryCount), errJob), errJob.Error(), job.Id)
+		if err != nil {
+			dbg.E(gjTag, "Error updating retryTime of GeocodeJob %d : ", job.Id, err)
+			return
+		}
+	}
+	if len(jobs) != 0 {
+		dbg.I(gjTag, "Retried %d GeocodeJobs, %d succeeded", len(jobs), doneCount)
+	}
+	return
+}
+
+// retryGeocodeJob looks up the address of the given job and updates its KeyPoint if successful, deleting the job.
+func retryGeocodeJob(job *GeocodeJob, geocoder Geocoder, uId int64, dbCon *sql.DB) (err error) {
+	var addrId sql.NullInt64
+	var closed bool
+	err = dbCon.QueryRow("SELECT K.addressId,"+periodManager.ClosedKeyPointCondition("K")+" FROM KeyPoints K WHERE K._keyPointId=?",
+		job.KeyPointId).Scan(&addrId, &closed)
+	if err == sql.ErrNoRows {
+		dbg.I(gjTag, "KeyPoint %d of GeocodeJob %d does not exist anymore", job.KeyPointId, job.Id)
+		_, err = dbCon.Exec("DELETE FROM GeocodeJobs WHERE _geocodeJobId=?", job.Id)
+		return
+	}
+	if err != nil {
+		dbg.E(gjTag, "Error getting KeyPoint %d : ", job.KeyPointId, err)
+		return ErrNeedFixBeforeRetry
+	}
+	if closed {
+		// the KeyPoint can't be changed until its period is reopened, don't waste the geocoder quota on it
+		dbg.I(gjTag, "KeyPoint %d of GeocodeJob %d is in a closed period", job.KeyPointId, job.Id)
+		return ErrNeedFixBeforeRetry
+	}
+
+	if addrId.Valid && addrId.Int64 > 0 {
+		var retryTime int64
+		err = dbCon.QueryRow("SELECT retrytime FROM Addresses WHERE _addressId=?", addrId.Int64).Scan(&retryTime)
+		if err != nil && err != sql.ErrNoRows {
+			dbg.E(gjTag, "Error getting retrytime of address %d : ", addrId.Int64, err)
+			return ErrNeedFixBeforeRetry
+		}
+		if err == nil && retryTime != 0 {
+			// the KeyPoint has an unknown address, fill it (RetryAddresses might also do this)
+			addr := &Address{Id: S.NInt64(addrId.Int64)}
+			err = FillAddressForLatLngWithGeocoder(addr, float64(job.Latitude), float64(job.Longitude), geocoder, uId, dbCon)
+			if err != nil {
+				return
+			}
+			err = UpdateAddress(addr, dbCon)
+			if err != nil {
+				dbg.E(gjTag, "Error updating address %d : ", addrId.Int64, err)
+				return
+			}
+		} else if err == sql.ErrNoRows {
+			addrId.Valid = false
+		}
+		// otherwise the address has been found in the meantime
+	}
+	if !addrId.Valid || addrId.Int64 <= 0 {
+		var addr Address
+		err = FillAddressForLatLngWithGeocoder(&addr, float64(job.Latitude), float64(job.Longitude), geocoder, uId, dbCon)
+		if err != nil {
+			return
+		}
+		addrId.Int64, err = insertAddress(&addr, 0, int64(job.TryCount)+1, dbCon)
+		if err != nil {
+			return ErrNeedFixBeforeRetry
+		}
+		_, err = dbCon.Exec("UPDATE KeyPoints SET addressId=? WHERE _keyPointId=?", addrId.Int64, job.KeyPointId)
+		if err != nil {
+			dbg.E(gjTag, "Error setting address of KeyPoint %d : ", job.KeyPointId, err)
+			return ErrNeedFixBeforeRetry
+		}
+	}
+
+	err = UpdateKeyPointsForAllGeozones([]int64{job.KeyPointId}, dbCon)
+	if err != nil {
+		dbg.E(gjTag, "Error updating GeoZones for KeyPoint %d : ", job.KeyPointId, err)
+		return ErrNeedFixBeforeRetry
+	}
+	_, err = dbCon.Exec("DELETE FROM GeocodeJobs WHERE _geocodeJobId=?", job.Id)
+	if err != nil {
+		dbg.E(gjTag, "Error deleting GeocodeJob %d : ", job.Id, err)
+	}
+	return
+}
@@ -0,0 +1,87 @@
+package addressManager_test
+
+import (
+	"database/sql"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/dbMan"
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/addressManager"
+)
+
+var _ = Describe("GeocodeJobs", func() {
+	var (
+		dbCon  *sql.DB
+		kpId   int64
+		addrId int64
+	)
+
+	BeforeEach(func() {
+		dbCon, _ = dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+		res, err := dbCon.Exec("INSERT INTO KeyPoints(latitude,longitude,startTime,endTime,addressId,deviceId) VALUES(0.7331,-0.7331,1,2,-1,1)")
+		Expect(err).To(BeNil())
+		kpId, _ = res.LastInsertId()
+	})
+
+	AfterEach(func() {
+		dbCon.Exec("DELETE FROM GeocodeJobs WHERE keyPointId=?", kpId)
+		dbCon.Exec("DELETE FROM Addresses WHERE street='Wiederholungsweg' OR _addressId=?", addrId)
+		dbCon.Exec("DELETE FROM KeyPoints WHERE _keyPointId=?", kpId)
+		dbCon.Close()
+	})
+
+	It("should keep the error of a failed lookup, so a job is created for it", func() {
+		var err error
+		addrId, err = GetAddressIdForLatLngWithGeocoder(0.7331, -0.7331, failingGeocoder{}, 1, dbCon)
+		Expect(err).To(Equal(ErrEmptyResult))
+		Expect(addrId).To(BeNumerically(">", 0))
+
+		_, err = CreateGeocodeJob(kpId, 0.7331, -0.7331, err, dbCon)
+		Expect(err).To(BeNil())
+		jobs, err := GetGeocodeJobs("keyPointId=?", dbCon, kpId)
+		Expect(err).To(BeNil())
+		Expect(jobs).To(HaveLen(1))
+		Expect(string(jobs[0].LastError)).To(Equal(ErrEmptyResult.Error()))
+	})
+
+	It("should retry failed lookups when their retryTime is reached", func() {
+		_, err := CreateGeocodeJob(kpId, 0.7331, -0.7331, ErrEmptyResult, dbCon)
+		Expect(err).To(BeNil())
+		g, err := LoadGazetteerFromCSV(strings.NewReader("lat,lon,street,housenumber,postcode,city\n0.7331,-0.7331,Wiederholungsweg,1,01337,Testhausen\n"))
+		Expect(err).To(BeNil())
+
+		done, err := RetryGeocodeJobsWithGeocoder(g, 1, dbCon)
+		Expect(err).To(BeNil())
+		Expect(done).To(Equal(0))
+
+		_, err = dbCon.Exec("UPDATE GeocodeJobs SET retryTime=0 WHERE keyPointId=?", kpId)
+		Expect(err).To(BeNil())
+		done, err = RetryGeocodeJobsWithGeocoder(g, 1, dbCon)
+		Expect(err).To(BeNil())
+		Expect(done).To(Equal(1))
+
+		var street string
+		err = dbCon.QueryRow("SELECT street FROM KeyPoints LEFT JOIN Addresses ON addressId=_addressId WHERE _keyPointId=?", kpId).Scan(&street)
+		Expect(err).To(BeNil())
+		Expect(street).To(Equal("Wiederholungsweg"))
+		jobs, err := GetGeocodeJobs("keyPointId=?", dbCon, kpId)
+		Expect(err).To(BeNil())
+		Expect(jobs).To(BeEmpty())
+	})
+})
+
+// failingGeocoder finds nothing anywhere.
+type failingGeocoder struct{}
+
+func (failingGeocoder) Name() string { return "failing" }
+
+func (failingGeocoder) Reverse(addr *Address, lat float64, lng float64, uId int64) error {
+	FillUnknownAddress(addr)
+	return ErrEmptyResult
+}
+
+func (failingGeocoder) Forward(query string, uId int64) (*Address, error) {
+	return nil, ErrEmptyResult
+}
@@ -0,0 +1,128 @@
+package addressManager
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Compufreak345/dbg"
+)
+
+// Geocoder finds addresses for coordinates (reverse) and coordinates for addresses (forward).
+// Implementations return ErrEmptyResult if nothing was found and ErrNeedFixBeforeRetry if retrying makes no sense
+// without fixing something, so the caller can decide when to retry (see CalcRetryTime).
+type Geocoder interface {
+	// Name returns the name of the Geocoder, used if the result does not name its provider.
+	Name() string
+	// Reverse fills addr with the address found at the given latitude & longitude.
+	Reverse(addr *Address, lat float64, lng float64, uId int64) error
+	// Forward returns the geocoded address for the given address string.
+	Forward(query string, uId int64) (*Address, error)
+}
+
+// orDefaultGeocoder returns g, or a HTTPGeocoder for GeoChainAddr keeping its quota usage in dbCon if g is nil.
+func orDefaultGeocoder(g Geocoder, dbCon *sql.DB) Geocoder {
+	if g == nil {
+		return &HTTPGeocoder{DbCon: dbCon}
+	}
+	return g
+}
+
+// HTTPGeocoder is the Geocoder asking an odl-geocoder-Server https://github.com/OpenDriversLog/odl-geocoder
+type HTTPGeocoder struct {
+	// BaseUrl is the address of the odl-geocoder, GeoChainAddr if empty
+	BaseUrl string
+	// Client is the client used for requests, initialised automatically if nil
+	Client *http.Client
+	// DbCon is the database the quota usage is kept in (see CheckGeocoderQuota), the quota is ignored if nil
+	DbCon *sql.DB
+}
+
+// NewHTTPGeocoder returns a HTTPGeocoder for the odl-geocoder at the given address, keeping its quota usage in dbCon.
+func NewHTTPGeocoder(baseUrl string, client *http.Client, dbCon *sql.DB) *HTTPGeocoder {
+	return &HTTPGeocoder{BaseUrl: baseUrl, Client: client, DbCon: dbCon}
+}
+
+// Name returns "odl-geocoder".
+func (g *HTTPGeocoder) Name() string {
+	return "odl-geocoder"
+}
+
+// Reverse fills addr with the address the odl-geocoder found at the given latitude & longitude.
+func (g *HTTPGeocoder) Reverse(addr *Address, lat float64, lng float64, uId int64) (err error) {
+	body, err := g.get(fmt.Sprintf("/reverse/%d/b/abc/%f/%f", uId, lat, lng), uId)
+	if err != nil {
+		FillUnknownAddress(addr)
+		return
+	}
+	err = FillAddrFromGeocoderResp(string(body), addr, false)
+	return
+}
+
+// Forward returns the address the odl-geocoder found for the given address string.
+func (g *HTTPGeocoder) Forward(query string, uId int64) (a *Address, err error) {
+	a = &Address{}
+	body, err := g.get(fmt.Sprintf("/forward/%d/b/abc/%s", uId, url.QueryEscape(query)), uId)
+	if err != nil {
+		FillUnknownAddress(a)
+		if err == ErrNeedFixBeforeRetry {
+			return nil, err
+		}
+		return
+	}
+	err = FillAddrFromGeocoderResp(string(body), a, true)
+	if err != nil {
+		dbg.W(TAG, "Error filling address from resp : ", err)
+		if dbg.Debugging {
+			dbg.W(TAG, "Resp : %s", string(body))
+		}
+	}
+	return
+}
+
+// get requests the given path from the odl-geocoder for the given user, returning the response body.
+// Returns ErrQuotaExceeded without asking if the users quota is used up (see CheckGeocoderQuota).
+func (g *HTTPGeocoder) get(path string, uId int64) (body []byte, err error) {
+	if g.DbCon != nil {
+		err = CheckGeocoderQuota(uId, g.DbCon)
+		if err == ErrQuotaExceeded {
+			dbg.W(TAG, "Not asking geocoder for user %d : ", uId, err)
+			return
+		}
+		// without knowing the usage we ask anyway, the geocoder enforces its limits itself
+		err = nil
+	}
+	base := g.BaseUrl
+	if base == "" {
+		base = GeoChainAddr
+	}
+	req, err := http.NewRequest("GET", base+path, nil)
+	if err != nil {
+		dbg.E(TAG, "Error initializing httpRequest : ", err)
+		return
+	}
+	client := g.Client
+	if client == nil {
+		client = &http.Client{
+			Timeout: time.Duration(10 * time.Second),
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		dbg.E(TAG, "Error executing geocoda request: %s", err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		dbg.E(TAG, "Error reading geocoda response: %s", err)
+		return nil, ErrNeedFixBeforeRetry
+	}
+	if g.DbCon != nil {
+		RecordGeocoderUsage(uId, string(body), g.Name(), g.DbCon)
+	}
+	return
+}
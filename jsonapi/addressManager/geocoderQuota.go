@@ -0,0 +1,178 @@
+package addressManager
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Compufreak345/dbg"
+	gc "github.com/OpenDriversLog/goodl-lib/models/odl-geocode"
+)
+
+const gqTag = "goodl-lib/jsonApi/addressManager/geocoderQuota.go"
+
+var ErrQuotaExceeded = errors.New("Geocoder quota exceeded")
+
+// GeocoderQuotaMargin is the count of requests we keep in reserve before the limits reported by the geocoder,
+// so we stop before they are hit.
+var GeocoderQuotaMargin = 5
+
+// GeocoderUsage is the quota usage of a user at a geocoding provider in the current window (one day, UTC),
+// as reported by the odl-geocoder and stored in GeocoderUsage.
+type GeocoderUsage struct {
+	UserId               int64
+	Provider             string
+	MaxRequestsPerDay    int
+	MaxRequestsPerUser   int
+	CurDailyRequestsUsed int
+	CurUserRequestsUsed  int
+	// Requests is the count of answered requests in this window
+	Requests int
+	// Deferred is the count of requests not sent in this window because the quota was exceeded
+	Deferred int
+	// WindowStart is the unix time the current window started
+	WindowStart int64
+	// Updated is the unix time of the last answer
+	Updated int64
+}
+
+// GeocoderUsageReport describes the quota usage of a user and how many addresses are waiting for geocoding.
+type GeocoderUsageReport struct {
+	Usage              []*GeocoderUsage
+	QuotaExceeded      bool
+	NextWindow         int64
+	PendingAddresses   int
+	PendingGeocodeJobs int
+}
+
+// geocoderWindowStart returns the unix time the quota window containing t started.
+func geocoderWindowStart(t time.Time) int64 {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix()
+}
+
+// NextGeocoderQuotaWindow returns the unix time the next quota window starts.
+func NextGeocoderQuotaWindow() int64 {
+	return geocoderWindowStart(time.Now()) + OneDay
+}
+
+// RecordGeocoderUsage stores the quota usage reported in the given odl-geocoder response for the given user.
+// Responses without limits are ignored.
+func RecordGeocoderUsage(uId int64, resp string, defaultProvider string, dbCon *sql.DB) (err error) {
+	res := gc.GeoResp{}
+	if json.Unmarshal([]byte(resp), &res) != nil {
+		return
+	}
+	if res.MaxRequestsPerDay == 0 && res.MaxRequestsPerUser == 0 {
+		return
+	}
+	provider := res.Provider
+	if provider == "" {
+		provider = defaultProvider
+	}
+	now := time.Now()
+	window := geocoderWindowStart(now)
+
+	_, err = dbCon.Exec("INSERT OR IGNORE INTO GeocoderUsage(userId,provider,windowStart) VALUES(?,?,?)", uId, provider, window)
+	if err != nil {
+		dbg.E(gqTag, "Error inserting GeocoderUsage : ", err)
+		return
+	}
+	_, err = dbCon.Exec(`UPDATE GeocoderUsage SET maxRequestsPerDay=?,maxRequestsPerUser=?,curDailyRequestsUsed=?,
+		curUserRequestsUsed=?,requests=requests+1,updated=? WHERE userId=? AND provider=? AND windowStart=?`,
+		res.MaxRequestsPerDay, res.MaxRequestsPerUser, res.CurDailyRequestsUsed, res.CurUserRequestsUsed, now.Unix(),
+		uId, provider, window)
+	if err != nil {
+		dbg.E(gqTag, "Error updating GeocoderUsage : ", err)
+	}
+	return
+}
+
+// CheckGeocoderQuota returns ErrQuotaExceeded if the given user reached GeocoderQuotaMargin before its own limit
+// or the daily limit of a provider in the current window. Deferred requests are counted.
+func CheckGeocoderQuota(uId int64, dbCon *sql.DB) (err error) {
+	window := geocoderWindowStart(time.Now())
+	var exceeded int
+	err = dbCon.QueryRow(`SELECT COUNT(*) FROM GeocoderUsage WHERE windowStart=? AND
+		((maxRequestsPerDay>0 AND curDailyRequestsUsed>=maxRequestsPerDay-?) OR
+		(userId=? AND maxRequestsPerUser>0 AND curUserRequestsUsed>=maxRequestsPerUser-?))`,
+		window, GeocoderQuotaMargin, uId, GeocoderQuotaMargin).Scan(&exceeded)
+	if err != nil {
+		dbg.E(gqTag, "Error checking GeocoderUsage : ", err)
+		return
+	}
+	if exceeded == 0 {
+		return
+	}
+	_, err = dbCon.Exec("UPDATE GeocoderUsage SET deferred=deferred+1 WHERE userId=? AND windowStart=?", uId, window)
+	if err != nil {
+		dbg.E(gqTag, "Error counting deferred request : ", err)
+		return
+	}
+	err = ErrQuotaExceeded
+	return
+}
+
+// quotaReached returns true if used is within GeocoderQuotaMargin of max (ignored if max is 0).
+func quotaReached(used int, max int) bool {
+	return max > 0 && used >= max-GeocoderQuotaMargin
+}
+
+// ResetGeocoderUsage forgets all recorded quota usage, e.g. after the limits of the geocoder have been raised.
+func ResetGeocoderUsage(dbCon *sql.DB) (err error) {
+	_, err = dbCon.Exec("DELETE FROM GeocoderUsage")
+	if err != nil {
+		dbg.E(gqTag, "Error deleting GeocoderUsage : ", err)
+	}
+	return
+}
+
+// GetGeocoderUsage returns the quota usage of the given user in the current window.
+func GetGeocoderUsage(uId int64, dbCon *sql.DB) (usage []*GeocoderUsage, err error) {
+	usage = make([]*GeocoderUsage, 0)
+	rows, err := dbCon.Query(`SELECT userId,provider,maxRequestsPerDay,maxRequestsPerUser,curDailyRequestsUsed,
+		curUserRequestsUsed,requests,deferred,windowStart,updated FROM GeocoderUsage WHERE userId=? AND windowStart=?
+		ORDER BY provider`, uId, geocoderWindowStart(time.Now()))
+	if err != nil {
+		dbg.E(gqTag, "Error getting GeocoderUsage : ", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u := &GeocoderUsage{}
+		err = rows.Scan(&u.UserId, &u.Provider, &u.MaxRequestsPerDay, &u.MaxRequestsPerUser, &u.CurDailyRequestsUsed,
+			&u.CurUserRequestsUsed, &u.Requests, &u.Deferred, &u.WindowStart, &u.Updated)
+		if err != nil {
+			dbg.E(gqTag, "Error scanning GeocoderUsage : ", err)
+			return
+		}
+		usage = append(usage, u)
+	}
+	err = rows.Err()
+	return
+}
+
+// GetGeocoderUsageReport returns the quota usage of the given user and the count of addresses waiting for geocoding.
+func GetGeocoderUsageReport(uId int64, dbCon *sql.DB) (report *GeocoderUsageReport, err error) {
+	report = &GeocoderUsageReport{NextWindow: NextGeocoderQuotaWindow()}
+	report.Usage, err = GetGeocoderUsage(uId, dbCon)
+	if err != nil {
+		return
+	}
+	for _, u := range report.Usage {
+		if quotaReached(u.CurDailyRequestsUsed, u.MaxRequestsPerDay) || quotaReached(u.CurUserRequestsUsed, u.MaxRequestsPerUser) {
+			report.QuotaExceeded = true
+		}
+	}
+	err = dbCon.QueryRow("SELECT COUNT(*) FROM Addresses WHERE retrytime!=0").Scan(&report.PendingAddresses)
+	if err != nil {
+		dbg.E(gqTag, "Error counting pending addresses : ", err)
+		return
+	}
+	err = dbCon.QueryRow("SELECT COUNT(*) FROM GeocodeJobs").Scan(&report.PendingGeocodeJobs)
+	if err != nil {
+		dbg.E(gqTag, "Error counting GeocodeJobs : ", err)
+	}
+	return
+}
@@ -0,0 +1,72 @@
+package addressManager_test
+
+import (
+	"database/sql"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/dbMan"
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/addressManager"
+)
+
+var _ = Describe("GeocoderQuota", func() {
+	var dbCon *sql.DB
+
+	BeforeEach(func() {
+		dbCon, _ = dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+		Expect(ResetGeocoderUsage(dbCon)).To(BeNil())
+	})
+
+	AfterEach(func() {
+		ResetGeocoderUsage(dbCon)
+		dbCon.Close()
+	})
+
+	It("should stop asking the geocoder before the users limit is hit", func() {
+		Expect(RecordGeocoderUsage(4711, `{"MaxRequestsPerDay":1000,"MaxRequestsPerUser":100,"CurDailyRequestsUsed":500,"CurUserRequestsUsed":90,"Provider":"nominatim"}`, "odl-geocoder", dbCon)).To(BeNil())
+		Expect(CheckGeocoderQuota(4711, dbCon)).To(BeNil())
+		Expect(CheckGeocoderQuota(4712, dbCon)).To(BeNil())
+
+		Expect(RecordGeocoderUsage(4711, `{"MaxRequestsPerDay":1000,"MaxRequestsPerUser":100,"CurDailyRequestsUsed":510,"CurUserRequestsUsed":96,"Provider":"nominatim"}`, "odl-geocoder", dbCon)).To(BeNil())
+		Expect(CheckGeocoderQuota(4711, dbCon)).To(Equal(ErrQuotaExceeded))
+		Expect(CheckGeocoderQuota(4712, dbCon)).To(BeNil())
+
+		usage, err := GetGeocoderUsage(4711, dbCon)
+		Expect(err).To(BeNil())
+		Expect(usage).To(HaveLen(1))
+		Expect(usage[0].Provider).To(Equal("nominatim"))
+		Expect(usage[0].Requests).To(Equal(2))
+		Expect(usage[0].Deferred).To(Equal(1))
+
+		g := NewHTTPGeocoder("http://127.0.0.1:1", nil, dbCon)
+		var addr Address
+		Expect(g.Reverse(&addr, 51.05, 13.73, 4711)).To(Equal(ErrQuotaExceeded))
+		Expect(CalcRetryTime(0, ErrQuotaExceeded)).To(Equal(NextGeocoderQuotaWindow()))
+	})
+
+	It("should stop all users when the daily limit is reached", func() {
+		Expect(RecordGeocoderUsage(4721, `{"MaxRequestsPerDay":1000,"CurDailyRequestsUsed":999,"CurUserRequestsUsed":3}`, "odl-geocoder", dbCon)).To(BeNil())
+		Expect(CheckGeocoderQuota(4722, dbCon)).To(Equal(ErrQuotaExceeded))
+		usage, err := GetGeocoderUsage(4721, dbCon)
+		Expect(err).To(BeNil())
+		Expect(usage[0].Provider).To(Equal("odl-geocoder"))
+	})
+
+	It("should keep the usage of each provider separately and across connections", func() {
+		Expect(RecordGeocoderUsage(4731, `{"MaxRequestsPerUser":100,"CurUserRequestsUsed":99,"Provider":"nominatim"}`, "odl-geocoder", dbCon)).To(BeNil())
+		Expect(RecordGeocoderUsage(4731, `{"MaxRequestsPerUser":100,"CurUserRequestsUsed":10,"Provider":"photon"}`, "odl-geocoder", dbCon)).To(BeNil())
+
+		otherCon, err := dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+		Expect(err).To(BeNil())
+		defer otherCon.Close()
+		usage, err := GetGeocoderUsage(4731, otherCon)
+		Expect(err).To(BeNil())
+		Expect(usage).To(HaveLen(2))
+		Expect(usage[0].Provider).To(Equal("nominatim"))
+		Expect(usage[0].CurUserRequestsUsed).To(Equal(99))
+		Expect(usage[1].Provider).To(Equal("photon"))
+		Expect(usage[1].CurUserRequestsUsed).To(Equal(10))
+		Expect(CheckGeocoderQuota(4731, otherCon)).To(Equal(ErrQuotaExceeded))
+	})
+})
@@ -240,3 +240,63 @@ func JSONUpdateContact(contactJson string, dbCon *sql.DB) (res JSONUpdateAddress
 	return
 
 }
+
+// JSONGetGeocodeCacheStats returns the GeocodeCacheStats.
+func JSONGetGeocodeCacheStats() (res models.JSONSelectAnswer, err error) {
+	res = models.GetGoodJSONSelectAnswer(GetGeocodeCacheStats())
+	return
+}
+
+// JSONReResolveUnknownAddresses looks for the addresses of all KeyPoints with unknown address with the given Geocoder
+// (see ReResolveUnknownAddressesWithGeocoder).
+func JSONReResolveUnknownAddresses(geocoder Geocoder, uId int64, dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	r, err := ReResolveUnknownAddressesWithGeocoder(geocoder, uId, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error in ReResolveUnknownAddresses : ", err)
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		err = nil
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(r)
+	return
+}
+
+// JSONGetGeocoderUsage returns the GeocoderUsageReport of the given user, so it can be seen why addresses are pending.
+func JSONGetGeocoderUsage(uId int64, dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	r, err := GetGeocoderUsageReport(uId, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error in GetGeocoderUsageReport : ", err)
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		err = nil
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(r)
+	return
+}
+
+// JSONReGeocodeAddresses re-geocodes the next batch of addresses matching the ReGeocodeFilter in filterJson with the
+// given Geocoder, only returning the changes if dryRun is true (see ReGeocodeAddresses). The next batch is requested
+// with the NextAfterId of the answer as AfterId.
+func JSONReGeocodeAddresses(filterJson string, dryRun bool, geocoder Geocoder, uId int64, dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	filter := &ReGeocodeFilter{}
+	if filterJson != "" {
+		err = json.Unmarshal([]byte(filterJson), filter)
+		if err != nil {
+			dbg.W(TAG, "Could not read JSON %v in JSONReGeocodeAddresses : ", filterJson, err)
+			res = models.GetBadJSONSelectAnswer("Invalid format")
+			err = nil
+			return
+		}
+	}
+	config := GetDefaultReGeocodeConfig()
+	config.DryRun = dryRun
+	r, err := ReGeocodeAddresses(filter, config, geocoder, uId, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error in ReGeocodeAddresses : ", err)
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		err = nil
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(r)
+	return
+}
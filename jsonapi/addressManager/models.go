@@ -57,6 +57,17 @@ type GeoRectangle struct {
 	BotRightLon S.NFloat64
 }
 
+// GeocodeJob is a failed address lookup for a KeyPoint, waiting to be retried at RetryTime.
+type GeocodeJob struct {
+	Id         int64
+	KeyPointId int64
+	Latitude   S.NFloat64
+	Longitude  S.NFloat64
+	TryCount   S.NInt64
+	RetryTime  S.NInt64
+	LastError  S.NString
+}
+
 type JSONAddressManAnswer struct {
 	models.JSONAnswer
 	Addresses []*Address
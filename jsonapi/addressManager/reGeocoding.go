@@ -0,0 +1,242 @@
+package addressManager
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/Compufreak345/dbg"
+)
+
+const rgTag = "goodl-lib/jsonApi/addressManager/reGeocoding.go"
+
+// ReGeocodeFilter selects the addresses for ReGeocodeAddresses. All given criteria need to match.
+type ReGeocodeFilter struct {
+	// Providers are the GeoCoders which filled the addresses ("" for unknown), all if empty
+	Providers []string
+	// GeocodedBefore selects addresses geocoded before this unix time (or at an unknown time), ignored if 0
+	GeocodedBefore int64
+	// MissingStreet selects addresses without street, MissingHouseNumber without house number -
+	// if both are set addresses missing one of them are selected
+	MissingStreet      bool
+	MissingHouseNumber bool
+	// IncludeUserEdited also selects addresses entered by the user
+	IncludeUserEdited bool
+	// IncludeContacts also selects addresses of contacts
+	IncludeContacts bool
+	// Limit is the maximum count of addresses handled by one call, config.BatchSize if 0 or higher
+	Limit int
+	// AfterId selects addresses with a higher ID, used to continue with the next batch (see ReGeocodeReport.NextAfterId)
+	AfterId int64
+}
+
+// ReGeocodeConfig configures how fast ReGeocodeAddresses asks the Geocoder.
+type ReGeocodeConfig struct {
+	// Interval is the minimum time between two requests
+	Interval time.Duration
+	// BatchSize is the maximum count of addresses handled by one call, unlimited if 0.
+	// The next batch should not be started before BatchPause passed (see ReGeocodeReport.ContinueAt).
+	BatchSize  int
+	BatchPause time.Duration
+	// DryRun only returns the changes without saving them
+	DryRun bool
+	// DryRunBudget is the count of addresses a dry run may look up with a Geocoder limited by a quota (HTTPGeocoder),
+	// the others are skipped. These lookups count against the quota like in real runs.
+	DryRunBudget int
+}
+
+// GetDefaultReGeocodeConfig returns the default ReGeocodeConfig.
+func GetDefaultReGeocodeConfig() *ReGeocodeConfig {
+	return &ReGeocodeConfig{
+		Interval:     200 * time.Millisecond,
+		BatchSize:    50,
+		BatchPause:   10 * time.Second,
+		DryRunBudget: 5,
+	}
+}
+
+// AddressChange is the result of re-geocoding a single address.
+type AddressChange struct {
+	AddressId int64
+	Before    *Address
+	After     *Address `json:",omitempty"`
+	// Changed is true if any field of the address changed
+	Changed bool
+	// Applied is true if the change has been saved
+	Applied bool
+	Error   string `json:",omitempty"`
+}
+
+// ReGeocodeReport describes what ReGeocodeAddresses did or would do.
+type ReGeocodeReport struct {
+	Selected  int
+	Changed   int
+	Unchanged int
+	Failed    int
+	// Skipped is the count of addresses not looked up as the DryRunBudget was used up
+	Skipped int
+	// QuotaUsed is the count of lookups counting against the quota of the Geocoder (see CheckGeocoderQuota)
+	QuotaUsed int
+	// Aborted is the reason the run stopped early, e.g. because the quota was exceeded
+	Aborted string `json:",omitempty"`
+	// Remaining is the count of addresses matching the filter left for the next batches
+	Remaining int
+	// NextAfterId is the ReGeocodeFilter.AfterId for the next batch, 0 if nothing remains
+	NextAfterId int64
+	// ContinueAt is the unix time the next batch may be started
+	ContinueAt int64
+	Changes    []*AddressChange
+}
+
+// ReGeocodeAddresses asks the given Geocoder (a HTTPGeocoder if nil) again for the next batch of addresses matching
+// the filter, throttled as configured (GetDefaultReGeocodeConfig if nil), and saves the new results unless
+// config.DryRun is set. It returns after one batch, the report tells how to continue with the next one.
+// Results less complete than the known address are never saved. Pending addresses are left to RetryAddresses.
+func ReGeocodeAddresses(filter *ReGeocodeFilter, config *ReGeocodeConfig, geocoder Geocoder, uId int64, dbCon *sql.DB) (report *ReGeocodeReport, err error) {
+	if filter == nil {
+		filter = &ReGeocodeFilter{}
+	}
+	if config == nil {
+		config = GetDefaultReGeocodeConfig()
+	}
+	geocoder = orDefaultGeocoder(geocoder, dbCon)
+	// dry runs only use a small part of the quota, so it is kept for real runs
+	_, limited := geocoder.(*HTTPGeocoder)
+
+	limit := filter.Limit
+	if config.BatchSize > 0 && (limit <= 0 || limit > config.BatchSize) {
+		limit = config.BatchSize
+	}
+	conds, params := filter.where()
+	where := conds + " ORDER BY _addressId"
+	if limit > 0 {
+		where += " LIMIT ?"
+		params = append(params, limit)
+	}
+	addrs, err := GetAddressesByWhere(where, dbCon, params...)
+	if err != nil {
+		dbg.E(rgTag, "Error selecting addresses for re-geocoding : ", err)
+		return
+	}
+
+	report = &ReGeocodeReport{Selected: len(addrs), Changes: make([]*AddressChange, 0)}
+	lastId := filter.AfterId
+	for idx, before := range addrs {
+		c := &AddressChange{AddressId: int64(before.Id), Before: before}
+		report.Changes = append(report.Changes, c)
+		if limited && config.DryRun && report.QuotaUsed >= config.DryRunBudget {
+			lastId = int64(before.Id)
+			report.Skipped++
+			continue
+		}
+		if idx != 0 {
+			time.Sleep(config.Interval)
+		}
+
+		after := &Address{Id: before.Id}
+		errGeo := geocoder.Reverse(after, float64(before.Latitude), float64(before.Longitude), uId)
+		if limited && errGeo != ErrQuotaExceeded {
+			report.QuotaUsed++
+		}
+		if errGeo == ErrQuotaExceeded {
+			// the next batch starts with this address
+			c.Error = errGeo.Error()
+			report.Failed++
+			report.Aborted = errGeo.Error()
+			break
+		}
+		lastId = int64(before.Id)
+		if errGeo != nil {
+			c.Error = errGeo.Error()
+			report.Failed++
+			continue
+		}
+		after.Latitude, after.Longitude = before.Latitude, before.Longitude
+		c.After = after
+		c.Changed = after.Street != before.Street || after.HouseNumber != before.HouseNumber ||
+			after.Postal != before.Postal || after.City != before.City
+		if !c.Changed {
+			report.Unchanged++
+		} else {
+			report.Changed++
+		}
+		if addressCompleteness(after) < addressCompleteness(before) {
+			c.Error = "Result is less complete than the known address"
+			continue
+		}
+		if config.DryRun || (!c.Changed && after.GeoCoder == before.GeoCoder) {
+			continue
+		}
+		_, err = dbCon.Exec("UPDATE Addresses SET street=?,postal=?,city=?,houseNumber=?,geoCoder=?,geocodedAt=? WHERE _addressId=?",
+			after.Street, after.Postal, after.City, after.HouseNumber, after.GeoCoder, time.Now().Unix(), before.Id)
+		if err != nil {
+			dbg.E(rgTag, "Error saving re-geocoded address %d : ", before.Id, err)
+			return
+		}
+		c.Applied = true
+	}
+	dbg.I(rgTag, "Re-geocoded %d addresses : %d changed, %d unchanged, %d failed, %d skipped, %d counted against the quota",
+		report.Selected, report.Changed, report.Unchanged, report.Failed, report.Skipped, report.QuotaUsed)
+
+	remaining := *filter
+	remaining.AfterId = lastId
+	conds, params = remaining.where()
+	err = dbCon.QueryRow("SELECT COUNT(*) FROM Addresses WHERE "+conds, params...).Scan(&report.Remaining)
+	if err != nil {
+		dbg.E(rgTag, "Error counting addresses left for re-geocoding : ", err)
+		return
+	}
+	if report.Remaining != 0 {
+		report.NextAfterId = lastId
+		report.ContinueAt = time.Now().Add(config.BatchPause).Unix()
+		if report.Aborted != "" {
+			report.ContinueAt = NextGeocoderQuotaWindow()
+		}
+	}
+	return
+}
+
+// where returns the where-string & parameters selecting the addresses matching the filter, without order or limit.
+func (f *ReGeocodeFilter) where() (where string, params []interface{}) {
+	conds := []string{"retrytime=0", "(latitude!=0 OR longitude!=0)"}
+	params = make([]interface{}, 0)
+	if len(f.Providers) != 0 {
+		conds = append(conds, "IFNULL(geoCoder,'') IN (?"+strings.Repeat(",?", len(f.Providers)-1)+")")
+		for _, p := range f.Providers {
+			params = append(params, p)
+		}
+	}
+	if f.GeocodedBefore != 0 {
+		conds = append(conds, "IFNULL(geocodedAt,0)<?")
+		params = append(params, f.GeocodedBefore)
+	}
+	if f.MissingStreet && f.MissingHouseNumber {
+		conds = append(conds, "(IFNULL(street,'')='' OR IFNULL(houseNumber,'')='')")
+	} else if f.MissingStreet {
+		conds = append(conds, "IFNULL(street,'')=''")
+	} else if f.MissingHouseNumber {
+		conds = append(conds, "IFNULL(houseNumber,'')=''")
+	}
+	if !f.IncludeUserEdited {
+		conds = append(conds, "IFNULL(userEdited,0)=0")
+	}
+	if !f.IncludeContacts {
+		conds = append(conds, "_addressId NOT IN (SELECT addressId FROM Contacts WHERE addressId IS NOT NULL)")
+	}
+	if f.AfterId > 0 {
+		conds = append(conds, "_addressId>?")
+		params = append(params, f.AfterId)
+	}
+	where = strings.Join(conds, " AND ")
+	return
+}
+
+// addressCompleteness returns the count of filled address fields.
+func addressCompleteness(a *Address) (c int) {
+	for _, v := range []string{string(a.Street), string(a.HouseNumber), string(a.Postal), string(a.City)} {
+		if v != "" && v != "Unbekannt" {
+			c++
+		}
+	}
+	return
+}
@@ -0,0 +1,128 @@
+package addressManager_test
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/dbMan"
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/addressManager"
+)
+
+var _ = Describe("ReGeocoding", func() {
+	var (
+		dbCon    *sql.DB
+		addrId   int64
+		geocoder *GazetteerGeocoder
+	)
+
+	BeforeEach(func() {
+		dbCon, _ = dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+		res, err := dbCon.Exec("INSERT INTO Addresses(street,postal,city,houseNumber,latitude,longitude,geoCoder,retryTime) VALUES('Neugeocodierweg','01337','Testhausen','',0.7551,-0.7551,'altgeocoder',0)")
+		Expect(err).To(BeNil())
+		addrId, _ = res.LastInsertId()
+		geocoder, err = LoadGazetteerFromCSV(strings.NewReader("lat,lon,street,housenumber,postcode,city\n0.7551,-0.7551,Neugeocodierweg,9,01337,Testhausen\n"))
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		dbCon.Exec("DELETE FROM Addresses WHERE _addressId=?", addrId)
+		dbCon.Close()
+	})
+
+	It("should re-geocode addresses of a provider, saving only if no dry run", func() {
+		filter := &ReGeocodeFilter{Providers: []string{"altgeocoder"}, MissingHouseNumber: true}
+		config := &ReGeocodeConfig{DryRun: true}
+		report, err := ReGeocodeAddresses(filter, config, geocoder, 1, dbCon)
+		Expect(err).To(BeNil())
+		Expect(report.Selected).To(Equal(1))
+		Expect(report.Changed).To(Equal(1))
+		Expect(string(report.Changes[0].After.HouseNumber)).To(Equal("9"))
+		Expect(report.Changes[0].Applied).To(BeFalse())
+
+		config.DryRun = false
+		report, err = ReGeocodeAddresses(filter, config, geocoder, 1, dbCon)
+		Expect(err).To(BeNil())
+		Expect(report.Changes[0].Applied).To(BeTrue())
+		var houseNumber, provider string
+		err = dbCon.QueryRow("SELECT houseNumber,geoCoder FROM Addresses WHERE _addressId=?", addrId).Scan(&houseNumber, &provider)
+		Expect(err).To(BeNil())
+		Expect(houseNumber).To(Equal("9"))
+		Expect(provider).To(Equal(GazetteerProvider))
+
+		report, err = ReGeocodeAddresses(filter, config, geocoder, 1, dbCon)
+		Expect(err).To(BeNil())
+		Expect(report.Selected).To(Equal(0))
+	})
+
+	It("should return after one batch and continue with the next", func() {
+		res, err := dbCon.Exec("INSERT INTO Addresses(street,postal,city,houseNumber,latitude,longitude,geoCoder,retryTime) VALUES('Neugeocodierweg','01337','Testhausen','',0.7552,-0.7552,'altgeocoder',0)")
+		Expect(err).To(BeNil())
+		secondId, _ := res.LastInsertId()
+		defer dbCon.Exec("DELETE FROM Addresses WHERE _addressId=?", secondId)
+
+		filter := &ReGeocodeFilter{Providers: []string{"altgeocoder"}}
+		config := &ReGeocodeConfig{BatchSize: 1, BatchPause: time.Hour, DryRun: true}
+		report, err := ReGeocodeAddresses(filter, config, geocoder, 1, dbCon)
+		Expect(err).To(BeNil())
+		Expect(report.Selected).To(Equal(1))
+		Expect(report.Changes[0].AddressId).To(Equal(addrId))
+		Expect(report.Remaining).To(Equal(1))
+		Expect(report.NextAfterId).To(Equal(addrId))
+		Expect(report.ContinueAt).To(BeNumerically(">", time.Now().Unix()))
+
+		filter.AfterId = report.NextAfterId
+		report, err = ReGeocodeAddresses(filter, config, geocoder, 1, dbCon)
+		Expect(err).To(BeNil())
+		Expect(report.Selected).To(Equal(1))
+		Expect(report.Changes[0].AddressId).To(Equal(secondId))
+		Expect(report.Remaining).To(Equal(0))
+		Expect(report.NextAfterId).To(Equal(int64(0)))
+	})
+
+	It("should only use the dry run budget of the quota of the geocoder in dry runs", func() {
+		Expect(ResetGeocoderUsage(dbCon)).To(BeNil())
+		defer ResetGeocoderUsage(dbCon)
+		Expect(RecordGeocoderUsage(1, `{"MaxRequestsPerUser":100,"CurUserRequestsUsed":10}`, "odl-geocoder", dbCon)).To(BeNil())
+		res, err := dbCon.Exec("INSERT INTO Addresses(street,postal,city,houseNumber,latitude,longitude,geoCoder,retryTime) VALUES('Neugeocodierweg','01337','Testhausen','',0.7552,-0.7552,'altgeocoder',0)")
+		Expect(err).To(BeNil())
+		secondId, _ := res.LastInsertId()
+		defer dbCon.Exec("DELETE FROM Addresses WHERE _addressId=?", secondId)
+
+		filter := &ReGeocodeFilter{Providers: []string{"altgeocoder"}}
+		report, err := ReGeocodeAddresses(filter, &ReGeocodeConfig{DryRun: true, DryRunBudget: 1}, NewHTTPGeocoder("http://127.0.0.1:1", nil, dbCon), 1, dbCon)
+		Expect(err).To(BeNil())
+		Expect(report.Selected).To(Equal(2))
+		Expect(report.QuotaUsed).To(Equal(1))
+		// the geocoder is not reachable
+		Expect(report.Failed).To(Equal(1))
+		Expect(report.Skipped).To(Equal(1))
+		Expect(report.Changes[1].After).To(BeNil())
+
+		report, err = ReGeocodeAddresses(filter, &ReGeocodeConfig{DryRun: true}, NewHTTPGeocoder("http://127.0.0.1:1", nil, dbCon), 1, dbCon)
+		Expect(err).To(BeNil())
+		Expect(report.QuotaUsed).To(Equal(0))
+		Expect(report.Skipped).To(Equal(2))
+	})
+
+	It("should stop at the quota of the geocoder", func() {
+		Expect(ResetGeocoderUsage(dbCon)).To(BeNil())
+		defer ResetGeocoderUsage(dbCon)
+		Expect(RecordGeocoderUsage(1, `{"MaxRequestsPerUser":100,"CurUserRequestsUsed":99}`, "odl-geocoder", dbCon)).To(BeNil())
+
+		filter := &ReGeocodeFilter{Providers: []string{"altgeocoder"}}
+		report, err := ReGeocodeAddresses(filter, GetDefaultReGeocodeConfig(), NewHTTPGeocoder("http://127.0.0.1:1", nil, dbCon), 1, dbCon)
+		Expect(err).To(BeNil())
+		Expect(report.Selected).To(Equal(1))
+		Expect(report.QuotaUsed).To(Equal(0))
+		Expect(report.Aborted).To(Equal(ErrQuotaExceeded.Error()))
+		Expect(report.Changes[0].After).To(BeNil())
+
+		usage, err := GetGeocoderUsage(1, dbCon)
+		Expect(err).To(BeNil())
+		Expect(usage[0].Requests).To(Equal(1))
+	})
+})
@@ -22,7 +22,7 @@ func GetDevices(dbCon *sql.DB) (devices []*Device, err error) {
 // GetDevicesByWhere returns the devices matching the given where-string with the given parameters
 func GetDevicesByWhere(dbCon *sql.DB, where string, params ...interface{}) (devices []*Device, err error) {
 	devices = make([]*Device, 0)
-	q := "SELECT _deviceId, desc, checked, colorId,carId,Guid FROM Devices"
+	q := "SELECT _deviceId, desc, checked, colorId,carId,Guid,stopDetector,IFNULL(skipNonCarTracks,0)=1 FROM Devices"
 	if where !="" {
 		q += " WHERE " + where
 	}
@@ -36,11 +36,13 @@ func GetDevicesByWhere(dbCon *sql.DB, where string, params ...interface{}) (devi
 
 	for res.Next() {
 		device := &Device{Color: &colorManager.Color{}}
-		err = res.Scan(&device.Id, &device.Description, &device.Checked, &device.Color.Id, &device.CarId,&device.Guid)
+		var skipNonCarTracks bool
+		err = res.Scan(&device.Id, &device.Description, &device.Checked, &device.Color.Id, &device.CarId,&device.Guid,&device.StopDetector,&skipNonCarTracks)
 		if err != nil {
 			dbg.E(TAG, "Unable to scan device!", err)
 			return
 		}
+		device.SkipNonCarTracks = &skipNonCarTracks
 		if device.Color.Id > 0 {
 			device.Color, err = colorManager.GetColor(int64(device.Color.Id), dbCon)
 			if err != nil {
@@ -100,6 +102,16 @@ func CreateDevice(device *Device, dbCon *sql.DB) (key int64, err error) {
 		valString += ",?"
 		vals = append(vals, device.Guid)
 	}
+	if device.StopDetector != "" {
+		insFields += ",stopDetector"
+		valString += ",?"
+		vals = append(vals, device.StopDetector)
+	}
+	if device.SkipNonCarTracks != nil && *device.SkipNonCarTracks {
+		insFields += ",skipNonCarTracks"
+		valString += ",?"
+		vals = append(vals, 1)
+	}
 	q := "INSERT INTO Devices(" + insFields + ") VALUES(" + valString + ")"
 	var res sql.Result
 	res, err = dbCon.Exec(q, vals...)
@@ -133,6 +145,19 @@ func UpdateDevice(d *Device, dbCon *sql.DB) (rowCount int64, err error) {
 		}
 		update.AppendNString("Guid", &d.Guid)
 	}
+	if d.StopDetector != "" {
+		if d.StopDetector=="-" {
+			d.StopDetector = models.NString("")
+		}
+		update.AppendNString("stopDetector", &d.StopDetector)
+	}
+	if d.SkipNonCarTracks != nil {
+		var skipNonCarTracks int64
+		if *d.SkipNonCarTracks {
+			skipNonCarTracks = 1
+		}
+		update.AppendInt64("skipNonCarTracks", &skipNonCarTracks)
+	}
 	// at least update one field to don't get errors ;)
 	update.AppendNString("desc", &d.Description)
 
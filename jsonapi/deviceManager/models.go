@@ -13,6 +13,8 @@ type Device struct {
 	Checked     S.NInt64
 	CarId 		S.NInt64
 	Guid	    S.NString
+	StopDetector S.NString // name of the stop detection algorithm used for this device, "" for default, "-" to reset it to default on update
+	SkipNonCarTracks *bool // true to not create trips for tracks classified as walk, bicycle or rail, only updated if given
 }
 
 type JSONDeleteDeviceAnswer struct {
@@ -18,8 +18,8 @@ func JSONExport(format string, targetDir string, startTime int64, endTime int64,
 	if format == "pdf" {
 		// TODO: Make timeconfig language dependent!
 		timeConfig := tools.GetDefaultTimeConfig()
-		var resPath string
-		resPath, err = ExportToPdf(targetDir+"/exported/pdfs/", startTime, endTime, carId, timeConfig,activeNotifications,T, dbCon)
+		var resPath, headHash string
+		resPath, headHash, err = ExportToPdf(targetDir+"/exported/pdfs/", startTime, endTime, carId, timeConfig,activeNotifications,T, dbCon)
 		resPath = "./protectedDownload/exported/pdfs/" + filepath.Base(resPath)
 		if err != nil {
 			dbg.E(TAG, "Error JSONExport/exporting to pdf : ", err)
@@ -30,6 +30,7 @@ func JSONExport(format string, targetDir string, startTime int64, endTime int64,
 		}
 		answer.Success = true
 		answer.ResPath = resPath
+		answer.HeadHash = headHash
 		return
 	}
 
@@ -3,4 +3,6 @@ import "github.com/OpenDriversLog/goodl-lib/models"
 type JSONExportAnswer struct {
 	models.JSONAnswer
 	ResPath string
+	// HeadHash is the head of the trip hash chain at the time of the export
+	HeadHash string
 }
\ No newline at end of file
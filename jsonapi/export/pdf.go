@@ -23,6 +23,7 @@ import (
 	"time"
 	"github.com/OpenDriversLog/goodl-lib/jsonapi/addressManager"
 	S "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	geo "github.com/OpenDriversLog/goodl-lib/models/geo"
 
 )
 
@@ -49,7 +50,7 @@ type Color struct {
 
 // ExportToPdf exports the trips in the given timespan for the given car to a file in the given directory,
 // returning the path of the result file.
-func ExportToPdf(dir string, startTime int64, endTime int64, carId int64, timeConfig *tools.TimeConfig,activeNotifications *[]*notificationManager.Notification,T *translate.Translater, dbCon *sql.DB) (resPath string, err error) {
+func ExportToPdf(dir string, startTime int64, endTime int64, carId int64, timeConfig *tools.TimeConfig,activeNotifications *[]*notificationManager.Notification,T *translate.Translater, dbCon *sql.DB) (resPath string, headHash string, err error) {
 	if dir == "" {
 		dbg.E(TAG, "Error path for pdf was empty : ", err)
 		return
@@ -68,7 +69,19 @@ func ExportToPdf(dir string, startTime int64, endTime int64, carId int64, timeCo
 	wSum := 0.0
 	header := []string{"Datum", "Art der Fahrt", "km Start", "km Ende", "Start", "Ziel", "Kundenadresse", "Fahrer", "Grund"}
 
-	trips, err := tripMan.GetTripsByWhere("sEndTime<=? AND eStartTime>=? AND sCarId=?", true, false, true, activeNotifications,T,true, dbCon, endTime, startTime, carId)
+	headHash, chainLen, err := tripMan.GetTripHashChainHead(dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error getting trip hash chain head : ", err)
+		return
+	}
+	unsealed, err := tripMan.CountUnsealedTripChanges(dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error counting unsealed trip changes : ", err)
+		return
+	}
+
+	filter := &models.TripFilter{MinTime: startTime, MaxTime: endTime, CarIds: []int64{carId}}
+	trips, err := tripMan.GetTripsByFilter(filter, true, false, true, activeNotifications,T,true, dbCon)
 	drivers, err := driverManager.GetDrivers(dbCon)
 	contacts, err := addressManager.GetContactsWithGeoZones("",dbCon)
 	if err != nil {
@@ -117,6 +130,15 @@ func ExportToPdf(dir string, startTime int64, endTime int64, carId int64, timeCo
 			} else {
 				dateString += tools.GetDateOnlyForText(int64(t.EndTime), true)
 			}
+			switch int(t.DataQuality) {
+			case geo.DataQualityInterpolated:
+				dateString += "\n(GPS interpoliert)"
+			case geo.DataQualityGap:
+				dateString += "\n(GPS-Lücke)"
+			}
+			if t.SpeedingEvents > 0 {
+				dateString += fmt.Sprintf("\n(%dx zu schnell, max. %.0f km/h)", int64(t.SpeedingEvents), float64(t.MaxSpeed))
+			}
 			r.Cells = append(r.Cells,calcMultiCell(w[0], dateString, pdf, &maxH))
 
 			ttype := "???"
@@ -273,6 +295,17 @@ func ExportToPdf(dir string, startTime int64, endTime int64, carId int64, timeCo
 		}
 	}
 	//pdf.CellFormat(wSum, 0, "", "T", 0, "", false, 0, "")
+	if pdf.GetY()+10 > 190.0 {
+		pdf.AddPage()
+	}
+	pdf.SetY(pdf.GetY() + 5)
+	pdf.SetTextColor(0, 0, 0)
+	pdf.SetFont("Arial", "", 7)
+	checksum := fmt.Sprintf("Prüfsumme der Fahrtenhistorie (SHA-256, %d Einträge): %s", chainLen, headHash)
+	if unsealed > 0 {
+		checksum += fmt.Sprintf(" - %d Änderungen sind noch nicht enthalten", unsealed)
+	}
+	pdf.Cell(270, 4, convertUtfToIso(checksum))
 	err = pdf.OutputFileAndClose(resPath)
 	if err != nil {
 		dbg.E(TAG, "Error writing pdf file : ", err)
@@ -3,9 +3,12 @@ package notificationManager
 
 import (
 	"database/sql"
+	"time"
+
 	"github.com/Compufreak345/dbg"
 	. "github.com/OpenDriversLog/goodl-lib/tools"
 
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/policyManager"
 	tripMan "github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan/models"
 	"github.com/OpenDriversLog/goodl-lib/translate"
 )
@@ -250,8 +253,15 @@ func GetNextNotification(ActiveNotifications *[]*Notification, dbCon *sql.DB) (N
 	return
 }
 
-// CheckForNotificationUpdate checks if any notifications need to be created, updated or deleted by the changes in UpdatedTrip
+// CheckForNotificationUpdate checks if any notifications need to be created, updated or deleted by the changes in UpdatedTrip.
+// The reminder time is taken from the TripPolicy of the trips car, relative to its TimeOverDue.
 func CheckForNotificationUpdate(UpdatedTrip *tripMan.Trip,ActiveNotifications *[]*Notification,T *translate.Translater,dbCon *sql.DB) (notificationsUpdated bool, err error){
+	policy, err := policyManager.GetTripPolicyForTrip(UpdatedTrip.Id, dbCon)
+	if err != nil {
+		dbg.E(TAG,"Error getting TripPolicy for trip %d : ", UpdatedTrip.Id, err)
+		return
+	}
+	expTime, remind := policyManager.GetReminderTime(policy, UpdatedTrip.TimeOverDue, time.Now().Unix()*1000)
 	deleteIdxs := make([]int,0)
 	var nearestNotification = &Notification{ExpirationTime:0x7FFFFFFFFFFFFFFF, Id:-1}
 	nearestNotificationIdx := 0
@@ -270,7 +280,7 @@ func CheckForNotificationUpdate(UpdatedTrip *tripMan.Trip,ActiveNotifications *[
 		}
 		skip := false
 		if UpdatedTrip.Id == n.TripId {
-			if UpdatedTrip.Reviewed>0 {
+			if UpdatedTrip.Reviewed>0 || !remind {
 				skip = true
 				notificationsUpdated = true
 				_,err = DeleteNotification(n.Id, dbCon)
@@ -279,8 +289,8 @@ func CheckForNotificationUpdate(UpdatedTrip *tripMan.Trip,ActiveNotifications *[
 					return
 				}
 				deleteIdxs = append(deleteIdxs, i)
-			} else if UpdatedTrip.TimeOverDue != n.ExpirationTime+3*24*60*60*1000 {
-				n.ExpirationTime = UpdatedTrip.TimeOverDue - 3*24*60*60*1000
+			} else if expTime != n.ExpirationTime {
+				n.ExpirationTime = expTime
 				_,err = UpdateNotification(n, dbCon)
 				if err != nil {
 					dbg.E(TAG,"Error updating notification %d : ", n.Id, err)
@@ -293,8 +303,7 @@ func CheckForNotificationUpdate(UpdatedTrip *tripMan.Trip,ActiveNotifications *[
 			nearestNotificationIdx = i
 		}
 	}
-	expTime := UpdatedTrip.TimeOverDue - 3*24*60*60*1000
-	if nearestNotification.ExpirationTime > expTime {
+	if remind && nearestNotification.ExpirationTime > expTime {
 
 		notificationsUpdated = true
 		if nearestNotification.Id!=-1 {
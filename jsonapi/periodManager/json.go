@@ -0,0 +1,75 @@
+package periodManager
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/models"
+)
+
+const NoDataGiven = "Please fill at least one entry."
+
+// JSONGetClosedPeriods returns all closed and reopened periods of the given car (all cars if carId is 0).
+func JSONGetClosedPeriods(carId int64, dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	periods, err := GetClosedPeriods(carId, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error getting ClosedPeriods : ", err)
+		err = nil
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(periods)
+	return
+}
+
+// JSONClosePeriod closes the period given as ClosedPeriod with CarId, StartTime, EndTime and CloseReason for the
+// given user.
+func JSONClosePeriod(periodJson string, uId int64, dbCon *sql.DB) (res models.JSONInsertAnswer, err error) {
+	p := &ClosedPeriod{}
+	if periodJson == "" {
+		res = models.GetBadJSONInsertAnswer(NoDataGiven)
+		return
+	}
+	err = json.Unmarshal([]byte(periodJson), p)
+	if err != nil {
+		dbg.W(TAG, "Could not read JSON %v in JSONClosePeriod : ", periodJson, err)
+		res = models.GetBadJSONInsertAnswer("Invalid format")
+		err = nil
+		return
+	}
+	key, err := ClosePeriod(int64(p.CarId), int64(p.StartTime), int64(p.EndTime), string(p.CloseReason), uId, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error in JSONClosePeriod ClosePeriod: ", err)
+		msg := "Internal server error"
+		if err == ErrReasonMissing || err == ErrInvalidTimeRange {
+			msg = err.Error()
+		}
+		err = nil
+		res = models.GetBadJSONInsertAnswer(msg)
+		return
+	}
+	res = models.GetGoodJSONInsertAnswer(key)
+	return
+}
+
+// JSONReopenPeriod reopens the given closed period if the user (uId) is an admin.
+func JSONReopenPeriod(id int64, reason string, uId int64, isAdmin bool, dbCon *sql.DB) (res models.JSONUpdateAnswer, err error) {
+	if !isAdmin {
+		res = models.GetBadJSONUpdateAnswer("Only admins can reopen periods", id)
+		return
+	}
+	rowCount, err := ReopenPeriod(id, reason, uId, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error in JSONReopenPeriod ReopenPeriod: ", err)
+		msg := "Internal server error"
+		if err == ErrReasonMissing || err == ErrPeriodNotClosed {
+			msg = err.Error()
+		}
+		err = nil
+		res = models.GetBadJSONUpdateAnswer(msg, id)
+		return
+	}
+	res = models.GetGoodJSONUpdateAnswer(rowCount, id)
+	return
+}
@@ -0,0 +1,24 @@
+package periodManager
+
+import (
+	S "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+)
+
+// ClosedPeriod is a time range of a car whose trips, tracks and keypoints can't be changed anymore, e.g. because
+// it was submitted to the accountant. Periods are never deleted, so they also are the audit of closing & reopening.
+type ClosedPeriod struct {
+	Id        int64
+	CarId     S.NInt64
+	StartTime S.NInt64
+	EndTime   S.NInt64
+	// ClosedAt is the time (unix millis) the period was closed at
+	ClosedAt    S.NInt64
+	CloseReason S.NString
+	// ClosedBy is the ID of the user who closed the period, 0 if unknown
+	ClosedBy S.NInt64
+	// ReopenedAt is the time (unix millis) an admin reopened the period at, 0 as long as it is closed
+	ReopenedAt   S.NInt64
+	ReopenReason S.NString
+	// ReopenedBy is the ID of the admin who reopened the period
+	ReopenedBy S.NInt64
+}
@@ -0,0 +1,172 @@
+// Package periodManager is responsible for closing periods of a car, so their trips, tracks and keypoints can't be
+// changed anymore, and for reopening them.
+package periodManager
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/tools"
+)
+
+const TAG = "goodl-lib/jsonApi/periodManager"
+const SelectColumns = "_closedPeriodId,carId,startTime,endTime,closedAt,closeReason,IFNULL(reopenedAt,0),IFNULL(reopenReason,''),IFNULL(closedBy,0),IFNULL(reopenedBy,0)"
+
+// closedByTrigger is the message the triggers of the ClosedPeriods migration abort with.
+const closedByTrigger = "PERIOD_CLOSED"
+
+// ErrPeriodClosed is returned when something in a closed period should be changed.
+var ErrPeriodClosed = errors.New("The period is closed, its trips can't be changed anymore")
+var ErrReasonMissing = errors.New("Please give a reason")
+var ErrInvalidTimeRange = errors.New("Invalid time range")
+var ErrPeriodNotClosed = errors.New("The period is not closed")
+
+// CheckError returns ErrPeriodClosed if the given database error was caused by a change in a closed period,
+// else err.
+func CheckError(err error) error {
+	if err != nil && strings.Contains(err.Error(), closedByTrigger) {
+		return ErrPeriodClosed
+	}
+	return err
+}
+
+// ClosedTripCondition returns an SQL condition that is true if the trip with the ID in the given column overlaps a
+// closed period of its car - the check of the closedperiod_update_trips trigger, for leaving those trips out of
+// bulk updates instead of aborting them.
+func ClosedTripCondition(tripIdColumn string) string {
+	return `EXISTS (SELECT 1 FROM Tracks_Trips cptt JOIN Tracks cpt ON cpt._trackId=cptt.trackId
+	JOIN KeyPoints cps ON cps._keyPointId=cpt.startKeyPointId JOIN KeyPoints cpe ON cpe._keyPointId=cpt.endKeyPointId
+	JOIN ClosedPeriods cpp ON cpp.carId=cpt.carId AND cpp.reopenedAt IS NULL AND cps.endTime<=cpp.endTime AND cpe.startTime>=cpp.startTime
+	WHERE cptt.tripId=` + tripIdColumn + `)`
+}
+
+// ClosedKeyPointCondition returns an SQL condition that is true if the KeyPoint with the given table alias lies
+// completely in a closed period of its car - the check of the closedperiod_update_keypoints trigger.
+func ClosedKeyPointCondition(keyPoint string) string {
+	return `EXISTS (SELECT 1 FROM ClosedPeriods cpp
+	WHERE cpp.carId=IFNULL(` + keyPoint + `.carId, (SELECT carId FROM Devices WHERE _deviceId=` + keyPoint + `.deviceId))
+	AND cpp.reopenedAt IS NULL AND ` + keyPoint + `.startTime>=cpp.startTime AND ` + keyPoint + `.endTime<=cpp.endTime)`
+}
+
+// FindClosedPeriod returns the first of the given periods of the given car that is closed and overlaps the time
+// range from startTime to endTime, nil if there is none.
+func FindClosedPeriod(periods []*ClosedPeriod, carId int64, startTime int64, endTime int64) *ClosedPeriod {
+	for _, p := range periods {
+		if int64(p.CarId) == carId && p.ReopenedAt == 0 && startTime <= int64(p.EndTime) && endTime >= int64(p.StartTime) {
+			return p
+		}
+	}
+	return nil
+}
+
+// scanClosedPeriod scans a ClosedPeriod with the SelectColumns from the given row.
+func scanClosedPeriod(row tools.Scannable) (p *ClosedPeriod, err error) {
+	p = &ClosedPeriod{}
+	err = row.Scan(&p.Id, &p.CarId, &p.StartTime, &p.EndTime, &p.ClosedAt, &p.CloseReason, &p.ReopenedAt, &p.ReopenReason, &p.ClosedBy, &p.ReopenedBy)
+	return
+}
+
+// GetClosedPeriods returns all periods of the given car (all cars if carId is 0) including the reopened ones.
+func GetClosedPeriods(carId int64, dbCon *sql.DB) (periods []*ClosedPeriod, err error) {
+	periods = make([]*ClosedPeriod, 0)
+	rows, err := dbCon.Query("SELECT "+SelectColumns+" FROM ClosedPeriods WHERE ?=0 OR carId=? ORDER BY startTime ASC, _closedPeriodId ASC", carId, carId)
+	if err != nil {
+		dbg.E(TAG, "unable to get ClosedPeriods", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p *ClosedPeriod
+		p, err = scanClosedPeriod(rows)
+		if err != nil {
+			dbg.E(TAG, "Unable to scan ClosedPeriod!", err)
+			return
+		}
+		periods = append(periods, p)
+	}
+	err = rows.Err()
+	return
+}
+
+// CheckTimeRangeOpen returns ErrPeriodClosed if the time range from startTime to endTime of the given car overlaps
+// a closed period.
+func CheckTimeRangeOpen(carId int64, startTime int64, endTime int64, dbCon *sql.DB) (err error) {
+	periods, err := GetClosedPeriods(carId, dbCon)
+	if err != nil {
+		return
+	}
+	if p := FindClosedPeriod(periods, carId, startTime, endTime); p != nil {
+		dbg.W(TAG, "Time range %d - %d of car %d is in closed period %d", startTime, endTime, carId, p.Id)
+		err = ErrPeriodClosed
+	}
+	return
+}
+
+// CheckTracksOpen returns ErrPeriodClosed if one of the given tracks overlaps a closed period of its car.
+func CheckTracksOpen(trackIds []int64, dbCon *sql.DB) (err error) {
+	for _, trackId := range trackIds {
+		var carId, startTime, endTime int64
+		err = dbCon.QueryRow(`SELECT IFNULL(t.carId,0), s.endTime, e.startTime FROM Tracks t
+			JOIN KeyPoints s ON s._keyPointId=t.startKeyPointId JOIN KeyPoints e ON e._keyPointId=t.endKeyPointId
+			WHERE t._trackId=?`, trackId).Scan(&carId, &startTime, &endTime)
+		if err == sql.ErrNoRows {
+			err = nil
+			continue
+		}
+		if err != nil {
+			dbg.E(TAG, "unable to get time range of track %d", trackId, err)
+			return
+		}
+		if err = CheckTimeRangeOpen(carId, startTime, endTime, dbCon); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ClosePeriod closes the time range from startTime to endTime of the given car, from now on its trips, tracks and
+// keypoints can't be changed anymore, even by admins. uId is the user closing it.
+func ClosePeriod(carId int64, startTime int64, endTime int64, reason string, uId int64, dbCon *sql.DB) (key int64, err error) {
+	if strings.TrimSpace(reason) == "" {
+		err = ErrReasonMissing
+		return
+	}
+	if startTime >= endTime {
+		err = ErrInvalidTimeRange
+		return
+	}
+	res, err := dbCon.Exec("INSERT INTO ClosedPeriods(carId,startTime,endTime,closedAt,closeReason,closedBy) VALUES(?,?,?,?,?,?)",
+		carId, startTime, endTime, time.Now().Unix()*1000, reason, uId)
+	if err != nil {
+		dbg.E(TAG, "Error in dbCon.Exec for ClosePeriod: %v ", err)
+		return
+	}
+	key, err = res.LastInsertId()
+	dbg.I(TAG, "User %d closed period %d of car %d from %d to %d : %s", uId, key, carId, startTime, endTime, reason)
+	return
+}
+
+// ReopenPeriod reopens the given closed period, only admins are allowed to do so.
+// The period is kept with the time, reason and user (uId) of reopening.
+func ReopenPeriod(id int64, reason string, uId int64, dbCon *sql.DB) (rowCount int64, err error) {
+	if strings.TrimSpace(reason) == "" {
+		err = ErrReasonMissing
+		return
+	}
+	res, err := dbCon.Exec("UPDATE ClosedPeriods SET reopenedAt=?, reopenReason=?, reopenedBy=? WHERE _closedPeriodId=? AND reopenedAt IS NULL",
+		time.Now().Unix()*1000, reason, uId, id)
+	if err != nil {
+		dbg.E(TAG, "Error in ReopenPeriod : ", err)
+		return
+	}
+	rowCount, err = res.RowsAffected()
+	if err == nil && rowCount == 0 {
+		err = ErrPeriodNotClosed
+		return
+	}
+	dbg.I(TAG, "User %d reopened period %d : %s", uId, id, reason)
+	return
+}
@@ -0,0 +1,13 @@
+package periodManager_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestPeriodManager(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "PeriodManager Suite")
+}
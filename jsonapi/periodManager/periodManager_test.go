@@ -0,0 +1,173 @@
+package periodManager_test
+
+import (
+	"database/sql"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/dbMan"
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/periodManager"
+)
+
+var _ = Describe("PeriodManager", func() {
+	It("should find closed periods overlapping a time range of the car", func() {
+		may := &ClosedPeriod{Id: 1, CarId: 3, StartTime: 100, EndTime: 200}
+		reopened := &ClosedPeriod{Id: 2, CarId: 3, StartTime: 300, EndTime: 400, ReopenedAt: 500}
+		periods := []*ClosedPeriod{may, reopened}
+		Expect(FindClosedPeriod(periods, 3, 150, 160)).To(Equal(may))
+		Expect(FindClosedPeriod(periods, 3, 50, 100)).To(Equal(may))
+		Expect(FindClosedPeriod(periods, 3, 200, 250)).To(Equal(may))
+		Expect(FindClosedPeriod(periods, 3, 201, 250)).To(BeNil())
+		Expect(FindClosedPeriod(periods, 4, 150, 160)).To(BeNil())
+		Expect(FindClosedPeriod(periods, 3, 350, 360)).To(BeNil())
+	})
+
+	It("should recognize errors of the closed period triggers", func() {
+		Expect(CheckError(errors.New("PERIOD_CLOSED"))).To(Equal(ErrPeriodClosed))
+		other := errors.New("database is locked")
+		Expect(CheckError(other)).To(Equal(other))
+		Expect(CheckError(nil)).To(BeNil())
+	})
+
+	Describe("closed periods in the database", func() {
+		var (
+			dbCon                                *sql.DB
+			carId, deviceId, tripId, periodId    int64
+			closedTrackId, openTrackId, closedKp int64
+		)
+		insert := func(q string, args ...interface{}) int64 {
+			res, err := dbCon.Exec(q, args...)
+			Expect(err).To(BeNil())
+			id, _ := res.LastInsertId()
+			return id
+		}
+
+		BeforeEach(func() {
+			dbCon, _ = dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+			carId = insert("INSERT INTO Cars (type, plate) VALUES ('Periodentest', 'DD-PM 51')")
+			deviceId = insert("INSERT INTO Devices (desc, colorId, carId) VALUES ('Periodentest', 1, ?)", carId)
+			kp := func(startTime int64, endTime int64) int64 {
+				return insert("INSERT INTO KeyPoints (latitude, longitude, startTime, endTime, deviceId, carId) VALUES (51.05, 13.73, ?, ?, ?, ?)",
+					startTime, endTime, deviceId, carId)
+			}
+			// stops at 100-200, 300-400 (in the period 100 - 1000) and 1100-1200
+			closedKp = kp(100, 200)
+			middle := kp(300, 400)
+			end := kp(1100, 1200)
+			closedTrackId = insert("INSERT INTO Tracks (deviceId, startKeyPointId, endKeyPointId, distance, carId) VALUES (?,?,?,1000,?)", deviceId, closedKp, middle, carId)
+			openTrackId = insert("INSERT INTO Tracks (deviceId, startKeyPointId, endKeyPointId, distance, carId) VALUES (?,?,?,1000,?)", deviceId, end, end, carId)
+			tripId = insert("INSERT INTO Trips (type, title) VALUES (1, 'Periodentest')")
+			insert("INSERT INTO Tracks_Trips (trackId, tripId) VALUES (?,?)", closedTrackId, tripId)
+			var err error
+			periodId, err = ClosePeriod(carId, 100, 1000, "Steuerjahr", 1, dbCon)
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			_, err := dbCon.Exec("DELETE FROM ClosedPeriods WHERE carId=?", carId)
+			Expect(err).To(BeNil())
+			for _, q := range []string{
+				"DELETE FROM Trip_History WHERE tripId=?",
+				"DELETE FROM Tracks_Trips WHERE tripId=?",
+				"DELETE FROM Trips WHERE _tripId=?",
+			} {
+				_, err = dbCon.Exec(q, tripId)
+				Expect(err).To(BeNil())
+			}
+			for _, q := range []string{
+				"DELETE FROM Tracks_Trips_History WHERE trackIdNEW IN (SELECT _trackId FROM Tracks WHERE carId=?1) OR trackIdOLD IN (SELECT _trackId FROM Tracks WHERE carId=?1)",
+				"DELETE FROM Tracks WHERE carId=?",
+				"DELETE FROM KeyPoints WHERE carId=?",
+				"DELETE FROM Devices WHERE carId=?",
+				"DELETE FROM Cars WHERE _carId=?",
+			} {
+				_, err = dbCon.Exec(q, carId)
+				Expect(err).To(BeNil())
+			}
+			dbCon.Close()
+		})
+
+		It("should let the triggers reject changes of trips, tracks and keypoints", func() {
+			_, err := dbCon.Exec("UPDATE Trips SET title='changed' WHERE _tripId=?", tripId)
+			Expect(CheckError(err)).To(Equal(ErrPeriodClosed))
+			_, err = dbCon.Exec("DELETE FROM Trips WHERE _tripId=?", tripId)
+			Expect(CheckError(err)).To(Equal(ErrPeriodClosed))
+			_, err = dbCon.Exec("DELETE FROM Tracks_Trips WHERE trackId=?", closedTrackId)
+			Expect(CheckError(err)).To(Equal(ErrPeriodClosed))
+			_, err = dbCon.Exec("INSERT INTO Tracks_Trips (trackId, tripId) VALUES (?,?)", openTrackId, tripId)
+			Expect(CheckError(err)).To(Equal(ErrPeriodClosed))
+
+			_, err = dbCon.Exec("UPDATE Tracks SET distance=2000 WHERE _trackId=?", closedTrackId)
+			Expect(CheckError(err)).To(Equal(ErrPeriodClosed))
+			_, err = dbCon.Exec("DELETE FROM Tracks WHERE _trackId=?", closedTrackId)
+			Expect(CheckError(err)).To(Equal(ErrPeriodClosed))
+
+			_, err = dbCon.Exec("UPDATE KeyPoints SET endTime=250 WHERE _keyPointId=?", closedKp)
+			Expect(CheckError(err)).To(Equal(ErrPeriodClosed))
+			_, err = dbCon.Exec("DELETE FROM KeyPoints WHERE _keyPointId=?", closedKp)
+			Expect(CheckError(err)).To(Equal(ErrPeriodClosed))
+			// without a car the KeyPoint belongs to the car of its device
+			_, err = dbCon.Exec("INSERT INTO KeyPoints (latitude, longitude, startTime, endTime, deviceId) VALUES (51.05, 13.73, 500, 600, ?)", deviceId)
+			Expect(CheckError(err)).To(Equal(ErrPeriodClosed))
+
+			_, err = dbCon.Exec("UPDATE Tracks SET distance=2000 WHERE _trackId=?", openTrackId)
+			Expect(err).To(BeNil())
+
+			_, err = ReopenPeriod(periodId, "Korrektur", 2, dbCon)
+			Expect(err).To(BeNil())
+			_, err = dbCon.Exec("UPDATE Trips SET title='Periodentest' WHERE _tripId=?", tripId)
+			Expect(err).To(BeNil())
+			_, err = dbCon.Exec("UPDATE Tracks SET distance=2000 WHERE _trackId=?", closedTrackId)
+			Expect(err).To(BeNil())
+		})
+
+		It("should check if tracks are in closed periods of their car", func() {
+			Expect(CheckTracksOpen([]int64{closedTrackId}, dbCon)).To(Equal(ErrPeriodClosed))
+			Expect(CheckTracksOpen([]int64{openTrackId, closedTrackId}, dbCon)).To(Equal(ErrPeriodClosed))
+			Expect(CheckTracksOpen([]int64{openTrackId}, dbCon)).To(BeNil())
+			Expect(CheckTracksOpen([]int64{-1}, dbCon)).To(BeNil())
+			Expect(CheckTracksOpen(nil, dbCon)).To(BeNil())
+
+			_, err := ReopenPeriod(periodId, "Korrektur", 2, dbCon)
+			Expect(err).To(BeNil())
+			Expect(CheckTracksOpen([]int64{closedTrackId}, dbCon)).To(BeNil())
+		})
+
+		It("should remember who closed and reopened the period", func() {
+			_, err := ReopenPeriod(periodId, "Korrektur", 2, dbCon)
+			Expect(err).To(BeNil())
+			periods, err := GetClosedPeriods(carId, dbCon)
+			Expect(err).To(BeNil())
+			Expect(periods).To(HaveLen(1))
+			Expect(periods[0].ClosedBy).To(BeEquivalentTo(1))
+			Expect(periods[0].CloseReason).To(BeEquivalentTo("Steuerjahr"))
+			Expect(periods[0].ReopenedBy).To(BeEquivalentTo(2))
+			Expect(periods[0].ReopenReason).To(BeEquivalentTo("Korrektur"))
+		})
+
+		It("should find trips and keypoints in closed periods for bulk statements", func() {
+			openTripId := insert("INSERT INTO Trips (type, title) VALUES (1, 'Periodentest')")
+			insert("INSERT INTO Tracks_Trips (trackId, tripId) VALUES (?,?)", openTrackId, openTripId)
+			defer func() {
+				dbCon.Exec("DELETE FROM Tracks_Trips WHERE tripId=?", openTripId)
+				dbCon.Exec("DELETE FROM Trips WHERE _tripId=?", openTripId)
+			}()
+
+			var closed bool
+			Expect(dbCon.QueryRow("SELECT "+ClosedTripCondition("_tripId")+" FROM Trips WHERE _tripId=?", tripId).Scan(&closed)).To(BeNil())
+			Expect(closed).To(BeTrue())
+			Expect(dbCon.QueryRow("SELECT "+ClosedTripCondition("_tripId")+" FROM Trips WHERE _tripId=?", openTripId).Scan(&closed)).To(BeNil())
+			Expect(closed).To(BeFalse())
+			res, err := dbCon.Exec("UPDATE Trips SET title='changed' WHERE _tripId IN (?,?) AND NOT "+ClosedTripCondition("_tripId"), tripId, openTripId)
+			Expect(err).To(BeNil())
+			Expect(res.RowsAffected()).To(BeEquivalentTo(1))
+
+			res, err = dbCon.Exec("UPDATE KeyPoints SET endTime=endTime WHERE carId=? AND NOT "+ClosedKeyPointCondition("KeyPoints"), carId)
+			Expect(err).To(BeNil())
+			// the stop at 1100-1200 is the only one not completely in the period
+			Expect(res.RowsAffected()).To(BeEquivalentTo(1))
+		})
+	})
+})
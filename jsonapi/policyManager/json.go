@@ -0,0 +1,69 @@
+package policyManager
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/models"
+)
+
+const NoDataGiven = "Please fill at least one entry."
+
+// JSONGetTripPolicies returns all stored policies and the default used if none is stored.
+func JSONGetTripPolicies(dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	policies, err := GetTripPolicies(dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error getting TripPolicies : ", err)
+		err = nil
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(struct {
+		Policies []*TripPolicy
+		Default  TripPolicy
+	}{policies, DefaultTripPolicy})
+	return
+}
+
+// JSONSetTripPolicy stores the given policy for its car or the account.
+func JSONSetTripPolicy(policyJson string, dbCon *sql.DB) (res models.JSONInsertAnswer, err error) {
+	p := &TripPolicy{}
+	if policyJson == "" {
+		res = models.GetBadJSONInsertAnswer(NoDataGiven)
+		return
+	}
+	err = json.Unmarshal([]byte(policyJson), p)
+	if err != nil {
+		dbg.W(TAG, "Could not read JSON %v in JSONSetTripPolicy : ", policyJson, err)
+		res = models.GetBadJSONInsertAnswer("Invalid format")
+		err = nil
+		return
+	}
+	key, err := SetTripPolicy(p, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error in JSONSetTripPolicy SetTripPolicy: ", err)
+		msg := "Internal server error"
+		if err == ErrInvalidDeadlineType {
+			msg = err.Error()
+		}
+		err = nil
+		res = models.GetBadJSONInsertAnswer(msg)
+		return
+	}
+	res = models.GetGoodJSONInsertAnswer(key)
+	return
+}
+
+// JSONDeleteTripPolicy deletes the policy of the given car (or the account if carId is 0), so the default applies again.
+func JSONDeleteTripPolicy(carId int64, dbCon *sql.DB) (res models.JSONDeleteAnswer, err error) {
+	rowCount, err := DeleteTripPolicy(carId, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error in JSONDeleteTripPolicy DeleteTripPolicy: ", err)
+		err = nil
+		res = models.GetBadJSONDeleteAnswer("Internal server error", carId)
+		return
+	}
+	res = models.GetGoodJSONDeleteAnswer(rowCount, carId)
+	return
+}
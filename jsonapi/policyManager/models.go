@@ -0,0 +1,20 @@
+package policyManager
+
+import (
+	S "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+)
+
+// TripPolicy defines until when trips can be edited by non-admins (their deadline, see GetDeadline) and when
+// reminders about unreviewed trips are created.
+type TripPolicy struct {
+	Id int64
+	// CarId is the car the policy applies to, 0 for the default of the account
+	CarId S.NInt64
+	// DeadlineType is one of the Deadline* types
+	DeadlineType S.NString
+	// DeadlineOffset is the count of days (DeadlineRolling, DeadlineEndOfDay) or months (DeadlineEndOfMonth)
+	// added after the end of the trip
+	DeadlineOffset S.NInt64
+	// ReminderOffsets are the hours before the deadline reminders are created at, e.g. [72, 24]
+	ReminderOffsets []int64
+}
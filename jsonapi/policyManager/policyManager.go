@@ -0,0 +1,288 @@
+// Package policyManager is responsible for the policies until when trips can be edited and when to remind about them.
+package policyManager
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/periodManager"
+	S "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	"github.com/OpenDriversLog/goodl-lib/tools"
+)
+
+const TAG = "goodl-lib/jsonApi/policyManager"
+const SelectColumns = "_tripPolicyId,carId,deadlineType,deadlineOffset,reminderOffsets"
+
+const (
+	// DeadlineRolling ends DeadlineOffset days after the end of the trip
+	DeadlineRolling = "rolling"
+	// DeadlineEndOfDay ends at the end of the day of the trip, plus DeadlineOffset days
+	DeadlineEndOfDay = "endOfDay"
+	// DeadlineEndOfMonth ends at the end of the month of the trip, plus DeadlineOffset months
+	DeadlineEndOfMonth = "endOfMonth"
+)
+
+// DefaultTripPolicy is used if neither the car nor the account have a policy: trips can be edited for 7 days,
+// reminded 3 days before.
+var DefaultTripPolicy = TripPolicy{
+	DeadlineType:    DeadlineRolling,
+	DeadlineOffset:  7,
+	ReminderOffsets: []int64{72},
+}
+
+var ErrInvalidDeadlineType = errors.New("Invalid deadline type")
+
+// GetDeadline returns the time (unix millis) until trips ending at tripEndTime can be edited by non-admins.
+// Calendar based deadlines use local time.
+func GetDeadline(p *TripPolicy, tripEndTime int64) int64 {
+	end := tools.GetTimeFromMillis(tripEndTime)
+	offset := int(p.DeadlineOffset)
+	var deadline time.Time
+	switch string(p.DeadlineType) {
+	case DeadlineEndOfDay:
+		deadline = time.Date(end.Year(), end.Month(), end.Day()+offset+1, 0, 0, 0, 0, end.Location())
+	case DeadlineEndOfMonth:
+		deadline = time.Date(end.Year(), end.Month()+time.Month(offset)+1, 1, 0, 0, 0, 0, end.Location())
+	default:
+		return tripEndTime + int64(offset)*24*60*60*1000
+	}
+	return deadline.UnixNano() / int64(time.Millisecond)
+}
+
+// GetReminderTime returns the time (unix millis) of the next reminder before the given deadline, the last one
+// if all are before now. remind is false if the policy has no reminders.
+func GetReminderTime(p *TripPolicy, deadline int64, now int64) (remindTime int64, remind bool) {
+	if len(p.ReminderOffsets) == 0 {
+		return
+	}
+	offsets := make([]int64, len(p.ReminderOffsets))
+	copy(offsets, p.ReminderOffsets)
+	sort.Sort(sort.Reverse(int64s(offsets)))
+	remind = true
+	for _, o := range offsets {
+		remindTime = deadline - o*60*60*1000
+		if remindTime > now {
+			return
+		}
+	}
+	return
+}
+
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// GetPolicyForCar returns the policy of the given car from the given policies, the default of the account if the car
+// has none or DefaultTripPolicy if the account has none either.
+func GetPolicyForCar(policies []*TripPolicy, carId int64) *TripPolicy {
+	var res *TripPolicy
+	for _, p := range policies {
+		if int64(p.CarId) == carId {
+			return p
+		}
+		if p.CarId == 0 {
+			res = p
+		}
+	}
+	if res == nil {
+		def := DefaultTripPolicy
+		res = &def
+	}
+	return res
+}
+
+// scanTripPolicy scans a TripPolicy with the SelectColumns from the given row.
+func scanTripPolicy(row tools.Scannable) (p *TripPolicy, err error) {
+	p = &TripPolicy{ReminderOffsets: make([]int64, 0)}
+	var offsets S.NString
+	err = row.Scan(&p.Id, &p.CarId, &p.DeadlineType, &p.DeadlineOffset, &offsets)
+	if err != nil {
+		return
+	}
+	for _, o := range strings.Split(string(offsets), ",") {
+		if o == "" {
+			continue
+		}
+		var h int64
+		h, err = strconv.ParseInt(strings.TrimSpace(o), 10, 64)
+		if err != nil {
+			dbg.E(TAG, "Invalid reminder offset %s in policy %d : ", o, p.Id, err)
+			return
+		}
+		p.ReminderOffsets = append(p.ReminderOffsets, h)
+	}
+	return
+}
+
+// GetTripPolicies returns all stored policies.
+func GetTripPolicies(dbCon tools.DbRunner) (policies []*TripPolicy, err error) {
+	policies = make([]*TripPolicy, 0)
+	rows, err := dbCon.Query("SELECT " + SelectColumns + " FROM TripPolicies ORDER BY carId ASC")
+	if err != nil {
+		dbg.E(TAG, "unable to get TripPolicies", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p *TripPolicy
+		p, err = scanTripPolicy(rows)
+		if err != nil {
+			dbg.E(TAG, "Unable to scan TripPolicy!", err)
+			return
+		}
+		policies = append(policies, p)
+	}
+	err = rows.Err()
+	return
+}
+
+// GetTripPolicyForCar returns the policy of the given car (see GetPolicyForCar).
+func GetTripPolicyForCar(carId int64, dbCon *sql.DB) (p *TripPolicy, err error) {
+	p, err = scanTripPolicy(dbCon.QueryRow("SELECT "+SelectColumns+" FROM TripPolicies WHERE carId IN (?,0) ORDER BY carId DESC LIMIT 1", carId))
+	if err == sql.ErrNoRows {
+		err = nil
+		p = GetPolicyForCar(nil, carId)
+	} else if err != nil {
+		dbg.E(TAG, "unable to get TripPolicy for car %d", carId, err)
+	}
+	return
+}
+
+// GetTripPolicyForTrip returns the policy of the car the given trip was driven with (see GetPolicyForCar).
+func GetTripPolicyForTrip(tripId int64, dbCon *sql.DB) (p *TripPolicy, err error) {
+	var carId int64
+	err = dbCon.QueryRow(`SELECT IFNULL(t.carId,0) FROM Tracks_Trips tt JOIN Tracks t ON t._trackId=tt.trackId
+		WHERE tt.tripId=? LIMIT 1`, tripId).Scan(&carId)
+	if err != nil && err != sql.ErrNoRows {
+		dbg.E(TAG, "unable to get car of trip %d", tripId, err)
+		return
+	}
+	return GetTripPolicyForCar(carId, dbCon)
+}
+
+// SetTripPolicy stores the policy of a car (or the account if CarId is 0), replacing the previous one.
+// The deadlines of all trips are recalculated in the same transaction (see UpdateTimeOverDue).
+func SetTripPolicy(p *TripPolicy, dbCon *sql.DB) (key int64, err error) {
+	switch string(p.DeadlineType) {
+	case DeadlineRolling, DeadlineEndOfDay, DeadlineEndOfMonth:
+	default:
+		err = ErrInvalidDeadlineType
+		return
+	}
+	offsets := make([]string, len(p.ReminderOffsets))
+	for i, o := range p.ReminderOffsets {
+		offsets[i] = strconv.FormatInt(o, 10)
+	}
+	tx, err := dbCon.Begin()
+	if err != nil {
+		dbg.E(TAG, "Error starting transaction for SetTripPolicy : ", err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	res, err := tx.Exec("INSERT OR REPLACE INTO TripPolicies(carId,deadlineType,deadlineOffset,reminderOffsets) VALUES(?,?,?,?)",
+		p.CarId, p.DeadlineType, p.DeadlineOffset, strings.Join(offsets, ","))
+	if err != nil {
+		dbg.E(TAG, "Error in dbCon.Exec for SetTripPolicy: %v ", err)
+		return
+	}
+	key, err = res.LastInsertId()
+	if err != nil {
+		return
+	}
+	if _, err = UpdateTimeOverDue(tx); err != nil {
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		dbg.E(TAG, "Error commiting SetTripPolicy : ", err)
+	}
+	return
+}
+
+// DeleteTripPolicy deletes the policy of the given car (or the account if carId is 0).
+// The deadlines of all trips are recalculated in the same transaction (see UpdateTimeOverDue).
+func DeleteTripPolicy(carId int64, dbCon *sql.DB) (rowCount int64, err error) {
+	tx, err := dbCon.Begin()
+	if err != nil {
+		dbg.E(TAG, "Error starting transaction for DeleteTripPolicy : ", err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	res, err := tx.Exec("DELETE FROM TripPolicies WHERE carId=?", carId)
+	if err != nil {
+		dbg.E(TAG, "Error in DeleteTripPolicy : ", err)
+		return
+	}
+	rowCount, err = res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if _, err = UpdateTimeOverDue(tx); err != nil {
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		dbg.E(TAG, "Error commiting DeleteTripPolicy : ", err)
+	}
+	return
+}
+
+// UpdateTimeOverDue sets the timeOverDue of all trips to the deadline of the policy of their car (see
+// GetPolicyForCar), calculated from the arrival at the end of their last track. Only changed trips are updated,
+// trips in closed periods are left as they are.
+func UpdateTimeOverDue(dbCon tools.DbRunner) (rowCount int64, err error) {
+	policies, err := GetTripPolicies(dbCon)
+	if err != nil {
+		return
+	}
+	rows, err := dbCon.Query(`SELECT tt.tripId, IFNULL(MIN(t.carId),0), MAX(e.startTime), tr.timeOverDue FROM Tracks_Trips tt
+		JOIN Trips tr ON tr._tripId=tt.tripId JOIN Tracks t ON t._trackId=tt.trackId
+		JOIN KeyPoints e ON e._keyPointId=t.endKeyPointId WHERE NOT ` + periodManager.ClosedTripCondition("tt.tripId") + `
+		GROUP BY tt.tripId`)
+	if err != nil {
+		dbg.E(TAG, "unable to get trips to update timeOverDue", err)
+		return
+	}
+	deadlines := make(map[int64]int64)
+	for rows.Next() {
+		var tripId, carId, endTime, timeOverDue int64
+		err = rows.Scan(&tripId, &carId, &endTime, &timeOverDue)
+		if err != nil {
+			rows.Close()
+			dbg.E(TAG, "Unable to scan trip to update timeOverDue", err)
+			return
+		}
+		if d := GetDeadline(GetPolicyForCar(policies, carId), endTime); d != timeOverDue {
+			deadlines[tripId] = d
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for tripId, d := range deadlines {
+		_, err = dbCon.Exec("UPDATE Trips SET timeOverDue=? WHERE _tripId=?", d, tripId)
+		if err != nil {
+			dbg.E(TAG, "unable to update timeOverDue of trip %d", tripId, err)
+			return
+		}
+		rowCount++
+	}
+	dbg.I(TAG, "Updated timeOverDue of %d trips", rowCount)
+	return
+}
@@ -0,0 +1,13 @@
+package policyManager_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestPolicyManager(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "PolicyManager Suite")
+}
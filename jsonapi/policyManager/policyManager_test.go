@@ -0,0 +1,125 @@
+package policyManager_test
+
+import (
+	"database/sql"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/OpenDriversLog/goodl-lib/dbMan"
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/policyManager"
+	S "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+)
+
+var _ = Describe("PolicyManager", func() {
+	const hour = int64(60 * 60 * 1000)
+	millis := func(month time.Month, day int, h int) int64 {
+		return time.Date(2016, month, day, h, 0, 0, 0, time.Local).UnixNano() / int64(time.Millisecond)
+	}
+	end := millis(5, 12, 18)
+
+	It("should calculate rolling and calendar based deadlines", func() {
+		Expect(GetDeadline(&DefaultTripPolicy, end)).To(Equal(end + 7*24*hour))
+		Expect(GetDeadline(&TripPolicy{DeadlineType: DeadlineEndOfDay}, end)).To(Equal(millis(5, 13, 0)))
+		Expect(GetDeadline(&TripPolicy{DeadlineType: DeadlineEndOfDay, DeadlineOffset: 2}, end)).To(Equal(millis(5, 15, 0)))
+		Expect(GetDeadline(&TripPolicy{DeadlineType: DeadlineEndOfMonth}, end)).To(Equal(millis(6, 1, 0)))
+		Expect(GetDeadline(&TripPolicy{DeadlineType: DeadlineEndOfMonth, DeadlineOffset: 1}, end)).To(Equal(millis(7, 1, 0)))
+	})
+
+	It("should remind at the next reminder offset before the deadline", func() {
+		p := &TripPolicy{ReminderOffsets: []int64{24, 72}}
+		deadline := millis(5, 20, 0)
+		t, remind := GetReminderTime(p, deadline, millis(5, 12, 0))
+		Expect(remind).To(BeTrue())
+		Expect(t).To(Equal(deadline - 72*hour))
+		t, _ = GetReminderTime(p, deadline, millis(5, 18, 0))
+		Expect(t).To(Equal(deadline - 24*hour))
+		t, _ = GetReminderTime(p, deadline, millis(5, 19, 12))
+		Expect(t).To(Equal(deadline - 24*hour))
+
+		_, remind = GetReminderTime(&TripPolicy{}, deadline, millis(5, 12, 0))
+		Expect(remind).To(BeFalse())
+	})
+
+	It("should fall back to the policy of the account and the default", func() {
+		account := &TripPolicy{DeadlineType: DeadlineEndOfDay}
+		car := &TripPolicy{CarId: 3, DeadlineType: DeadlineEndOfMonth}
+		Expect(GetPolicyForCar([]*TripPolicy{car, account}, 3)).To(Equal(car))
+		Expect(GetPolicyForCar([]*TripPolicy{car, account}, 4)).To(Equal(account))
+		Expect(*GetPolicyForCar([]*TripPolicy{car}, 4)).To(Equal(DefaultTripPolicy))
+	})
+
+	Describe("deadlines in the database", func() {
+		var (
+			dbCon         *sql.DB
+			carId, tripId int64
+		)
+		insert := func(q string, args ...interface{}) int64 {
+			res, err := dbCon.Exec(q, args...)
+			Expect(err).To(BeNil())
+			id, _ := res.LastInsertId()
+			return id
+		}
+		timeOverDue := func() (t int64) {
+			Expect(dbCon.QueryRow("SELECT timeOverDue FROM Trips WHERE _tripId=?", tripId).Scan(&t)).To(BeNil())
+			return
+		}
+
+		BeforeEach(func() {
+			dbCon, _ = dbMan.GetLocationDb("/go/src/github.com/OpenDriversLog/goodl-lib/test_integration/tests.db", -1)
+			carId = insert("INSERT INTO Cars (type, plate) VALUES ('Fristtest', 'DD-PO 47')")
+			deviceId := insert("INSERT INTO Devices (desc, colorId, carId) VALUES ('Fristtest', 1, ?)", carId)
+			kp := func(startTime int64, endTime int64) int64 {
+				return insert("INSERT INTO KeyPoints (latitude, longitude, startTime, endTime, deviceId, carId) VALUES (51.05, 13.73, ?, ?, ?, ?)",
+					startTime, endTime, deviceId, carId)
+			}
+			// the trip arrives at 18:00 and stays until 20:00
+			start := kp(end-2*hour, end-hour)
+			stop := kp(end, end+2*hour)
+			trackId := insert("INSERT INTO Tracks (deviceId, startKeyPointId, endKeyPointId, distance, carId) VALUES (?,?,?,1000,?)", deviceId, start, stop, carId)
+			tripId = insert("INSERT INTO Trips (type, title) VALUES (1, 'Fristtest')")
+			insert("INSERT INTO Tracks_Trips (trackId, tripId) VALUES (?,?)", trackId, tripId)
+		})
+
+		AfterEach(func() {
+			_, err := dbCon.Exec("DELETE FROM TripPolicies WHERE carId=?", carId)
+			Expect(err).To(BeNil())
+			for _, q := range []string{
+				"DELETE FROM Trip_History WHERE tripId=?",
+				"DELETE FROM Tracks_Trips WHERE tripId=?",
+				"DELETE FROM Trips WHERE _tripId=?",
+			} {
+				_, err = dbCon.Exec(q, tripId)
+				Expect(err).To(BeNil())
+			}
+			for _, q := range []string{
+				"DELETE FROM Tracks_Trips_History WHERE trackIdNEW IN (SELECT _trackId FROM Tracks WHERE carId=?)",
+				"DELETE FROM Tracks WHERE carId=?",
+				"DELETE FROM KeyPoints WHERE carId=?",
+				"DELETE FROM Devices WHERE carId=?",
+				"DELETE FROM Cars WHERE _carId=?",
+			} {
+				_, err = dbCon.Exec(q, carId)
+				Expect(err).To(BeNil())
+			}
+			dbCon.Close()
+		})
+
+		It("should update the deadlines of the trips when the policy changes", func() {
+			_, err := SetTripPolicy(&TripPolicy{CarId: S.NInt64(carId), DeadlineType: DeadlineEndOfDay}, dbCon)
+			Expect(err).To(BeNil())
+			Expect(timeOverDue()).To(Equal(millis(5, 13, 0)))
+
+			_, err = SetTripPolicy(&TripPolicy{CarId: S.NInt64(carId), DeadlineType: DeadlineEndOfMonth}, dbCon)
+			Expect(err).To(BeNil())
+			Expect(timeOverDue()).To(Equal(millis(6, 1, 0)))
+
+			_, err = DeleteTripPolicy(carId, dbCon)
+			Expect(err).To(BeNil())
+			policies, err := GetTripPolicies(dbCon)
+			Expect(err).To(BeNil())
+			Expect(timeOverDue()).To(Equal(GetDeadline(GetPolicyForCar(policies, carId), end)))
+		})
+	})
+})
@@ -0,0 +1,151 @@
+package jsonapi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sync"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/datapolish"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/addressManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/notificationManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/periodManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan"
+	tripModels "github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan/models"
+	"github.com/OpenDriversLog/goodl-lib/models"
+	"github.com/OpenDriversLog/goodl-lib/translate"
+)
+
+// processingLocks make the requests changing the tracks & trips of a user wait for each other, one lock per user.
+var processingLocks = make(map[int64]*sync.Mutex)
+var processingLocksMutex sync.Mutex
+
+// lockProcessing waits until no other request processes the data of the given user and locks it for the caller,
+// who needs to call the returned function when done.
+func lockProcessing(uId int64) (unlock func()) {
+	processingLocksMutex.Lock()
+	l := processingLocks[uId]
+	if l == nil {
+		l = &sync.Mutex{}
+		processingLocks[uId] = l
+	}
+	processingLocksMutex.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// JSONProcessingAnswer is the answer to a request processing GPS data, including the report of what has been done.
+type JSONProcessingAnswer struct {
+	models.JSONAnswer
+	Report *datapolish.ProcessingReport
+}
+
+// JSONProcessGPSData processes the GPS data of the given device in the given time range, looking up addresses with
+// the given Geocoder (see datapolish.ProcessGPSDataWithGeocoder).
+// The report is included even if processing failed, so the user can see how far we got. Requests processing the data
+// of the same user wait for each other.
+func JSONProcessGPSData(startTime int64, endTime int64, deviceId int, recalculate bool, uId int64, geocoder addressManager.Geocoder, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (res JSONProcessingAnswer, err error) {
+	defer lockProcessing(uId)()
+	report, err := datapolish.ProcessGPSDataWithGeocoder(startTime, endTime, deviceId, recalculate, uId, geocoder, activeNotifications, T, dbCon)
+	if err != nil {
+		dbg.E(jaTag, "Error processing GPS data for device %d : ", deviceId, err)
+		msg := "Internal server error"
+		if err == datapolish.ErrGpsDataAlreadyImported {
+			msg = "GPS data already imported"
+		} else if periodManager.CheckError(err) == periodManager.ErrPeriodClosed {
+			msg = periodManager.ErrPeriodClosed.Error()
+		}
+		res = GetBadJSONProcessingAnswer(msg)
+		res.Report = report
+		err = nil
+		return
+	}
+	res = JSONProcessingAnswer{
+		JSONAnswer: models.GetGoodJSONAnswer(),
+		Report:     report,
+	}
+	return
+}
+
+// JSONReprocessDataForDeviceInTimeRange recalculates the GPS data of the given device in the given time range.
+func JSONReprocessDataForDeviceInTimeRange(startTime int64, endTime int64, deviceId int, uId int64, geocoder addressManager.Geocoder, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (res JSONProcessingAnswer, err error) {
+	return JSONProcessGPSData(startTime, endTime, deviceId, true, uId, geocoder, activeNotifications, T, dbCon)
+}
+
+// GetBadJSONProcessingAnswer returns a bad JSONProcessingAnswer in case of an error.
+func GetBadJSONProcessingAnswer(message string) JSONProcessingAnswer {
+	return JSONProcessingAnswer{
+		JSONAnswer: models.GetBadJSONAnswer(message),
+	}
+}
+
+// JSONReprocessDiffAnswer is the answer to a dry run of reprocessing, including what would change.
+type JSONReprocessDiffAnswer struct {
+	models.JSONAnswer
+	Diff *datapolish.ReprocessDiff
+}
+
+// JSONDryRunReprocessDataForDeviceInTimeRange returns what JSONReprocessDataForDeviceInTimeRange would change, without
+// changing anything (see datapolish.DryRunReprocessDataForDeviceInTimeRange).
+func JSONDryRunReprocessDataForDeviceInTimeRange(startTime int64, endTime int64, deviceId int, uId int64, T *translate.Translater, dbCon *sql.DB) (res JSONReprocessDiffAnswer, err error) {
+	diff, err := datapolish.DryRunReprocessDataForDeviceInTimeRange(startTime, endTime, deviceId, uId, T, dbCon)
+	if err != nil {
+		dbg.E(jaTag, "Error in dry run reprocessing device %d : ", deviceId, err)
+		res = JSONReprocessDiffAnswer{
+			JSONAnswer: models.GetBadJSONAnswer("Internal server error"),
+		}
+		err = nil
+		return
+	}
+	res = JSONReprocessDiffAnswer{
+		JSONAnswer: models.GetGoodJSONAnswer(),
+		Diff:       diff,
+	}
+	return
+}
+
+// JSONBatchProcessingAnswer is the answer to a request processing GPS data of multiple devices.
+type JSONBatchProcessingAnswer struct {
+	models.JSONAnswer
+	Report *datapolish.BatchReport
+}
+
+// JSONProcessGPSDataBatch processes the GPS data for all datapolish.BatchJobs in jobsJson in parallel
+// (see datapolish.ProcessGPSDataBatch). workers and geocodeWorkers <= 0 use the defaults, addresses are looked up
+// with the given Geocoder. The answer is only marked as failed if no job could be processed at all.
+func JSONProcessGPSDataBatch(jobsJson string, workers int, geocodeWorkers int, geocoder addressManager.Geocoder, uId int64, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (res JSONBatchProcessingAnswer, err error) {
+	jobs := make([]datapolish.BatchJob, 0)
+	err = json.Unmarshal([]byte(jobsJson), &jobs)
+	if err != nil || len(jobs) == 0 {
+		dbg.E(jaTag, "Error unmarshalling batch jobs : ", err)
+		res = JSONBatchProcessingAnswer{JSONAnswer: models.GetBadJSONAnswer("Invalid jobs")}
+		err = nil
+		return
+	}
+	config := datapolish.GetDefaultBatchConfig()
+	if workers > 0 {
+		config.Workers = workers
+	}
+	if geocodeWorkers > 0 {
+		config.GeocodeWorkers = geocodeWorkers
+	}
+	config.Geocoder = geocoder
+
+	defer lockProcessing(uId)()
+	report := datapolish.ProcessGPSDataBatch(jobs, config, uId, activeNotifications, T, dbCon)
+	if report.Succeeded == 0 {
+		res = JSONBatchProcessingAnswer{JSONAnswer: models.GetBadJSONAnswer("Processing failed for all devices")}
+	} else {
+		res = JSONBatchProcessingAnswer{JSONAnswer: models.GetGoodJSONAnswer()}
+	}
+	res.Report = report
+	return
+}
+
+// JSONSplitTripAt splits the given trip at timeMillis, splitting the track driven at this time if needed
+// (see datapolish.SplitTripAt). It waits for processing of the users GPS data, which could change the same tracks.
+func JSONSplitTripAt(tripId int64, timeMillis int64, isAdmin bool, getUpdatedTrips bool, uId int64, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (res tripModels.JSONInsertTripAnswer, err error) {
+	defer lockProcessing(uId)()
+	newTripId, affectedTrips, updNots, err := datapolish.SplitTripAt(tripId, timeMillis, isAdmin, activeNotifications, T, dbCon)
+	return tripMan.GetSplitTripAnswer(newTripId, affectedTrips, updNots, err, getUpdatedTrips, activeNotifications, T, dbCon)
+}
@@ -400,7 +400,7 @@ func UpdateFromAddress(a *StructuredPostalAddress, c GoogleContactsItem, sync *S
 		Id:               S.NInt64(prevId),
 	}
 
-	address, err := addressManager.GetAddressFromString(a.FormattedAddress, geoCodingClient, uId)
+	address, err := addressManager.GetAddressFromStringWithQuota(a.FormattedAddress, geoCodingClient, uId, dbCon)
 	if err != nil {
 		dbg.W(TAG, "Error getting contact address : ", err)
 		newAddr.RetryTime = S.NInt64(addressManager.CalcRetryTime(int64(newAddr.TryCount), err))
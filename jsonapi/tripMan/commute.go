@@ -0,0 +1,390 @@
+package tripMan
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/addressManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/periodManager"
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan/models"
+	S "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	"github.com/OpenDriversLog/goodl-lib/tools"
+	geo "github.com/kellydunn/golang-geo"
+)
+
+const cmTag = "glib/tripMan/commute.go"
+
+// PlaceClusterRadius is the distance (meters) in which stays are considered to be at the same place.
+var PlaceClusterRadius = 150.0
+
+// HomeNightStartHour & HomeNightEndHour are the local hours a stay has to overlap to count as a night at home.
+var HomeNightStartHour, HomeNightEndHour = 22, 6
+
+// WorkStartHour & WorkEndHour are the local hours on weekdays a stay has to overlap to count as a day at work.
+var WorkStartHour, WorkEndHour = 9, 17
+
+// MinPlaceDwell is the time (ms) a stay has to overlap a night or working day to count it.
+var MinPlaceDwell = int64(4 * 60 * 60 * 1000)
+
+// MinPlaceDays is the count of nights / working days needed to propose a place as home / workplace.
+var MinPlaceDays = 3
+
+// ErrMissingCommutePlace is returned when home or workplace are missing to set up commuting.
+var ErrMissingCommutePlace = errors.New("Home and workplace are needed")
+
+// ErrMissingPlaceGeoZone is returned when no GeoZone could be created for home or workplace.
+var ErrMissingPlaceGeoZone = errors.New("No GeoZone could be created for home or workplace")
+
+// placeCluster are the stays at one place.
+type placeCluster struct {
+	lat, lng  float64
+	stays     []*PlaceStay
+	nightDays map[string]bool
+	workDays  map[string]bool
+	nightTime int64
+	workTime  int64
+}
+
+// DetectHomeAndWork proposes the place with the most time spent at night as home and the other place with the most
+// time spent in working hours on weekdays as workplace. Places need stays on at least MinPlaceDays nights or weekdays.
+func DetectHomeAndWork(stays []*PlaceStay) (proposal *CommuteProposal) {
+	proposal = &CommuteProposal{}
+	clusters := make([]*placeCluster, 0)
+	for _, s := range stays {
+		p := geo.NewPoint(s.Latitude, s.Longitude)
+		var c *placeCluster
+		for _, other := range clusters {
+			if p.GreatCircleDistance(geo.NewPoint(other.lat, other.lng))*1000 <= PlaceClusterRadius {
+				c = other
+				break
+			}
+		}
+		if c == nil {
+			c = &placeCluster{nightDays: make(map[string]bool), workDays: make(map[string]bool)}
+			clusters = append(clusters, c)
+		}
+		c.stays = append(c.stays, s)
+		n := float64(len(c.stays))
+		c.lat += (s.Latitude - c.lat) / n
+		c.lng += (s.Longitude - c.lng) / n
+		addStayTimes(c, s)
+	}
+
+	var home, work *placeCluster
+	for _, c := range clusters {
+		if len(c.nightDays) >= MinPlaceDays && (home == nil || c.nightTime > home.nightTime) {
+			home = c
+		}
+	}
+	for _, c := range clusters {
+		if c != home && len(c.workDays) >= MinPlaceDays && (work == nil || c.workTime > work.workTime) {
+			work = c
+		}
+	}
+	if home != nil {
+		proposal.Home = &PlaceCandidate{Latitude: home.lat, Longitude: home.lng, Days: len(home.nightDays), DwellTime: home.nightTime}
+	}
+	if work != nil {
+		proposal.Work = &PlaceCandidate{Latitude: work.lat, Longitude: work.lng, Days: len(work.workDays), DwellTime: work.workTime}
+	}
+	return
+}
+
+// addStayTimes adds the time of the given stay overlapping nights & working hours to the given cluster.
+func addStayTimes(c *placeCluster, s *PlaceStay) {
+	start := tools.GetTimeFromMillis(s.StartTime)
+	day := time.Date(start.Year(), start.Month(), start.Day()-1, 0, 0, 0, 0, start.Location())
+	for ; day.UnixNano()/int64(time.Millisecond) <= s.EndTime; day = day.AddDate(0, 0, 1) {
+		key := day.Format("2006-01-02")
+		nightStart := time.Date(day.Year(), day.Month(), day.Day(), HomeNightStartHour, 0, 0, 0, day.Location())
+		nightEnd := time.Date(day.Year(), day.Month(), day.Day()+1, HomeNightEndHour, 0, 0, 0, day.Location())
+		if ov := millisOverlap(s, nightStart, nightEnd); ov > 0 {
+			c.nightTime += ov
+			if ov >= MinPlaceDwell {
+				c.nightDays[key] = true
+			}
+		}
+		if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			continue
+		}
+		workStart := time.Date(day.Year(), day.Month(), day.Day(), WorkStartHour, 0, 0, 0, day.Location())
+		workEnd := time.Date(day.Year(), day.Month(), day.Day(), WorkEndHour, 0, 0, 0, day.Location())
+		if ov := millisOverlap(s, workStart, workEnd); ov > 0 {
+			c.workTime += ov
+			if ov >= MinPlaceDwell {
+				c.workDays[key] = true
+			}
+		}
+	}
+}
+
+// millisOverlap returns the time (ms) the given stay overlaps the given window.
+func millisOverlap(s *PlaceStay, from time.Time, to time.Time) int64 {
+	start, end := from.UnixNano()/int64(time.Millisecond), to.UnixNano()/int64(time.Millisecond)
+	if s.StartTime > start {
+		start = s.StartTime
+	}
+	if s.EndTime < end {
+		end = s.EndTime
+	}
+	return end - start
+}
+
+// ProposeHomeAndWork detects home and workplace from the stays of the given devices between minTime and maxTime
+// (see DetectHomeAndWork).
+func ProposeHomeAndWork(minTime int64, maxTime int64, deviceIds []interface{}, dbCon *sql.DB) (proposal *CommuteProposal, err error) {
+	if len(deviceIds) == 0 {
+		proposal = &CommuteProposal{}
+		return
+	}
+	rows, err := dbCon.Query(fmt.Sprintf(`SELECT _keyPointId, latitude, longitude, startTime, endTime FROM KeyPoints
+		WHERE endTime>=? AND startTime<=? AND latitude IS NOT NULL AND longitude IS NOT NULL AND deviceId IN (%s)
+		ORDER BY startTime ASC`, strings.TrimSuffix(strings.Repeat("?,", len(deviceIds)), ",")),
+		append([]interface{}{minTime, maxTime}, deviceIds...)...)
+	if err != nil {
+		dbg.E(cmTag, "Failed to get stays from %d to %d : ", minTime, maxTime, err)
+		return
+	}
+	defer rows.Close()
+	stays := make([]*PlaceStay, 0)
+	for rows.Next() {
+		s := &PlaceStay{}
+		err = rows.Scan(&s.KeyPointId, &s.Latitude, &s.Longitude, &s.StartTime, &s.EndTime)
+		if err != nil {
+			dbg.E(cmTag, "Failed to scan stay : ", err)
+			return
+		}
+		stays = append(stays, s)
+	}
+	err = rows.Err()
+	if err != nil {
+		dbg.E(cmTag, "ProposeHomeAndWork rows-iteration-Error", err)
+		return
+	}
+	proposal = DetectHomeAndWork(stays)
+	return
+}
+
+// createPlaceContact creates a contact with a GeoZone around the given place in tx.
+// Returns the contact and the ID of its GeoZone, ErrMissingPlaceGeoZone if none was created.
+func createPlaceContact(place *PlaceCandidate, defaultTitle string, tx *sql.Tx) (contact *addressManager.Contact, geoZoneId int64, err error) {
+	title := place.Title
+	if title == "" {
+		title = S.NString(defaultTitle)
+	}
+	contact = &addressManager.Contact{
+		Title:    title,
+		TripType: S.NInt64(COMMUTING),
+		Address: &addressManager.Address{
+			Latitude:  S.NFloat64(place.Latitude),
+			Longitude: S.NFloat64(place.Longitude),
+			Title:     title,
+		},
+	}
+	_, err = addressManager.CreateContactInTx(contact, tx)
+	if err != nil {
+		dbg.E(cmTag, "Failed to create contact %s : ", title, err)
+		return
+	}
+	if len(contact.Address.GeoZones) > 0 {
+		geoZoneId = int64(contact.Address.GeoZones[0].Id)
+	}
+	if geoZoneId == 0 {
+		// a rule without GeoZone would match every trip
+		dbg.W(cmTag, "No GeoZone created for contact %s at %f, %f", title, place.Latitude, place.Longitude)
+		err = ErrMissingPlaceGeoZone
+	}
+	return
+}
+
+// changedTripFields returns the fields TripRules can set (see tripRuleFields) that have been changed on the given
+// trip before according to Trip_History, so they are not overwritten.
+func changedTripFields(tripId int64, dbCon tools.DbRunner) (fields map[string]bool, err error) {
+	changed := make([]bool, len(tripRuleFields))
+	dest := make([]interface{}, len(tripRuleFields))
+	cols := make([]string, len(tripRuleFields))
+	for i, f := range tripRuleFields {
+		dest[i] = &changed[i]
+		cols[i] = fmt.Sprintf("IFNULL(MAX(%[1]sOLD IS NOT %[1]sNEW),0)", f)
+	}
+	err = dbCon.QueryRow("SELECT "+strings.Join(cols, ",")+" FROM Trip_History WHERE tripId=?", tripId).Scan(dest...)
+	if err != nil {
+		dbg.E(cmTag, "Failed to get changed fields of trip %d : ", tripId, err)
+		return
+	}
+	fields = make(map[string]bool)
+	for i, f := range tripRuleFields {
+		if changed[i] {
+			fields[f] = true
+		}
+	}
+	return
+}
+
+// ConfirmHomeAndWork creates contacts with GeoZones for the given home & workplace and TripRules classifying trips
+// between them as COMMUTING. The rules are applied to all unreviewed trips not in a closed period, without changing
+// fields already changed on a trip (see changedTripFields). Everything is done in one transaction.
+func ConfirmHomeAndWork(home *PlaceCandidate, work *PlaceCandidate, dbCon *sql.DB) (setup *CommuteSetup, err error) {
+	setup = &CommuteSetup{TripRuleIds: make([]int64, 0), ClassifiedTripIds: make([]int64, 0)}
+	if home == nil || work == nil {
+		err = ErrMissingCommutePlace
+		return
+	}
+	tx, err := dbCon.Begin()
+	if err != nil {
+		dbg.E(cmTag, "Error starting transaction : ", err)
+		return
+	}
+	err = confirmHomeAndWork(home, work, setup, tx)
+	if err != nil {
+		tx.Rollback()
+		setup = nil
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		dbg.E(cmTag, "Failed to commit home & workplace : ", err)
+		setup = nil
+	}
+	return
+}
+
+// confirmHomeAndWork implements ConfirmHomeAndWork in tx, filling setup.
+func confirmHomeAndWork(home *PlaceCandidate, work *PlaceCandidate, setup *CommuteSetup, tx *sql.Tx) (err error) {
+	homeContact, homeZone, err := createPlaceContact(home, "Home", tx)
+	if err != nil {
+		return
+	}
+	workContact, workZone, err := createPlaceContact(work, "Work", tx)
+	if err != nil {
+		return
+	}
+	setup.HomeContactId, setup.WorkContactId = int64(homeContact.Id), int64(workContact.Id)
+
+	for _, r := range []*TripRule{
+		{Title: homeContact.Title + " - " + workContact.Title, StartGeoZoneId: S.NInt64(homeZone), EndGeoZoneId: S.NInt64(workZone), SetType: COMMUTING},
+		{Title: workContact.Title + " - " + homeContact.Title, StartGeoZoneId: S.NInt64(workZone), EndGeoZoneId: S.NInt64(homeZone), SetType: COMMUTING},
+	} {
+		var key int64
+		key, err = CreateTripRule(r, tx)
+		if err != nil {
+			return
+		}
+		setup.TripRuleIds = append(setup.TripRuleIds, key)
+	}
+
+	// trips in closed periods can't be changed anymore, they are counted instead
+	rows, err := tx.Query("SELECT _tripId," + periodManager.ClosedTripCondition("_tripId") + " FROM Trips WHERE reviewed=0")
+	if err != nil {
+		dbg.E(cmTag, "Failed to get unreviewed trips : ", err)
+		return
+	}
+	tripIds := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		var closed bool
+		err = rows.Scan(&id, &closed)
+		if err != nil {
+			dbg.E(cmTag, "Failed to scan unreviewed trip : ", err)
+			rows.Close()
+			return
+		}
+		if closed {
+			setup.ClosedTrips++
+			continue
+		}
+		tripIds = append(tripIds, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for _, id := range tripIds {
+		var skip map[string]bool
+		skip, err = changedTripFields(id, tx)
+		if err != nil {
+			return
+		}
+		var res *TripRuleResult
+		res, err = ApplyTripRules(id, skip, tx)
+		if err != nil {
+			return
+		}
+		if res != nil && res.Changes["type"] == int64(COMMUTING) {
+			setup.ClassifiedTripIds = append(setup.ClassifiedTripIds, id)
+		}
+	}
+	return
+}
+
+// CountCommuteDays returns the count of days with commuting trips (by their local start times) per month, sorted by month.
+func CountCommuteDays(tripStartTimes []int64) (months []*CommuteMonth) {
+	months = make([]*CommuteMonth, 0)
+	byMonth := make(map[string]*CommuteMonth)
+	days := make(map[string]bool)
+	for _, t := range tripStartTimes {
+		start := tools.GetTimeFromMillis(t)
+		key := start.Format("2006-01")
+		m := byMonth[key]
+		if m == nil {
+			m = &CommuteMonth{Month: key}
+			byMonth[key] = m
+			months = append(months, m)
+		}
+		m.Trips++
+		if day := start.Format("2006-01-02"); !days[day] {
+			days[day] = true
+			m.Days++
+		}
+	}
+	sort.Sort(commuteMonthsByMonth(months))
+	return
+}
+
+type commuteMonthsByMonth []*CommuteMonth
+
+func (m commuteMonthsByMonth) Len() int           { return len(m) }
+func (m commuteMonthsByMonth) Less(i, j int) bool { return m[i].Month < m[j].Month }
+func (m commuteMonthsByMonth) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// GetCommuteDays returns the days with COMMUTING trips of the given devices between minTime and maxTime per month,
+// e.g. for the commuter allowance.
+func GetCommuteDays(minTime int64, maxTime int64, deviceIds []interface{}, dbCon *sql.DB) (months []*CommuteMonth, err error) {
+	if len(deviceIds) == 0 {
+		months = make([]*CommuteMonth, 0)
+		return
+	}
+	// Trips_FullBlown has a row per track of a trip, each trip counts once at the time it started
+	rows, err := dbCon.Query(fmt.Sprintf(`SELECT tripId, MIN(sEndTime) FROM Trips_FullBlown
+		WHERE tripType=? AND sEndTime<=? AND sDeviceId IN (%s)
+		GROUP BY tripId HAVING MIN(sEndTime)>=?`,
+		strings.TrimSuffix(strings.Repeat("?,", len(deviceIds)), ",")),
+		append(append([]interface{}{COMMUTING, maxTime}, deviceIds...), minTime)...)
+	if err != nil {
+		dbg.E(cmTag, "Failed to get commuting trips from %d to %d : ", minTime, maxTime, err)
+		return
+	}
+	defer rows.Close()
+	startTimes := make([]int64, 0)
+	for rows.Next() {
+		var tripId, startTime int64
+		err = rows.Scan(&tripId, &startTime)
+		if err != nil {
+			dbg.E(cmTag, "Failed to scan commuting trip : ", err)
+			return
+		}
+		startTimes = append(startTimes, startTime)
+	}
+	err = rows.Err()
+	if err != nil {
+		dbg.E(cmTag, "GetCommuteDays rows-iteration-Error", err)
+		return
+	}
+	months = CountCommuteDays(startTimes)
+	return
+}
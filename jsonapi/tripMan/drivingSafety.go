@@ -0,0 +1,143 @@
+package tripMan
+
+import (
+	"database/sql"
+	"math"
+
+	"github.com/Compufreak345/dbg"
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan/models"
+	. "github.com/OpenDriversLog/goodl-lib/models/geo"
+)
+
+const dsTag = "glib/tripMan/drivingSafety.go"
+
+// SafetyScorePenalty is the count of points a driver loses per severity of harsh events per 100 km.
+var SafetyScorePenalty = 5.0
+
+// GetHarshEventsForTrack returns the harsh driving events on the track with the given ID.
+func GetHarshEventsForTrack(db *sql.DB, trackId int64) (events []*HarshEvent, err error) {
+	events = make([]*HarshEvent, 0)
+	rows, err := db.Query(`SELECT startTime, endTime, kind, peakAcceleration, latitude, longitude, speed, severity
+		FROM HarshEvents WHERE trackId=? ORDER BY startTime ASC`, trackId)
+	if err != nil {
+		dbg.E(dsTag, "failed to get rows from HarshEvents", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := &HarshEvent{}
+		err = rows.Scan(&e.StartTime, &e.EndTime, &e.Kind, &e.PeakAcceleration, &e.Lat, &e.Lng, &e.Speed, &e.Severity)
+		if err != nil {
+			dbg.E(dsTag, "failed to scan HarshEvent for track %d", trackId, err)
+			return
+		}
+		events = append(events, e)
+	}
+	err = rows.Err()
+	if err != nil {
+		dbg.E(dsTag, "GetHarshEventsForTrack %d rows-iteration-Error", trackId, err)
+	}
+	return
+}
+
+// GetHarshEvents returns the harsh driving events between minTime and maxTime, only the ones of the
+// given driver if driverId is not 0.
+func GetHarshEvents(minTime int64, maxTime int64, driverId int64, dbCon *sql.DB) (events []*DriverHarshEvent, err error) {
+	events = make([]*DriverHarshEvent, 0)
+	q := `SELECT HE.trackId, TT.tripId, Trips.driverId, HE.startTime, HE.endTime, HE.kind, HE.peakAcceleration,
+		HE.latitude, HE.longitude, HE.speed, HE.severity
+		FROM HarshEvents HE
+		LEFT JOIN Tracks_Trips TT ON TT.trackId=HE.trackId
+		LEFT JOIN Trips ON Trips._tripId=TT.tripId
+		WHERE HE.startTime>=? AND HE.startTime<=?`
+	params := []interface{}{minTime, maxTime}
+	if driverId != 0 {
+		q += " AND Trips.driverId=?"
+		params = append(params, driverId)
+	}
+	rows, err := dbCon.Query(q+" ORDER BY HE.startTime ASC", params...)
+	if err != nil {
+		dbg.E(dsTag, "failed to get HarshEvents from %d to %d", minTime, maxTime, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := &DriverHarshEvent{}
+		err = rows.Scan(&e.TrackId, &e.TripId, &e.DriverId, &e.StartTime, &e.EndTime, &e.Kind, &e.PeakAcceleration,
+			&e.Lat, &e.Lng, &e.Speed, &e.Severity)
+		if err != nil {
+			dbg.E(dsTag, "failed to scan DriverHarshEvent", err)
+			return
+		}
+		events = append(events, e)
+	}
+	err = rows.Err()
+	if err != nil {
+		dbg.E(dsTag, "GetHarshEvents rows-iteration-Error", err)
+	}
+	return
+}
+
+// GetDriverSafetyScores returns the safety score of all drivers with trips between minTime and maxTime.
+// Drivers lose SafetyScorePenalty points per severity of their harsh events per 100 km, but at most
+// the penalty of 100 km if they drove less.
+func GetDriverSafetyScores(minTime int64, maxTime int64, dbCon *sql.DB) (scores []*DriverSafetyScore, err error) {
+	scores = make([]*DriverSafetyScore, 0)
+	byDriver := make(map[int64]*DriverSafetyScore)
+
+	rows, err := dbCon.Query(`SELECT Trips.driverId, COUNT(DISTINCT Trips._tripId),
+		SUM(CASE WHEN Tracks.distance>0 THEN Tracks.distance ELSE 0 END)
+		FROM Trips
+		JOIN Tracks_Trips TT ON TT.tripId=Trips._tripId
+		JOIN Tracks ON Tracks._trackId=TT.trackId
+		JOIN KeyPoints KP ON KP._keyPointId=Tracks.startKeyPointId
+		WHERE KP.endTime>=? AND KP.endTime<=? AND IFNULL(Trips.driverId,0)>0
+		GROUP BY Trips.driverId ORDER BY Trips.driverId`, minTime, maxTime)
+	if err != nil {
+		dbg.E(dsTag, "failed to get driven distances from %d to %d", minTime, maxTime, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s := &DriverSafetyScore{}
+		err = rows.Scan(&s.DriverId, &s.Trips, &s.Distance)
+		if err != nil {
+			dbg.E(dsTag, "failed to scan driven distance", err)
+			return
+		}
+		scores = append(scores, s)
+		byDriver[s.DriverId] = s
+	}
+	err = rows.Err()
+	if err != nil {
+		dbg.E(dsTag, "GetDriverSafetyScores rows-iteration-Error", err)
+		return
+	}
+
+	events, err := GetHarshEvents(minTime, maxTime, 0, dbCon)
+	if err != nil {
+		return
+	}
+	for _, e := range events {
+		s := byDriver[int64(e.DriverId)]
+		if s == nil {
+			continue
+		}
+		switch e.Kind {
+		case HarshAcceleration:
+			s.Accelerations++
+		case HarshBraking:
+			s.Brakings++
+		case HarshCornering:
+			s.Cornerings++
+		}
+		s.SeveritySum += e.Severity
+	}
+	for _, s := range scores {
+		// Distance is in meters
+		s.Score = math.Max(0, 100-SafetyScorePenalty*s.SeveritySum/math.Max(s.Distance/1000/100, 1))
+	}
+	return
+}
@@ -0,0 +1,451 @@
+package tripMan
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Compufreak345/dbg"
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan/models"
+	"github.com/OpenDriversLog/goodl-lib/tools"
+)
+
+const hcTag = "glib/tripMan/hashChain.go"
+
+// quoteConcat returns an SQL expression concatenating the quoted values of the given columns, so NULLs, numbers
+// and texts are hashed distinguishably.
+func quoteConcat(cols ...string) string {
+	q := make([]string, len(cols))
+	for i, c := range cols {
+		q[i] = "quote(" + c + ")"
+	}
+	return strings.Join(q, "||','||")
+}
+
+// hashContentQueries select the ID and the hashed content of each entry type, the trip content includes its tracks.
+var hashContentQueries = map[string]string{
+	HashEntryTrip: "SELECT _tripId, " + quoteConcat("_tripId", "type", "title", "desc", "driverId", "contactId",
+		"startContactId", "endContactId", "isReturnTrip", "reviewed") +
+		"||','||quote((SELECT group_concat(trackId) FROM (SELECT trackId FROM Tracks_Trips WHERE tripId=Trips._tripId ORDER BY trackId))) FROM Trips",
+	HashEntryTripHistory: "SELECT id, " + quoteConcat("id", "tripId", "changeDate", "typeOLD", "typeNEW", "titleOLD", "titleNEW",
+		"descOLD", "descNEW", "driverIdOLD", "driverIdNEW", "contactIdOLD", "contactIdNEW", "startContactIdOLD", "startContactIdNEW",
+		"endContactIdOLD", "endContactIdNEW", "isReturnTripOLD", "isReturnTripNEW", "isReviewedOLD", "isReviewedNEW") + " FROM Trip_History",
+	HashEntryTracksTripsHistory: "SELECT id, " + quoteConcat("id", "changeDate", "tripIdOLD", "tripIdNEW", "trackIdOLD", "trackIdNEW",
+		"sqlAction", "timeEnter") + " FROM Tracks_Trips_History",
+}
+
+// GetContentHash returns the hex SHA-256 over the type, ID and content of a chain entry.
+func GetContentHash(entryType string, entryId int64, content string) string {
+	h := sha256.Sum256([]byte(entryType + "\n" + strconv.FormatInt(entryId, 10) + "\n" + content))
+	return hex.EncodeToString(h[:])
+}
+
+// GetChainHash returns the hex SHA-256 linking a content hash to the hash of its predecessor.
+func GetChainHash(prevHash string, contentHash string) string {
+	h := sha256.Sum256([]byte(prevHash + "\n" + contentHash))
+	return hex.EncodeToString(h[:])
+}
+
+// VerifyChainLinks checks that each of the given entries (sorted by ID) references its predecessor
+// and its hash matches.
+func VerifyChainLinks(entries []*HashChainEntry) (breaks []*HashChainBreak) {
+	breaks = make([]*HashChainBreak, 0)
+	prevHash := ""
+	for _, e := range entries {
+		if e.PrevHash != prevHash {
+			breaks = append(breaks, &HashChainBreak{ChainId: e.Id, EntryType: e.EntryType, EntryId: e.EntryId, Reason: HashBreakLink})
+		} else if e.Hash != GetChainHash(e.PrevHash, e.ContentHash) {
+			breaks = append(breaks, &HashChainBreak{ChainId: e.Id, EntryType: e.EntryType, EntryId: e.EntryId, Reason: HashBreakHash})
+		}
+		prevHash = e.Hash
+	}
+	return
+}
+
+// getContentHashes returns the current content hashes of the entries of the given type, by ID.
+// where filters the entries and may use params.
+func getContentHashes(entryType string, where string, dbCon tools.DbRunner, params ...interface{}) (hashes map[int64]string, ids []int64, err error) {
+	hashes = make(map[int64]string)
+	ids = make([]int64, 0)
+	q := hashContentQueries[entryType]
+	if where != "" {
+		q += " WHERE " + where
+	}
+	rows, err := dbCon.Query(q+" ORDER BY 1 ASC", params...)
+	if err != nil {
+		dbg.E(hcTag, "Failed to get content of %s entries : ", entryType, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var content string
+		err = rows.Scan(&id, &content)
+		if err != nil {
+			dbg.E(hcTag, "Failed to scan content of %s entry : ", entryType, err)
+			return
+		}
+		hashes[id] = GetContentHash(entryType, id, content)
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	return
+}
+
+// GetTripHashChain returns all entries of the hash chain, sorted by ID.
+func GetTripHashChain(dbCon *sql.DB) (entries []*HashChainEntry, err error) {
+	entries = make([]*HashChainEntry, 0)
+	rows, err := dbCon.Query("SELECT id, entryType, entryId, contentHash, prevHash, hash, sealedAt FROM TripHashChain ORDER BY id ASC")
+	if err != nil {
+		dbg.E(hcTag, "Failed to get hash chain : ", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := &HashChainEntry{}
+		err = rows.Scan(&e.Id, &e.EntryType, &e.EntryId, &e.ContentHash, &e.PrevHash, &e.Hash, &e.SealedAt)
+		if err != nil {
+			dbg.E(hcTag, "Failed to scan hash chain entry : ", err)
+			return
+		}
+		entries = append(entries, e)
+	}
+	err = rows.Err()
+	return
+}
+
+// GetTripHashChainHead returns the hash of the last entry of the chain and the count of entries.
+func GetTripHashChainHead(dbCon *sql.DB) (headHash string, count int, err error) {
+	return getTripHashChainHead(dbCon)
+}
+
+func getTripHashChainHead(dbCon tools.DbRunner) (headHash string, count int, err error) {
+	err = dbCon.QueryRow("SELECT IFNULL((SELECT hash FROM TripHashChain ORDER BY id DESC LIMIT 1),''), COUNT(*) FROM TripHashChain").Scan(&headHash, &count)
+	if err != nil {
+		dbg.E(hcTag, "Failed to get head of hash chain : ", err)
+	}
+	return
+}
+
+// CountUnsealedTripChanges returns the count of history entries and trips not sealed into the hash chain yet,
+// without sealing them.
+func CountUnsealedTripChanges(dbCon *sql.DB) (count int, err error) {
+	err = dbCon.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM Trip_History WHERE id>(SELECT IFNULL(MAX(entryId),0) FROM TripHashChain WHERE entryType=?1))+
+		(SELECT COUNT(*) FROM Tracks_Trips_History WHERE id>(SELECT IFNULL(MAX(entryId),0) FROM TripHashChain WHERE entryType=?2))+
+		(SELECT COUNT(*) FROM Trips WHERE NOT EXISTS (SELECT 1 FROM TripHashChain WHERE entryType=?3 AND entryId=Trips._tripId))`,
+		HashEntryTripHistory, HashEntryTracksTripsHistory, HashEntryTrip).Scan(&count)
+	if err != nil {
+		dbg.E(hcTag, "Failed to count unsealed trip changes : ", err)
+	}
+	return
+}
+
+// maxSealedId returns the highest ID of the given entry type in the chain.
+func maxSealedId(entryType string, dbCon tools.DbRunner) (id int64, err error) {
+	err = dbCon.QueryRow("SELECT IFNULL(MAX(entryId),0) FROM TripHashChain WHERE entryType=?", entryType).Scan(&id)
+	if err != nil {
+		dbg.E(hcTag, "Failed to get last sealed %s entry : ", entryType, err)
+	}
+	return
+}
+
+// SealTripHashChain appends all new history entries, new trips and trips changed by them to the hash chain.
+// Trips changed without history entries are not sealed again, so VerifyTripHashChain reports them.
+// Returns the count of appended entries.
+func SealTripHashChain(dbCon *sql.DB) (sealed int, err error) {
+	tx, err := beginImmediate(dbCon)
+	if err != nil {
+		return
+	}
+	sealed, head, err := sealTripHashChain(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		dbg.E(hcTag, "Failed to commit sealing the hash chain : ", err)
+		return 0, err
+	}
+	if sealed > 0 {
+		dbg.I(hcTag, "Sealed %d entries, head is %s", sealed, head)
+	}
+	return
+}
+
+// beginImmediate starts a transaction holding the write lock right away like BEGIN IMMEDIATE, so no other
+// connection can append to the chain between reading its head and appending to it.
+func beginImmediate(dbCon *sql.DB) (tx *sql.Tx, err error) {
+	tx, err = dbCon.Begin()
+	if err != nil {
+		dbg.E(hcTag, "Failed to begin transaction for hash chain : ", err)
+		return
+	}
+	// database/sql only begins deferred transactions, the first write takes the lock
+	if _, err = tx.Exec("UPDATE TripHashChain SET id=id WHERE 0"); err != nil {
+		dbg.E(hcTag, "Failed to lock hash chain : ", err)
+		tx.Rollback()
+	}
+	return
+}
+
+// changedTripsWhere filters the given trip ID column by the trips changed by history entries after the IDs ?1
+// (Trip_History) and ?2 (Tracks_Trips_History).
+func changedTripsWhere(col string) string {
+	return col + " IN (SELECT tripId FROM Trip_History WHERE id>?1) OR " +
+		col + " IN (SELECT tripIdOLD FROM Tracks_Trips_History WHERE id>?2) OR " +
+		col + " IN (SELECT tripIdNEW FROM Tracks_Trips_History WHERE id>?2)"
+}
+
+// sealTripHashChain does the work of SealTripHashChain inside tx, returning the new head.
+// Only the trips not sealed yet and the trips changed by the new history entries are hashed.
+func sealTripHashChain(tx *sql.Tx) (sealed int, head string, err error) {
+	head, _, err = getTripHashChainHead(tx)
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix() * 1000
+	appendEntry := func(entryType string, entryId int64, contentHash string) (err error) {
+		head, err = appendHashChainEntry(entryType, entryId, contentHash, head, now, tx)
+		if err == nil {
+			sealed++
+		}
+		return
+	}
+
+	lastIds := make([]interface{}, 0, 3)
+	for _, entryType := range []string{HashEntryTripHistory, HashEntryTracksTripsHistory} {
+		var lastId int64
+		lastId, err = maxSealedId(entryType, tx)
+		if err != nil {
+			return
+		}
+		lastIds = append(lastIds, lastId)
+		var hashes map[int64]string
+		var ids []int64
+		hashes, ids, err = getContentHashes(entryType, "id>?", tx, lastId)
+		if err != nil {
+			return
+		}
+		for _, id := range ids {
+			if err = appendEntry(entryType, id, hashes[id]); err != nil {
+				return
+			}
+		}
+	}
+	params := append(lastIds, HashEntryTrip)
+
+	latest, err := getLatestTripHashes(changedTripsWhere("entryId"), tx, params...)
+	if err != nil {
+		return
+	}
+	hashes, ids, err := getContentHashes(HashEntryTrip, changedTripsWhere("_tripId")+
+		" OR NOT EXISTS (SELECT 1 FROM TripHashChain WHERE entryType=?3 AND entryId=Trips._tripId)", tx, params...)
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		if sealedHash, ok := latest[id]; ok && sealedHash == hashes[id] {
+			continue
+		}
+		if err = appendEntry(HashEntryTrip, id, hashes[id]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// appendHashChainEntry appends an entry after the given head of the chain, returning the new head.
+func appendHashChainEntry(entryType string, entryId int64, contentHash string, head string, sealedAt int64, tx *sql.Tx) (hash string, err error) {
+	hash = GetChainHash(head, contentHash)
+	_, err = tx.Exec("INSERT INTO TripHashChain(entryType, entryId, contentHash, prevHash, hash, sealedAt) VALUES(?,?,?,?,?,?)",
+		entryType, entryId, contentHash, head, hash, sealedAt)
+	if err != nil {
+		dbg.E(hcTag, "Failed to seal %s entry %d : ", entryType, entryId, err)
+	}
+	return
+}
+
+// GetDeletionHash returns the content hash of the tombstone of a trip, whose last snapshot had the given content hash.
+func GetDeletionHash(tripId int64, tripContentHash string) string {
+	return GetContentHash(HashEntryTripDeletion, tripId, tripContentHash)
+}
+
+// DeleteTrips deletes the given trips and their tracks assignments, recording a tombstone for each of them in the
+// hash chain, so VerifyTripHashChain can tell them from trips deleted behind its back. Pending changes are sealed
+// before, so the tombstones follow the last state of the trips. Trips in closed periods can't be deleted.
+func DeleteTrips(tripIds []int64, dbCon *sql.DB) (rowCount int64, err error) {
+	if len(tripIds) == 0 {
+		return
+	}
+	tx, err := beginImmediate(dbCon)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			rowCount = 0
+		}
+	}()
+	if _, _, err = sealTripHashChain(tx); err != nil {
+		return
+	}
+	ids := make([]string, len(tripIds))
+	for i, id := range tripIds {
+		ids[i] = strconv.FormatInt(id, 10)
+	}
+	// the entry type is ?3
+	latest, err := getLatestTripHashes("entryId IN ("+strings.Join(ids, ",")+")", tx, nil, nil, HashEntryTrip)
+	if err != nil {
+		return
+	}
+	head, _, err := getTripHashChainHead(tx)
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix() * 1000
+	for _, id := range tripIds {
+		contentHash, ok := latest[id]
+		if !ok {
+			// not a trip
+			continue
+		}
+		if _, err = tx.Exec("DELETE FROM Tracks_Trips WHERE tripId=?", id); err != nil {
+			dbg.E(hcTag, "Failed to delete tracks of trip %d : ", id, err)
+			return
+		}
+		var res sql.Result
+		if res, err = tx.Exec("DELETE FROM Trips WHERE _tripId=?", id); err != nil {
+			dbg.E(hcTag, "Failed to delete trip %d : ", id, err)
+			return
+		}
+		var n int64
+		if n, err = res.RowsAffected(); err != nil {
+			return
+		}
+		rowCount += n
+		if head, err = appendHashChainEntry(HashEntryTripDeletion, id, GetDeletionHash(id, contentHash), head, now, tx); err != nil {
+			return
+		}
+	}
+	// the history of the removed tracks assignments
+	if _, _, err = sealTripHashChain(tx); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		dbg.E(hcTag, "Failed to commit deleting trips : ", err)
+		return
+	}
+	dbg.I(hcTag, "Deleted %d trips", rowCount)
+	return
+}
+
+// getLatestTripHashes returns the content hashes of the latest snapshots of the trips in the chain, by trip ID.
+// where filters the entryId of the snapshots and may use params, the entry type is ?3.
+func getLatestTripHashes(where string, dbCon tools.DbRunner, params ...interface{}) (hashes map[int64]string, err error) {
+	hashes = make(map[int64]string)
+	rows, err := dbCon.Query(`SELECT entryId, contentHash FROM TripHashChain WHERE id IN
+		(SELECT MAX(id) FROM TripHashChain WHERE entryType=?3 AND (`+where+`) GROUP BY entryId)`, params...)
+	if err != nil {
+		dbg.E(hcTag, "Failed to get sealed trips : ", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var hash string
+		if err = rows.Scan(&id, &hash); err != nil {
+			dbg.E(hcTag, "Failed to scan sealed trip : ", err)
+			return
+		}
+		hashes[id] = hash
+	}
+	err = rows.Err()
+	return
+}
+
+// VerifyTripHashChain checks the links of the hash chain and that no sealed history entry and no trip (compared to
+// its latest snapshot) was changed or deleted since it was sealed. Trips deleted by DeleteTrips are recognized by
+// their tombstones.
+func VerifyTripHashChain(dbCon *sql.DB) (v *HashChainVerification, err error) {
+	v = &HashChainVerification{Breaks: make([]*HashChainBreak, 0)}
+	entries, err := GetTripHashChain(dbCon)
+	if err != nil {
+		return
+	}
+	v.Entries = len(entries)
+	if len(entries) > 0 {
+		v.HeadHash = entries[len(entries)-1].Hash
+	}
+	v.Breaks = append(v.Breaks, VerifyChainLinks(entries)...)
+
+	current := make(map[string]map[int64]string)
+	for entryType := range hashContentQueries {
+		current[entryType], _, err = getContentHashes(entryType, "", dbCon)
+		if err != nil {
+			return
+		}
+	}
+	latestTrip := make(map[int64]*HashChainEntry)
+	// deleted holds the tombstones of the trips deleted after their latest snapshot
+	deleted := make(map[int64]*HashChainEntry)
+	sealed := make(map[string]map[int64]bool)
+	for _, e := range entries {
+		if sealed[e.EntryType] == nil {
+			sealed[e.EntryType] = make(map[int64]bool)
+		}
+		sealed[e.EntryType][e.EntryId] = true
+		switch e.EntryType {
+		case HashEntryTrip:
+			latestTrip[e.EntryId] = e
+			delete(deleted, e.EntryId)
+		case HashEntryTripDeletion:
+			// the tombstone has to follow the snapshot of the trip it deletes
+			if t := latestTrip[e.EntryId]; t == nil || deleted[e.EntryId] != nil || e.ContentHash != GetDeletionHash(e.EntryId, t.ContentHash) {
+				v.Breaks = append(v.Breaks, &HashChainBreak{ChainId: e.Id, EntryType: e.EntryType, EntryId: e.EntryId, Reason: HashBreakContent})
+			}
+			deleted[e.EntryId] = e
+		default:
+			checkHashChainContent(v, e, current[e.EntryType])
+		}
+	}
+	for _, e := range entries {
+		if e.EntryType != HashEntryTrip || latestTrip[e.EntryId] != e {
+			continue
+		}
+		if d := deleted[e.EntryId]; d != nil {
+			if _, ok := current[HashEntryTrip][e.EntryId]; ok {
+				// the deleted trip came back without being sealed again
+				v.Breaks = append(v.Breaks, &HashChainBreak{ChainId: d.Id, EntryType: d.EntryType, EntryId: d.EntryId, Reason: HashBreakContent})
+			}
+			continue
+		}
+		checkHashChainContent(v, e, current[HashEntryTrip])
+	}
+	for entryType, hashes := range current {
+		for id := range hashes {
+			if !sealed[entryType][id] {
+				v.Unsealed++
+			}
+		}
+	}
+	v.Valid = len(v.Breaks) == 0
+	if !v.Valid {
+		dbg.W(hcTag, "Hash chain has %d breaks", len(v.Breaks))
+	}
+	return
+}
+
+// checkHashChainContent adds a break to v if the content of the given entry changed or is missing.
+func checkHashChainContent(v *HashChainVerification, e *HashChainEntry, current map[int64]string) {
+	hash, ok := current[e.EntryId]
+	if !ok {
+		v.Breaks = append(v.Breaks, &HashChainBreak{ChainId: e.Id, EntryType: e.EntryType, EntryId: e.EntryId, Reason: HashBreakMissing})
+	} else if hash != e.ContentHash {
+		v.Breaks = append(v.Breaks, &HashChainBreak{ChainId: e.Id, EntryType: e.EntryType, EntryId: e.EntryId, Reason: HashBreakContent})
+	}
+}
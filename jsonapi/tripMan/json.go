@@ -18,6 +18,7 @@ import (
 	geo "github.com/OpenDriversLog/goodl-lib/models/geo"
 	. "github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan/models"
 	"github.com/OpenDriversLog/goodl-lib/jsonapi/notificationManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/periodManager"
 	"github.com/OpenDriversLog/goodl-lib/translate"
 )
 
@@ -74,6 +75,33 @@ func JSONSelectTripsInTimeframe(minTime int64, maxTime int64, deviceIds []interf
 	return
 }
 
+// JSONSelectTripsByFilter returns the trips matching the filter given as TripFilter, see GetTripsByFilter.
+func JSONSelectTripsByFilter(filterJson string, includeTracks bool, trackDetails bool, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, withHistory bool, dbCon *sql.DB) (res JSONTripManAnswer, err error) {
+	f := &TripFilter{}
+	if filterJson != "" {
+		err = json.Unmarshal([]byte(filterJson), f)
+		if err != nil {
+			dbg.W(TAG, "Could not read JSON %v in JSONSelectTripsByFilter : ", filterJson, err)
+			res = GetBadJsonTripManAnswer("Invalid format")
+			err = nil
+			return
+		}
+	}
+	res.Trips, err = GetTripsByFilter(f, false, includeTracks, trackDetails, activeNotifications, T, withHistory, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error in JSONSelectTripsByFilter GetTripsByFilter: ", err)
+		msg := "Internal server error"
+		if IsTripFilterError(err) {
+			msg = err.Error()
+		}
+		err = nil
+		res = GetBadJsonTripManAnswer(msg)
+		return
+	}
+	res.Success = true
+	return
+}
+
 // JSONSelectTrip gets the trip with the given ID.
 func JSONSelectTrip(tripId int64, includeTracks bool, trackDetails bool,activeNotifications *[]*notificationManager.Notification,T *translate.Translater,withHistory bool, dbCon *sql.DB) (res JSONTripManAnswer, err error) {
 
@@ -100,6 +128,24 @@ func JSONSelectTrip(tripId int64, includeTracks bool, trackDetails bool,activeNo
 	return
 }
 
+// JSONSelectNonCarTracksWithoutTrip returns the tracks of the given devices between minTime and maxTime which got no
+// trip because they were not driven by car, see GetNonCarTracksWithoutTrip.
+func JSONSelectNonCarTracksWithoutTrip(minTime int64, maxTime int64, deviceIds []interface{}, dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	if len(deviceIds) == 0 || minTime < 0 || (maxTime != 0 && minTime >= maxTime) {
+		res = models.GetBadJSONSelectAnswer("faulty selectNonCarTracksWithoutTrip query")
+		return
+	}
+	tracks, err := GetNonCarTracksWithoutTrip(minTime, maxTime, deviceIds, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error in JSONSelectNonCarTracksWithoutTrip : ", err)
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		err = nil
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(tracks)
+	return
+}
+
 func GetBadJsonTripManAnswer(message string) JSONTripManAnswer {
 	return JSONTripManAnswer{
 		JSONAnswer: models.GetBadJSONAnswer(message),
@@ -147,6 +193,36 @@ func JSONGetTrackPointsForTrack(dbCon *sql.DB, trackId int64) (marshaled []byte,
 
 }
 
+// JSONGetMatchedTrackPointsForTrack returns the road-matched geometry of the given track as multiline-GeoFeature.
+// The feature has no coordinates if the track has not been map matched.
+func JSONGetMatchedTrackPointsForTrack(dbCon *sql.DB, trackId int64) (marshaled []byte, err error) {
+	points, err := GetMatchedTrackPointsForTrack(dbCon, trackId)
+	if err != nil {
+		dbg.E(TAG, "unable to get MatchedTrackPointsForTrack id=%d", trackId, err)
+		marshaled = []byte("unable to get MatchedTrackPointsForTrack")
+		return
+	}
+
+	geoFeature := geo.NewGeoFeature()
+	geoFeature.Id = "MatchedTrack"
+	geoFeature.Properties["id"] = trackId
+	geoFeature.Properties["numberOfPoints"] = len(*points)
+
+	multiline := geo.NewGeoLineStringGeometry()
+	for _, val := range *points {
+		multiline.Coordinates = append(multiline.Coordinates, geo.NewGeoCoord(val.Longitude.Float64, val.Latitude.Float64))
+	}
+	geoFeature.Geometry = multiline
+
+	marshaled, err = json.Marshal(geoFeature)
+	if err != nil {
+		marshaled = []byte("unable to convert MatchedTrackPointsForTrack to JSON")
+		return marshaled, err
+	}
+
+	return marshaled, nil
+}
+
 // JSONUpdateTrips updates the given trips
 func JSONUpdateTrips(tripJson string, getUpdatedTrips bool,isAdmin bool,activeNotifications *[]*notificationManager.Notification,T *translate.Translater, dbCon *sql.DB) (res JSONUpdateTripAnswer, err error) {
 
@@ -278,8 +354,12 @@ func JSONCreateOrReviveTripByTrackIds(trackIds string, getUpdatedTrips bool,acti
 	tripId, affectedTrips, updNots, err := CreateOrReviveTripByTracks(tracks, PRIVATE, "", "", 0, 0, true, true, getUpdatedTrips,activeNotifications,T, dbCon)
 	if err != nil {
 		dbg.E(TAG, "Error at at JSONCreateOrReviveTripByTrackIDs (CreateOrReviveTripByTracks) : ", err)
+		msg := "Internal server error"
+		if err == periodManager.ErrPeriodClosed {
+			msg = err.Error()
+		}
 		err = nil
-		res.JSONInsertAnswer = models.GetBadJSONInsertAnswer("Internal server error")
+		res.JSONInsertAnswer = models.GetBadJSONInsertAnswer(msg)
 		return
 	}
 	res.UpdatedNotifications = updNots
@@ -296,3 +376,312 @@ func JSONCreateOrReviveTripByTrackIds(trackIds string, getUpdatedTrips bool,acti
 	res.Success = true
 	return
 }
+
+// JSONGetHarshEvents returns the harsh driving events between minTime and maxTime, only the ones of the
+// given driver if driverId is not 0.
+func JSONGetHarshEvents(minTime int64, maxTime int64, driverId int64, dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	if minTime >= maxTime {
+		res = models.GetBadJSONSelectAnswer("faulty time range")
+		return
+	}
+	events, err := GetHarshEvents(minTime, maxTime, driverId, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error getting harsh events : ", err)
+		err = nil
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(events)
+	return
+}
+
+// JSONGetDriverSafetyScores returns the safety scores of all drivers with trips between minTime and maxTime.
+func JSONGetDriverSafetyScores(minTime int64, maxTime int64, dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	if minTime >= maxTime {
+		res = models.GetBadJSONSelectAnswer("faulty time range")
+		return
+	}
+	scores, err := GetDriverSafetyScores(minTime, maxTime, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error getting driver safety scores : ", err)
+		err = nil
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(scores)
+	return
+}
+
+// JSONGetMergeSuggestions returns the ranked suggestions which trips of the given devices between minTime
+// and maxTime could be merged. Accept them by passing their TrackIds to JSONCreateOrReviveTripByTrackIds.
+func JSONGetMergeSuggestions(minTime int64, maxTime int64, deviceIds []interface{}, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	if minTime >= maxTime {
+		res = models.GetBadJSONSelectAnswer("faulty time range")
+		return
+	}
+	suggestions, err := GetMergeSuggestions(minTime, maxTime, deviceIds, activeNotifications, T, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error getting merge suggestions : ", err)
+		err = nil
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(suggestions)
+	return
+}
+
+// JSONSplitTripAtKeyPoint splits the given trip at the given KeyPoint between two of its tracks (see SplitTripAtKeyPoint).
+func JSONSplitTripAtKeyPoint(tripId int64, keyPointId int64, isAdmin bool, getUpdatedTrips bool, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (res JSONInsertTripAnswer, err error) {
+	newTripId, affectedTrips, updNots, err := SplitTripAtKeyPoint(tripId, keyPointId, isAdmin, activeNotifications, T, dbCon)
+	return GetSplitTripAnswer(newTripId, affectedTrips, updNots, err, getUpdatedTrips, activeNotifications, T, dbCon)
+}
+
+// GetSplitTripAnswer returns the answer to a trip split with the given results.
+func GetSplitTripAnswer(newTripId int64, affectedTrips []int64, updNots bool, splitErr error, getUpdatedTrips bool, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (res JSONInsertTripAnswer, err error) {
+	if splitErr != nil {
+		dbg.E(TAG, "Error splitting trip : ", splitErr)
+		msg := "Internal server error"
+		if splitErr = periodManager.CheckError(splitErr); splitErr == ErrInvalidSplitPoint || splitErr == ErrTripTooOld || splitErr == periodManager.ErrPeriodClosed {
+			msg = splitErr.Error()
+		}
+		res.JSONInsertAnswer = models.GetBadJSONInsertAnswer(msg)
+		return
+	}
+	res.UpdatedNotifications = updNots
+	res.LastKey = newTripId
+
+	if getUpdatedTrips {
+		res.RemovedTrips, res.UpdatedTrips, err = GetUpdatedTrips(newTripId, affectedTrips, activeNotifications, T, dbCon)
+		if err != nil {
+			dbg.E(TAG, "Error getting trips after split : ", err)
+			err = nil
+			res.JSONInsertAnswer = models.GetBadJSONInsertAnswer("Internal server error")
+			return
+		}
+	}
+	res.Success = true
+	return
+}
+
+// JSONGetTripRules returns all TripRules, sorted by priority (highest first).
+func JSONGetTripRules(dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	rules, err := GetTripRules(dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error getting TripRules : ", err)
+		err = nil
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(rules)
+	return
+}
+
+// JSONCreateTripRule creates a new TripRule.
+func JSONCreateTripRule(ruleJson string, dbCon *sql.DB) (res models.JSONInsertAnswer, err error) {
+	r := &TripRule{}
+	if ruleJson == "" {
+		res = models.GetBadJSONInsertAnswer(NoDataGiven)
+		return
+	}
+	err = json.Unmarshal([]byte(ruleJson), r)
+	if err != nil {
+		dbg.W(TAG, "Could not read JSON %v in JSONCreateTripRule : ", ruleJson, err)
+		res = models.GetBadJSONInsertAnswer("Invalid format")
+		err = nil
+		return
+	}
+	key, err := CreateTripRule(r, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error in JSONCreateTripRule CreateTripRule: ", err)
+		err = nil
+		res = models.GetBadJSONInsertAnswer("Internal server error")
+		return
+	}
+	res = models.GetGoodJSONInsertAnswer(key)
+	return
+}
+
+// JSONUpdateTripRule replaces the given TripRule (by its ID).
+func JSONUpdateTripRule(ruleJson string, dbCon *sql.DB) (res models.JSONUpdateAnswer, err error) {
+	r := &TripRule{}
+	if ruleJson == "" {
+		res = models.GetBadJSONUpdateAnswer(NoDataGiven, -1)
+		return
+	}
+	err = json.Unmarshal([]byte(ruleJson), r)
+	if err != nil {
+		dbg.W(TAG, "Could not read JSON %v in JSONUpdateTripRule : ", ruleJson, err)
+		res = models.GetBadJSONUpdateAnswer("Invalid format", -1)
+		err = nil
+		return
+	}
+	rowCount, err := UpdateTripRule(r, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error in JSONUpdateTripRule UpdateTripRule: ", err)
+		err = nil
+		res = models.GetBadJSONUpdateAnswer("Internal server error", r.Id)
+		return
+	}
+	res = models.GetGoodJSONUpdateAnswer(rowCount, r.Id)
+	return
+}
+
+// JSONDeleteTripRule deletes the given TripRule (by its ID).
+func JSONDeleteTripRule(ruleJson string, dbCon *sql.DB) (res models.JSONDeleteAnswer, err error) {
+	r := &TripRule{}
+	if ruleJson == "" {
+		res = models.GetBadJSONDeleteAnswer(NoDataGiven, -1)
+		return
+	}
+	err = json.Unmarshal([]byte(ruleJson), r)
+	if err != nil {
+		dbg.W(TAG, "Could not read JSON %v in JSONDeleteTripRule : ", ruleJson, err)
+		res = models.GetBadJSONDeleteAnswer("Invalid format", -1)
+		err = nil
+		return
+	}
+	rowCount, err := DeleteTripRule(r.Id, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error in JSONDeleteTripRule DeleteTripRule: ", err)
+		err = nil
+		res = models.GetBadJSONDeleteAnswer("Internal server error", r.Id)
+		return
+	}
+	res = models.GetGoodJSONDeleteAnswer(rowCount, r.Id)
+	return
+}
+
+// JSONPreviewTripRule returns what the given TripRule would change on the trips of the given devices between
+// minTime and maxTime, without changing anything (see PreviewTripRule).
+func JSONPreviewTripRule(ruleJson string, minTime int64, maxTime int64, deviceIds []interface{}, dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	r := &TripRule{}
+	if ruleJson == "" {
+		res = models.GetBadJSONSelectAnswer(NoDataGiven)
+		return
+	}
+	if minTime >= maxTime {
+		res = models.GetBadJSONSelectAnswer("faulty time range")
+		return
+	}
+	err = json.Unmarshal([]byte(ruleJson), r)
+	if err != nil {
+		dbg.W(TAG, "Could not read JSON %v in JSONPreviewTripRule : ", ruleJson, err)
+		res = models.GetBadJSONSelectAnswer("Invalid format")
+		err = nil
+		return
+	}
+	results, err := PreviewTripRule(r, minTime, maxTime, deviceIds, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error in JSONPreviewTripRule PreviewTripRule: ", err)
+		err = nil
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(results)
+	return
+}
+
+// JSONProposeHomeAndWork returns the home and workplace detected from the stays of the given devices between
+// minTime and maxTime (see DetectHomeAndWork).
+func JSONProposeHomeAndWork(minTime int64, maxTime int64, deviceIds []interface{}, dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	if minTime >= maxTime {
+		res = models.GetBadJSONSelectAnswer("faulty time range")
+		return
+	}
+	proposal, err := ProposeHomeAndWork(minTime, maxTime, deviceIds, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error proposing home and workplace : ", err)
+		err = nil
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(proposal)
+	return
+}
+
+// JSONConfirmHomeAndWork creates contacts & TripRules for the given (possibly edited) CommuteProposal,
+// so trips between home and workplace are classified as COMMUTING (see ConfirmHomeAndWork).
+func JSONConfirmHomeAndWork(proposalJson string, dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	p := &CommuteProposal{}
+	if proposalJson == "" {
+		res = models.GetBadJSONSelectAnswer(NoDataGiven)
+		return
+	}
+	err = json.Unmarshal([]byte(proposalJson), p)
+	if err != nil {
+		dbg.W(TAG, "Could not read JSON %v in JSONConfirmHomeAndWork : ", proposalJson, err)
+		res = models.GetBadJSONSelectAnswer("Invalid format")
+		err = nil
+		return
+	}
+	setup, err := ConfirmHomeAndWork(p.Home, p.Work, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error in JSONConfirmHomeAndWork ConfirmHomeAndWork: ", err)
+		msg := "Internal server error"
+		if err == ErrMissingCommutePlace || err == ErrMissingPlaceGeoZone {
+			msg = err.Error()
+		}
+		err = nil
+		res = models.GetBadJSONSelectAnswer(msg)
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(setup)
+	return
+}
+
+// JSONGetCommuteDays returns the days with commuting trips of the given devices between minTime and maxTime per month.
+func JSONGetCommuteDays(minTime int64, maxTime int64, deviceIds []interface{}, dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	if minTime >= maxTime {
+		res = models.GetBadJSONSelectAnswer("faulty time range")
+		return
+	}
+	months, err := GetCommuteDays(minTime, maxTime, deviceIds, dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error getting commute days : ", err)
+		err = nil
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(months)
+	return
+}
+
+// JSONVerifyTripHashChain seals pending changes and verifies the trip hash chain.
+func JSONVerifyTripHashChain(dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	_, err = SealTripHashChain(dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error sealing trip hash chain : ", err)
+		err = nil
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		return
+	}
+	v, err := VerifyTripHashChain(dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error verifying trip hash chain : ", err)
+		err = nil
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		return
+	}
+	res = models.GetGoodJSONSelectAnswer(v)
+	return
+}
+
+// JSONGetTripHashChain returns all entries of the trip hash chain and its head.
+func JSONGetTripHashChain(dbCon *sql.DB) (res models.JSONSelectAnswer, err error) {
+	entries, err := GetTripHashChain(dbCon)
+	if err != nil {
+		dbg.E(TAG, "Error getting trip hash chain : ", err)
+		err = nil
+		res = models.GetBadJSONSelectAnswer("Internal server error")
+		return
+	}
+	head := ""
+	if len(entries) > 0 {
+		head = entries[len(entries)-1].Hash
+	}
+	res = models.GetGoodJSONSelectAnswer(struct {
+		Entries  []*HashChainEntry
+		HeadHash string
+	}{entries, head})
+	return
+}
@@ -0,0 +1,147 @@
+package tripMan
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/notificationManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/periodManager"
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan/models"
+	"github.com/OpenDriversLog/goodl-lib/translate"
+)
+
+const msTag = "glib/tripMan/mergeSuggestions.go"
+
+// MaxMergeStopDuration is the longest stop (in milliseconds) between two tracks that can be merged into one trip.
+const MaxMergeStopDuration = int64(2 * 60 * 60 * 1000)
+
+// ShortStopDuration is the duration (in milliseconds) below which a stop is considered as too short for a visit,
+// e.g. for refueling or buying bread.
+var ShortStopDuration = int64(15 * 60 * 1000)
+
+// stopTooLongToMerge returns if a stop from arrival to departure is too long to merge the tracks before and after it.
+func stopTooLongToMerge(arrival int64, departure int64) bool {
+	return departure-arrival > MaxMergeStopDuration
+}
+
+// MinMergeSuggestionScore is the score a merge needs to be suggested.
+var MinMergeSuggestionScore = 0.3
+
+// SuggestMerges proposes merges of consecutive trips of the same device & driver with a stop between them that
+// isMergeAllowed would accept, ranked by their score. Reviewed trips are never suggested.
+// fuelStops contains the IDs of the KeyPoints at fuel stations.
+//   - the score starts with how short the stop was compared to MaxMergeStopDuration
+//   - stops at fuel stations and unknown addresses raise it, stops at known contacts lower it
+func SuggestMerges(trips []*Trip, fuelStops map[int64]bool) (suggestions []*MergeSuggestion) {
+	suggestions = make([]*MergeSuggestion, 0)
+	sorted := make([]*Trip, len(trips))
+	copy(sorted, trips)
+	sort.Sort(tripsByStartTime(sorted))
+
+	lastByDevice := make(map[int64]*Trip)
+	for _, t := range sorted {
+		prev := lastByDevice[int64(t.DeviceId)]
+		lastByDevice[int64(t.DeviceId)] = t
+		if prev == nil || prev.Reviewed != 0 || t.Reviewed != 0 || prev.DriverId != t.DriverId {
+			continue
+		}
+		stop := int64(t.StartTime) - int64(prev.EndTime)
+		if stop < 0 || stopTooLongToMerge(int64(prev.EndTime), int64(t.StartTime)) {
+			continue
+		}
+
+		s := &MergeSuggestion{
+			TripIds:     []int64{prev.Id, t.Id},
+			TrackIds:    append(append([]int64{}, prev.TrackIdInts...), t.TrackIdInts...),
+			StopStart:   int64(prev.EndTime),
+			StopEnd:     int64(t.StartTime),
+			StopAddress: prev.EndAddress,
+			Score:       0.5 * (1 - float64(stop)/float64(MaxMergeStopDuration)),
+			Reasons:     make([]string, 0),
+		}
+		if stop < ShortStopDuration {
+			s.Reasons = append(s.Reasons, MergeReasonShortStop)
+		}
+		if fuelStops[int64(prev.EndKeyPointId)] {
+			s.Score += 0.5
+			s.Reasons = append(s.Reasons, MergeReasonFuelStop)
+		}
+		if prev.EndContactId > 0 || prev.ProposedEndContactIds != "" {
+			s.Score -= 0.4
+			s.Reasons = append(s.Reasons, MergeReasonKnownContact)
+		} else {
+			s.Score += 0.2
+			s.Reasons = append(s.Reasons, MergeReasonUnknownStop)
+		}
+		if prev.Type == t.Type {
+			s.Score += 0.1
+			s.Reasons = append(s.Reasons, MergeReasonSameType)
+		}
+		if s.Score > 1 {
+			s.Score = 1
+		}
+		if s.Score >= MinMergeSuggestionScore {
+			suggestions = append(suggestions, s)
+		}
+	}
+	sort.Stable(mergeSuggestionsByScore(suggestions))
+	return
+}
+
+type tripsByStartTime []*Trip
+
+func (t tripsByStartTime) Len() int           { return len(t) }
+func (t tripsByStartTime) Less(i, j int) bool { return t[i].StartTime < t[j].StartTime }
+func (t tripsByStartTime) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+type mergeSuggestionsByScore []*MergeSuggestion
+
+func (s mergeSuggestionsByScore) Len() int           { return len(s) }
+func (s mergeSuggestionsByScore) Less(i, j int) bool { return s[i].Score > s[j].Score }
+func (s mergeSuggestionsByScore) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// GetMergeSuggestions returns the ranked merge suggestions for the trips of the given devices between minTime and maxTime.
+// Trips in closed periods are left out, they can't be merged anymore.
+func GetMergeSuggestions(minTime int64, maxTime int64, deviceIds []interface{}, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (suggestions []*MergeSuggestion, err error) {
+	if len(deviceIds) == 0 {
+		suggestions = make([]*MergeSuggestion, 0)
+		return
+	}
+	trips, err := GetTripsByWhere(fmt.Sprintf("sEndTime<=? AND eStartTime>=? AND sDeviceId IN (%s) AND NOT %s",
+		strings.TrimSuffix(strings.Repeat("?,", len(deviceIds)), ","), periodManager.ClosedTripCondition("Trips_FullBlown.tripId")),
+		false, false, false, activeNotifications, T, false, dbCon, append([]interface{}{maxTime, minTime}, deviceIds...)...)
+	if err != nil {
+		dbg.E(msTag, "Failed to get trips from %d to %d : ", minTime, maxTime, err)
+		return
+	}
+
+	fuelStops := make(map[int64]bool)
+	rows, err := dbCon.Query(`SELECT KP._keyPointId FROM KeyPoints KP
+		JOIN Addresses A ON A._addressId=KP.addressId
+		WHERE KP.startTime<=? AND KP.endTime>=? AND IFNULL(A.fuel,'')!=''`, maxTime, minTime)
+	if err != nil {
+		dbg.E(msTag, "Failed to get fuel stops from %d to %d : ", minTime, maxTime, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kpId int64
+		err = rows.Scan(&kpId)
+		if err != nil {
+			dbg.E(msTag, "Failed to scan fuel stop : ", err)
+			return
+		}
+		fuelStops[kpId] = true
+	}
+	err = rows.Err()
+	if err != nil {
+		dbg.E(msTag, "GetMergeSuggestions rows-iteration-Error", err)
+		return
+	}
+
+	suggestions = SuggestMerges(trips, fuelStops)
+	return
+}
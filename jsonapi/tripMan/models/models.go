@@ -56,6 +56,29 @@ type Trip struct {
 	Reviewed                int64
 	EditableTime		int64
 	TimeOverDue int64
+	// CarId is the car of the first track
+	CarId NInt64
+	// DataQuality is the worst geo.DataQuality* of the trips tracks
+	DataQuality NInt64
+	// MaxSpeed & AvgMovingSpeed (km/h) are calculated over all tracks of the trip, WeightedMedianSpeed is the mean
+	// of the median speeds of the tracks weighted by their MovingTime (ms) - not the median of the whole trip
+	MaxSpeed            NFloat64
+	AvgMovingSpeed      NFloat64
+	WeightedMedianSpeed NFloat64
+	MovingTime          NInt64
+	// SpeedingEvents is the count of geo.SpeedingEvents on the trips tracks
+	SpeedingEvents NInt64
+	// Ascent, Descent, MinAltitude and MaxAltitude (m) are calculated over all tracks of the trip
+	Ascent      NFloat64
+	Descent     NFloat64
+	MinAltitude NFloat64
+	MaxAltitude NFloat64
+	// TransportMode is the geo.Transport* mode of the longest track, trips not driven by car should be reviewed
+	TransportMode NString
+	// RuleExplanation describes which TripRules set fields of the trip
+	RuleExplanation NString `json:",omitempty"`
+	// ElevationProfile is the joined profile of the TrackDetails, only filled if they are requested
+	ElevationProfile []*geo.ElevationPoint `json:",omitempty"`
 	History 		[]*CleanTripHistoryEntry	`json:",omitempty"`
 }
 
@@ -127,3 +150,244 @@ type JSONUpdateTripAnswer struct {
 	RemovedTrips []*Trip
 	Changes []*CleanTripHistoryEntry
 }
+
+// DriverHarshEvent is a geo.HarshEvent with the track, trip & driver it belongs to.
+type DriverHarshEvent struct {
+	geo.HarshEvent
+	TrackId  int64
+	TripId   NInt64
+	DriverId NInt64
+}
+
+// DriverSafetyScore summarizes the harsh driving events of a driver in a time range.
+type DriverSafetyScore struct {
+	DriverId int64
+	Trips    int
+	// Distance is the driven distance in meters
+	Distance      float64
+	Accelerations int
+	Brakings      int
+	Cornerings    int
+	// SeveritySum is the sum of the severities of all events
+	SeveritySum float64
+	// Score is between 0 (worst) and 100 (no harsh events)
+	Score float64
+}
+
+// MergeSuggestion proposes to merge two consecutive trips because the stop between them was probably
+// not a destination of its own.
+type MergeSuggestion struct {
+	TripIds []int64
+	// TrackIds are the tracks of both trips, ready to be passed to CreateOrReviveTripByTracks
+	TrackIds []int64
+	// StopStart & StopEnd are the times the first trip ended and the second one started
+	StopStart int64
+	StopEnd   int64
+	// StopAddress is the address of the stop between both trips
+	StopAddress *addressManager.Address
+	// Score is between 0 (unlikely) and 1 (very likely the same trip)
+	Score float64
+	// Reasons are the MergeReason* constants that lead to the Score
+	Reasons []string
+}
+
+const (
+	// MergeReasonShortStop means the stop was shorter than a typical visit
+	MergeReasonShortStop = "shortStop"
+	// MergeReasonFuelStop means the stop was at a fuel station
+	MergeReasonFuelStop = "fuelStop"
+	// MergeReasonUnknownStop means the stop was not at the address of a known contact
+	MergeReasonUnknownStop = "unknownStop"
+	// MergeReasonKnownContact means the stop was at the address of a known contact, so it might be a destination
+	MergeReasonKnownContact = "knownContact"
+	// MergeReasonSameType means both trips have the same type
+	MergeReasonSameType = "sameType"
+)
+
+// TripRule sets fields of trips matching all of its conditions when they are created or updated.
+// Conditions with their zero value match every trip, actions with their zero value don't change anything.
+type TripRule struct {
+	Id    int64
+	Title NString
+	// Priority decides which rule sets a field if multiple matching rules do, the highest one wins
+	Priority NInt64
+	Disabled NInt64
+
+	StartContactId NInt64
+	EndContactId   NInt64
+	StartGeoZoneId NInt64
+	EndGeoZoneId   NInt64
+	// Weekdays is a bitmask of the weekdays (1<<time.Sunday ... 1<<time.Saturday) the trip needs to start at
+	Weekdays NInt64
+	// StartMinute & EndMinute (minutes of the day) are the time window the trip needs to start in,
+	// it wraps around midnight if EndMinute is before StartMinute
+	StartMinute NInt64
+	EndMinute   NInt64
+	DeviceId    NInt64
+	CarId       NInt64
+	DriverId    NInt64
+	// MinDistance & MaxDistance are in meters
+	MinDistance NFloat64
+	MaxDistance NFloat64
+
+	SetType        NInt64
+	SetTitle       NString
+	SetDescription NString
+	SetDriverId    NInt64
+	SetContactId   NInt64
+}
+
+// TripRuleFacts are the properties of a trip TripRules are evaluated against.
+type TripRuleFacts struct {
+	TripId          int64
+	Reviewed        int64
+	Type            int
+	Title           NString
+	Description     NString
+	ContactId       int64
+	StartContactId  int64
+	EndContactId    int64
+	StartGeoZoneIds []int64
+	EndGeoZoneIds   []int64
+	StartTime       int64
+	DeviceId        int64
+	CarId           int64
+	DriverId        int64
+	// Distance is in meters
+	Distance float64
+}
+
+// TripRuleResult describes which fields the TripRules matching a trip set.
+type TripRuleResult struct {
+	TripId int64
+	// Changes are the new values by column (type, title, desc, driverId, contactId)
+	Changes map[string]interface{}
+	// RuleIds are the IDs of the rules that set at least one field
+	RuleIds []int64
+	// Explanation describes which rule set which fields
+	Explanation string
+}
+
+// PlaceStay is a stay at a KeyPoint, used to detect regularly visited places.
+type PlaceStay struct {
+	KeyPointId int64
+	Latitude   float64
+	Longitude  float64
+	StartTime  int64
+	EndTime    int64
+}
+
+// PlaceCandidate is a place proposed as home or workplace, detected by the stays at it.
+type PlaceCandidate struct {
+	Latitude  float64
+	Longitude float64
+	// Days is the count of nights (home) or weekdays (workplace) with a long enough stay at the place
+	Days int
+	// DwellTime is the time (ms) spent at the place at night (home) or in working hours (workplace)
+	DwellTime int64
+	// Title is used for the contact created when the place is confirmed
+	Title NString
+}
+
+// CommuteProposal contains the detected home and workplace, nil if none was found.
+type CommuteProposal struct {
+	Home *PlaceCandidate
+	Work *PlaceCandidate
+}
+
+// CommuteSetup is the result of confirming a CommuteProposal.
+type CommuteSetup struct {
+	HomeContactId int64
+	WorkContactId int64
+	TripRuleIds   []int64
+	// ClassifiedTripIds are the unreviewed trips which were classified as COMMUTING
+	ClassifiedTripIds []int64
+	// ClosedTrips is the count of unreviewed trips left out because they are in a closed period
+	ClosedTrips int
+}
+
+// CommuteMonth contains the count of days with commuting trips in a month.
+type CommuteMonth struct {
+	// Month is formatted as 2006-01
+	Month string
+	Days  int
+	Trips int
+}
+
+const (
+	// HashEntryTrip is a snapshot of a trip, sealed when it is created and after its history changed
+	HashEntryTrip = "trip"
+	// HashEntryTripHistory is an entry of Trip_History
+	HashEntryTripHistory = "tripHistory"
+	// HashEntryTracksTripsHistory is an entry of Tracks_Trips_History
+	HashEntryTracksTripsHistory = "tracksTripsHistory"
+	// HashEntryTripDeletion is a tombstone of a trip deleted on purpose, its content is the hash of the last
+	// snapshot of the trip
+	HashEntryTripDeletion = "tripDeletion"
+)
+
+const (
+	// HashBreakLink means the entry does not reference the hash of its predecessor
+	HashBreakLink = "link"
+	// HashBreakHash means the hash of the entry does not match its content hash & predecessor
+	HashBreakHash = "hash"
+	// HashBreakContent means the trip or history entry was changed after it was sealed
+	HashBreakContent = "content"
+	// HashBreakMissing means the trip or history entry was deleted after it was sealed
+	HashBreakMissing = "missing"
+)
+
+// HashChainEntry links a trip or history entry to its predecessor in the tamper-evident hash chain.
+type HashChainEntry struct {
+	Id          int64
+	EntryType   string
+	EntryId     int64
+	ContentHash string
+	PrevHash    string
+	Hash        string
+	SealedAt    int64
+}
+
+// HashChainBreak is an entry of the hash chain not matching the chain or its trip / history entry anymore.
+type HashChainBreak struct {
+	ChainId   int64
+	EntryType string
+	EntryId   int64
+	// Reason is one of the HashBreak* reasons
+	Reason string
+}
+
+// HashChainVerification is the result of verifying the hash chain.
+type HashChainVerification struct {
+	Valid    bool
+	Entries  int
+	HeadHash string
+	// Unsealed is the count of trips and history entries not added to the chain yet
+	Unsealed int
+	Breaks   []*HashChainBreak
+}
+
+// TripFilter selects trips (see GetTripsByFilter). Empty fields don't restrict the result, the set ones all have to
+// match.
+type TripFilter struct {
+	// MinTime & MaxTime (unix millis) select trips overlapping this time range
+	MinTime   int64
+	MaxTime   int64
+	DeviceIds []int64
+	CarIds    []int64
+	DriverIds []int64
+	Types     []int
+	// ContactIds match the contact, start or end contact of a trip
+	ContactIds []int64
+	Reviewed   *bool
+	// NonCar selects trips whose longest track was classified as another TransportMode than car (true), which should
+	// be reviewed, or the others (false)
+	NonCar *bool
+	// Overdue selects unreviewed trips whose edit deadline passed (true) or the others (false)
+	Overdue *bool
+	// MinDistance & MaxDistance are in meters
+	MinDistance float64
+	MaxDistance float64
+	// Text is searched in title, description, addresses and contacts of a trip
+	Text string
+}
@@ -0,0 +1,182 @@
+package tripMan
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/notificationManager"
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan/models"
+	"github.com/OpenDriversLog/goodl-lib/translate"
+)
+
+// MaxTripFilterIds is the maximum count of IDs in each list of a TripFilter, SQLite limits the count of parameters.
+const MaxTripFilterIds = 200
+
+// MaxTripFilterText is the maximum length of TripFilter.Text.
+const MaxTripFilterText = 100
+
+var ErrFilterTimeRange = errors.New("Invalid time range")
+var ErrFilterTooManyIds = errors.New("Too many IDs in filter")
+var ErrFilterInvalidId = errors.New("Invalid ID in filter")
+var ErrFilterTripType = errors.New("Invalid trip type")
+var ErrFilterDistanceRange = errors.New("Invalid distance range")
+var ErrFilterTextTooLong = errors.New("Search text too long")
+
+// tripDistanceCol sums up the distances of the tracks of a trip in Trips_FullBlown, tracks without a distance yet
+// have -1.
+const tripDistanceCol = "(SELECT IFNULL(SUM(MAX(distance,0)),0) FROM Tracks WHERE _trackId IN (SELECT trackId FROM Tracks_Trips WHERE tripId=Trips_FullBlown.tripId))"
+
+// tripTransportModeCol is the TransportMode of the longest track of a trip in Trips_FullBlown, NULL if not classified.
+const tripTransportModeCol = "(SELECT transportMode FROM Tracks WHERE _trackId IN (SELECT trackId FROM Tracks_Trips WHERE tripId=Trips_FullBlown.tripId) ORDER BY distance DESC LIMIT 1)"
+
+// tripTextCols are searched for TripFilter.Text.
+var tripTextCols = []string{"tripTitle", "tripDesc", "sStreet", "sCity", "sAddTitle", "eStreet", "eCity", "eAddTitle",
+	"sContactTitle", "eContactTitle", "tripContactTitle"}
+
+// CompileTripFilter validates the given filter and returns the where clause against Trips_FullBlown and its
+// parameters selecting the trips matching it. now (unix millis) decides which trips are overdue.
+func CompileTripFilter(f *TripFilter, now int64) (where string, params []interface{}, err error) {
+	conds := make([]string, 0)
+	params = make([]interface{}, 0)
+	if f.MinTime < 0 || f.MaxTime < 0 || (f.MaxTime != 0 && f.MinTime > f.MaxTime) {
+		err = ErrFilterTimeRange
+		return
+	}
+	if f.MinTime != 0 {
+		conds = append(conds, "eStartTime>=?")
+		params = append(params, f.MinTime)
+	}
+	if f.MaxTime != 0 {
+		conds = append(conds, "sEndTime<=?")
+		params = append(params, f.MaxTime)
+	}
+
+	inConds := []struct {
+		cols []string
+		ids  []int64
+	}{
+		{[]string{"sDeviceId"}, f.DeviceIds},
+		{[]string{"sCarId"}, f.CarIds},
+		{[]string{"tripDriverId"}, f.DriverIds},
+		{[]string{"tripContactId", "tripStartContactId", "tripEndContactId"}, f.ContactIds},
+	}
+	for _, in := range inConds {
+		if len(in.ids) == 0 {
+			continue
+		}
+		if len(in.ids) > MaxTripFilterIds {
+			err = ErrFilterTooManyIds
+			return
+		}
+		for _, id := range in.ids {
+			if id <= 0 {
+				err = ErrFilterInvalidId
+				return
+			}
+		}
+		placeholders := strings.Repeat(",?", len(in.ids))[1:]
+		ors := make([]string, len(in.cols))
+		for i, c := range in.cols {
+			ors[i] = c + " IN (" + placeholders + ")"
+			for _, id := range in.ids {
+				params = append(params, id)
+			}
+		}
+		conds = append(conds, "("+strings.Join(ors, " OR ")+")")
+	}
+
+	if len(f.Types) != 0 {
+		if len(f.Types) > MaxTripFilterIds {
+			err = ErrFilterTooManyIds
+			return
+		}
+		for _, t := range f.Types {
+			if t != PRIVATE && t != COMMUTING && t != BUSINESS {
+				err = ErrFilterTripType
+				return
+			}
+			params = append(params, t)
+		}
+		conds = append(conds, "tripType IN ("+strings.Repeat(",?", len(f.Types))[1:]+")")
+	}
+
+	if f.Reviewed != nil {
+		conds = append(conds, "IFNULL(tripReviewed,0)=?")
+		if *f.Reviewed {
+			params = append(params, 1)
+		} else {
+			params = append(params, 0)
+		}
+	}
+	if f.NonCar != nil {
+		nonCar := "IFNULL(" + tripTransportModeCol + ",'car')!='car'"
+		if !*f.NonCar {
+			nonCar = "NOT " + nonCar
+		}
+		conds = append(conds, nonCar)
+	}
+	if f.Overdue != nil {
+		overdue := "(IFNULL(tripReviewed,0)=0 AND tripTimeOverDue>0 AND tripTimeOverDue<?)"
+		if !*f.Overdue {
+			overdue = "NOT " + overdue
+		}
+		conds = append(conds, overdue)
+		params = append(params, now)
+	}
+
+	if f.MinDistance < 0 || f.MaxDistance < 0 || (f.MaxDistance != 0 && f.MinDistance > f.MaxDistance) {
+		err = ErrFilterDistanceRange
+		return
+	}
+	if f.MinDistance != 0 {
+		conds = append(conds, tripDistanceCol+">=?")
+		params = append(params, f.MinDistance)
+	}
+	if f.MaxDistance != 0 {
+		conds = append(conds, tripDistanceCol+"<=?")
+		params = append(params, f.MaxDistance)
+	}
+
+	text := strings.TrimSpace(f.Text)
+	if len(text) > MaxTripFilterText {
+		err = ErrFilterTextTooLong
+		return
+	}
+	if text != "" {
+		// the text is searched literally, not as pattern
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text) + "%"
+		ors := make([]string, len(tripTextCols))
+		for i, c := range tripTextCols {
+			ors[i] = c + ` LIKE ? ESCAPE '\'`
+			params = append(params, pattern)
+		}
+		conds = append(conds, "("+strings.Join(ors, " OR ")+")")
+	}
+
+	if len(conds) == 0 {
+		where = "1=1"
+		return
+	}
+	where = strings.Join(conds, " AND ")
+	return
+}
+
+// GetTripsByFilter returns the trips matching the given filter (see CompileTripFilter and GetTripsByWhere).
+func GetTripsByFilter(f *TripFilter, detailedContactData bool, includeTracks bool, trackDetails bool, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, withHistory bool, dbCon *sql.DB) (trips []*Trip, err error) {
+	where, params, err := CompileTripFilter(f, time.Now().Unix()*1000)
+	if err != nil {
+		return
+	}
+	return GetTripsByWhere(where, detailedContactData, includeTracks, trackDetails, activeNotifications, T, withHistory, dbCon, params...)
+}
+
+// IsTripFilterError returns true if err is one of the errors of an invalid TripFilter.
+func IsTripFilterError(err error) bool {
+	switch err {
+	case ErrFilterTimeRange, ErrFilterTooManyIds, ErrFilterInvalidId, ErrFilterTripType, ErrFilterDistanceRange, ErrFilterTextTooLong:
+		return true
+	}
+	return false
+}
@@ -18,6 +18,8 @@ import (
 	"github.com/OpenDriversLog/goodl-lib/tools"
 	. "github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan/models"
 	"github.com/OpenDriversLog/goodl-lib/jsonapi/notificationManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/periodManager"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/policyManager"
 	"github.com/OpenDriversLog/goodl-lib/translate"
 )
 
@@ -97,6 +99,9 @@ func CreateOrReviveTripByTracks(trackIds []int64, tripType int, title string, de
 	} else if tripType != BUSINESS && tripType != COMMUTING && tripType != PRIVATE { // completely wrong tripType changes to PRIVATE
 		tripType = PRIVATE
 	}
+	if err := periodManager.CheckTracksOpen(trackIds, dbCon); err != nil {
+		return -1, affectedTripIds, false, err
+	}
 	if checkMergeAllowed {
 		allowed, err := isMergeAllowed(trackIds, dbCon)
 		if !allowed || err != nil {
@@ -154,18 +159,34 @@ func CreateOrReviveTripByTracks(trackIds []int64, tripType int, title string, de
 			return -1, affectedTripIds, false, err
 		}
 	}
+	DueUpd, err := finishTripTracksChange(lastTripId, affectedTripIds, activeNotifications, T, dbCon)
+	if err != nil {
+		return -1, affectedTripIds, false, err
+	}
+	return lastTripId, affectedTripIds, DueUpd, nil
+}
+
+// finishTripTracksChange applies the TripRules to the trip the tracks were moved to, seals the hash chain and updates
+// timeOverDue & notifications of the trips they were moved from and to. Returns if notifications were changed.
+func finishTripTracksChange(lastTripId int64, affectedTripIds []int64, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (bool, error) {
+	if _, err := ApplyTripRules(lastTripId, nil, dbCon); err != nil {
+		dbg.E(TAG, "Error applying TripRules to trip %d : ", lastTripId, err)
+	}
+	if _, err := SealTripHashChain(dbCon); err != nil {
+		dbg.E(TAG, "Error sealing trip hash chain after creating trip %d : ", lastTripId, err)
+	}
 	DueUpd := false
 	for _,id := range affectedTripIds {
 		trip, err := GetTrip(id,false,false,true,activeNotifications,T,true,dbCon)
-		origTOD := trip.TimeOverDue
 		if err != nil {
-			dbg.E(TAG,"Could not get trip in CreateOrReviveTripByTracks : ", err)
-			return -1,affectedTripIds, false,err
+			dbg.E(TAG,"Could not get affected trip %d : ", id, err)
+			return false, err
 		}
+		origTOD := trip.TimeOverDue
 		err = calcOverDue(trip,dbCon)
 		if err != nil {
 			dbg.E(TAG,"Error calculating overdue : ", err)
-			return -1,affectedTripIds, false,err
+			return false, err
 		}
 		thisDueUpd := false
 		if origTOD != trip.TimeOverDue {
@@ -173,7 +194,7 @@ func CreateOrReviveTripByTracks(trackIds []int64, tripType int, title string, de
 			_, err = dbCon.Exec("UPDATE TRIPS SET timeOverDue=? WHERE _tripId=?;", trip.TimeOverDue, trip.Id)
 			if err != nil {
 				dbg.E(TAG,"Error setting timeOverDue for trip %d : ",trip.Id, err)
-				return -1,affectedTripIds, false,err
+				return false, err
 			}
 		}
 		if thisDueUpd {
@@ -202,7 +223,7 @@ func CreateOrReviveTripByTracks(trackIds []int64, tripType int, title string, de
 			DueUpd = true
 		}
 	}
-	return lastTripId, affectedTripIds,DueUpd, nil
+	return DueUpd, nil
 }
 
 // isMergeAllowed checks if the given trackIds can be merged
@@ -228,8 +249,7 @@ func isMergeAllowed(trackIds []int64, dbCon *sql.DB) (allowed bool, err error) {
 				dbg.E(TAG, "Could not find track %d", trackId, err)
 				return
 			}
-			var twoHours = int64(7200000)
-			if track.StartKeyPointInfo.MaxTime-track.StartKeyPointInfo.MinTime > twoHours {
+			if stopTooLongToMerge(track.StartKeyPointInfo.MinTime, track.StartKeyPointInfo.MaxTime) {
 				//stop >2 hours
 				dbg.WTF(TAG, "Can't merge tracks with stops >2 hours - based on StartKeyPointInfo : %+v", track.StartKeyPointInfo)
 				err = errors.New("Can't merge tracks with stops >2 hours")
@@ -333,6 +353,19 @@ trackId,
 tripReviewed,
 sDeviceId,
 tripTimeOverDue,
+sCarId,
+(SELECT dataQuality FROM Tracks WHERE Tracks._trackId=Trips_FullBlown.trackId) AS trackDataQuality,
+TripStats.maxSpeed AS tripMaxSpeed,
+TripStats.avgMovingSpeed AS tripAvgMovingSpeed,
+TripStats.weightedMedianSpeed AS tripWeightedMedianSpeed,
+TripStats.movingTime AS tripMovingTime,
+TripStats.speedingEvents AS tripSpeedingEvents,
+TripStats.ascent AS tripAscent,
+TripStats.descent AS tripDescent,
+TripStats.minAltitude AS tripMinAltitude,
+TripStats.maxAltitude AS tripMaxAltitude,
+(SELECT transportMode FROM Tracks WHERE _trackId IN (SELECT trackId FROM Tracks_Trips WHERE tripId=Trips_FullBlown.tripId) ORDER BY distance DESC LIMIT 1) AS tripTransportMode,
+(SELECT explanation FROM TripRuleApplications WHERE TripRuleApplications.tripId=Trips_FullBlown.tripId) AS tripRuleExplanation,
 ` + strings.Replace(contactCols, "__", "proposedS", -1) +
 		`,` + strings.Replace(contactCols, "__", "proposedE", -1) +
 		`,` + strings.Replace(contactCols, "__", "s", -1) +
@@ -340,10 +373,15 @@ tripTimeOverDue,
 		`,` + strings.Replace(contactCols, "__", "trip", -1) +
 		historyCols +
 		`
-	FROM Trips_FullBlown `+
+	FROM Trips_FullBlown LEFT JOIN TripStats ON TripStats.tripId=Trips_FullBlown.tripId `+
 		historyJoin +
 		` WHERE
 		` + where + " ORDER BY tripReviewed ASC,sStartTime ASC"
+	policies, err := policyManager.GetTripPolicies(dbCon)
+	if err != nil {
+		dbg.E(TAG, "Failed to get TripPolicies : ", err)
+		return trips, err
+	}
 	//dbg.WTF(TAG, "Executing query : %v with params : ", append([]interface{}{interface{}(q)}, params...)...)
 	res, err := dbCon.Query(q, params...)
 	dbg.I(TAG, "Finished query.")
@@ -390,7 +428,9 @@ tripTimeOverDue,
 			&trip.EndAddress.Postal,&trip.EndAddress.GeoCoder, &trip.EndAddress.City, &trip.EndAddress.Additional1,
 			&trip.EndAddress.Additional2, &trip.EndAddress.Latitude, &trip.EndAddress.Longitude,
 			&trip.EndAddress.HouseNumber, &trip.EndAddress.Title,
-			&trip.TrackIds, &trip.Reviewed, &trip.DeviceId,&trip.TimeOverDue,
+			&trip.TrackIds, &trip.Reviewed, &trip.DeviceId,&trip.TimeOverDue, &trip.CarId, &trip.DataQuality,
+			&trip.MaxSpeed, &trip.AvgMovingSpeed, &trip.WeightedMedianSpeed, &trip.MovingTime, &trip.SpeedingEvents,
+			&trip.Ascent, &trip.Descent, &trip.MinAltitude, &trip.MaxAltitude, &trip.TransportMode, &trip.RuleExplanation,
 		}
 
 		scanFields = append(scanFields, &trip.ProposedStartContactIds)
@@ -605,14 +645,11 @@ tripTimeOverDue,
 		}
 
 		if(trip.EndKeyPoint != nil) {
-			overDueTime := trip.EndKeyPoint.StartTime + 7 * 24 * 60 * 60 * 1000;
+			// stored by policyManager.UpdateTimeOverDue when the policies change, so this is only a fallback
+			overDueTime := policyManager.GetDeadline(policyManager.GetPolicyForCar(policies, int64(trip.CarId)), tripEndTime(&trip))
 			if trip.TimeOverDue != overDueTime {
+				dbg.W(TAG,"Stored TimeOverDue %d of trip %d differs from %d",trip.TimeOverDue, trip.Id, overDueTime)
 				trip.TimeOverDue = overDueTime
-				dbg.W(TAG,"Updating trip %d with new TimeOverDue of %d",trip.Id, overDueTime)
-				_,_,_,_, err = UpdateTrip(&trip,true,activeNotifications,T, dbCon)
-				if err != nil {
-					dbg.E(TAG,"Error updating trip with new TimeOverDue")
-				}
 			}
 			trip.EditableTime = trip.TimeOverDue - time.Now().Unix() * 1000
 
@@ -631,6 +668,9 @@ tripTimeOverDue,
 
 				lastTrip.TrackIdInts = append(lastTrip.TrackIdInts, trip.TrackIdInts[0])
 			}
+			if trip.DataQuality > lastTrip.DataQuality {
+				lastTrip.DataQuality = trip.DataQuality
+			}
 			lastTrip.ProposedEndContactIds = S.NString(tools.AppendStringsByComma(string(lastTrip.ProposedEndContactIds),
 				string(trip.ProposedEndContactIds)))
 			lastTrip.ProposedStartContactIds = S.NString(tools.AppendStringsByComma(string(lastTrip.ProposedStartContactIds),
@@ -643,6 +683,11 @@ tripTimeOverDue,
 
 		prevTrip = &trip
 	}
+	if trackDetails {
+		for _, t := range trips {
+			t.ElevationProfile = tripElevationProfile(t.TrackDetails)
+		}
+	}
 
 	//dbg.I(TAG, "Waiting for Waitgroup")
 	//wg.Wait()
@@ -688,6 +733,37 @@ func GetTrackIdsForTripId(tripId int64, dbCon *sql.DB) (tIds []int64, err error)
 	return
 }
 
+// ErrTripTooOld is returned when a non-admin tries to change a trip after its edit window.
+var ErrTripTooOld = errors.New("Trip is too old to review")
+
+// tripEndTime returns the time the deadline of the given trip is calculated from: the arrival at its end KeyPoint,
+// like policyManager.UpdateTimeOverDue does.
+func tripEndTime(trip *Trip) int64 {
+	if trip.EndKeyPoint != nil {
+		return trip.EndKeyPoint.StartTime
+	}
+	return int64(trip.EndTime)
+}
+
+// CheckTripEditable returns periodManager.ErrPeriodClosed if the given trip is in a closed period of its car and
+// ErrTripTooOld if it can't be changed anymore by non-admins, as the deadline of the TripPolicy of its car passed.
+func CheckTripEditable(trip *Trip, isAdmin bool, dbCon *sql.DB) error {
+	if err := periodManager.CheckTimeRangeOpen(int64(trip.CarId), int64(trip.StartTime), int64(trip.EndTime), dbCon); err != nil {
+		return err
+	}
+	if isAdmin {
+		return nil
+	}
+	policy, err := policyManager.GetTripPolicyForCar(int64(trip.CarId), dbCon)
+	if err != nil {
+		return err
+	}
+	if policyManager.GetDeadline(policy, tripEndTime(trip)) < time.Now().Unix()*1000 {
+		return ErrTripTooOld
+	}
+	return nil
+}
+
 // UpdateTrip updates trip, returns new tripData. Also automatically removes tracks from previous trips if used in this updated one.
 func UpdateTrip(trip *Trip, isAdmin bool,activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (updatedTrip *Trip, affectedTripIds []int64,notificationsChanged bool,changes CleanTripHistoryEntry, err error) {
 
@@ -698,8 +774,8 @@ func UpdateTrip(trip *Trip, isAdmin bool,activeNotifications *[]*notificationMan
 		return trip, affectedTripIds,false,changes, errors.New("Trip to update could not be found")
 	}
 
-	if !isAdmin && int64(oldTrip.EndTime)+1000*60*60*24*7 < time.Now().Unix()*1000 {
-		return trip, affectedTripIds,false, changes,errors.New("Trip is too old to review")
+	if err = CheckTripEditable(oldTrip, isAdmin, dbCon); err != nil {
+		return trip, affectedTripIds,false, changes,err
 	}
 
 
@@ -809,6 +885,7 @@ func UpdateTrip(trip *Trip, isAdmin bool,activeNotifications *[]*notificationMan
 		cmd := ""
 		pms := make([]interface{}, 0)
 		doAnything := false
+		addedTids := make([]int64, 0)
 		for _, v := range newTids {
 			if !containsString(oldTids, v) {
 				doAnything = true
@@ -829,6 +906,8 @@ func UpdateTrip(trip *Trip, isAdmin bool,activeNotifications *[]*notificationMan
 
 				cmd += "DELETE FROM Tracks_Trips WHERE trackId=?;INSERT INTO Tracks_Trips (trackId,tripId) VALUES (?,?);"
 				pms = append(pms, v, v, trip.Id)
+				tId, _ := strconv.ParseInt(v, 10, 64)
+				addedTids = append(addedTids, tId)
 			}
 		}
 		for _, v := range oldTids {
@@ -839,9 +918,16 @@ func UpdateTrip(trip *Trip, isAdmin bool,activeNotifications *[]*notificationMan
 			}
 		}
 		if doAnything {
+			// tracks taken from trips in closed periods
+			if err = periodManager.CheckTracksOpen(addedTids, dbCon); err != nil {
+				return trip, affectedTripIds, false, changes, err
+			}
 			_, err = dbCon.Exec(cmd, pms...)
 			if err != nil {
 				dbg.E(TAG, "UpdateTrip: error dbCon.Exec", err)
+				if periodManager.CheckError(err) == periodManager.ErrPeriodClosed {
+					return trip, affectedTripIds, false, changes, periodManager.ErrPeriodClosed
+				}
 				return trip, affectedTripIds,false, changes,errors.New("Trip update not successful. Database error!")
 			}
 		}
@@ -868,11 +954,32 @@ func UpdateTrip(trip *Trip, isAdmin bool,activeNotifications *[]*notificationMan
 	res, err := update.ExecUpdate("Trips", "_tripId=?", trip.Id)
 	if err != nil {
 		dbg.E(TAG, "UpdateTrip: error execUpdate", err)
+		if periodManager.CheckError(err) == periodManager.ErrPeriodClosed {
+			return trip, affectedTripIds, false, changes, periodManager.ErrPeriodClosed
+		}
 		return trip, affectedTripIds, false, changes, errors.New("Trip update failed internally.")
 	} else if crows, err := res.RowsAffected(); err != nil || crows == 0 {
 		return trip, affectedTripIds,false, changes, errors.New("Trip update affected nothing.")
 	}
 
+	// conditions of TripRules changed - re-apply them, but don't overwrite what the user just changed
+	_, tracksChanged := changes.Changes["trackIds"]
+	_, startChanged := changes.Changes["startContactId"]
+	_, endChanged := changes.Changes["endContactId"]
+	_, driverChanged := changes.Changes["driverId"]
+	if trip.Reviewed == 0 && (tracksChanged || startChanged || endChanged || driverChanged) {
+		skip := make(map[string]bool)
+		for k, f := range map[string]string{"type": "type", "title": "title", "description": "desc", "driverId": "driverId", "contactId": "contactId"} {
+			_, skip[f] = changes.Changes[k]
+		}
+		if _, err := ApplyTripRules(trip.Id, skip, dbCon); err != nil {
+			dbg.E(TAG, "Error applying TripRules to trip %d : ", trip.Id, err)
+		}
+	}
+	if _, err := SealTripHashChain(dbCon); err != nil {
+		dbg.E(TAG, "Error sealing trip hash chain after updating trip %d : ", trip.Id, err)
+	}
+
 	//TODO: I really don't like the idea of querying it again if we trust our algorithm... But as long as it is no performance Issue, OK...
 	//return trip, nil
 	t, err := GetTrip(trip.Id, false, false, true,activeNotifications,T,true, dbCon)
@@ -916,7 +1023,12 @@ func calcOverDue(trip *Trip,dbCon *sql.DB) (err error) {
 
 	}
 	if trip.EndKeyPoint != nil {
-		overDueTime := trip.EndKeyPoint.StartTime + 7 * 24 * 60 * 60 * 1000;
+		var policy *policyManager.TripPolicy
+		policy, err = policyManager.GetTripPolicyForTrip(trip.Id, dbCon)
+		if err != nil {
+			return
+		}
+		overDueTime := policyManager.GetDeadline(policy, tripEndTime(trip))
 		if trip.TimeOverDue != overDueTime {
 			trip.TimeOverDue = overDueTime
 		}
@@ -1003,6 +1115,51 @@ func GetTrackIdsInTimeRange(minTime int64, maxTime int64, deviceIds []interface{
 	return ids, nil
 }
 
+// GetNonCarTracksWithoutTrip returns the tracks of the given devices between minTime and maxTime that were classified
+// as another TransportMode than car and got no trip (see Device.SkipNonCarTracks), so they can be reviewed and
+// turned into trips by CreateOrReviveTripByTracks if they were driven by car anyway.
+func GetNonCarTracksWithoutTrip(minTime int64, maxTime int64, deviceIds []interface{}, dbCon *sql.DB) (tracks []*Track, err error) {
+	tracks = make([]*Track, 0)
+	if len(deviceIds) == 0 {
+		return
+	}
+	if maxTime == 0 {
+		maxTime = math.MaxInt64
+	}
+	rows, err := dbCon.Query(`SELECT t._trackId FROM Tracks AS t
+		INNER JOIN KeyPoints AS skp ON skp._keyPointId = t.startKeyPointId
+		INNER JOIN KeyPoints AS ekp ON ekp._keyPointId = t.endKeyPointId
+		WHERE skp.endTime<=? AND ekp.startTime>=? AND t.deviceId IN (?`+strings.Repeat(",?", len(deviceIds)-1)+`)
+		AND IFNULL(t.transportMode,?)!=? AND t.fusedIntoTrackId IS NULL
+		AND NOT EXISTS (SELECT 1 FROM Tracks_Trips WHERE trackId=t._trackId)
+		ORDER BY skp.endTime`, append(append([]interface{}{maxTime, minTime}, deviceIds...), TransportCar, TransportCar)...)
+	if err != nil {
+		dbg.E(TAG, "GetNonCarTracksWithoutTrip: Failed to get trackIds : ", err)
+		return
+	}
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			dbg.E(TAG, "GetNonCarTracksWithoutTrip: Failed to scan trackId : ", err)
+			rows.Close()
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		var track Track
+		track, err = GetTrackById(dbCon, id)
+		if err != nil {
+			return
+		}
+		tracks = append(tracks, &track)
+	}
+	return
+}
+
 // GetKeyPointById returns the KeyPoint_Slim with the given ID
 func GetKeyPointById(db *sql.DB, kpId int64) (kp KeyPoint_Slim, err error) {
 	// TODO: CS use crossplattform DB stuff
@@ -1048,11 +1205,11 @@ func GetTrackById(db *sql.DB, trackId int64) (track Track, err error) {
 		skp.longitude AS startLng,
 		skp.startTime AS startStartTime,
 		skp.endTime AS startEndTime,
-		sAddr.postal AS sPostal,
-		sAddr.geoCoder AS sGeoCoder,
-		sAddr.city AS sCity,
-		sAddr.street AS sStreet,
-		sAddr.HouseNumber AS sHouseNumber,
+		IFNULL(sAddr.postal,'') AS sPostal,
+		IFNULL(sAddr.geoCoder,'') AS sGeoCoder,
+		IFNULL(sAddr.city,'') AS sCity,
+		IFNULL(sAddr.street,'') AS sStreet,
+		IFNULL(sAddr.HouseNumber,'') AS sHouseNumber,
 		(SELECT GROUP_CONCAT(_contactId) FROM NoKeyPoint_GeoFenceRegion_Contact NKGC WHERE NKGC.keyPointId=skp._keyPointId) AS sContacts,
 		ekp._keyPointId AS eId,
 		ekp.startTime AS endTime,
@@ -1060,15 +1217,27 @@ func GetTrackById(db *sql.DB, trackId int64) (track Track, err error) {
 		ekp.longitude AS endLng,
 		ekp.startTime AS endStartTime,
 		ekp.endTime AS endEndTime,
-		eAddr.postal AS ePostal,
-		eAddr.geoCoder AS eGeoCoder,
-		eAddr.city AS eCity,
-		eAddr.street AS eStreet,
-		eAddr.HouseNumber AS eHouseNumber,
+		IFNULL(eAddr.postal,'') AS ePostal,
+		IFNULL(eAddr.geoCoder,'') AS eGeoCoder,
+		IFNULL(eAddr.city,'') AS eCity,
+		IFNULL(eAddr.street,'') AS eStreet,
+		IFNULL(eAddr.HouseNumber,'') AS eHouseNumber,
 		(SELECT GROUP_CONCAT(_contactId) FROM NoKeyPoint_GeoFenceRegion_Contact NKGC WHERE NKGC.keyPointId=ekp._keyPointId) AS eContacts,
 		t.startKeyPointId,
 		t.endKeyPointId,
 		t.distance,
+		t.matchedDistance,
+		t.dataQuality,
+		t.maxSpeed,
+		t.avgMovingSpeed,
+		t.medianSpeed,
+		t.movingTime,
+		t.ascent,
+		t.descent,
+		t.minAltitude,
+		t.maxAltitude,
+		t.transportMode,
+		t.fusedIntoTrackId,
 		t.deviceId
 		FROM tracks AS t
 		LEFT JOIN keyPoints AS skp ON skp._keyPointId = t.startKeyPointId
@@ -1102,19 +1271,44 @@ func GetTrackById(db *sql.DB, trackId int64) (track Track, err error) {
 		&track.EndKeyPointInfo.MatchingContactids,
 		&track.StartKeyPointId,
 		&track.EndKeyPointId,
-		&track.Distance, &track.DeviceId)
+		&track.Distance, &track.MatchedDistance, &track.DataQuality,
+		&track.MaxSpeed, &track.AvgMovingSpeed, &track.MedianSpeed, &track.MovingTime,
+		&track.Ascent, &track.Descent, &track.MinAltitude, &track.MaxAltitude,
+		&track.TransportMode, &track.FusedIntoTrackId, &track.DeviceId)
 
 	if err != nil {
 		dbg.E(TAG, "getTrackById: Failed to get trackData for %d from DB...", trackId, err)
 
 		return Track{}, err
 	}
+	if track.DataQuality != DataQualityOk {
+		track.Gaps, err = GetTrackGapsForTrack(db, trackId)
+		if err != nil {
+			return Track{}, err
+		}
+	}
+	track.SpeedingEvents, err = GetSpeedingEventsForTrack(db, trackId)
+	if err != nil {
+		return Track{}, err
+	}
+	track.HarshEvents, err = GetHarshEventsForTrack(db, trackId)
+	if err != nil {
+		return Track{}, err
+	}
+	track.ElevationProfile, err = GetElevationProfileForTrack(db, trackId)
+	if err != nil {
+		return Track{}, err
+	}
+	track.DeviceIds, err = GetDeviceIdsForTrack(db, trackId)
+	if err != nil {
+		return Track{}, err
+	}
 	dbg.I(TAG, "End GetTrackById for %d", trackId)
 	return track, nil
 }
 
 // GetTrackPointsForTrack returns trackPoints for the track with the given ID.
-func GetTrackPointsForTrack(db *sql.DB, trackId int64) (*[]S.TrackPoint, error) {
+func GetTrackPointsForTrack(db tools.DbRunner, trackId int64) (*[]S.TrackPoint, error) {
 	var tp S.TrackPoint
 	tps := make([]S.TrackPoint, 0)
 
@@ -1144,3 +1338,158 @@ func GetTrackPointsForTrack(db *sql.DB, trackId int64) (*[]S.TrackPoint, error)
 	}
 	return &tps, nil
 }
+
+// GetMatchedTrackPointsForTrack returns the geometry of the track with the given ID matched to the road graph.
+// Returns an empty list if the track has not been map matched.
+func GetMatchedTrackPointsForTrack(db *sql.DB, trackId int64) (*[]S.MatchedTrackPoint, error) {
+	var mtp S.MatchedTrackPoint
+	mtps := make([]S.MatchedTrackPoint, 0)
+
+	rows, err := db.Query("SELECT _matchedTrackPointId, trackId, seq, latitude, longitude, trackPointId, wayId FROM `MatchedTrackPoints` WHERE (trackId=?) ORDER BY seq ASC", trackId)
+	if err != nil {
+		dbg.E(TAG, "failed to get rows from MatchedTrackPoints", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		mtp = S.MatchedTrackPoint{}
+		err = rows.Scan(&mtp.MatchedTrackPointId, &mtp.TrackId, &mtp.Seq, &mtp.Latitude,
+			&mtp.Longitude, &mtp.TrackPointId, &mtp.WayId)
+		if err != nil {
+			dbg.E(TAG, "failed to get rows from MatchedTrackPoints", err)
+			return nil, err
+		}
+		mtps = append(mtps, mtp)
+	}
+
+	if err = rows.Err(); err != nil {
+		dbg.E(TAG, "GetMatchedTrackPointsForTrack %d rows-iteration-Error", trackId, err)
+		return nil, err
+	}
+	return &mtps, nil
+}
+
+// GetTrackGapsForTrack returns the gaps in the GPS data of the track with the given ID.
+func GetTrackGapsForTrack(db *sql.DB, trackId int64) (gaps []*TrackGap, err error) {
+	gaps = make([]*TrackGap, 0)
+	rows, err := db.Query(`SELECT startTime, endTime, startLatitude, startLongitude, endLatitude, endLongitude, distance, kind
+		FROM TrackGaps WHERE trackId=? ORDER BY startTime ASC`, trackId)
+	if err != nil {
+		dbg.E(TAG, "failed to get rows from TrackGaps", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		g := &TrackGap{}
+		var kind S.NString
+		err = rows.Scan(&g.StartTime, &g.EndTime, &g.StartLat, &g.StartLng, &g.EndLat, &g.EndLng, &g.Distance, &kind)
+		if err != nil {
+			dbg.E(TAG, "failed to scan TrackGap for track %d", trackId, err)
+			return
+		}
+		g.Kind = string(kind)
+		gaps = append(gaps, g)
+	}
+	err = rows.Err()
+	if err != nil {
+		dbg.E(TAG, "GetTrackGapsForTrack %d rows-iteration-Error", trackId, err)
+	}
+	return
+}
+
+// GetSpeedingEventsForTrack returns the times the speed limit was exceeded on the track with the given ID.
+func GetSpeedingEventsForTrack(db *sql.DB, trackId int64) (events []*SpeedingEvent, err error) {
+	events = make([]*SpeedingEvent, 0)
+	rows, err := db.Query(`SELECT startTime, endTime, peakSpeed, latitude, longitude, threshold
+		FROM SpeedingEvents WHERE trackId=? ORDER BY startTime ASC`, trackId)
+	if err != nil {
+		dbg.E(TAG, "failed to get rows from SpeedingEvents", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := &SpeedingEvent{}
+		err = rows.Scan(&e.StartTime, &e.EndTime, &e.PeakSpeed, &e.Lat, &e.Lng, &e.Threshold)
+		if err != nil {
+			dbg.E(TAG, "failed to scan SpeedingEvent for track %d", trackId, err)
+			return
+		}
+		events = append(events, e)
+	}
+	err = rows.Err()
+	if err != nil {
+		dbg.E(TAG, "GetSpeedingEventsForTrack %d rows-iteration-Error", trackId, err)
+	}
+	return
+}
+
+// GetElevationProfileForTrack returns the downsampled elevation profile of the track with the given ID.
+func GetElevationProfileForTrack(db *sql.DB, trackId int64) (profile []*ElevationPoint, err error) {
+	profile = make([]*ElevationPoint, 0)
+	rows, err := db.Query(`SELECT timeMillis, distance, altitude FROM ElevationProfiles WHERE trackId=? ORDER BY seq ASC`, trackId)
+	if err != nil {
+		dbg.E(TAG, "failed to get rows from ElevationProfiles", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := &ElevationPoint{}
+		err = rows.Scan(&p.Time, &p.Distance, &p.Altitude)
+		if err != nil {
+			dbg.E(TAG, "failed to scan ElevationPoint for track %d", trackId, err)
+			return
+		}
+		profile = append(profile, p)
+	}
+	err = rows.Err()
+	if err != nil {
+		dbg.E(TAG, "GetElevationProfileForTrack %d rows-iteration-Error", trackId, err)
+	}
+	return
+}
+
+// GetDeviceIdsForTrack returns the devices whose GPS data got fused into the track with the given ID,
+// empty if it was recorded by a single device.
+func GetDeviceIdsForTrack(db tools.DbRunner, trackId int64) (deviceIds []int64, err error) {
+	deviceIds = make([]int64, 0)
+	rows, err := db.Query(`SELECT deviceId FROM TrackDevices WHERE trackId=? ORDER BY deviceId ASC`, trackId)
+	if err != nil {
+		dbg.E(TAG, "failed to get rows from TrackDevices", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var deviceId int64
+		err = rows.Scan(&deviceId)
+		if err != nil {
+			dbg.E(TAG, "failed to scan TrackDevice for track %d", trackId, err)
+			return
+		}
+		deviceIds = append(deviceIds, deviceId)
+	}
+	err = rows.Err()
+	if err != nil {
+		dbg.E(TAG, "GetDeviceIdsForTrack %d rows-iteration-Error", trackId, err)
+	}
+	return
+}
+
+// tripElevationProfile joins the elevation profiles of the given tracks, continuing the distance.
+func tripElevationProfile(tracks []*Track) (profile []*ElevationPoint) {
+	profile = make([]*ElevationPoint, 0)
+	var offset float64
+	for _, t := range tracks {
+		for _, p := range t.ElevationProfile {
+			profile = append(profile, &ElevationPoint{Time: p.Time, Distance: offset + p.Distance, Altitude: p.Altitude})
+		}
+		if len(t.ElevationProfile) != 0 {
+			offset += t.ElevationProfile[len(t.ElevationProfile)-1].Distance
+		}
+	}
+	return
+}
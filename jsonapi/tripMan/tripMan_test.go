@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"encoding/json"
 	"math"
+	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -12,8 +14,11 @@ import (
 
 	"github.com/OpenDriversLog/goodl-lib/dbMan"
 	"github.com/OpenDriversLog/goodl-lib/jsonapi"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/periodManager"
 	"github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan"
 	m "github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan/models"
+	S "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	geo "github.com/OpenDriversLog/goodl-lib/models/geo"
 
 	"github.com/OpenDriversLog/goodl-lib/translate"
 )
@@ -253,4 +258,656 @@ INSERT INTO Tracks_Trips (tripId, trackId) VALUES (?,238)`, id)
 		})
 	})
 
+	Describe("SuggestMerges", func() {
+		const minute = int64(60 * 1000)
+		trip := func(id int64, start int64, end int64, endKeyPointId int64) *m.Trip {
+			return &m.Trip{Id: id, TrackIdInts: []int64{id * 10}, DeviceId: 1, DriverId: 1, Type: tripMan.PRIVATE,
+				StartTime: S.NInt64(start * minute), EndTime: S.NInt64(end * minute), EndKeyPointId: S.NInt64(endKeyPointId)}
+		}
+
+		It("should rank fuel stops above other short stops", func() {
+			trips := []*m.Trip{trip(3, 100, 130, 3), trip(1, 0, 30, 1), trip(2, 40, 90, 2), trip(4, 135, 150, 4)}
+			suggestions := tripMan.SuggestMerges(trips, map[int64]bool{3: true})
+			Expect(suggestions).To(HaveLen(3))
+			Expect(suggestions[0].TripIds).To(Equal([]int64{3, 4}))
+			Expect(suggestions[0].TrackIds).To(Equal([]int64{30, 40}))
+			Expect(suggestions[0].Reasons).To(ContainElement(m.MergeReasonFuelStop))
+			Expect(suggestions[0].Reasons).To(ContainElement(m.MergeReasonShortStop))
+			Expect(suggestions[1].TripIds).To(Equal([]int64{1, 2}))
+			Expect(suggestions[2].TripIds).To(Equal([]int64{2, 3}))
+		})
+
+		It("should not suggest long stops, reviewed trips or likely visits of contacts", func() {
+			long := []*m.Trip{trip(1, 0, 30, 1), trip(2, 151, 180, 2)}
+			Expect(tripMan.SuggestMerges(long, nil)).To(BeEmpty())
+
+			reviewed := []*m.Trip{trip(1, 0, 30, 1), trip(2, 40, 90, 2)}
+			reviewed[1].Reviewed = 1
+			Expect(tripMan.SuggestMerges(reviewed, nil)).To(BeEmpty())
+
+			visit := []*m.Trip{trip(1, 0, 30, 1), trip(2, 90, 120, 2)}
+			visit[0].EndContactId = 5
+			Expect(tripMan.SuggestMerges(visit, nil)).To(BeEmpty())
+			visit[0].EndContactId = 0
+			Expect(tripMan.SuggestMerges(visit, nil)).To(HaveLen(1))
+		})
+
+		It("should measure the stop like merging does", func() {
+			// a stop of exactly MaxMergeStopDuration can still be merged
+			fuel := []*m.Trip{trip(1, 0, 30, 1), trip(2, 150, 180, 2)}
+			Expect(tripMan.SuggestMerges(fuel, map[int64]bool{1: true})).To(HaveLen(1))
+			fuel[1].StartTime++
+			Expect(tripMan.SuggestMerges(fuel, map[int64]bool{1: true})).To(BeEmpty())
+		})
+	})
+
+	Describe("GetMergeSuggestions", func() {
+		const minute = int64(60 * 1000)
+		var carId, deviceId int64
+		var tripIds []int64
+		insert := func(q string, args ...interface{}) int64 {
+			res, err := dbCon.Exec(q, args...)
+			Expect(err).To(BeNil())
+			id, _ := res.LastInsertId()
+			return id
+		}
+
+		BeforeEach(func() {
+			carId = insert("INSERT INTO Cars (type, plate) VALUES ('Mergetest', 'DD-MS 43')")
+			deviceId = insert("INSERT INTO Devices (desc, colorId, carId) VALUES ('Mergetest', 1, ?)", carId)
+			// two trips with a stop of 10 minutes in between
+			kps := make([]int64, 3)
+			for i := range kps {
+				t := int64(i) * 40 * minute
+				kps[i] = insert("INSERT INTO KeyPoints (latitude, longitude, startTime, endTime, deviceId, carId) VALUES (51.05, 13.73, ?, ?, ?, ?)",
+					t, t+10*minute, deviceId, carId)
+			}
+			tripIds = make([]int64, 0)
+			for i := 0; i < 2; i++ {
+				trackId := insert("INSERT INTO Tracks (deviceId, startKeyPointId, endKeyPointId, distance, carId) VALUES (?,?,?,1000,?)",
+					deviceId, kps[i], kps[i+1], carId)
+				tripId := insert("INSERT INTO Trips (type, title) VALUES (?, 'Mergetest')", tripMan.PRIVATE)
+				insert("INSERT INTO Tracks_Trips (trackId, tripId) VALUES (?,?)", trackId, tripId)
+				tripIds = append(tripIds, tripId)
+			}
+		})
+
+		AfterEach(func() {
+			dbCon.Exec("DELETE FROM ClosedPeriods WHERE carId=?", carId)
+			for _, tripId := range tripIds {
+				dbCon.Exec("DELETE FROM Tracks_Trips WHERE tripId=?", tripId)
+				dbCon.Exec("DELETE FROM Trips WHERE _tripId=?", tripId)
+			}
+			dbCon.Exec("DELETE FROM Tracks WHERE carId=?", carId)
+			dbCon.Exec("DELETE FROM KeyPoints WHERE carId=?", carId)
+			dbCon.Exec("DELETE FROM Devices WHERE _deviceId=?", deviceId)
+			dbCon.Exec("DELETE FROM Cars WHERE _carId=?", carId)
+		})
+
+		It("should leave out trips in closed periods", func() {
+			suggestions, err := tripMan.GetMergeSuggestions(0, 120*minute, []interface{}{deviceId}, nil, T, dbCon)
+			Expect(err).To(BeNil())
+			Expect(suggestions).To(HaveLen(1))
+			Expect(suggestions[0].TripIds).To(Equal(tripIds))
+
+			_, err = periodManager.ClosePeriod(carId, 0, 45*minute, "test", 1, dbCon)
+			Expect(err).To(BeNil())
+			suggestions, err = tripMan.GetMergeSuggestions(0, 120*minute, []interface{}{deviceId}, nil, T, dbCon)
+			Expect(err).To(BeNil())
+			Expect(suggestions).To(BeEmpty())
+		})
+	})
+
+	Describe("EvaluateTripRules", func() {
+		// monday morning
+		start := time.Date(2016, 5, 2, 7, 30, 0, 0, time.Local).UnixNano() / int64(time.Millisecond)
+		facts := func() *m.TripRuleFacts {
+			return &m.TripRuleFacts{TripId: 1, Type: tripMan.PRIVATE, StartContactId: 2, EndContactId: 3,
+				EndGeoZoneIds: []int64{7}, StartTime: start, DeviceId: 1, CarId: 4, DriverId: 5, Distance: 12000}
+		}
+
+		It("should match weekdays, time windows, contacts, geozones and distances", func() {
+			commute := &m.TripRule{Id: 1, StartContactId: 2, EndGeoZoneId: 7, Weekdays: 62, StartMinute: 6 * 60,
+				EndMinute: 9 * 60, MaxDistance: 20000}
+			Expect(tripMan.MatchesTripRule(commute, facts())).To(BeTrue())
+
+			weekend := *commute
+			weekend.Weekdays = 65
+			Expect(tripMan.MatchesTripRule(&weekend, facts())).To(BeFalse())
+
+			night := *commute
+			night.StartMinute, night.EndMinute = 22*60, 7*60
+			Expect(tripMan.MatchesTripRule(&night, facts())).To(BeFalse())
+			night.EndMinute = 8 * 60
+			Expect(tripMan.MatchesTripRule(&night, facts())).To(BeTrue())
+
+			long := *commute
+			long.MinDistance = 50000
+			Expect(tripMan.MatchesTripRule(&long, facts())).To(BeFalse())
+
+			otherZone := *commute
+			otherZone.EndGeoZoneId = 8
+			Expect(tripMan.MatchesTripRule(&otherZone, facts())).To(BeFalse())
+
+			commute.Disabled = 1
+			Expect(tripMan.MatchesTripRule(commute, facts())).To(BeFalse())
+		})
+
+		It("should let the highest priority win per field and explain the result", func() {
+			rules := []*m.TripRule{
+				{Id: 1, Title: "car", CarId: 4, SetType: tripMan.BUSINESS, SetDriverId: 6},
+				{Id: 2, Title: "commute", Priority: 10, EndContactId: 3, SetType: tripMan.COMMUTING, SetTitle: "Work"},
+				{Id: 3, Title: "other device", DeviceId: 9, SetTitle: "Other"},
+			}
+			res := tripMan.EvaluateTripRules(rules, facts(), nil)
+			Expect(res.Changes).To(Equal(map[string]interface{}{"type": int64(tripMan.COMMUTING), "title": S.NString("Work"), "driverId": int64(6)}))
+			Expect(res.RuleIds).To(Equal([]int64{2, 1}))
+			Expect(res.Explanation).To(Equal(`Rule "commute" (#2): type, title; Rule "car" (#1): driverId`))
+
+			res = tripMan.EvaluateTripRules(rules, facts(), map[string]bool{"type": true, "driverId": true})
+			Expect(res.Changes).To(Equal(map[string]interface{}{"title": S.NString("Work")}))
+
+			f := facts()
+			f.Type = tripMan.COMMUTING
+			res = tripMan.EvaluateTripRules(rules, f, nil)
+			Expect(res.Changes).NotTo(HaveKey("type"))
+		})
+	})
+
+	Describe("DetectHomeAndWork", func() {
+		millis := func(day int, hour int) int64 {
+			return time.Date(2016, 5, day, hour, 0, 0, 0, time.Local).UnixNano() / int64(time.Millisecond)
+		}
+		home := []float64{50.8300, 12.9200}
+		work := []float64{50.8500, 12.9500}
+		shop := []float64{50.8400, 12.9300}
+
+		It("should propose the place of the nights as home and the place of the working hours as workplace", func() {
+			stays := make([]*m.PlaceStay, 0)
+			// monday 2nd to friday 6th of May 2016
+			for day := 2; day <= 6; day++ {
+				stays = append(stays, &m.PlaceStay{Latitude: home[0], Longitude: home[1], StartTime: millis(day-1, 18), EndTime: millis(day, 7)})
+				stays = append(stays, &m.PlaceStay{Latitude: work[0] + 0.0005, Longitude: work[1], StartTime: millis(day, 8), EndTime: millis(day, 17)})
+				stays = append(stays, &m.PlaceStay{Latitude: shop[0], Longitude: shop[1], StartTime: millis(day, 17), EndTime: millis(day, 18)})
+			}
+			proposal := tripMan.DetectHomeAndWork(stays)
+			Expect(proposal.Home).NotTo(BeNil())
+			Expect(proposal.Home.Latitude).To(BeNumerically("~", home[0], 0.0001))
+			Expect(proposal.Home.Days).To(Equal(5))
+			Expect(proposal.Work).NotTo(BeNil())
+			Expect(proposal.Work.Latitude).To(BeNumerically("~", work[0]+0.0005, 0.0001))
+			Expect(proposal.Work.Days).To(Equal(5))
+			Expect(proposal.Work.DwellTime).To(Equal(5 * 8 * 60 * 60 * int64(1000)))
+		})
+
+		It("should not propose places visited too rarely", func() {
+			stays := []*m.PlaceStay{
+				{Latitude: home[0], Longitude: home[1], StartTime: millis(1, 18), EndTime: millis(2, 7)},
+				{Latitude: work[0], Longitude: work[1], StartTime: millis(2, 8), EndTime: millis(2, 17)},
+				// saturday
+				{Latitude: work[0], Longitude: work[1], StartTime: millis(7, 8), EndTime: millis(7, 17)},
+			}
+			proposal := tripMan.DetectHomeAndWork(stays)
+			Expect(proposal.Home).To(BeNil())
+			Expect(proposal.Work).To(BeNil())
+		})
+	})
+
+	Describe("ConfirmHomeAndWork", func() {
+		home := &m.PlaceCandidate{Latitude: 10.5, Longitude: 20.5, Title: "Commutetest home"}
+		work := &m.PlaceCandidate{Latitude: 10.6, Longitude: 20.6, Title: "Commutetest work"}
+		var deviceId int64
+		var tripIds []int64
+
+		count := func(table string) (c int) {
+			err := dbCon.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&c)
+			Expect(err).To(BeNil())
+			return
+		}
+		tripType := func(tripId int64) (t int) {
+			err := dbCon.QueryRow("SELECT type FROM Trips WHERE _tripId=?", tripId).Scan(&t)
+			Expect(err).To(BeNil())
+			return
+		}
+
+		BeforeEach(func() {
+			res, err := dbCon.Exec("INSERT INTO Devices (desc, colorId) VALUES ('Commutetest', 1)")
+			Expect(err).To(BeNil())
+			deviceId, _ = res.LastInsertId()
+			tripIds = make([]int64, 0)
+			for i := int64(0); i < 2; i++ {
+				t := 1462168800000 + i*86400000
+				res, err = dbCon.Exec("INSERT INTO KeyPoints (latitude, longitude, startTime, endTime, deviceId) VALUES (?,?,?,?,?)", home.Latitude, home.Longitude, t-3600000, t, deviceId)
+				Expect(err).To(BeNil())
+				startKp, _ := res.LastInsertId()
+				res, err = dbCon.Exec("INSERT INTO KeyPoints (latitude, longitude, startTime, endTime, deviceId) VALUES (?,?,?,?,?)", work.Latitude, work.Longitude, t+1800000, t+3600000, deviceId)
+				Expect(err).To(BeNil())
+				endKp, _ := res.LastInsertId()
+				res, err = dbCon.Exec("INSERT INTO Tracks (deviceId, startKeyPointId, endKeyPointId, distance) VALUES (?,?,?,15000)", deviceId, startKp, endKp)
+				Expect(err).To(BeNil())
+				trackId, _ := res.LastInsertId()
+				res, err = dbCon.Exec("INSERT INTO Trips (type, title, desc) VALUES (?, 'commutetest', '')", tripMan.PRIVATE)
+				Expect(err).To(BeNil())
+				tripId, _ := res.LastInsertId()
+				_, err = dbCon.Exec("INSERT INTO Tracks_Trips (trackId, tripId) VALUES (?,?)", trackId, tripId)
+				Expect(err).To(BeNil())
+				tripIds = append(tripIds, tripId)
+			}
+		})
+
+		AfterEach(func() {
+			for _, q := range []string{
+				"DELETE FROM TripRuleApplications WHERE tripId IN (SELECT _tripId FROM Trips WHERE title='commutetest')",
+				"DELETE FROM TripRules WHERE title LIKE 'Commutetest %'",
+				"DELETE FROM Trip_History WHERE tripId IN (SELECT _tripId FROM Trips WHERE title='commutetest')",
+				"DELETE FROM Tracks_Trips WHERE tripId IN (SELECT _tripId FROM Trips WHERE title='commutetest')",
+				"DELETE FROM Trips WHERE title='commutetest'",
+				"DELETE FROM KeyPoints_GeoFenceRegions WHERE keyPointId IN (SELECT _keyPointId FROM KeyPoints WHERE deviceId=?)",
+				"DELETE FROM Tracks WHERE deviceId=?",
+				"DELETE FROM KeyPoints WHERE deviceId=?",
+				"DELETE FROM Contacts WHERE title LIKE 'Commutetest %'",
+				"DELETE FROM Addresses WHERE title LIKE 'Commutetest %'",
+				"DELETE FROM Devices WHERE _deviceId=?",
+			} {
+				args := []interface{}{}
+				if strings.Contains(q, "?") {
+					args = append(args, deviceId)
+				}
+				_, err := dbCon.Exec(q, args...)
+				Expect(err).To(BeNil())
+			}
+		})
+
+		It("should not overwrite the type of trips changed before", func() {
+			_, err := dbCon.Exec("UPDATE Trips SET type=? WHERE _tripId=?", tripMan.BUSINESS, tripIds[1])
+			Expect(err).To(BeNil())
+
+			setup, err := tripMan.ConfirmHomeAndWork(home, work, dbCon)
+			Expect(err).To(BeNil())
+			Expect(setup.TripRuleIds).To(HaveLen(2))
+			Expect(setup.ClassifiedTripIds).To(ContainElement(tripIds[0]))
+			Expect(setup.ClassifiedTripIds).NotTo(ContainElement(tripIds[1]))
+			Expect(tripType(tripIds[0])).To(Equal(tripMan.COMMUTING))
+			Expect(tripType(tripIds[1])).To(Equal(tripMan.BUSINESS))
+		})
+
+		It("should create nothing if there is no GeoZone for a place", func() {
+			contacts, rules := count("Contacts"), count("TripRules")
+			_, err := tripMan.ConfirmHomeAndWork(home, &m.PlaceCandidate{Title: "Commutetest nowhere"}, dbCon)
+			Expect(err).To(Equal(tripMan.ErrMissingPlaceGeoZone))
+			Expect(count("Contacts")).To(Equal(contacts))
+			Expect(count("TripRules")).To(Equal(rules))
+			Expect(tripType(tripIds[0])).To(Equal(tripMan.PRIVATE))
+		})
+	})
+
+	Describe("CountCommuteDays", func() {
+		It("should count days with commuting trips per month", func() {
+			at := func(month time.Month, day int, hour int) int64 {
+				return time.Date(2016, month, day, hour, 0, 0, 0, time.Local).UnixNano() / int64(time.Millisecond)
+			}
+			months := tripMan.CountCommuteDays([]int64{at(6, 1, 7), at(5, 2, 7), at(5, 2, 17), at(5, 3, 7), at(6, 1, 17)})
+			Expect(months).To(HaveLen(2))
+			Expect(*months[0]).To(Equal(m.CommuteMonth{Month: "2016-05", Days: 2, Trips: 3}))
+			Expect(*months[1]).To(Equal(m.CommuteMonth{Month: "2016-06", Days: 1, Trips: 2}))
+		})
+	})
+
+	Describe("GetCommuteDays", func() {
+		const deviceId = int64(9046)
+		var tripId int64
+		at := func(day int, hour int, minute int) int64 {
+			return time.Date(2016, 5, day, hour, minute, 0, 0, time.Local).UnixNano() / int64(time.Millisecond)
+		}
+		insert := func(q string, args ...interface{}) int64 {
+			res, err := dbCon.Exec(q, args...)
+			Expect(err).To(BeNil())
+			id, _ := res.LastInsertId()
+			return id
+		}
+
+		BeforeEach(func() {
+			// one commuting trip of two tracks with a stop at the bakery
+			kps := make([]int64, 3)
+			for i := range kps {
+				kps[i] = insert("INSERT INTO KeyPoints (latitude, longitude, startTime, endTime, deviceId) VALUES(50.83,12.92,?,?,?)",
+					at(2, 7, i*20), at(2, 7, i*20+5), deviceId)
+			}
+			tripId = insert("INSERT INTO Trips (type) VALUES(?)", tripMan.COMMUTING)
+			for i := 0; i < 2; i++ {
+				trackId := insert("INSERT INTO Tracks (deviceId, startKeyPointId, endKeyPointId, distance) VALUES(?,?,?,1000)", deviceId, kps[i], kps[i+1])
+				insert("INSERT INTO Tracks_Trips (trackId, tripId) VALUES(?,?)", trackId, tripId)
+			}
+		})
+
+		AfterEach(func() {
+			dbCon.Exec("DELETE FROM Tracks_Trips WHERE tripId=?", tripId)
+			dbCon.Exec("DELETE FROM Trips WHERE _tripId=?", tripId)
+			dbCon.Exec("DELETE FROM Tracks WHERE deviceId=?", deviceId)
+			dbCon.Exec("DELETE FROM KeyPoints WHERE deviceId=?", deviceId)
+		})
+
+		It("should count a trip of several tracks once", func() {
+			months, err := tripMan.GetCommuteDays(at(1, 0, 0), at(31, 0, 0), []interface{}{deviceId}, dbCon)
+			Expect(err).To(BeNil())
+			Expect(months).To(HaveLen(1))
+			Expect(*months[0]).To(Equal(m.CommuteMonth{Month: "2016-05", Days: 1, Trips: 1}))
+
+			months, err = tripMan.GetCommuteDays(at(2, 7, 10), at(31, 0, 0), []interface{}{deviceId}, dbCon)
+			Expect(err).To(BeNil())
+			Expect(months).To(BeEmpty())
+		})
+	})
+
+	Describe("trip speed & elevation", func() {
+		var deviceId, tripId int64
+		var trackIds []int64
+
+		BeforeEach(func() {
+			res, err := dbCon.Exec("INSERT INTO Devices (desc, colorId) VALUES ('Tripstatstest', 1)")
+			Expect(err).To(BeNil())
+			deviceId, _ = res.LastInsertId()
+			res, err = dbCon.Exec("INSERT INTO Trips (type, title, desc) VALUES (?, 'tripstatstest', '')", tripMan.PRIVATE)
+			Expect(err).To(BeNil())
+			tripId, _ = res.LastInsertId()
+			trackIds = make([]int64, 0)
+			// maxSpeed, avgMovingSpeed, medianSpeed, movingTime, ascent, minAltitude, maxAltitude
+			for i, stats := range [][]float64{{100, 60, 50, 3600000, 20, 100, 150}, {140, 90, 80, 1200000, 40, 120, 200}} {
+				t := 1462168800000 + int64(i)*7200000
+				res, err = dbCon.Exec("INSERT INTO KeyPoints (latitude, longitude, startTime, endTime, deviceId) VALUES (10.5,20.5,?,?,?)", t-60000, t, deviceId)
+				Expect(err).To(BeNil())
+				startKp, _ := res.LastInsertId()
+				res, err = dbCon.Exec("INSERT INTO KeyPoints (latitude, longitude, startTime, endTime, deviceId) VALUES (10.6,20.6,?,?,?)", t+3600000, t+3660000, deviceId)
+				Expect(err).To(BeNil())
+				endKp, _ := res.LastInsertId()
+				res, err = dbCon.Exec(`INSERT INTO Tracks (deviceId, startKeyPointId, endKeyPointId, distance, maxSpeed, avgMovingSpeed,
+					medianSpeed, movingTime, ascent, descent, minAltitude, maxAltitude) VALUES (?,?,?,1000,?,?,?,?,?,0,?,?)`,
+					deviceId, startKp, endKp, stats[0], stats[1], stats[2], stats[3], stats[4], stats[5], stats[6])
+				Expect(err).To(BeNil())
+				trackId, _ := res.LastInsertId()
+				trackIds = append(trackIds, trackId)
+				_, err = dbCon.Exec("INSERT INTO Tracks_Trips (trackId, tripId) VALUES (?,?)", trackId, tripId)
+				Expect(err).To(BeNil())
+			}
+			_, err = dbCon.Exec("INSERT INTO SpeedingEvents (trackId, startTime, endTime, peakSpeed, threshold) VALUES (?,0,0,140,130)", trackIds[1])
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			for _, q := range []string{
+				"DELETE FROM SpeedingEvents WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?)",
+				"DELETE FROM Trip_History WHERE tripId IN (SELECT tripId FROM Tracks_Trips WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?))",
+				"DELETE FROM Trips WHERE _tripId IN (SELECT tripId FROM Tracks_Trips WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?))",
+				"DELETE FROM Tracks_Trips WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?)",
+				"DELETE FROM Tracks WHERE deviceId=?",
+				"DELETE FROM KeyPoints WHERE deviceId=?",
+				"DELETE FROM Devices WHERE _deviceId=?",
+			} {
+				_, err := dbCon.Exec(q, deviceId)
+				Expect(err).To(BeNil())
+			}
+		})
+
+		It("should be calculated over all tracks of the trip", func() {
+			trip, err := tripMan.GetTrip(tripId, false, false, false, nil, T, false, dbCon)
+			Expect(err).To(BeNil())
+			Expect(float64(trip.MaxSpeed)).To(Equal(140.0))
+			Expect(float64(trip.AvgMovingSpeed)).To(BeNumerically("~", 67.5, 0.001))
+			Expect(float64(trip.WeightedMedianSpeed)).To(BeNumerically("~", 57.5, 0.001))
+			Expect(int64(trip.MovingTime)).To(Equal(int64(4800000)))
+			Expect(int64(trip.SpeedingEvents)).To(Equal(int64(1)))
+			Expect(float64(trip.Ascent)).To(Equal(60.0))
+			Expect(float64(trip.MinAltitude)).To(Equal(100.0))
+			Expect(float64(trip.MaxAltitude)).To(Equal(200.0))
+		})
+
+		It("should follow changes of the tracks", func() {
+			_, err := dbCon.Exec("UPDATE Tracks SET maxSpeed=180, maxAltitude=250 WHERE _trackId=?", trackIds[0])
+			Expect(err).To(BeNil())
+			_, err = dbCon.Exec("DELETE FROM SpeedingEvents WHERE trackId=?", trackIds[1])
+			Expect(err).To(BeNil())
+			trip, err := tripMan.GetTrip(tripId, false, false, false, nil, T, false, dbCon)
+			Expect(err).To(BeNil())
+			Expect(float64(trip.MaxSpeed)).To(Equal(180.0))
+			Expect(float64(trip.MaxAltitude)).To(Equal(250.0))
+			Expect(int64(trip.SpeedingEvents)).To(Equal(int64(0)))
+
+			_, err = dbCon.Exec("DELETE FROM Tracks_Trips WHERE trackId=?", trackIds[1])
+			Expect(err).To(BeNil())
+			trip, err = tripMan.GetTrip(tripId, false, false, false, nil, T, false, dbCon)
+			Expect(err).To(BeNil())
+			Expect(float64(trip.AvgMovingSpeed)).To(Equal(60.0))
+			Expect(float64(trip.Ascent)).To(Equal(20.0))
+		})
+	})
+
+	Describe("GetDriverSafetyScores", func() {
+		const deviceId = int64(9047)
+		var driverIds, tripIds []int64
+		insert := func(q string, args ...interface{}) int64 {
+			res, err := dbCon.Exec(q, args...)
+			Expect(err).To(BeNil())
+			id, _ := res.LastInsertId()
+			return id
+		}
+
+		BeforeEach(func() {
+			driverIds, tripIds = make([]int64, 0), make([]int64, 0)
+			// a long trip with two harsh brakings and a short one with a harsh acceleration
+			for i, drive := range []struct {
+				meters   int
+				kind     string
+				severity []float64
+			}{
+				{250000, geo.HarshBraking, []float64{1.5, 1.5}},
+				{10000, geo.HarshAcceleration, []float64{1}},
+			} {
+				start := int64(1000000 + i*100000)
+				driverId := insert("INSERT INTO Drivers (name) VALUES ('Sicherheitstest')")
+				sKp := insert("INSERT INTO KeyPoints (latitude, longitude, startTime, endTime, deviceId) VALUES(50.83,12.92,?,?,?)", start, start+10, deviceId)
+				eKp := insert("INSERT INTO KeyPoints (latitude, longitude, startTime, endTime, deviceId) VALUES(50.83,12.92,?,?,?)", start+5000, start+6000, deviceId)
+				trackId := insert("INSERT INTO Tracks (deviceId, startKeyPointId, endKeyPointId, distance) VALUES(?,?,?,?)", deviceId, sKp, eKp, drive.meters)
+				tripId := insert("INSERT INTO Trips (type, driverId) VALUES(?,?)", tripMan.BUSINESS, driverId)
+				insert("INSERT INTO Tracks_Trips (trackId, tripId) VALUES(?,?)", trackId, tripId)
+				for j, severity := range drive.severity {
+					insert(`INSERT INTO HarshEvents (trackId, startTime, endTime, kind, peakAcceleration, latitude, longitude, speed, severity)
+						VALUES(?,?,?,?,?,50.83,12.92,50,?)`, trackId, start+int64(100*(j+1)), start+int64(100*(j+1)+50), drive.kind, 3*severity, severity)
+				}
+				driverIds = append(driverIds, driverId)
+				tripIds = append(tripIds, tripId)
+			}
+		})
+
+		AfterEach(func() {
+			for _, tripId := range tripIds {
+				dbCon.Exec("DELETE FROM Tracks_Trips WHERE tripId=?", tripId)
+				dbCon.Exec("DELETE FROM Trips WHERE _tripId=?", tripId)
+			}
+			dbCon.Exec("DELETE FROM HarshEvents WHERE trackId IN (SELECT _trackId FROM Tracks WHERE deviceId=?)", deviceId)
+			dbCon.Exec("DELETE FROM Tracks WHERE deviceId=?", deviceId)
+			dbCon.Exec("DELETE FROM KeyPoints WHERE deviceId=?", deviceId)
+			for _, driverId := range driverIds {
+				dbCon.Exec("DELETE FROM Drivers WHERE _driverId=?", driverId)
+			}
+		})
+
+		It("should normalise the severities per 100 km driven", func() {
+			scores, err := tripMan.GetDriverSafetyScores(1000000, 1200000, dbCon)
+			Expect(err).To(BeNil())
+			byDriver := make(map[int64]*m.DriverSafetyScore)
+			for _, s := range scores {
+				byDriver[s.DriverId] = s
+			}
+			Expect(byDriver).To(HaveKey(driverIds[0]))
+			Expect(byDriver).To(HaveKey(driverIds[1]))
+
+			long := byDriver[driverIds[0]]
+			Expect(long.Distance).To(BeEquivalentTo(250000))
+			Expect(long.Brakings).To(Equal(2))
+			Expect(long.SeveritySum).To(BeEquivalentTo(3))
+			// 5 points per severity per 100 km: 5 * 3 / 2.5
+			Expect(long.Score).To(BeNumerically("~", 94, 0.001))
+
+			// less than 100 km count as 100 km
+			short := byDriver[driverIds[1]]
+			Expect(short.Accelerations).To(Equal(1))
+			Expect(short.Score).To(BeNumerically("~", 95, 0.001))
+		})
+	})
+
+	Describe("CompileTripFilter", func() {
+		It("should compile filters to parameterised SQL", func() {
+			where, params, err := tripMan.CompileTripFilter(&m.TripFilter{}, 0)
+			Expect(err).To(BeNil())
+			Expect(where).To(Equal("1=1"))
+			Expect(params).To(BeEmpty())
+
+			reviewed := false
+			where, params, err = tripMan.CompileTripFilter(&m.TripFilter{MinTime: 100, MaxTime: 200, CarIds: []int64{3},
+				ContactIds: []int64{7, 8}, Types: []int{tripMan.BUSINESS}, Reviewed: &reviewed, Text: "50%"}, 0)
+			Expect(err).To(BeNil())
+			Expect(where).To(HavePrefix("eStartTime>=? AND sEndTime<=? AND (sCarId IN (?)) AND " +
+				"(tripContactId IN (?,?) OR tripStartContactId IN (?,?) OR tripEndContactId IN (?,?)) AND tripType IN (?) AND IFNULL(tripReviewed,0)=? AND (tripTitle LIKE ?"))
+			Expect(params[:11]).To(Equal([]interface{}{int64(100), int64(200), int64(3), int64(7), int64(8), int64(7), int64(8), int64(7), int64(8), tripMan.BUSINESS, 0}))
+			Expect(params[11]).To(Equal(`%50\%%`))
+			Expect(where).NotTo(ContainSubstring("50"))
+
+			nonCar := true
+			where, params, err = tripMan.CompileTripFilter(&m.TripFilter{NonCar: &nonCar}, 0)
+			Expect(err).To(BeNil())
+			Expect(where).To(HavePrefix("IFNULL((SELECT transportMode FROM Tracks"))
+			Expect(where).To(HaveSuffix(",'car')!='car'"))
+			Expect(params).To(BeEmpty())
+		})
+
+		It("should reject invalid filters", func() {
+			invalid := map[error]*m.TripFilter{
+				tripMan.ErrFilterTimeRange:     {MinTime: 200, MaxTime: 100},
+				tripMan.ErrFilterInvalidId:     {DeviceIds: []int64{1, 0}},
+				tripMan.ErrFilterTooManyIds:    {DriverIds: make([]int64, tripMan.MaxTripFilterIds+1)},
+				tripMan.ErrFilterTripType:      {Types: []int{4}},
+				tripMan.ErrFilterDistanceRange: {MinDistance: -1},
+			}
+			for expected, f := range invalid {
+				_, _, err := tripMan.CompileTripFilter(f, 0)
+				Expect(err).To(Equal(expected))
+				Expect(tripMan.IsTripFilterError(err)).To(BeTrue())
+			}
+		})
+	})
+
+	Describe("VerifyChainLinks", func() {
+		var entries []*m.HashChainEntry
+		BeforeEach(func() {
+			entries = make([]*m.HashChainEntry, 0)
+			prev := ""
+			for i := int64(1); i <= 3; i++ {
+				c := tripMan.GetContentHash(m.HashEntryTripHistory, i, "content")
+				e := &m.HashChainEntry{Id: i, EntryType: m.HashEntryTripHistory, EntryId: i, ContentHash: c, PrevHash: prev, Hash: tripMan.GetChainHash(prev, c)}
+				entries = append(entries, e)
+				prev = e.Hash
+			}
+		})
+		It("should accept an intact chain", func() {
+			Expect(tripMan.VerifyChainLinks(entries)).To(BeEmpty())
+		})
+		It("should detect changed hashes and removed entries", func() {
+			entries[1].ContentHash = tripMan.GetContentHash(m.HashEntryTripHistory, 2, "changed")
+			breaks := tripMan.VerifyChainLinks(entries)
+			Expect(breaks).To(HaveLen(1))
+			Expect(breaks[0].ChainId).To(BeEquivalentTo(2))
+			Expect(breaks[0].Reason).To(Equal(m.HashBreakHash))
+
+			breaks = tripMan.VerifyChainLinks([]*m.HashChainEntry{entries[0], entries[2]})
+			Expect(breaks).To(HaveLen(1))
+			Expect(breaks[0].ChainId).To(BeEquivalentTo(3))
+			Expect(breaks[0].Reason).To(Equal(m.HashBreakLink))
+		})
+	})
+
+	Describe("SealTripHashChain", func() {
+		var tripId int64
+		// breaksOf returns the reasons of the breaks of the test trip & its history entries
+		breaksOf := func() []string {
+			v, err := tripMan.VerifyTripHashChain(dbCon)
+			Expect(err).To(BeNil())
+			historyIds := make(map[int64]bool)
+			rows, err := dbCon.Query("SELECT id FROM Trip_History WHERE tripId=?", tripId)
+			Expect(err).To(BeNil())
+			for rows.Next() {
+				var id int64
+				rows.Scan(&id)
+				historyIds[id] = true
+			}
+			rows.Close()
+			reasons := make([]string, 0)
+			for _, b := range v.Breaks {
+				if (b.EntryType == m.HashEntryTrip && b.EntryId == tripId) || (b.EntryType == m.HashEntryTripHistory && historyIds[b.EntryId]) {
+					reasons = append(reasons, b.EntryType+" "+b.Reason)
+				}
+			}
+			return reasons
+		}
+
+		BeforeEach(func() {
+			// other specs delete the trips & history entries they sealed, so start a new chain
+			_, err := dbCon.Exec("DELETE FROM TripHashChain")
+			Expect(err).To(BeNil())
+			res, err := dbCon.Exec("INSERT INTO Trips (type, title) VALUES(?, 'hash chain test')", tripMan.PRIVATE)
+			Expect(err).To(BeNil())
+			tripId, _ = res.LastInsertId()
+		})
+
+		AfterEach(func() {
+			dbCon.Exec("DELETE FROM Trip_History WHERE tripId=?", tripId)
+			dbCon.Exec("DELETE FROM Trips WHERE _tripId=?", tripId)
+			dbCon.Exec("DELETE FROM TripHashChain")
+		})
+
+		It("should seal edits with their history and detect changes made afterwards", func() {
+			_, err := tripMan.SealTripHashChain(dbCon)
+			Expect(err).To(BeNil())
+			Expect(tripMan.CountUnsealedTripChanges(dbCon)).To(Equal(0))
+			Expect(breaksOf()).To(BeEmpty())
+
+			_, err = dbCon.Exec("UPDATE Trips SET title='edited' WHERE _tripId=?", tripId)
+			Expect(err).To(BeNil())
+			Expect(tripMan.CountUnsealedTripChanges(dbCon)).To(Equal(1))
+			sealed, err := tripMan.SealTripHashChain(dbCon)
+			Expect(err).To(BeNil())
+			// the history entry & the new snapshot of the trip
+			Expect(sealed).To(Equal(2))
+			Expect(breaksOf()).To(BeEmpty())
+			sealed, err = tripMan.SealTripHashChain(dbCon)
+			Expect(err).To(BeNil())
+			Expect(sealed).To(BeZero())
+
+			_, err = dbCon.Exec("UPDATE Trip_History SET titleNEW='forged' WHERE tripId=?", tripId)
+			Expect(err).To(BeNil())
+			Expect(breaksOf()).To(Equal([]string{m.HashEntryTripHistory + " " + m.HashBreakContent}))
+
+			_, err = dbCon.Exec("DELETE FROM Trips WHERE _tripId=?", tripId)
+			Expect(err).To(BeNil())
+			Expect(breaksOf()).To(ContainElement(m.HashEntryTrip + " " + m.HashBreakMissing))
+		})
+
+		It("should record trips deleted on purpose with a tombstone", func() {
+			_, err := dbCon.Exec("UPDATE Trips SET title='edited' WHERE _tripId=?", tripId)
+			Expect(err).To(BeNil())
+			// the edit is sealed before the trip is deleted
+			Expect(tripMan.DeleteTrips([]int64{tripId}, dbCon)).To(Equal(int64(1)))
+			Expect(tripMan.CountUnsealedTripChanges(dbCon)).To(Equal(0))
+			Expect(breaksOf()).To(BeEmpty())
+
+			var tombstone m.HashChainEntry
+			Expect(dbCon.QueryRow("SELECT id, contentHash FROM TripHashChain WHERE entryType=? AND entryId=?",
+				m.HashEntryTripDeletion, tripId).Scan(&tombstone.Id, &tombstone.ContentHash)).To(BeNil())
+			_, err = dbCon.Exec("UPDATE TripHashChain SET contentHash=? WHERE id=?", tripMan.GetDeletionHash(tripId, "forged"), tombstone.Id)
+			Expect(err).To(BeNil())
+			v, err := tripMan.VerifyTripHashChain(dbCon)
+			Expect(err).To(BeNil())
+			Expect(v.Breaks).To(ContainElement(&m.HashChainBreak{ChainId: tombstone.Id, EntryType: m.HashEntryTripDeletion, EntryId: tripId, Reason: m.HashBreakContent}))
+		})
+	})
+
 })
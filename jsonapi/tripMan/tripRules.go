@@ -0,0 +1,348 @@
+package tripMan
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/dbMan/helpers"
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan/models"
+	. "github.com/OpenDriversLog/goodl-lib/models/SQLite"
+	"github.com/OpenDriversLog/goodl-lib/tools"
+)
+
+const trTag = "glib/tripMan/tripRules.go"
+
+const tripRuleColumns = `_tripRuleId,title,priority,disabled,startContactId,endContactId,startGeoZoneId,endGeoZoneId,
+weekdays,startMinute,endMinute,deviceId,carId,driverId,minDistance,maxDistance,
+setType,setTitle,setDescription,setDriverId,setContactId`
+
+// tripRuleFields are the columns of Trips TripRules can set, in the order they are explained.
+var tripRuleFields = []string{"type", "title", "desc", "driverId", "contactId"}
+
+// GetTripRules returns all TripRules, sorted by priority (highest first).
+func GetTripRules(dbCon tools.DbRunner) (rules []*TripRule, err error) {
+	rules = make([]*TripRule, 0)
+	rows, err := dbCon.Query("SELECT " + tripRuleColumns + " FROM TripRules ORDER BY priority DESC, _tripRuleId ASC")
+	if err != nil {
+		dbg.E(trTag, "Failed to get TripRules : ", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := &TripRule{}
+		err = rows.Scan(&r.Id, &r.Title, &r.Priority, &r.Disabled, &r.StartContactId, &r.EndContactId,
+			&r.StartGeoZoneId, &r.EndGeoZoneId, &r.Weekdays, &r.StartMinute, &r.EndMinute, &r.DeviceId,
+			&r.CarId, &r.DriverId, &r.MinDistance, &r.MaxDistance, &r.SetType, &r.SetTitle,
+			&r.SetDescription, &r.SetDriverId, &r.SetContactId)
+		if err != nil {
+			dbg.E(trTag, "Failed to scan TripRule : ", err)
+			return
+		}
+		rules = append(rules, r)
+	}
+	err = rows.Err()
+	if err != nil {
+		dbg.E(trTag, "GetTripRules rows-iteration-Error", err)
+	}
+	return
+}
+
+// tripRuleValues returns the values of the given rule in the order of tripRuleColumns, without the ID.
+func tripRuleValues(r *TripRule) []interface{} {
+	return []interface{}{r.Title, r.Priority, r.Disabled, r.StartContactId, r.EndContactId,
+		r.StartGeoZoneId, r.EndGeoZoneId, r.Weekdays, r.StartMinute, r.EndMinute, r.DeviceId,
+		r.CarId, r.DriverId, r.MinDistance, r.MaxDistance, r.SetType, r.SetTitle,
+		r.SetDescription, r.SetDriverId, r.SetContactId}
+}
+
+// CreateTripRule creates a new TripRule. It only applies to trips created or updated afterwards.
+func CreateTripRule(rule *TripRule, dbCon tools.DbRunner) (key int64, err error) {
+	cols := strings.TrimPrefix(tripRuleColumns, "_tripRuleId,")
+	res, err := dbCon.Exec("INSERT INTO TripRules("+cols+") VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+		tripRuleValues(rule)...)
+	if err != nil {
+		dbg.E(trTag, "Error in dbCon.Exec for CreateTripRule: %v ", err)
+		return
+	}
+	key, err = res.LastInsertId()
+	return
+}
+
+// UpdateTripRule replaces all conditions & actions of the given TripRule.
+func UpdateTripRule(rule *TripRule, dbCon *sql.DB) (rowCount int64, err error) {
+	cols := strings.Split(strings.TrimPrefix(tripRuleColumns, "_tripRuleId,"), ",")
+	for i := range cols {
+		cols[i] = strings.TrimSpace(cols[i]) + "=?"
+	}
+	res, err := dbCon.Exec("UPDATE TripRules SET "+strings.Join(cols, ",")+" WHERE _tripRuleId=?",
+		append(tripRuleValues(rule), rule.Id)...)
+	if err != nil {
+		dbg.E(trTag, "Error in dbCon.Exec for UpdateTripRule: %v ", err)
+		return
+	}
+	rowCount, err = res.RowsAffected()
+	return
+}
+
+// DeleteTripRule deletes the TripRule with the given ID. Trips it was applied to keep their values & explanation.
+func DeleteTripRule(id int64, dbCon *sql.DB) (rowCount int64, err error) {
+	res, err := dbCon.Exec("DELETE FROM TripRules WHERE _tripRuleId=?", id)
+	if err != nil {
+		dbg.E(trTag, "Error in DeleteTripRule : ", err)
+		return
+	}
+	rowCount, err = res.RowsAffected()
+	if err != nil {
+		dbg.E(trTag, "Error in DeleteTripRule get RowsAffected : ", err)
+	}
+	return
+}
+
+// MatchesTripRule returns if the given trip fulfills all conditions of the given rule. Weekdays and the time window
+// are checked against the local start time of the trip.
+func MatchesTripRule(rule *TripRule, facts *TripRuleFacts) bool {
+	if rule.Disabled != 0 {
+		return false
+	}
+	if (rule.StartContactId > 0 && int64(rule.StartContactId) != facts.StartContactId) ||
+		(rule.EndContactId > 0 && int64(rule.EndContactId) != facts.EndContactId) ||
+		(rule.StartGeoZoneId > 0 && !containsInt64(facts.StartGeoZoneIds, int64(rule.StartGeoZoneId))) ||
+		(rule.EndGeoZoneId > 0 && !containsInt64(facts.EndGeoZoneIds, int64(rule.EndGeoZoneId))) ||
+		(rule.DeviceId > 0 && int64(rule.DeviceId) != facts.DeviceId) ||
+		(rule.CarId > 0 && int64(rule.CarId) != facts.CarId) ||
+		(rule.DriverId > 0 && int64(rule.DriverId) != facts.DriverId) ||
+		(rule.MinDistance > 0 && facts.Distance < float64(rule.MinDistance)) ||
+		(rule.MaxDistance > 0 && facts.Distance > float64(rule.MaxDistance)) {
+		return false
+	}
+	start := tools.GetTimeFromMillis(facts.StartTime)
+	if rule.Weekdays > 0 && int64(rule.Weekdays)&(1<<uint(start.Weekday())) == 0 {
+		return false
+	}
+	if rule.StartMinute != rule.EndMinute {
+		minute := int64(start.Hour()*60 + start.Minute())
+		from, to := int64(rule.StartMinute), int64(rule.EndMinute)
+		if from < to && (minute < from || minute >= to) {
+			return false
+		}
+		if from > to && minute < from && minute >= to {
+			return false
+		}
+	}
+	return true
+}
+
+type tripRulesByPriority []*TripRule
+
+func (r tripRulesByPriority) Len() int           { return len(r) }
+func (r tripRulesByPriority) Less(i, j int) bool { return r[i].Priority > r[j].Priority }
+func (r tripRulesByPriority) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// EvaluateTripRules evaluates the given rules against the given trip. Each field is set by the matching rule with
+// the highest priority setting it. Fields in skipFields (e.g. just changed by the user) are left out, as well as
+// fields already having the value of that rule.
+func EvaluateTripRules(rules []*TripRule, facts *TripRuleFacts, skipFields map[string]bool) (result *TripRuleResult) {
+	result = &TripRuleResult{
+		TripId:  facts.TripId,
+		Changes: make(map[string]interface{}),
+		RuleIds: make([]int64, 0),
+	}
+	sorted := make([]*TripRule, len(rules))
+	copy(sorted, rules)
+	sort.Stable(tripRulesByPriority(sorted))
+
+	current := map[string]interface{}{
+		"type":      int64(facts.Type),
+		"title":     facts.Title,
+		"desc":      facts.Description,
+		"driverId":  facts.DriverId,
+		"contactId": facts.ContactId,
+	}
+	claimed := make(map[string]bool)
+	explanations := make([]string, 0)
+	for _, r := range sorted {
+		if !MatchesTripRule(r, facts) {
+			continue
+		}
+		actions := map[string]interface{}{}
+		if r.SetType > 0 {
+			actions["type"] = int64(r.SetType)
+		}
+		if r.SetTitle != "" {
+			actions["title"] = r.SetTitle
+		}
+		if r.SetDescription != "" {
+			actions["desc"] = r.SetDescription
+		}
+		if r.SetDriverId > 0 {
+			actions["driverId"] = int64(r.SetDriverId)
+		}
+		if r.SetContactId > 0 {
+			actions["contactId"] = int64(r.SetContactId)
+		}
+		set := make([]string, 0)
+		for _, f := range tripRuleFields {
+			v, ok := actions[f]
+			if !ok || skipFields[f] || claimed[f] {
+				continue
+			}
+			claimed[f] = true
+			if v != current[f] {
+				result.Changes[f] = v
+				set = append(set, f)
+			}
+		}
+		if len(set) == 0 {
+			continue
+		}
+		result.RuleIds = append(result.RuleIds, r.Id)
+		explanations = append(explanations, fmt.Sprintf("Rule %q (#%d): %s", string(r.Title), r.Id, strings.Join(set, ", ")))
+	}
+	result.Explanation = strings.Join(explanations, "; ")
+	return
+}
+
+// GetTripRuleFacts returns the properties of the given trip TripRules are evaluated against.
+func GetTripRuleFacts(tripId int64, dbCon tools.DbRunner) (facts *TripRuleFacts, err error) {
+	facts = &TripRuleFacts{TripId: tripId, StartGeoZoneIds: make([]int64, 0), EndGeoZoneIds: make([]int64, 0)}
+	err = dbCon.QueryRow(`SELECT IFNULL(reviewed,0), IFNULL(type,0), title, desc, IFNULL(driverId,0), IFNULL(contactId,0),
+		IFNULL(startContactId,0), IFNULL(endContactId,0) FROM Trips WHERE _tripId=?`, tripId).Scan(&facts.Reviewed,
+		&facts.Type, &facts.Title, &facts.Description, &facts.DriverId, &facts.ContactId, &facts.StartContactId, &facts.EndContactId)
+	if err != nil {
+		dbg.E(trTag, "Failed to get trip %d for TripRules : ", tripId, err)
+		return
+	}
+
+	rows, err := dbCon.Query(`SELECT t.startKeyPointId, t.endKeyPointId, skp.endTime, t.deviceId, IFNULL(t.carId,0), IFNULL(t.distance,0)
+		FROM Tracks_Trips tt
+		JOIN Tracks t ON t._trackId=tt.trackId
+		JOIN KeyPoints skp ON skp._keyPointId=t.startKeyPointId
+		WHERE tt.tripId=? ORDER BY skp.endTime ASC`, tripId)
+	if err != nil {
+		dbg.E(trTag, "Failed to get tracks of trip %d for TripRules : ", tripId, err)
+		return
+	}
+	var startKpId, endKpId int64
+	first := true
+	for rows.Next() {
+		var sKp, eKp, startTime, deviceId, carId int64
+		var distance float64
+		err = rows.Scan(&sKp, &eKp, &startTime, &deviceId, &carId, &distance)
+		if err != nil {
+			dbg.E(trTag, "Failed to scan track of trip %d for TripRules : ", tripId, err)
+			rows.Close()
+			return
+		}
+		if first {
+			startKpId, facts.StartTime, facts.DeviceId, facts.CarId = sKp, startTime, deviceId, carId
+			first = false
+		}
+		endKpId = eKp
+		if distance > 0 {
+			facts.Distance += distance
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || first {
+		return
+	}
+
+	rows, err = dbCon.Query("SELECT keyPointId, geoFenceRegionId FROM KeyPoints_GeoFenceRegions WHERE keyPointId IN (?,?)", startKpId, endKpId)
+	if err != nil {
+		dbg.E(trTag, "Failed to get GeoZones of trip %d for TripRules : ", tripId, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kpId, zoneId int64
+		err = rows.Scan(&kpId, &zoneId)
+		if err != nil {
+			dbg.E(trTag, "Failed to scan GeoZone of trip %d for TripRules : ", tripId, err)
+			return
+		}
+		if kpId == startKpId {
+			facts.StartGeoZoneIds = append(facts.StartGeoZoneIds, zoneId)
+		}
+		if kpId == endKpId {
+			facts.EndGeoZoneIds = append(facts.EndGeoZoneIds, zoneId)
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+// ApplyTripRules applies the enabled TripRules to the given trip if it is not reviewed yet and remembers which
+// rules set which fields. Fields in skipFields are not changed (see EvaluateTripRules).
+// The changes are written directly, so they are recorded in the trip history without calling UpdateTrip again.
+func ApplyTripRules(tripId int64, skipFields map[string]bool, dbCon tools.DbRunner) (result *TripRuleResult, err error) {
+	facts, err := GetTripRuleFacts(tripId, dbCon)
+	if err != nil || facts.Reviewed != 0 {
+		return
+	}
+	rules, err := GetTripRules(dbCon)
+	if err != nil || len(rules) == 0 {
+		return
+	}
+	result = EvaluateTripRules(rules, facts, skipFields)
+	if len(result.Changes) == 0 {
+		return
+	}
+	dbg.I(trTag, "Applying TripRules to trip %d : %s", tripId, result.Explanation)
+
+	update := helpers.NewUpdateHelper(dbCon)
+	for _, f := range tripRuleFields {
+		switch v := result.Changes[f].(type) {
+		case int64:
+			update.AppendInt64(f, &v)
+		case NString:
+			update.AppendNString(f, &v)
+		}
+	}
+	_, err = update.ExecUpdate("Trips", "_tripId=?", tripId)
+	if err != nil {
+		dbg.E(trTag, "Failed to apply TripRules to trip %d : ", tripId, err)
+		return
+	}
+
+	ruleIds := make([]string, len(result.RuleIds))
+	for i, id := range result.RuleIds {
+		ruleIds[i] = strconv.FormatInt(id, 10)
+	}
+	_, err = dbCon.Exec("INSERT OR REPLACE INTO TripRuleApplications(tripId, ruleIds, explanation, appliedAt) VALUES(?,?,?,?)",
+		tripId, strings.Join(ruleIds, ","), result.Explanation, time.Now().Unix()*1000)
+	if err != nil {
+		dbg.E(trTag, "Failed to remember TripRules applied to trip %d : ", tripId, err)
+	}
+	return
+}
+
+// PreviewTripRule returns what the given (possibly not yet saved) rule would change on the trips of the given
+// devices between minTime and maxTime, without changing anything. Reviewed trips are included, although rules
+// are only applied to unreviewed ones.
+func PreviewTripRule(rule *TripRule, minTime int64, maxTime int64, deviceIds []interface{}, dbCon *sql.DB) (results []*TripRuleResult, err error) {
+	results = make([]*TripRuleResult, 0)
+	tripIds, err := GetTripIdsInTimeRange(minTime, maxTime, deviceIds, dbCon)
+	if err != nil {
+		dbg.E(trTag, "Failed to get trips from %d to %d for TripRule preview : ", minTime, maxTime, err)
+		return
+	}
+	preview := *rule
+	preview.Disabled = 0
+	for _, id := range tripIds {
+		var facts *TripRuleFacts
+		facts, err = GetTripRuleFacts(id, dbCon)
+		if err != nil {
+			return
+		}
+		res := EvaluateTripRules([]*TripRule{&preview}, facts, nil)
+		if len(res.Changes) > 0 {
+			results = append(results, res)
+		}
+	}
+	return
+}
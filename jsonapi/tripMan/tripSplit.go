@@ -0,0 +1,127 @@
+package tripMan
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+
+	"github.com/Compufreak345/dbg"
+	"github.com/OpenDriversLog/goodl-lib/jsonapi/notificationManager"
+	. "github.com/OpenDriversLog/goodl-lib/jsonapi/tripMan/models"
+	. "github.com/OpenDriversLog/goodl-lib/models/geo"
+	"github.com/OpenDriversLog/goodl-lib/translate"
+)
+
+const tsTag = "glib/tripMan/tripSplit.go"
+
+// ErrInvalidSplitPoint is returned when a trip should be split at a KeyPoint or time not inside of it.
+var ErrInvalidSplitPoint = errors.New("Split point is not inside the trip")
+
+// GetSortedTripTracks returns the tracks of the given trip sorted by time.
+func GetSortedTripTracks(tripId int64, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (trip *Trip, tracks []*Track, err error) {
+	trip, err = GetTrip(tripId, false, false, true, activeNotifications, T, false, dbCon)
+	if err != nil {
+		dbg.E(tsTag, "Failed to get trip %d : ", tripId, err)
+		return
+	}
+	tracks = make([]*Track, len(trip.TrackDetails))
+	copy(tracks, trip.TrackDetails)
+	sort.Sort(tracksByStartTime(tracks))
+	return
+}
+
+type tracksByStartTime []*Track
+
+func (t tracksByStartTime) Len() int           { return len(t) }
+func (t tracksByStartTime) Less(i, j int) bool { return t[i].StartTime < t[j].StartTime }
+func (t tracksByStartTime) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// SplitTripAtKeyPoint splits the given trip at one of the KeyPoints between its tracks. The tracks after the KeyPoint
+// are moved to a new trip in one transaction (see MoveTracksToNewTrip). Both trips keep their history, the
+// timeOverDue & notifications of both are updated (see FinishTripSplit).
+// Returns the ID of the new trip, the IDs of the affected trips and if notifications were changed.
+func SplitTripAtKeyPoint(tripId int64, keyPointId int64, isAdmin bool, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (newTripId int64, affectedTripIds []int64, notificationsChanged bool, err error) {
+	affectedTripIds = make([]int64, 0)
+	trip, tracks, err := GetSortedTripTracks(tripId, activeNotifications, T, dbCon)
+	if err != nil {
+		return
+	}
+	if err = CheckTripEditable(trip, isAdmin, dbCon); err != nil {
+		return
+	}
+
+	splitIdx := -1
+	for i := 0; i < len(tracks)-1; i++ {
+		if tracks[i].EndKeyPointId == keyPointId {
+			splitIdx = i + 1
+			break
+		}
+	}
+	if splitIdx == -1 {
+		dbg.I(tsTag, "KeyPoint %d is not between two tracks of trip %d", keyPointId, tripId)
+		err = ErrInvalidSplitPoint
+		return
+	}
+	trackIds := make([]int64, 0, len(tracks)-splitIdx)
+	for _, t := range tracks[splitIdx:] {
+		trackIds = append(trackIds, t.TrackId)
+	}
+
+	tx, err := dbCon.Begin()
+	if err != nil {
+		dbg.E(tsTag, "Error starting transaction : ", err)
+		return
+	}
+	newTripId, err = MoveTracksToNewTrip(trip, trackIds, tx)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		dbg.E(tsTag, "Failed to commit split of trip %d : ", tripId, err)
+		return
+	}
+	affectedTripIds, notificationsChanged, err = FinishTripSplit(tripId, newTripId, activeNotifications, T, dbCon)
+	return
+}
+
+// MoveTracksToNewTrip creates a trip with the type, title, description, driver, contact and end contact of the given
+// trip in tx and moves the given tracks there. The end contact is removed from the given trip, as it now ends before.
+// The caller commits tx and calls FinishTripSplit afterwards.
+func MoveTracksToNewTrip(trip *Trip, trackIds []int64, tx *sql.Tx) (newTripId int64, err error) {
+	res, err := tx.Exec("INSERT INTO Trips(type,title,desc,driverId,contactId,endContactId) VALUES (?,?,?,?,?,?)",
+		trip.Type, trip.Title, trip.Description, trip.DriverId, trip.ContactId, trip.EndContactId)
+	if err != nil {
+		dbg.E(tsTag, "Failed to insert trip for the tracks split from trip %d : ", trip.Id, err)
+		return
+	}
+	newTripId, err = res.LastInsertId()
+	if err != nil {
+		dbg.E(tsTag, "Error getting last insertId for Trip", err)
+		return
+	}
+	for _, trackId := range trackIds {
+		if _, err = tx.Exec("DELETE FROM Tracks_Trips WHERE trackId=?", trackId); err != nil {
+			dbg.E(tsTag, "Failed to remove track %d from trip %d : ", trackId, trip.Id, err)
+			return
+		}
+		if _, err = tx.Exec("INSERT INTO Tracks_Trips(trackId, tripId) VALUES (?, ?)", trackId, newTripId); err != nil {
+			dbg.E(tsTag, "Failed to move track %d to trip %d : ", trackId, newTripId, err)
+			return
+		}
+	}
+	_, err = tx.Exec("UPDATE Trips SET endContactId=0 WHERE _tripId=?", trip.Id)
+	if err != nil {
+		dbg.E(tsTag, "Failed to move end contact of trip %d to trip %d : ", trip.Id, newTripId, err)
+	}
+	return
+}
+
+// FinishTripSplit applies the TripRules to the new trip, seals the hash chain and updates timeOverDue & notifications
+// of both trips after MoveTracksToNewTrip has been committed.
+// Returns the IDs of the affected trips and if notifications were changed.
+func FinishTripSplit(tripId int64, newTripId int64, activeNotifications *[]*notificationManager.Notification, T *translate.Translater, dbCon *sql.DB) (affectedTripIds []int64, notificationsChanged bool, err error) {
+	affectedTripIds = []int64{tripId}
+	notificationsChanged, err = finishTripTracksChange(newTripId, affectedTripIds, activeNotifications, T, dbCon)
+	return
+}
@@ -80,6 +80,10 @@ type Location struct {
 	Source         sql.NullInt64
 	AccuracyRating sql.NullInt64
 	Speed          sql.NullFloat64
+	// AccelLongitudinal & AccelLateral are the accelerations (in m/s²) measured by the device, if available.
+	// Braking is negative longitudinal acceleration.
+	AccelLongitudinal sql.NullFloat64
+	AccelLateral      sql.NullFloat64
 }
 
 // ServerLocation represents a trackRecords-table-entry with device
@@ -101,6 +105,17 @@ type TrackPoint struct {
 	MaxZoomLevel sql.NullInt64
 }
 
+// MatchedTrackPoint represents a MatchedTrackPoints-Table-entry.
+type MatchedTrackPoint struct {
+	MatchedTrackPointId sql.NullInt64
+	TrackId             sql.NullInt64
+	Seq                 sql.NullInt64
+	Latitude            sql.NullFloat64
+	Longitude           sql.NullFloat64
+	TrackPointId        sql.NullInt64 // invalid for road vertices between two matched trackPoints
+	WayId               sql.NullInt64
+}
+
 // KeyPoint represents a KeyPoints-Table-entry.
 type KeyPoint struct {
 	KeyPointId        sql.NullInt64
@@ -19,6 +19,57 @@ type LocationConfig struct {
 	// AccuraryThreshold configures the Accuracy where we stop worrying about the point
 	AccuracyThreshold int
 
+	// MaxTimeGap configures the time (in milliseconds) without locations after which we consider the GPS
+	// data to have a gap.
+	MaxTimeGap int
+
+	// MaxPlausibleSpeed configures the speed (in km/h) above which a jump between two locations is
+	// considered as gap instead of movement.
+	MaxPlausibleSpeed int
+
+	// MinGapTravelSpeed configures the speed (in km/h) we assume as the slowest plausible travel speed during
+	// a gap. If the time of a gap is longer than needed for the distance at this speed, there must have been a stop.
+	MinGapTravelSpeed int
+
+	// SpeedingThreshold configures the speed (in km/h) above which driving is considered as speeding.
+	SpeedingThreshold int
+
+	// MinSpeedingDuration configures the time (in milliseconds) the speed needs to stay above SpeedingThreshold
+	// to be reported as speeding event.
+	MinSpeedingDuration int
+
+	// MinMovingSpeed configures the speed (in km/h) below which the vehicle is considered as standing,
+	// e.g. for the average moving speed.
+	MinMovingSpeed int
+
+	// HarshAccelerationThreshold, HarshBrakingThreshold & HarshCorneringThreshold configure the acceleration
+	// (in m/s²) above which accelerating, braking or cornering is considered harsh.
+	HarshAccelerationThreshold float64
+	HarshBrakingThreshold      float64
+	HarshCorneringThreshold    float64
+
+	// ElevationSmoothingWindow configures the time (in milliseconds) GPS altitudes are averaged over to remove noise.
+	ElevationSmoothingWindow int
+
+	// MinElevationChange configures the change of altitude (in meters) needed to count as ascent or descent.
+	MinElevationChange int
+
+	// ElevationProfilePoints configures the maximum count of points in the elevation profile of a track.
+	ElevationProfilePoints int
+
+	// SkipNonCarTracks configures to not create trips for tracks classified as another TransportMode than car.
+	// The skipped tracks can be reviewed with tripMan.GetNonCarTracksWithoutTrip, otherwise the trips are created and
+	// can be reviewed with TripFilter.NonCar.
+	SkipNonCarTracks bool
+
+	// FusionSegmentLength configures the length (in milliseconds) of the segments in which the most accurate
+	// device is chosen when fusing the tracks of multiple devices of the same car.
+	FusionSegmentLength int
+
+	// FusionMinOverlap configures the share (0-1) of the shorter track that needs to overlap with a track of
+	// another device of the same car to fuse them.
+	FusionMinOverlap float64
+
 	// minimal distances for points to display at the given zoom stage
 	// http://wiki.openstreetmap.org/wiki/DE:Zoom_levels
 	// TODO: implement usable config... how to set a const size?
@@ -78,6 +129,136 @@ type Track struct {
 	StartKeyPointInfo *KeyPointInfo
 	EndKeyPointInfo   *KeyPointInfo
 	Distance          float64
+	// MatchedDistance is the distance of the track matched to the road graph, 0 if not matched.
+	MatchedDistance models.NFloat64
+	// DataQuality is one of the DataQuality* constants, depending on the worst gap in the GPS data of this track.
+	DataQuality models.NInt64
+	Gaps        []*TrackGap `json:",omitempty"`
+	// MaxSpeed, AvgMovingSpeed and MedianSpeed are the speeds (in km/h) driven on this track,
+	// the average and median only counting the time spent moving.
+	MaxSpeed       models.NFloat64
+	AvgMovingSpeed models.NFloat64
+	MedianSpeed    models.NFloat64
+	// MovingTime is the time (in milliseconds) spent moving on this track
+	MovingTime     models.NInt64
+	SpeedingEvents []*SpeedingEvent `json:",omitempty"`
+	HarshEvents    []*HarshEvent    `json:",omitempty"`
+	// Ascent, Descent, MinAltitude and MaxAltitude are in meters, calculated from the smoothed GPS altitudes
+	Ascent           models.NFloat64
+	Descent          models.NFloat64
+	MinAltitude      models.NFloat64
+	MaxAltitude      models.NFloat64
+	ElevationProfile []*ElevationPoint `json:",omitempty"`
+	// TransportMode is one of the Transport* constants
+	TransportMode models.NString
+	// FusedIntoTrackId is the track this track got fused into, as it was recorded by another device of the same car.
+	FusedIntoTrackId models.NInt64
+	// DeviceIds are the devices whose GPS data was fused into this track, empty if only DeviceId contributed.
+	DeviceIds []int64 `json:",omitempty"`
+}
+
+const (
+	// TransportCar is a track driven by car (or another motor vehicle on the road).
+	TransportCar = "car"
+	// TransportWalk is a track walked by foot.
+	TransportWalk = "walk"
+	// TransportBicycle is a track ridden by bicycle.
+	TransportBicycle = "bicycle"
+	// TransportRail is a track travelled by train or another vehicle not on the road.
+	TransportRail = "rail"
+)
+
+// ElevationStats are the climbs & altitudes of a list of Locations, in meters.
+type ElevationStats struct {
+	Ascent      float64
+	Descent     float64
+	MinAltitude float64
+	MaxAltitude float64
+}
+
+// ElevationPoint is a point of an elevation profile.
+type ElevationPoint struct {
+	Time int64
+	// Distance is the distance (in meters) from the start of the profile
+	Distance float64
+	// Altitude is the smoothed altitude in meters
+	Altitude float64
+}
+
+// SpeedStats are the speeds driven in a list of Locations.
+type SpeedStats struct {
+	// MaxSpeed, AvgMovingSpeed and MedianSpeed are in km/h
+	MaxSpeed       float64
+	AvgMovingSpeed float64
+	MedianSpeed    float64
+	// MovingTime is the time (in milliseconds) spent above LocationConfig.MinMovingSpeed
+	MovingTime int64
+}
+
+// SpeedingEvent represents a time driving faster than the SpeedingThreshold for at least MinSpeedingDuration.
+type SpeedingEvent struct {
+	StartTime int64
+	EndTime   int64
+	// PeakSpeed is the highest speed (in km/h) during the event, Lat & Lng its position
+	PeakSpeed float64
+	Lat       float64
+	Lng       float64
+	// Threshold is the SpeedingThreshold (in km/h) used when detecting this event
+	Threshold float64
+}
+
+const (
+	// HarshAcceleration is a HarshEvent of accelerating too fast.
+	HarshAcceleration = "acceleration"
+	// HarshBraking is a HarshEvent of braking too hard.
+	HarshBraking = "braking"
+	// HarshCornering is a HarshEvent of taking a curve too fast.
+	HarshCornering = "cornering"
+)
+
+// HarshEvent represents a time of harsh acceleration, braking or cornering.
+type HarshEvent struct {
+	StartTime int64
+	EndTime   int64
+	// Kind is one of the Harsh* constants
+	Kind string
+	// PeakAcceleration is the highest acceleration (in m/s², always positive) during the event, Lat & Lng its position
+	PeakAcceleration float64
+	Lat              float64
+	Lng              float64
+	// Speed is the speed (in km/h) at the peak
+	Speed float64
+	// Severity is PeakAcceleration relative to the threshold, e.g. 1.5 for 50% above it
+	Severity float64
+}
+
+const (
+	// DataQualityOk means the track has no gaps in its GPS data.
+	DataQualityOk = 0
+	// DataQualityInterpolated means the track has gaps we could bridge by interpolation.
+	DataQualityInterpolated = 1
+	// DataQualityGap means the track has gaps where we don't know what happened.
+	DataQualityGap = 2
+)
+
+const (
+	// TrackGapInterpolated is a gap in the GPS data that was most likely bridged by driving straight on.
+	TrackGapInterpolated = "interpolated"
+	// TrackGapUnknown is a gap in the GPS data where we don't know what happened, e.g. an implausible jump.
+	TrackGapUnknown = "gap"
+)
+
+// TrackGap represents a part of a track without (plausible) GPS data.
+type TrackGap struct {
+	StartTime int64
+	EndTime   int64
+	StartLat  float64
+	StartLng  float64
+	EndLat    float64
+	EndLng    float64
+	// Distance is the direct distance (in meters) between start and end of the gap
+	Distance float64
+	Kind     string
 }
 
 // TrackPointJson represents a Trackpoint for JSON
@@ -45,6 +45,19 @@ type Scannable interface {
 	Scan(...interface{}) error
 }
 
+// interface DbRunner is implemented by *sql.DB and *sql.Tx, for functions that run inside and outside of transactions.
+type DbRunner interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// NoLock is a sync.Locker doing nothing.
+type NoLock struct{}
+
+func (NoLock) Lock()   {}
+func (NoLock) Unlock() {}
+
 // SQLIgnoreField is used to skip a field while scanning a SQL-row.
 type SQLIgnoreField struct {
 }